@@ -3,7 +3,6 @@ module github.com/imikewhite/synthesia
 go 1.17
 
 require (
-	github.com/cenkalti/backoff v2.2.1+incompatible
 	github.com/google/go-cmp v0.5.7
 	github.com/google/uuid v1.3.0
 	github.com/gorilla/mux v1.8.0
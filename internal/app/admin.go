@@ -0,0 +1,322 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requireAdmin is a middleware restricting routes to callers presenting the admin token as a bearer token, or
+// an API key or token with admin privileges. Admin routes are disabled entirely when none are configured
+func (application *Application) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if client, ok := clientFromContext(r); ok && client.Admin {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if application.AdminToken == "" && (application.APIKeys != nil || application.JWT != nil) {
+			writeDenied(w, http.StatusForbidden, ErrorForbidden, "Credentials with admin privileges are required.")
+			return
+		}
+		if application.AdminToken == "" {
+			writeDenied(w, http.StatusForbidden, ErrorForbidden, "Admin endpoints are disabled.")
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(application.AdminToken)) != 1 {
+			logFromRequest(r).Debugf("Rejected admin request with invalid token")
+			writeDenied(w, http.StatusUnauthorized, ErrorUnauthorized, "A valid admin token is required.")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireMetricsAccess is a middleware restricting the metrics to scrapers presenting the metrics token as a bearer
+// token, which grants nothing else, or to admins as requireAdmin does
+func (application *Application) requireMetricsAccess(next http.Handler) http.Handler {
+	admin := application.requireAdmin(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if application.MetricsToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(application.MetricsToken)) == 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		admin.ServeHTTP(w, r)
+	})
+}
+
+// adminTenant reports the tenant an admin is restricted to. Admins with the admin token, or credentials without a
+// tenant, oversee every tenant
+func adminTenant(r *http.Request) (string, bool) {
+	client, ok := clientFromContext(r)
+	if !ok || client.Tenant == "" {
+		return "", false
+	}
+	return client.Tenant, true
+}
+
+// Limits on the number of requests listed per page by the /admin/requests endpoint
+const (
+	defaultRequestListLimit = 50
+	maxRequestListLimit     = 500
+)
+
+// Fields the /admin/requests endpoint can sort by
+const (
+	SortTimeAdded = "timeAdded"
+	SortAttempts  = "attempts"
+)
+
+// RequestSummary describes a tracked request to operators. The message itself is only identified by its hash
+type RequestSummary struct {
+	RequestId   string
+	State       string
+	Attempts    int
+	MessageHash string
+	ClientId    string `json:",omitempty"`
+	CallbackUrl string `json:",omitempty"`
+	TenantId    string
+	Priority    string
+	TimeAdded   time.Time
+	AgeSeconds  float64
+}
+
+// RequestList represents a page of tracked requests, with a cursor to the next page if there is one
+type RequestList struct {
+	Body       string
+	Requests   []RequestSummary
+	NextCursor string `json:",omitempty"`
+	StatusCode int
+}
+
+// requestQuery holds the filters, ordering and page requested from the /admin/requests endpoint
+type requestQuery struct {
+	states      map[string]bool
+	minAge      time.Duration
+	maxAge      time.Duration
+	minAttempts int
+	maxAttempts int
+	messageHash string
+	tenant      string
+	sort        string
+	descending  bool
+	limit       int
+	after       *requestCursor
+}
+
+// requestCursor marks the last request of a page. It is bound to the ordering it was created for
+type requestCursor struct {
+	Sort       string
+	Descending bool
+	Key        int64
+	RequestId  string
+}
+
+// listRequestsHandler handles listing the tracked requests through the /admin/requests endpoint. Requests can be
+// filtered by state, age, attempts and message hash, sorted by time added or attempts, and paged through with a cursor
+func (application *Application) listRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := readRequestQuery(r)
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	if tenant, scoped := adminTenant(r); scoped {
+		query.tenant = tenant
+	}
+	now := time.Now()
+	var summaries []RequestSummary
+	application.requestsLock.RLock()
+	for requestId, request := range application.Requests {
+		summary := summarizeRequest(requestId, request, now)
+		if query.matches(summary) {
+			summaries = append(summaries, summary)
+		}
+	}
+	application.requestsLock.RUnlock()
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return query.less(summaries[i], summaries[j])
+	})
+	if query.after != nil {
+		start := sort.Search(len(summaries), func(i int) bool {
+			return query.lessCursor(*query.after, summaries[i])
+		})
+		summaries = summaries[start:]
+	}
+	list := RequestList{Body: "Requests matching the query.", Requests: []RequestSummary{}, StatusCode: http.StatusOK}
+	if len(summaries) > query.limit {
+		last := summaries[query.limit-1]
+		list.NextCursor = encodeRequestCursor(requestCursor{Sort: query.sort, Descending: query.descending, Key: query.key(last), RequestId: last.RequestId})
+		summaries = summaries[:query.limit]
+	}
+	list.Requests = append(list.Requests, summaries...)
+	writeResponse(w, http.StatusOK, list)
+}
+
+// summarizeRequest creates the operator view of a tracked request
+func summarizeRequest(requestId string, request PendingRequest, now time.Time) RequestSummary {
+	state := request.State
+	if state == "" {
+		state = StateQueued
+	}
+	return RequestSummary{
+		RequestId:   requestId,
+		State:       state,
+		Attempts:    request.Attempts,
+		MessageHash: hashMessage(request.Message),
+		ClientId:    request.ClientId,
+		CallbackUrl: request.CallbackUrl,
+		TenantId:    requestTenant(request.Request),
+		Priority:    requestPriority(request.Request),
+		TimeAdded:   request.TimeAdded,
+		AgeSeconds:  now.Sub(request.TimeAdded).Seconds(),
+	}
+}
+
+// hashMessage identifies a message without revealing it, as the hex encoded SHA-256 of the message
+func hashMessage(message string) string {
+	sum := sha256.Sum256([]byte(message))
+	return hex.EncodeToString(sum[:])
+}
+
+// matches reports whether a request passes every filter of the query
+func (query *requestQuery) matches(summary RequestSummary) bool {
+	age := time.Duration(summary.AgeSeconds * float64(time.Second))
+	switch {
+	case len(query.states) > 0 && !query.states[summary.State]:
+		return false
+	case query.minAge > 0 && age < query.minAge:
+		return false
+	case query.maxAge > 0 && age > query.maxAge:
+		return false
+	case summary.Attempts < query.minAttempts:
+		return false
+	case query.maxAttempts >= 0 && summary.Attempts > query.maxAttempts:
+		return false
+	case query.messageHash != "" && !strings.EqualFold(summary.MessageHash, query.messageHash):
+		return false
+	case query.tenant != "" && summary.TenantId != query.tenant:
+		return false
+	}
+	return true
+}
+
+// key is the value a request is sorted by
+func (query *requestQuery) key(summary RequestSummary) int64 {
+	if query.sort == SortAttempts {
+		return int64(summary.Attempts)
+	}
+	return summary.TimeAdded.UnixNano()
+}
+
+// less orders requests by the sort key, breaking ties with the request id so the order is stable between pages
+func (query *requestQuery) less(a RequestSummary, b RequestSummary) bool {
+	return query.compare(query.key(a), a.RequestId, query.key(b), b.RequestId)
+}
+
+// lessCursor reports whether a request comes after the cursor
+func (query *requestQuery) lessCursor(cursor requestCursor, summary RequestSummary) bool {
+	return query.compare(cursor.Key, cursor.RequestId, query.key(summary), summary.RequestId)
+}
+
+func (query *requestQuery) compare(keyA int64, requestIdA string, keyB int64, requestIdB string) bool {
+	if keyA != keyB {
+		return (keyA < keyB) != query.descending
+	}
+	return requestIdA < requestIdB
+}
+
+// readRequestQuery parses the query parameters of the /admin/requests endpoint
+func readRequestQuery(r *http.Request) (requestQuery, *MessageError) {
+	params := r.URL.Query()
+	query := requestQuery{sort: SortTimeAdded, limit: defaultRequestListLimit, maxAttempts: -1}
+	var err error
+	if states := params.Get("state"); states != "" {
+		query.states = make(map[string]bool)
+		for _, state := range strings.Split(states, ",") {
+			query.states[strings.TrimSpace(state)] = true
+		}
+	}
+	if query.minAge, err = readDurationParam(params.Get("minAge")); err != nil {
+		return query, badQuery("The minAge parameter must be a duration, such as '10m'.")
+	}
+	if query.maxAge, err = readDurationParam(params.Get("maxAge")); err != nil {
+		return query, badQuery("The maxAge parameter must be a duration, such as '10m'.")
+	}
+	if value := params.Get("minAttempts"); value != "" {
+		if query.minAttempts, err = strconv.Atoi(value); err != nil || query.minAttempts < 0 {
+			return query, badQuery("The minAttempts parameter must be a non-negative integer.")
+		}
+	}
+	if value := params.Get("maxAttempts"); value != "" {
+		if query.maxAttempts, err = strconv.Atoi(value); err != nil || query.maxAttempts < 0 {
+			return query, badQuery("The maxAttempts parameter must be a non-negative integer.")
+		}
+	}
+	query.messageHash = params.Get("messageHash")
+	query.tenant = params.Get("tenant")
+	if value := params.Get("sort"); value != "" {
+		if value != SortTimeAdded && value != SortAttempts {
+			return query, badQuery("The sort parameter must be one of 'timeAdded' or 'attempts'.")
+		}
+		query.sort = value
+	}
+	switch params.Get("order") {
+	case "", "asc":
+	case "desc":
+		query.descending = true
+	default:
+		return query, badQuery("The order parameter must be one of 'asc' or 'desc'.")
+	}
+	if value := params.Get("limit"); value != "" {
+		if query.limit, err = strconv.Atoi(value); err != nil || query.limit < 1 || query.limit > maxRequestListLimit {
+			return query, badQuery(fmt.Sprintf("The limit parameter must be between 1 and %d.", maxRequestListLimit))
+		}
+	}
+	if value := params.Get("cursor"); value != "" {
+		cursor, err := decodeRequestCursor(value)
+		if err != nil || cursor.Sort != query.sort || cursor.Descending != query.descending {
+			return query, badQuery("The cursor is invalid, or was created for a different sort order.")
+		}
+		query.after = &cursor
+	}
+	return query, nil
+}
+
+// readDurationParam parses an optional duration query parameter
+func readDurationParam(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func badQuery(reason string) *MessageError {
+	return &MessageError{StatusCode: http.StatusBadRequest, Reason: reason}
+}
+
+// encodeRequestCursor creates an opaque cursor string
+func encodeRequestCursor(cursor requestCursor) string {
+	cursorBytes, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(cursorBytes)
+}
+
+// decodeRequestCursor parses a cursor string created by encodeRequestCursor
+func decodeRequestCursor(value string) (requestCursor, error) {
+	var cursor requestCursor
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(cursorBytes, &cursor)
+	return cursor, err
+}
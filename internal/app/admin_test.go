@@ -0,0 +1,257 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApp_requireAdmin(t *testing.T) {
+	tests := []struct {
+		name          string
+		adminToken    string
+		authorization string
+		statusCode    int
+	}{
+		{
+			name:          "Admin endpoints disabled without token configured",
+			adminToken:    "",
+			authorization: "Bearer ",
+			statusCode:    403,
+		},
+		{
+			name:          "Missing token",
+			adminToken:    "token",
+			authorization: "",
+			statusCode:    401,
+		},
+		{
+			name:          "Invalid token",
+			adminToken:    "token",
+			authorization: "Bearer wrong",
+			statusCode:    401,
+		},
+		{
+			name:          "Valid token",
+			adminToken:    "token",
+			authorization: "Bearer token",
+			statusCode:    200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{AdminToken: tt.adminToken}
+			handler := application.requireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			req := httptest.NewRequest("GET", "/admin/events", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+		})
+	}
+}
+
+func TestApp_requireMetricsAccess(t *testing.T) {
+	tests := []struct {
+		name          string
+		metricsToken  string
+		target        string
+		authorization string
+		statusCode    int
+	}{
+		{
+			name:          "Metrics token scrapes the metrics",
+			metricsToken:  "scrape",
+			target:        "/metrics",
+			authorization: "Bearer scrape",
+			statusCode:    200,
+		},
+		{
+			name:          "Admin token still scrapes the metrics",
+			metricsToken:  "scrape",
+			target:        "/metrics",
+			authorization: "Bearer token",
+			statusCode:    200,
+		},
+		{
+			name:          "Invalid metrics token",
+			metricsToken:  "scrape",
+			target:        "/metrics",
+			authorization: "Bearer wrong",
+			statusCode:    401,
+		},
+		{
+			name:          "Empty token without metrics token configured",
+			metricsToken:  "",
+			target:        "/metrics",
+			authorization: "Bearer ",
+			statusCode:    401,
+		},
+		{
+			name:          "Metrics token can't call the admin endpoints",
+			metricsToken:  "scrape",
+			target:        "/admin/queue",
+			authorization: "Bearer scrape",
+			statusCode:    401,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Queue:        NewFairQueue(1, nil),
+				Control:      NewQueueControl(),
+				Metrics:      NewMetrics(),
+				AdminToken:   "token",
+				MetricsToken: tt.metricsToken,
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.Header.Set("Authorization", tt.authorization)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+		})
+	}
+}
+
+func TestApp_listRequestsHandler(t *testing.T) {
+	now := time.Now()
+	mockRequest := func(requestId string, message string, state string, attempts int, age time.Duration) PendingRequest {
+		return PendingRequest{
+			Request:  Request{RequestId: requestId, Message: message},
+			Timing:   Timing{now.Add(-age), 1},
+			State:    state,
+			Attempts: attempts,
+			Add:      true,
+		}
+	}
+	application := Application{
+		AdminToken: "token",
+		Requests: map[string]PendingRequest{
+			"a": mockRequest("a", "taco", StateQueued, 0, 1*time.Minute),
+			"b": mockRequest("b", "chicken", StateRunning, 1, 2*time.Minute),
+			"c": mockRequest("c", "burrito", StateRetrying, 3, 3*time.Minute),
+			"d": mockRequest("d", "taco", StateCancelled, 2, 4*time.Minute),
+			"e": mockRequest("e", "nachos", "", 0, 5*time.Minute),
+		},
+	}
+	tests := []struct {
+		name       string
+		query      string
+		statusCode int
+		want       [][]string
+	}{
+		{
+			name:       "Oldest first by default",
+			query:      "",
+			statusCode: 200,
+			want:       [][]string{{"e", "d", "c", "b", "a"}},
+		},
+		{
+			name:       "Filter by state, treating empty state as queued",
+			query:      "state=queued,retrying",
+			statusCode: 200,
+			want:       [][]string{{"e", "c", "a"}},
+		},
+		{
+			name:       "Filter by age",
+			query:      "minAge=90s&maxAge=210s",
+			statusCode: 200,
+			want:       [][]string{{"c", "b"}},
+		},
+		{
+			name:       "Filter by attempts",
+			query:      "minAttempts=1&maxAttempts=2",
+			statusCode: 200,
+			want:       [][]string{{"d", "b"}},
+		},
+		{
+			name:       "Filter by message hash",
+			query:      "messageHash=" + hashMessage("taco"),
+			statusCode: 200,
+			want:       [][]string{{"d", "a"}},
+		},
+		{
+			name:       "Sort by attempts descending",
+			query:      "sort=attempts&order=desc",
+			statusCode: 200,
+			want:       [][]string{{"c", "d", "b", "a", "e"}},
+		},
+		{
+			name:       "Paginates with a cursor",
+			query:      "sort=attempts&limit=2",
+			statusCode: 200,
+			want:       [][]string{{"a", "e"}, {"b", "d"}, {"c"}},
+		},
+		{
+			name:       "Invalid sort",
+			query:      "sort=message",
+			statusCode: 400,
+		},
+		{
+			name:       "Invalid limit",
+			query:      "limit=0",
+			statusCode: 400,
+		},
+		{
+			name:       "Invalid cursor",
+			query:      "cursor=nonsense",
+			statusCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(&application)
+			cursor := ""
+			for page := 0; ; page++ {
+				target := "/admin/requests?" + tt.query
+				if cursor != "" {
+					target += "&cursor=" + cursor
+				}
+				req := httptest.NewRequest("GET", target, nil)
+				req.Header.Set("Authorization", "Bearer token")
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+					t.Fatalf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+				}
+				if tt.statusCode != http.StatusOK {
+					return
+				}
+				var list RequestList
+				if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+					t.Fatalf("Unable to unmarshal response body. Details: %v", err.Error())
+				}
+				var got []string
+				for _, summary := range list.Requests {
+					got = append(got, summary.RequestId)
+				}
+				if page >= len(tt.want) {
+					t.Fatalf("Got more pages than expected. Extra page: %v", got)
+				}
+				if !cmp.Equal(got, tt.want[page]) {
+					t.Errorf("Page %v not as expected. Wanted: %v, Got: %v", page, tt.want[page], got)
+				}
+				cursor = list.NextCursor
+				if cursor == "" {
+					if page != len(tt.want)-1 {
+						t.Errorf("Got fewer pages than expected. Wanted: %v, Got: %v", len(tt.want), page+1)
+					}
+					return
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package app
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Machine-readable error codes reported by the /v1 API. Codes are stable, while the accompanying messages may change
+const (
+	ErrorInvalidRequest       = "invalid_request"
+	ErrorPayloadTooLarge      = "payload_too_large"
+	ErrorUnsupportedMediaType = "unsupported_media_type"
+	ErrorCallbacksUnavailable = "callbacks_unavailable"
+	ErrorUnauthorized         = "unauthorized"
+	ErrorForbidden            = "forbidden"
+	ErrorNotFound             = "not_found"
+	ErrorAlreadySigned        = "already_signed"
+	ErrorRequestIdConflict    = "request_id_conflict"
+	ErrorRequestCancelled     = "request_cancelled"
+	ErrorRequestExpired       = "request_expired"
+	ErrorIdempotencyKeyReused = "idempotency_key_reused"
+	ErrorTooManyQueued        = "too_many_queued"
+	ErrorRateLimited          = "rate_limited"
+	ErrorQuotaExceeded        = "quota_exceeded"
+	ErrorQueueFull            = "queue_full"
+	ErrorDraining             = "draining"
+	ErrorNotRequeueable       = "not_requeueable"
+	// ErrorUpstreamUnavailable is reported for requests the upstream service could not sign within the attempts allowed
+	ErrorUpstreamUnavailable = "upstream_unavailable"
+	ErrorInternal            = "internal_error"
+)
+
+// Envelope is the single shape of every /v1 response body. Exactly one of Data and Error is set
+type Envelope struct {
+	Data  interface{}    `json:"data,omitempty"`
+	Error *EnvelopeError `json:"error,omitempty"`
+}
+
+// EnvelopeError describes why a /v1 request could not be served
+type EnvelopeError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// v1Response is implemented by the response bodies of the legacy routes, converting them to their /v1 data
+type v1Response interface {
+	v1Data() interface{}
+}
+
+// v1ResponseWriter marks a response as belonging to the /v1 API, so the shared handlers write the /v1 envelope
+// instead of the legacy response bodies
+type v1ResponseWriter struct {
+	http.ResponseWriter
+}
+
+// Flush lets event streams flush through the wrapped response writer
+func (w *v1ResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// useV1Envelope is a middleware switching the handlers of the /v1 routes over to the /v1 envelope
+func useV1Envelope(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&v1ResponseWriter{ResponseWriter: w}, r)
+	})
+}
+
+// v1Writer prepares a response written by middleware running ahead of the /v1 middleware, so rejections on /v1
+// routes are still wrapped in the envelope
+func v1Writer(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	if strings.HasPrefix(r.URL.Path, "/v1/") {
+		return &v1ResponseWriter{ResponseWriter: w}
+	}
+	return w
+}
+
+// isV1 reports whether a response is being written for the /v1 API
+func isV1(w http.ResponseWriter) bool {
+	_, ok := w.(*v1ResponseWriter)
+	return ok
+}
+
+// envelope wraps a legacy response body in the /v1 envelope
+func envelope(body interface{}) Envelope {
+	if denied, ok := body.(RequestDenied); ok {
+		return Envelope{Error: &EnvelopeError{Code: denied.Code, Message: denied.Body}}
+	}
+	if response, ok := body.(v1Response); ok {
+		return Envelope{Data: response.v1Data()}
+	}
+	return Envelope{Data: body}
+}
+
+// registerV1Routes defines the /v1 routes, which share their handlers with the legacy routes
+func registerV1Routes(router *mux.Router, application *Application) {
+	v1 := router.PathPrefix("/v1").Subrouter()
+	v1.Use(useV1Envelope)
+	v1.HandleFunc("/health", application.healthHandler).Methods("GET").Name(EndpointHealth)
+	v1.HandleFunc("/requests", application.newRequestHandler).Methods("POST").Name(EndpointSign)
+	v1.HandleFunc("/requests/{requestId}", application.currentRequestHandler).Methods("GET").Name(EndpointStatus)
+	v1.HandleFunc("/requests/{requestId}", application.cancelRequestHandler).Methods("DELETE").Name(EndpointCancel)
+	v1.HandleFunc("/requests/{requestId}/events", application.requestEventsHandler).Methods("GET").Name(EndpointEvents)
+	v1.HandleFunc("/batches", application.newBatchHandler).Methods("POST").Name(EndpointBatch)
+	v1.HandleFunc("/batches/{batchId}", application.batchStatusHandler).Methods("GET").Name(EndpointBatchStatus)
+	admin := v1.PathPrefix("/admin").Subrouter()
+	admin.Use(application.requireAdmin)
+	admin.HandleFunc("/events", application.eventsHandler).Methods("GET").Name(EndpointAdminEvents)
+	admin.HandleFunc("/requests", application.listRequestsHandler).Methods("GET").Name(EndpointAdminRequests)
+	admin.HandleFunc("/requests/requeue", application.requeueRequestsHandler).Methods("POST").Name(EndpointAdminRequeueAll)
+	admin.HandleFunc("/requests/{requestId}/requeue", application.requeueRequestHandler).Methods("POST").Name(EndpointAdminRequeue)
+	admin.HandleFunc("/queue", application.queueStatusHandler).Methods("GET").Name(EndpointAdminQueue)
+	admin.HandleFunc("/queue/pause", application.pauseQueueHandler).Methods("POST").Name(EndpointAdminPause)
+	admin.HandleFunc("/queue/resume", application.resumeQueueHandler).Methods("POST").Name(EndpointAdminResume)
+	admin.HandleFunc("/queue/drain", application.drainQueueHandler).Methods("POST").Name(EndpointAdminDrain)
+}
+
+// HealthData is the /v1 data of a health check
+type HealthData struct {
+	Status string `json:"status"`
+}
+
+func (response HealthRequest) v1Data() interface{} {
+	return HealthData{Status: "running"}
+}
+
+// RequestData is the /v1 data describing a single request
+type RequestData struct {
+	RequestId    string            `json:"requestId"`
+	State        string            `json:"state"`
+	Signature    string            `json:"signature,omitempty"`
+	NotBefore    *time.Time        `json:"notBefore,omitempty"`
+	TimeEstimate float64           `json:"timeEstimate,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+// States reported by the /v1 API for requests that are signed, or still waiting on a signature. Signed requests are
+// also tracked in StateSigned until their signature is retrieved
+const (
+	StateSigned  = "signed"
+	StatePending = "pending"
+)
+
+func (response RequestFulfilled) v1Data() interface{} {
+	return RequestData{RequestId: response.RequestId, State: StateSigned, Signature: response.Signature, Metadata: response.Metadata}
+}
+
+func (response RequestProcessing) v1Data() interface{} {
+	state := StatePending
+	if response.State != "" {
+		state = response.State
+	}
+	return RequestData{RequestId: response.RequestId, State: state, NotBefore: response.NotBefore, TimeEstimate: response.TimeEstimate, Metadata: response.Metadata}
+}
+
+func (response RequestCancelled) v1Data() interface{} {
+	return RequestData{RequestId: response.RequestId, State: response.State}
+}
+
+// BatchData is the /v1 data describing a batch and the requests within it
+type BatchData struct {
+	BatchId      string          `json:"batchId"`
+	RequestIds   []string        `json:"requestIds,omitempty"`
+	Total        int             `json:"total"`
+	Pending      int             `json:"pending"`
+	Signed       int             `json:"signed"`
+	Cancelled    int             `json:"cancelled"`
+	Expired      int             `json:"expired"`
+	Failed       int             `json:"failed"`
+	Unknown      int             `json:"unknown"`
+	TimeEstimate float64         `json:"timeEstimate"`
+	Items        []BatchItemData `json:"items,omitempty"`
+}
+
+// BatchItemData is the /v1 data describing a single request within a batch
+type BatchItemData struct {
+	RequestId string `json:"requestId"`
+	Status    string `json:"status"`
+	Signature string `json:"signature,omitempty"`
+}
+
+func (response BatchProcessing) v1Data() interface{} {
+	return BatchData{
+		BatchId:      response.BatchId,
+		RequestIds:   response.RequestIds,
+		Total:        len(response.RequestIds),
+		Pending:      len(response.RequestIds),
+		TimeEstimate: response.TimeEstimate,
+	}
+}
+
+func (response BatchProgress) v1Data() interface{} {
+	items := make([]BatchItemData, 0, len(response.Items))
+	for _, item := range response.Items {
+		items = append(items, BatchItemData{RequestId: item.RequestId, Status: item.Status, Signature: item.Signature})
+	}
+	return BatchData{
+		BatchId:      response.BatchId,
+		Total:        response.Total,
+		Pending:      response.Pending,
+		Signed:       response.Signed,
+		Cancelled:    response.Cancelled,
+		Expired:      response.Expired,
+		Failed:       response.Failed,
+		Unknown:      response.Unknown,
+		TimeEstimate: response.TimeEstimate,
+		Items:        items,
+	}
+}
+
+// RequestListData is the /v1 data of a page of tracked requests
+type RequestListData struct {
+	Requests   []RequestSummaryData `json:"requests"`
+	NextCursor string               `json:"nextCursor,omitempty"`
+}
+
+// RequestSummaryData is the /v1 data summarising a tracked request
+type RequestSummaryData struct {
+	RequestId   string    `json:"requestId"`
+	State       string    `json:"state"`
+	Attempts    int       `json:"attempts"`
+	MessageHash string    `json:"messageHash"`
+	ClientId    string    `json:"clientId,omitempty"`
+	CallbackUrl string    `json:"callbackUrl,omitempty"`
+	TenantId    string    `json:"tenantId"`
+	Priority    string    `json:"priority"`
+	TimeAdded   time.Time `json:"timeAdded"`
+	AgeSeconds  float64   `json:"ageSeconds"`
+}
+
+func (response RequestList) v1Data() interface{} {
+	summaries := make([]RequestSummaryData, 0, len(response.Requests))
+	for _, summary := range response.Requests {
+		summaries = append(summaries, RequestSummaryData(summary))
+	}
+	return RequestListData{Requests: summaries, NextCursor: response.NextCursor}
+}
+
+// QueueStatusData is the /v1 data describing the state of the encrypt queue
+type QueueStatusData struct {
+	Paused    bool `json:"paused"`
+	Draining  bool `json:"draining"`
+	Drained   bool `json:"drained"`
+	Queued    int  `json:"queued"`
+	Scheduled int  `json:"scheduled"`
+	Running   int  `json:"running"`
+}
+
+func (response QueueStatus) v1Data() interface{} {
+	return QueueStatusData{
+		Paused:    response.Paused,
+		Draining:  response.Draining,
+		Drained:   response.Drained,
+		Queued:    response.Queued,
+		Scheduled: response.Scheduled,
+		Running:   response.Running,
+	}
+}
+
+// RequeueData is the /v1 data listing the requests placed back on the encrypt queue
+type RequeueData struct {
+	RequestIds []string `json:"requestIds"`
+}
+
+func (response RequeueResult) v1Data() interface{} {
+	return RequeueData{RequestIds: response.RequestIds}
+}
+
+// EventData is the /v1 data of a request state transition
+type EventData struct {
+	Sequence  uint64    `json:"sequence,omitempty"`
+	RequestId string    `json:"requestId"`
+	State     string    `json:"state"`
+	Attempt   int       `json:"attempt,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (event Event) v1Data() interface{} {
+	return EventData(event)
+}
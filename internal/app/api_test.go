@@ -0,0 +1,141 @@
+package app
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApp_v1Routes(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		body         string
+		queueSize    int
+		statusCode   int
+		bodyExpected string
+	}{
+		{
+			name:         "Health",
+			method:       "GET",
+			target:       "/v1/health",
+			statusCode:   200,
+			bodyExpected: `{"data":{"status":"running"}}`,
+		},
+		{
+			name:         "Submit a message",
+			method:       "POST",
+			target:       "/v1/requests?wait=0",
+			body:         `{"message":"taco","requestId":"job-1234"}`,
+			queueSize:    1,
+			statusCode:   202,
+			bodyExpected: `{"data":{"requestId":"job-1234","state":"pending","timeEstimate":1}}`,
+		},
+		{
+			name:         "Submit with a full queue",
+			method:       "POST",
+			target:       "/v1/requests",
+			body:         `{"message":"taco"}`,
+			statusCode:   503,
+			bodyExpected: `{"error":{"code":"queue_full","message":"The request could not be processed, server is at capacity. Please try again shortly."}}`,
+		},
+		{
+			name:         "Submit malformed JSON",
+			method:       "POST",
+			target:       "/v1/requests",
+			body:         `{"message":`,
+			statusCode:   400,
+			bodyExpected: `{"error":{"code":"invalid_request","message":"The request body is not valid JSON. Expected {\"message\": string}."}}`,
+		},
+		{
+			name:       "Submission by GET is not part of /v1",
+			method:     "GET",
+			target:     "/v1/requests?message=taco",
+			statusCode: 405,
+		},
+		{
+			name:         "Signed request",
+			method:       "GET",
+			target:       "/v1/requests/signed",
+			statusCode:   200,
+			bodyExpected: `{"data":{"requestId":"signed","state":"signed","signature":"signature"}}`,
+		},
+		{
+			name:         "Cancelled request",
+			method:       "GET",
+			target:       "/v1/requests/cancelled",
+			statusCode:   410,
+			bodyExpected: `{"error":{"code":"request_cancelled","message":"The request was cancelled before it was signed. Please use the 'crypto/sign' endpoint to generate a new request."}}`,
+		},
+		{
+			name:         "Unknown request",
+			method:       "GET",
+			target:       "/v1/requests/missing",
+			statusCode:   404,
+			bodyExpected: `{"error":{"code":"not_found","message":"The requestId is not recognized. Please use the 'crypto/sign' endpoint to generate a new request."}}`,
+		},
+		{
+			name:         "Cancel a signed request",
+			method:       "DELETE",
+			target:       "/v1/requests/signed",
+			statusCode:   409,
+			bodyExpected: `{"error":{"code":"already_signed","message":"The request has already been signed and can no longer be cancelled. Please use the 'crypto/sign/request/{requestId}' endpoint to retrieve the signature."}}`,
+		},
+		{
+			name:         "Batch progress",
+			method:       "GET",
+			target:       "/v1/batches/batch",
+			statusCode:   200,
+			bodyExpected: `{"data":{"batchId":"batch","total":2,"pending":0,"signed":1,"cancelled":1,"expired":0,"failed":0,"unknown":0,"timeEstimate":0,"items":[{"requestId":"signed","status":"signed","signature":"signature"},{"requestId":"cancelled","status":"cancelled"}]}}`,
+		},
+		{
+			name:         "Request events",
+			method:       "GET",
+			target:       "/v1/requests/signed/events",
+			statusCode:   200,
+			bodyExpected: `"requestId":"signed","state":"signed"`,
+		},
+		{
+			name:         "Admin endpoints disabled",
+			method:       "GET",
+			target:       "/v1/admin/requests",
+			statusCode:   403,
+			bodyExpected: `{"error":{"code":"forbidden","message":"Admin endpoints are disabled."}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Queue:      NewFairQueue(tt.queueSize, nil),
+				Store:      make(chan SignedRequest, 1),
+				Signatures: map[string]string{"signed": "signature"},
+				Track:      make(chan PendingRequest, 1),
+				Requests: map[string]PendingRequest{
+					"cancelled": {Request: Request{RequestId: "cancelled", Message: "taco"}, Timing: Timing{time.Now(), 1}, State: StateCancelled, Add: true},
+				},
+				ServerPort: ":8080",
+				Events:     NewEventBroker(),
+				Batches: &BatchStore{Batches: map[string]Batch{
+					"batch": {BatchId: "batch", RequestIds: []string{"signed", "cancelled"}},
+				}},
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@ package app
 
 import (
 	"math"
+	"net/http"
+	"net/url"
+	"sync"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -9,28 +12,94 @@ import (
 
 // Application contains the configuration settings for the core API service
 type Application struct {
-	Encrypt    chan Request
+	// Queue holds the requests waiting on an encryptor, shared fairly between clients
+	Queue *FairQueue
+	// Schedule holds back requests until their notBefore time, which are queued straight away when unset
+	Schedule   *Schedule
 	Store      chan SignedRequest
 	Signatures map[string]string
-	Track      chan PendingRequest
-	Requests   map[string]PendingRequest
-	ServerPort string
+	// signaturesLock guards Signatures, which the storer writes while handlers read them
+	signaturesLock sync.RWMutex
+	Track          chan PendingRequest
+	Requests       map[string]PendingRequest
+	// requestsLock guards Requests, which the tracker writes while handlers read them
+	requestsLock sync.RWMutex
+	ServerPort   string
+	// MaxMessageBytes limits the size of a message submitted for encryption, DefaultMaxMessageBytes when unset
+	MaxMessageBytes int64
+	// MaxBatchSize limits the number of messages submitted in a single batch, DefaultMaxBatchSize when unset
+	MaxBatchSize int
+	// MaxBatchBytes limits the size of the request body of a batch, DefaultMaxBatchBytes when unset
+	MaxBatchBytes int64
+	Batches       *BatchStore
+	Outbox        *Outbox
+	Events        *EventBroker
+	Notifier      *Notifier
+	// MaxWait caps how long a caller can wait for a signature with the 'wait' parameter, DefaultMaxWait when unset
+	MaxWait       time.Duration
+	Cancellations *Canceller
+	// AdminToken is the bearer token required by the /admin endpoints, which are disabled when unset
+	AdminToken string
+	// MetricsToken is a bearer token allowing the /metrics endpoint to be scraped without admin privileges, which
+	// only admins can scrape when unset
+	MetricsToken string
+	// Idempotency remembers the Idempotency-Keys of submissions, which are ignored when unset
+	Idempotency *IdempotencyStore
+	// Metadata holds the metadata clients attached to their requests until the signature is retrieved
+	Metadata *MetadataStore
+	// RequestIdClaims holds the client supplied request ids being enqueued, so racing submissions of one id are refused
+	RequestIdClaims *RequestIdClaims
+	// APIKeys authenticates callers and holds their policies, authentication is disabled when unset
+	APIKeys *KeyStore
+	// JWT verifies bearer tokens, which are not accepted when unset
+	JWT *JWTVerifier
+	// Limits enforces the rate limits and quotas of each client, which are off when unset
+	Limits *ClientLimiter
+	// Control pauses the encryptor handler and drains the service, which can't be done when unset
+	Control *QueueControl
+	// Metrics counts what happens to requests in the pipeline, for the /metrics endpoint
+	Metrics *Metrics
+	// Tracer times the handling of each call as a span, which is disabled when unset
+	Tracer *Tracer
 }
 
 // SignedRequest contains a unique identifier for the request, the encryption
 // signature of a message, and a flag to add (if true) or remove (if false)
-// from storage
+// from storage. The callback url and client are carried along so the client
+// can be notified once the signature is stored, and the span context and
+// correlation id so storing it joins the trace and logs of the request
 type SignedRequest struct {
-	RequestId string
-	Signature string
-	Add       bool
+	RequestId     string
+	Signature     string
+	Add           bool
+	CallbackUrl   string
+	ClientId      string
+	TenantId      string
+	Traceparent   string
+	CorrelationId string
 }
 
 // Request contains the message canidate for encryption and a unique identifier
-// for the request
+// for the request, as well as the client that submitted it and an optional url
+// to notify on completion
 type Request struct {
-	RequestId string
-	Message   string
+	RequestId   string
+	Message     string
+	ClientId    string
+	CallbackUrl string
+	TenantId    string `json:",omitempty"`
+	// Priority is the lane of the encrypt queue the request waits in, normal when empty
+	Priority string `json:",omitempty"`
+	// NotBefore is the time a scheduled request is held back until
+	NotBefore *time.Time `json:",omitempty"`
+	// Deadline is the time after which the request is no longer worth signing
+	Deadline *time.Time `json:",omitempty"`
+	// Traceparent is the span context of the call that submitted the request, which the work done on it is traced under
+	Traceparent string `json:",omitempty"`
+	// CorrelationId ties the log lines of the work done on the request to the call that submitted it
+	CorrelationId string `json:",omitempty"`
+	// IdempotencyKey is the Idempotency-Key the request was submitted with, which keeps its signature once retrieved
+	IdempotencyKey string `json:",omitempty"`
 }
 
 type Timing struct {
@@ -38,26 +107,83 @@ type Timing struct {
 	TimeEstimate float64
 }
 
-// PendingRequest contains a unique identifier for the request, and a flag to
-// add (if true) or remove (if false) from progress tracker
+// States of a request held by the progress tracker. Requests persisted before
+// states were introduced have an empty state, and are treated as queued. Failed
+// requests are dead-lettered, as the upstream service could not sign them.
+// Signed requests are tracked as StateSigned until their signature is retrieved
+const (
+	StateQueued    = "queued"
+	StateRunning   = "running"
+	StateRetrying  = "retrying"
+	StateCancelled = "cancelled"
+	StateExpired   = "expired"
+	StateFailed    = "failed"
+)
+
+// PendingRequest contains a unique identifier for the request, its state, the
+// number of upstream attempts made so far, when it reached a final state, and a
+// flag to add or update (if true) or remove (if false) from progress tracker
 type PendingRequest struct {
 	Request
 	Timing
-	Add bool
+	State        string
+	Attempts     int
+	TimeFinished time.Time
+	Add          bool
+}
+
+// pathVar reads a variable of the route's path, which is matched before being unescaped
+func pathVar(r *http.Request, name string) string {
+	value := mux.Vars(r)[name]
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		return unescaped
+	}
+	return value
 }
 
 // newRouter is a private function that defines the routes for the API and the call methods
 func NewRouter(application *Application) *mux.Router {
-	router := mux.NewRouter()
-	router.HandleFunc("/", application.healthHandler).Methods("GET")
-	router.HandleFunc("/crypto/sign", application.newRequestHandler).Methods("GET")
-	router.HandleFunc("/crypto/sign/request/{requestId}", application.currentRequestHandler).Methods("GET")
+	// Routes match the encoded path, so ids containing '/', such as those of clients outside the default tenant,
+	// stay within their path segment
+	router := mux.NewRouter().UseEncodedPath()
+	router.Use(application.logRequests, application.traceRequests, application.authenticate, application.rateLimit)
+	router.HandleFunc("/", application.healthHandler).Methods("GET").Name(EndpointHealth)
+	router.HandleFunc("/openapi.json", application.openAPIHandler).Methods("GET").Name(EndpointOpenAPI)
+	router.HandleFunc("/crypto/sign", application.newRequestHandler).Methods("GET", "POST").Name(EndpointSign)
+	router.HandleFunc("/crypto/sign/request/{requestId}", application.currentRequestHandler).Methods("GET").Name(EndpointStatus)
+	router.HandleFunc("/crypto/sign/request/{requestId}", application.cancelRequestHandler).Methods("DELETE").Name(EndpointCancel)
+	router.HandleFunc("/crypto/sign/batch", application.newBatchHandler).Methods("POST").Name(EndpointBatch)
+	router.HandleFunc("/crypto/sign/batch/{batchId}", application.batchStatusHandler).Methods("GET").Name(EndpointBatchStatus)
+	router.HandleFunc("/crypto/sign/request/{requestId}/events", application.requestEventsHandler).Methods("GET").Name(EndpointEvents)
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(application.requireAdmin)
+	admin.HandleFunc("/events", application.eventsHandler).Methods("GET").Name(EndpointAdminEvents)
+	admin.HandleFunc("/requests", application.listRequestsHandler).Methods("GET").Name(EndpointAdminRequests)
+	admin.HandleFunc("/requests/requeue", application.requeueRequestsHandler).Methods("POST").Name(EndpointAdminRequeueAll)
+	admin.HandleFunc("/requests/{requestId}/requeue", application.requeueRequestHandler).Methods("POST").Name(EndpointAdminRequeue)
+	admin.HandleFunc("/queue", application.queueStatusHandler).Methods("GET").Name(EndpointAdminQueue)
+	admin.HandleFunc("/queue/pause", application.pauseQueueHandler).Methods("POST").Name(EndpointAdminPause)
+	admin.HandleFunc("/queue/resume", application.resumeQueueHandler).Methods("POST").Name(EndpointAdminResume)
+	admin.HandleFunc("/queue/drain", application.drainQueueHandler).Methods("POST").Name(EndpointAdminDrain)
+	router.Handle("/metrics", application.requireMetricsAccess(http.HandlerFunc(application.metricsHandler))).Methods("GET").Name(EndpointMetrics)
+	registerV1Routes(router, application)
 	return router
 }
 
-// GetEncryptionTimeEstimate estimated time for a message to be encrypted, dependent on current encryption queue
+// GetEncryptionTimeEstimate estimated time for a message to be encrypted, dependent on its position in the encryption
+// queue, which takes the weights of the other clients with queued requests into account
 // Default to 1 minute (case where nothing in queue, yet encryptor is having to keep retrying)
-func (application *Application) GetEncryptionTiming(currentTime time.Time) Timing {
-	timeEstimate := math.Max(1, math.Ceil(float64(len(application.Encrypt))/5.0))
+func (application *Application) GetEncryptionTiming(currentTime time.Time, request Request) Timing {
+	timeEstimate := math.Max(1, math.Ceil(float64(application.Queue.Position(request))/signaturesPerMinute))
 	return Timing{TimeAdded: currentTime, TimeEstimate: timeEstimate}
 }
+
+// queueFullRetryMinutes is how long, in minutes, until the encrypt queue has freed enough room for a submission of
+// the given number of requests, as requests leave the head of the queue
+func (application *Application) queueFullRetryMinutes(submitted int) float64 {
+	excess := application.Queue.Len() + submitted - application.Queue.Capacity()
+	if excess < 1 {
+		excess = 1
+	}
+	return float64(excess) / signaturesPerMinute
+}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"net/http"
 	"net/http/httptest"
@@ -9,8 +10,8 @@ import (
 )
 
 func TestApp_NewRouter(t *testing.T) {
-	mockApplication := Application{
-		Encrypt:    make(chan Request),
+	mockApplication := &Application{
+		Queue:      NewFairQueue(0, nil),
 		Store:      make(chan SignedRequest),
 		Signatures: make(map[string]string),
 		Track:      make(chan PendingRequest),
@@ -20,7 +21,7 @@ func TestApp_NewRouter(t *testing.T) {
 	mockBodyExpected := `{"Body":"Server is running","StatusCode":200}`
 	tests := []struct {
 		name             string
-		application      Application
+		application      *Application
 		bodyExpected     string
 		want             int
 		isTestingFailure bool
@@ -42,7 +43,7 @@ func TestApp_NewRouter(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			router := NewRouter(&tt.application)
+			router := NewRouter(tt.application)
 			req, err := http.NewRequest("GET", "/", nil)
 			if err != nil {
 				t.Fatalf("Failed to create API request for tests. Details: %v", err)
@@ -60,69 +61,92 @@ func TestApp_NewRouter(t *testing.T) {
 }
 
 func TestApp_GetEncryptionTiming(t *testing.T) {
-	mockApplicationEmptyEncrypt := Application{
-		Encrypt:    make(chan Request, 301),
-		Store:      make(chan SignedRequest),
-		Signatures: make(map[string]string),
-		Track:      make(chan PendingRequest),
-		Requests:   make(map[string]PendingRequest),
-		ServerPort: ":8080",
-	}
-	mockApplicationLargeEncrypt := Application{
-		Encrypt:    make(chan Request, 301),
-		Store:      make(chan SignedRequest),
-		Signatures: make(map[string]string),
-		Track:      make(chan PendingRequest),
-		Requests:   make(map[string]PendingRequest),
-		ServerPort: ":8080",
-	}
-	mockApplicationSmallEncrypt := Application{
-		Encrypt:    make(chan Request, 301),
-		Store:      make(chan SignedRequest),
-		Signatures: make(map[string]string),
-		Track:      make(chan PendingRequest),
-		Requests:   make(map[string]PendingRequest),
-		ServerPort: ":8080",
-	}
 	mockTimeNow := time.Now()
 	tests := []struct {
-		name        string
-		application Application
-		queueSize   int
-		timeNow     time.Time
-		want        Timing
+		name string
+		// queued are the number of requests queued by each client ahead of the request, which comes from "alpha"
+		queued  map[string]int
+		weights map[string]int
+		timeNow time.Time
+		want    Timing
 	}{
 		{
-			name:        "1 minute wait time, empty Queue",
-			application: mockApplicationEmptyEncrypt,
-			queueSize:   0,
-			timeNow:     mockTimeNow,
-			want:        Timing{TimeAdded: mockTimeNow, TimeEstimate: float64(1)},
+			name:    "1 minute wait time, empty Queue",
+			timeNow: mockTimeNow,
+			want:    Timing{TimeAdded: mockTimeNow, TimeEstimate: float64(1)},
 		},
 		{
-			name:        "60 minute wait time, large queue",
-			application: mockApplicationLargeEncrypt,
-			queueSize:   300,
-			timeNow:     mockTimeNow,
-			want:        Timing{TimeAdded: mockTimeNow, TimeEstimate: float64(60)},
+			name:    "60 minute wait time, large queue",
+			queued:  map[string]int{"alpha": 299},
+			timeNow: mockTimeNow,
+			want:    Timing{TimeAdded: mockTimeNow, TimeEstimate: float64(60)},
 		},
 		{
-			name:        "7 minute wait time, small queue",
-			application: mockApplicationSmallEncrypt,
-			queueSize:   35,
-			timeNow:     mockTimeNow,
-			want:        Timing{TimeAdded: mockTimeNow, TimeEstimate: float64(7)},
+			name:    "7 minute wait time, small queue",
+			queued:  map[string]int{"alpha": 34},
+			timeNow: mockTimeNow,
+			want:    Timing{TimeAdded: mockTimeNow, TimeEstimate: float64(7)},
+		},
+		{
+			name:    "1 minute wait time, behind another client's burst",
+			queued:  map[string]int{"beta": 299},
+			timeNow: mockTimeNow,
+			want:    Timing{TimeAdded: mockTimeNow, TimeEstimate: float64(1)},
+		},
+		{
+			name:    "Shares the queue evenly with another client",
+			queued:  map[string]int{"alpha": 19, "beta": 299},
+			timeNow: mockTimeNow,
+			want:    Timing{TimeAdded: mockTimeNow, TimeEstimate: float64(8)},
+		},
+		{
+			name:    "Shares the queue by weight with another client",
+			queued:  map[string]int{"alpha": 19, "beta": 299},
+			weights: map[string]int{"beta": 3},
+			timeNow: mockTimeNow,
+			want:    Timing{TimeAdded: mockTimeNow, TimeEstimate: float64(16)},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			for i := 0; i < tt.queueSize; i++ {
-				tt.application.Encrypt <- Request{RequestId: "requestId", Message: "message"}
+			application := Application{Queue: NewFairQueue(601, tt.weights)}
+			for clientId, queued := range tt.queued {
+				for i := 0; i < queued; i++ {
+					application.Queue.Push(Request{RequestId: fmt.Sprintf("%v-%v", clientId, i), Message: "message", ClientId: clientId})
+				}
 			}
-			timing := tt.application.GetEncryptionTiming(tt.timeNow)
+			request := Request{RequestId: "requestId", Message: "message", ClientId: "alpha"}
+			application.Queue.Push(request)
+			timing := application.GetEncryptionTiming(tt.timeNow, request)
 			if !cmp.Equal(timing, tt.want) {
 				t.Errorf("Failed, wait time not as expected. Wanted: %v Got: %v", tt.want, timing)
 			}
 		})
 	}
 }
+
+func TestApp_queueFullRetryMinutes(t *testing.T) {
+	tests := []struct {
+		name      string
+		capacity  int
+		queued    int
+		submitted int
+		want      float64
+	}{
+		{name: "Full queue frees a slot for a single request", capacity: 10, queued: 10, submitted: 1, want: 1 / signaturesPerMinute},
+		{name: "Full queue frees slots for a batch", capacity: 10, queued: 10, submitted: 5, want: 5 / signaturesPerMinute},
+		{name: "Batch larger than the room left", capacity: 10, queued: 8, submitted: 5, want: 3 / signaturesPerMinute},
+		{name: "Queue without capacity", capacity: 0, queued: 0, submitted: 1, want: 1 / signaturesPerMinute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{Queue: NewFairQueue(tt.capacity, nil)}
+			for i := 0; i < tt.queued; i++ {
+				application.Queue.Push(Request{RequestId: fmt.Sprintf("request-%v", i), Message: "message"})
+			}
+			if got := application.queueFullRetryMinutes(tt.submitted); got != tt.want {
+				t.Errorf("Retry minutes not as expected. Wanted: %v, Recieved: %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Endpoint names, given to the routes so API key policies can refer to them. The legacy and /v1 routes
+// serving the same handler share a name
+const (
+	EndpointHealth          = "health"
+	EndpointOpenAPI         = "openapi"
+	EndpointSign            = "sign"
+	EndpointStatus          = "status"
+	EndpointCancel          = "cancel"
+	EndpointEvents          = "events"
+	EndpointBatch           = "batch"
+	EndpointBatchStatus     = "batchStatus"
+	EndpointAdminEvents     = "adminEvents"
+	EndpointAdminRequests   = "adminRequests"
+	EndpointAdminRequeue    = "adminRequeue"
+	EndpointAdminRequeueAll = "adminRequeueAll"
+	EndpointAdminQueue      = "adminQueue"
+	EndpointAdminPause      = "adminPause"
+	EndpointAdminResume     = "adminResume"
+	EndpointAdminDrain      = "adminDrain"
+	EndpointMetrics         = "metrics"
+)
+
+// publicEndpoints can be called without an API key
+var publicEndpoints = map[string]bool{EndpointHealth: true, EndpointOpenAPI: true}
+
+// adminEndpoints are governed by admin privileges rather than the endpoints of a policy, and can still be
+// called with the admin token instead of an API key
+var adminEndpoints = map[string]bool{
+	EndpointAdminEvents:     true,
+	EndpointAdminRequests:   true,
+	EndpointAdminRequeue:    true,
+	EndpointAdminRequeueAll: true,
+	EndpointAdminQueue:      true,
+	EndpointAdminPause:      true,
+	EndpointAdminResume:     true,
+	EndpointAdminDrain:      true,
+	EndpointMetrics:         true,
+}
+
+// clientContextKey is the context key the authenticated client is stored under
+type clientContextKey struct{}
+
+// Client is the identity and policy of the caller of a request
+type Client struct {
+	Id string
+	// Endpoints the client may call, every non-admin endpoint when empty
+	Endpoints []string
+	// MaxQueued limits the requests the client can have waiting on a signature, unlimited when zero
+	MaxQueued int
+	// Admin allows the client to call the admin endpoints
+	Admin bool
+	// Tenant the client belongs to, if any
+	Tenant string
+	// Priorities the client may submit requests at, normal and low when empty
+	Priorities []string
+	// Scopes granted to the client by its bearer token
+	Scopes []string `json:"-"`
+	// Limits on the rate the client can call at, and the messages it can submit
+	Limits
+}
+
+// APIKey is an entry of the API keys file. Only the hex encoded SHA-256 of each key is kept
+type APIKey struct {
+	KeyHash string
+	Client
+}
+
+// KeyStore holds the clients of every API key, by the hash of the key
+type KeyStore struct {
+	Clients map[string]Client
+}
+
+// Lookup finds the client an API key belongs to
+func (store *KeyStore) Lookup(key string) (Client, bool) {
+	client, ok := store.Clients[hashAPIKey(key)]
+	return client, ok
+}
+
+// allows reports whether the client's policy permits calling an endpoint
+func (client Client) allows(endpoint string) bool {
+	if adminEndpoints[endpoint] {
+		return client.Admin
+	}
+	if len(client.Endpoints) == 0 {
+		return true
+	}
+	for _, allowed := range client.Endpoints {
+		if allowed == endpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate is a middleware attaching the calling client to each request. With API keys or bearer tokens
+// configured, callers must present credentials permitting the endpoint, either a key in the X-API-Key header or a
+// token in the Authorization header. Without them, authentication is disabled and clients identify themselves
+// with the X-Client-Id header
+func (application *Application) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if application.APIKeys == nil && application.JWT == nil {
+			next.ServeHTTP(w, withClient(r, Client{Id: r.Header.Get("X-Client-Id"), Tenant: r.Header.Get("X-Tenant-Id")}))
+			return
+		}
+		endpoint := ""
+		if route := mux.CurrentRoute(r); route != nil {
+			endpoint = route.GetName()
+		}
+		if publicEndpoints[endpoint] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client, ok := application.clientFromCredentials(r)
+		if !ok && adminEndpoints[endpoint] {
+			// Admin endpoints fall back to the admin token, which is also sent as a bearer token
+			next.ServeHTTP(w, r)
+			return
+		}
+		denied := v1Writer(w, r)
+		if !ok {
+			if application.JWT != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="synthesia"`)
+			}
+			writeDenied(denied, http.StatusUnauthorized, ErrorUnauthorized, application.credentialsRequired())
+			return
+		}
+		if !client.allows(endpoint) {
+			logFromRequest(r).Debugf("Client %v is not allowed to call endpoint %v", client.Id, endpoint)
+			writeDenied(denied, http.StatusForbidden, ErrorForbidden, "The credentials are not allowed to call this endpoint.")
+			return
+		}
+		next.ServeHTTP(w, withClient(r, client))
+	})
+}
+
+// clientFromCredentials identifies the client from its API key or bearer token, whichever is presented
+func (application *Application) clientFromCredentials(r *http.Request) (Client, bool) {
+	if key := r.Header.Get("X-API-Key"); key != "" && application.APIKeys != nil {
+		client, ok := application.APIKeys.Lookup(key)
+		if !ok {
+			logFromRequest(r).Debugf("Rejected request with unknown API key")
+		}
+		return client, ok
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") || application.JWT == nil {
+		logFromRequest(r).Debugf("Rejected request without credentials")
+		return Client{}, false
+	}
+	client, err := application.JWT.Verify(token, time.Now())
+	if err != nil {
+		logFromRequest(r).Debugf("Rejected request with invalid bearer token. Details: %v", err)
+		return Client{}, false
+	}
+	return client, true
+}
+
+// credentialsRequired describes the credentials the server accepts
+func (application *Application) credentialsRequired() string {
+	switch {
+	case application.JWT == nil:
+		return "A valid API key is required in the X-API-Key header."
+	case application.APIKeys == nil:
+		return "A valid bearer token is required in the Authorization header."
+	default:
+		return "A valid API key in the X-API-Key header, or bearer token in the Authorization header, is required."
+	}
+}
+
+// withClient attaches a client to a request, and notes it for the access log
+func withClient(r *http.Request, client Client) *http.Request {
+	recordClient(r, client)
+	return r.WithContext(context.WithValue(r.Context(), clientContextKey{}, client))
+}
+
+// clientFromContext retrieves the client attached to a request, if there is one
+func clientFromContext(r *http.Request) (Client, bool) {
+	client, ok := r.Context().Value(clientContextKey{}).(Client)
+	return client, ok
+}
+
+// clientFromRequest identifies the client making a request
+func clientFromRequest(r *http.Request) string {
+	client, _ := clientFromContext(r)
+	return client.Id
+}
+
+// scopedClientFromRequest identifies the client making a request by its id scoped to its tenant
+func scopedClientFromRequest(r *http.Request) string {
+	client, _ := clientFromContext(r)
+	return client.scopedId()
+}
+
+// checkQueuedLimit rejects a submission of the given number of requests that would take the calling client over
+// the most requests its policy allows waiting on a signature at once
+func (application *Application) checkQueuedLimit(r *http.Request, submitted int) *MessageError {
+	client, ok := clientFromContext(r)
+	if !ok || client.MaxQueued <= 0 {
+		return nil
+	}
+	var queued []Request
+	application.requestsLock.RLock()
+	for _, request := range application.Requests {
+		if request.ClientId == client.Id && requestTenant(request.Request) == client.tenant() && !isFinalState(request.State) {
+			queued = append(queued, request.Request)
+		}
+	}
+	application.requestsLock.RUnlock()
+	excess := len(queued) + submitted - client.MaxQueued
+	if excess <= 0 {
+		return nil
+	}
+	// The client can try again once enough of its requests have been signed to make room for the submission
+	now := time.Now()
+	estimates := make([]float64, 0, len(queued))
+	for _, request := range queued {
+		estimates = append(estimates, application.GetEncryptionTiming(now, request).TimeEstimate)
+	}
+	sort.Float64s(estimates)
+	retryAfter := 0.0
+	if len(estimates) > 0 {
+		retryAfter = estimates[minInt(excess, len(estimates))-1]
+	}
+	return &MessageError{
+		StatusCode: http.StatusTooManyRequests,
+		Code:       ErrorTooManyQueued,
+		Reason:     fmt.Sprintf("The API key can have at most %d requests waiting on a signature. Please try again once some are signed.", client.MaxQueued),
+		RetryAfter: retryAfter,
+	}
+}
+
+// hashAPIKey is the form API keys are kept in, the hex encoded SHA-256 of the key
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadAPIKeys reads the API keys from a JSON file holding a list of keys. Authentication is disabled, and
+// nil returned, when no file is configured. A file that can't be read leaves every key rejected rather than
+// disabling authentication
+func LoadAPIKeys(apiKeysLocation string) *KeyStore {
+	if apiKeysLocation == "" {
+		return nil
+	}
+	store := &KeyStore{Clients: make(map[string]Client)}
+	keysBytes, err := os.ReadFile(apiKeysLocation)
+	if err != nil {
+		logrus.Errorf("Was unable to read API keys file. Details: %v", err)
+		return store
+	}
+	var keys []APIKey
+	if err := json.Unmarshal(keysBytes, &keys); err != nil {
+		logrus.Errorf("Was unable to unmarshal API keys into object. Details: %v", err)
+		return store
+	}
+	for _, key := range keys {
+		if key.Id == "" || key.KeyHash == "" {
+			logrus.Errorf("Skipping API key without an Id or KeyHash")
+			continue
+		}
+		store.Clients[strings.ToLower(key.KeyHash)] = key.Client
+	}
+	return store
+}
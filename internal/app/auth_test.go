@@ -0,0 +1,309 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+)
+
+func TestApp_authenticate(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		body          string
+		apiKey        string
+		authorization string
+		adminToken    string
+		statusCode    int
+		bodyExpected  string
+	}{
+		{
+			name:       "Health is public",
+			method:     "GET",
+			target:     "/v1/health",
+			statusCode: 200,
+		},
+		{
+			name:         "Missing key",
+			method:       "GET",
+			target:       "/v1/requests/signed",
+			statusCode:   401,
+			bodyExpected: `{"error":{"code":"unauthorized","message":"A valid API key is required in the X-API-Key header."}}`,
+		},
+		{
+			name:         "Unknown key",
+			method:       "GET",
+			target:       "/crypto/sign/request/signed",
+			apiKey:       "wrong-key",
+			statusCode:   401,
+			bodyExpected: `"Body":"A valid API key is required in the X-API-Key header."`,
+		},
+		{
+			name:       "Key allowed every endpoint",
+			method:     "GET",
+			target:     "/v1/requests/signed",
+			apiKey:     "alpha-key",
+			statusCode: 200,
+		},
+		{
+			name:       "Key allowed the endpoint",
+			method:     "GET",
+			target:     "/v1/requests/signed",
+			apiKey:     "status-key",
+			statusCode: 200,
+		},
+		{
+			name:         "Key not allowed the endpoint",
+			method:       "POST",
+			target:       "/v1/requests",
+			body:         `{"message":"taco"}`,
+			apiKey:       "status-key",
+			statusCode:   403,
+			bodyExpected: `{"error":{"code":"forbidden","message":"The credentials are not allowed to call this endpoint."}}`,
+		},
+		{
+			name:         "Key without admin privileges",
+			method:       "GET",
+			target:       "/v1/admin/requests",
+			apiKey:       "alpha-key",
+			statusCode:   403,
+			bodyExpected: `{"error":{"code":"forbidden","message":"The credentials are not allowed to call this endpoint."}}`,
+		},
+		{
+			name:       "Key with admin privileges",
+			method:     "GET",
+			target:     "/v1/admin/requests",
+			apiKey:     "admin-key",
+			statusCode: 200,
+		},
+		{
+			name:         "Admin endpoints require an admin key without an admin token",
+			method:       "GET",
+			target:       "/admin/requests",
+			statusCode:   403,
+			bodyExpected: `"Body":"Credentials with admin privileges are required."`,
+		},
+		{
+			name:          "Admin token without a key",
+			method:        "GET",
+			target:        "/admin/requests",
+			authorization: "Bearer token",
+			adminToken:    "token",
+			statusCode:    200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Queue:      NewFairQueue(1, nil),
+				Store:      make(chan SignedRequest, 1),
+				Track:      make(chan PendingRequest, 1),
+				Signatures: map[string]string{"signed": "signature"},
+				Requests:   make(map[string]PendingRequest),
+				Events:     NewEventBroker(),
+				AdminToken: tt.adminToken,
+				APIKeys:    LoadAPIKeys("../../testdata/apiKeys.json"),
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			if tt.apiKey != "" {
+				req.Header.Set("X-API-Key", tt.apiKey)
+			}
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
+			}
+		})
+	}
+}
+
+func TestApp_authenticateDisabled(t *testing.T) {
+	application := Application{
+		Queue:    NewFairQueue(1, nil),
+		Track:    make(chan PendingRequest, 1),
+		Requests: make(map[string]PendingRequest),
+		Events:   NewEventBroker(),
+	}
+	router := NewRouter(&application)
+	req := httptest.NewRequest("POST", "/v1/requests?wait=0", strings.NewReader(`{"message":"taco"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Client-Id", "alpha")
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; !cmp.Equal(status, 202) {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, 202)
+	}
+	if request, _ := application.Queue.Pop(context.Background()); request.ClientId != "alpha" {
+		t.Errorf("Request was not attributed to the X-Client-Id. Want: %v, Recieved: %v", "alpha", request.ClientId)
+	}
+}
+
+func TestApp_checkQueuedLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		body       string
+		queued     int
+		statusCode int
+	}{
+		{
+			name:       "Submission within the limit",
+			method:     "POST",
+			target:     "/v1/requests?wait=0",
+			body:       `{"message":"taco"}`,
+			queued:     1,
+			statusCode: 202,
+		},
+		{
+			name:       "Submission over the limit",
+			method:     "POST",
+			target:     "/v1/requests",
+			body:       `{"message":"taco"}`,
+			queued:     2,
+			statusCode: 429,
+		},
+		{
+			name:       "Batch within the limit",
+			method:     "POST",
+			target:     "/v1/batches",
+			body:       `{"messages":["taco","burrito"]}`,
+			statusCode: 202,
+		},
+		{
+			name:       "Batch over the limit",
+			method:     "POST",
+			target:     "/v1/batches",
+			body:       `{"messages":["taco","burrito"]}`,
+			queued:     1,
+			statusCode: 429,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := make(map[string]PendingRequest)
+			for i := 0; i < tt.queued; i++ {
+				requestId := string(rune('a' + i))
+				requests[requestId] = PendingRequest{Request: Request{RequestId: requestId, ClientId: "alpha"}, Timing: Timing{time.Now(), 1}, State: StateQueued, Add: true}
+			}
+			// Cancelled requests no longer count towards the limit
+			requests["cancelled"] = PendingRequest{Request: Request{RequestId: "cancelled", ClientId: "alpha"}, Timing: Timing{time.Now(), 1}, State: StateCancelled, Add: true}
+			application := Application{
+				Queue:    NewFairQueue(2, nil),
+				Track:    make(chan PendingRequest, 2),
+				Requests: requests,
+				Batches:  &BatchStore{Batches: make(map[string]Batch)},
+				Events:   NewEventBroker(),
+				APIKeys:  LoadAPIKeys("../../testdata/apiKeys.json"),
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-API-Key", "alpha-key")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if tt.statusCode == 429 {
+				if !strings.Contains(rr.Body.String(), `"code":"too_many_queued"`) {
+					t.Errorf("Handler returned unexpected body: got %v", rr.Body.String())
+				}
+				if rr.Header().Get("Retry-After") == "" {
+					t.Errorf("Handler did not set Retry-After")
+				}
+			}
+		})
+	}
+}
+
+func TestApp_NewRouterAdminEndpointNames(t *testing.T) {
+	want := map[string]string{
+		"GET /admin/events":                        EndpointAdminEvents,
+		"GET /admin/requests":                      EndpointAdminRequests,
+		"POST /admin/requests/{requestId}/requeue": EndpointAdminRequeue,
+		"POST /admin/requests/requeue":             EndpointAdminRequeueAll,
+		"GET /admin/queue":                         EndpointAdminQueue,
+		"POST /admin/queue/pause":                  EndpointAdminPause,
+		"POST /admin/queue/resume":                 EndpointAdminResume,
+		"POST /admin/queue/drain":                  EndpointAdminDrain,
+		"GET /metrics":                             EndpointMetrics,
+	}
+	got := make(map[string]string)
+	router := NewRouter(&Application{})
+	err := router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || !adminEndpoints[route.GetName()] {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, method := range methods {
+			// The /v1 routes share the names of the legacy routes
+			got[method+" "+strings.TrimPrefix(path, "/v1")] = route.GetName()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to walk the routes. Details: %v", err)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Admin endpoint names not as expected. Diff: %v", diff)
+	}
+}
+
+func TestLoadAPIKeys(t *testing.T) {
+	tests := []struct {
+		name              string
+		inputFileLocation string
+		want              *KeyStore
+	}{
+		{
+			name:              "Authentication disabled",
+			inputFileLocation: "",
+			want:              nil,
+		},
+		{
+			name:              "Successful Load of keys",
+			inputFileLocation: "../../testdata/apiKeys.json",
+			want: &KeyStore{Clients: map[string]Client{
+				hashAPIKey("alpha-key"):  {Id: "alpha", MaxQueued: 2, Priorities: []string{PriorityHigh, PriorityNormal}},
+				hashAPIKey("status-key"): {Id: "status", Endpoints: []string{EndpointStatus, EndpointBatchStatus}},
+				hashAPIKey("admin-key"):  {Id: "admin", Admin: true},
+			}},
+		},
+		{
+			name:              "Bad file location rejects every key",
+			inputFileLocation: "../../testdata/fakeLocation.json",
+			want:              &KeyStore{Clients: make(map[string]Client)},
+		},
+		{
+			name:              "Unmarshable keys rejects every key",
+			inputFileLocation: "../../testdata/unmarshableState.json",
+			want:              &KeyStore{Clients: make(map[string]Client)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := LoadAPIKeys(tt.inputFileLocation)
+			if !cmp.Equal(store, tt.want) {
+				t.Errorf("API keys were not loaded to the desired state. Want: %v, Recieved: %v", tt.want, store)
+			}
+		})
+	}
+}
@@ -0,0 +1,366 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMaxBatchSize is the largest number of messages accepted in a single batch when no limit has been configured
+const DefaultMaxBatchSize = 100
+
+// DefaultMaxBatchBytes is the largest request body accepted for a single batch when no limit has been configured
+const DefaultMaxBatchBytes = 8 << 20
+
+// Batch status values reported for each request in a batch
+const (
+	BatchItemPending   = "pending"
+	BatchItemSigned    = "signed"
+	BatchItemCancelled = "cancelled"
+	BatchItemExpired   = "expired"
+	BatchItemFailed    = "failed"
+	BatchItemUnknown   = "unknown"
+)
+
+// Batch groups the requests that were submitted together in a single batch
+type Batch struct {
+	BatchId    string
+	RequestIds []string
+	TimeAdded  time.Time
+	TenantId   string `json:",omitempty"`
+}
+
+// BatchStore maintains the set of known batches, safe for concurrent use by handlers
+type BatchStore struct {
+	mu      sync.RWMutex
+	Batches map[string]Batch
+}
+
+// BatchBody represents a JSON request body for a new batch of encryption requests
+type BatchBody struct {
+	Messages    []string `json:"messages"`
+	CallbackUrl string   `json:"callbackUrl"`
+	Priority    string   `json:"priority"`
+	NotBefore   string   `json:"notBefore"`
+	Deadline    string   `json:"deadline"`
+}
+
+// BatchProcessing represents a 202 response body for an accepted batch
+type BatchProcessing struct {
+	Body         string
+	BatchId      string
+	RequestIds   []string
+	TimeEstimate float64
+	StatusCode   int
+}
+
+// BatchItem represents the progress of a single request within a batch
+type BatchItem struct {
+	RequestId string
+	Status    string
+	Signature string `json:",omitempty"`
+}
+
+// BatchProgress represents a response body aggregating the progress of a batch
+type BatchProgress struct {
+	Body         string
+	BatchId      string
+	Total        int
+	Pending      int
+	Signed       int
+	Cancelled    int
+	Expired      int
+	Failed       int
+	Unknown      int
+	TimeEstimate float64
+	Items        []BatchItem
+	StatusCode   int
+}
+
+// Add stores a batch
+func (store *BatchStore) Add(batch Batch) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.Batches[batch.BatchId] = batch
+}
+
+// Get retrieves a batch by its id
+func (store *BatchStore) Get(batchId string) (Batch, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	batch, ok := store.Batches[batchId]
+	return batch, ok
+}
+
+// Len is the number of batches held
+func (store *BatchStore) Len() int {
+	if store == nil {
+		return 0
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return len(store.Batches)
+}
+
+// prune forgets the batches whose requests have all left the pipeline, once none of them is tracked any more or the
+// batch is older than the retention window. Callers must hold the lock guarding requests
+func (store *BatchStore) prune(now time.Time, retention time.Duration, requests map[string]PendingRequest) {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for batchId, batch := range store.Batches {
+		finished, forgotten := true, true
+		for _, requestId := range batch.RequestIds {
+			request, tracked := requests[requestId]
+			finished = finished && (!tracked || isFinalState(request.State))
+			forgotten = forgotten && !tracked
+		}
+		if finished && (forgotten || now.Sub(batch.TimeAdded) > retention) {
+			delete(store.Batches, batchId)
+		}
+	}
+}
+
+// MarshalJSON marshals the set of batches for persistence
+func (store *BatchStore) MarshalJSON() ([]byte, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return json.Marshal(store.Batches)
+}
+
+// InstantiateBatches creates a new store for batches and recreates previous state if applicable
+func InstantiateBatches(batchesPersistenceLocation string) *BatchStore {
+	store := &BatchStore{Batches: make(map[string]Batch)}
+	batchesBytes, err := os.ReadFile(batchesPersistenceLocation)
+	if err != nil {
+		logrus.Errorf("Was unable to read batches file. Details: %v", err)
+		return store
+	}
+	if len(batchesBytes) > 0 {
+		var batches map[string]Batch
+		if err := json.Unmarshal(batchesBytes, &batches); err != nil {
+			logrus.Errorf("Was unable to unmarshal batches into object. Details: %v", err)
+			return store
+		}
+		if batches != nil {
+			store.Batches = batches
+		}
+	}
+	return store
+}
+
+// maxBatchSize returns the configured batch size limit, falling back to the default when unset
+func (application *Application) maxBatchSize() int {
+	if application.MaxBatchSize <= 0 {
+		return DefaultMaxBatchSize
+	}
+	return application.MaxBatchSize
+}
+
+// maxBatchBytes returns the configured batch body limit, falling back to the default when unset
+func (application *Application) maxBatchBytes() int64 {
+	if application.MaxBatchBytes <= 0 {
+		return DefaultMaxBatchBytes
+	}
+	return application.MaxBatchBytes
+}
+
+// newBatchHandler handles calls to the /crypto/sign/batch endpoint. Either every message in the batch
+// is queued for encryption, or none are
+func (application *Application) newBatchHandler(w http.ResponseWriter, r *http.Request) {
+	batchBody, err := readBatch(w, r, application.maxBatchSize(), application.maxMessageBytes(), application.maxBatchBytes())
+	if err == nil {
+		err = application.checkDraining()
+	}
+	if err == nil {
+		err = application.validateCallback(batchBody.CallbackUrl, scopedClientFromRequest(r))
+	}
+	if err == nil {
+		err = validatePriority(batchBody.Priority)
+	}
+	if err == nil {
+		err = application.checkPriority(r, batchBody.Priority)
+	}
+	var notBefore, deadline *time.Time
+	if err == nil {
+		notBefore, err = parseNotBefore(batchBody.NotBefore)
+	}
+	if err == nil {
+		deadline, err = parseDeadline(batchBody.Deadline, notBefore, time.Now())
+	}
+	if err != nil {
+		logFromRequest(r).Debugf("Unable to read batch from request. Details: %v", err.Error())
+		writeMessageError(w, err)
+		return
+	}
+	submitted := time.Now()
+	if err := application.checkClientLimits(r, len(batchBody.Messages), submitted); err != nil {
+		logFromRequest(r).Debugf("Client %v is over its limits for the batch. Details: %v", clientFromRequest(r), err.Error())
+		writeMessageError(w, err)
+		return
+	}
+	client, _ := clientFromContext(r)
+	batch := Batch{BatchId: generateUUID().String(), RequestIds: make([]string, len(batchBody.Messages)), TimeAdded: submitted, TenantId: client.tenant()}
+	requests := make([]Request, len(batchBody.Messages))
+	for i, message := range batchBody.Messages {
+		requests[i] = Request{
+			RequestId:     generateUUID().String(),
+			Message:       message,
+			ClientId:      client.Id,
+			CallbackUrl:   batchBody.CallbackUrl,
+			TenantId:      client.tenant(),
+			Priority:      batchBody.Priority,
+			Deadline:      deadline,
+			Traceparent:   traceparentFromRequest(r),
+			CorrelationId: correlationIdFromRequest(r),
+		}
+		if application.scheduled(notBefore, submitted) {
+			requests[i].NotBefore = notBefore
+		}
+		batch.RequestIds[i] = requests[i].RequestId
+	}
+
+	// Scheduled batches have capacity held back for them, so they fit once they are due
+	scheduled := application.scheduled(notBefore, submitted)
+	var accepted bool
+	if scheduled {
+		accepted = application.Queue.Reserve(len(requests))
+	} else {
+		accepted = application.Queue.PushAll(requests)
+	}
+	if !accepted {
+		application.refundQuota(r, len(requests), submitted)
+		logFromRequest(r).Debugf("Encryption queue lacks capacity for a batch of %v requests", len(requests))
+		setRetryAfter(w, application.queueFullRetryMinutes(len(requests)))
+		writeDenied(w, http.StatusServiceUnavailable, ErrorQueueFull, "The batch could not be processed, server does not have capacity for every message. Please try again shortly or submit a smaller batch.")
+		return
+	}
+	application.Batches.Add(batch)
+	if scheduled {
+		timing := application.GetScheduledTiming(batch.TimeAdded, *notBefore)
+		application.scheduleRequests(requests, timing)
+		logFromRequest(r).Debugf("Batch %v of %v requests scheduled for %v", batch.BatchId, len(requests), notBefore)
+		writeBatchProcessing(w, batch, timing)
+		return
+	}
+
+	logFromRequest(r).Debugf("Encryption queue accepted batch %v of %v requests", batch.BatchId, len(requests))
+	// Each request is estimated by its own place in the queue, and the batch by its last request
+	var timing Timing
+	for _, request := range requests {
+		timing = application.GetEncryptionTiming(batch.TimeAdded, request)
+		application.Track <- PendingRequest{Request: request, Timing: timing, State: StateQueued, Add: true}
+		application.Events.Publish(Event{RequestId: request.RequestId, State: EventQueued, Timestamp: timing.TimeAdded})
+	}
+	writeBatchProcessing(w, batch, timing)
+}
+
+// writeBatchProcessing writes a 202 response for an accepted batch, along with where and when to check back on it
+func writeBatchProcessing(w http.ResponseWriter, batch Batch, timing Timing) {
+	w.Header().Set("Location", batchLocation(w, batch.BatchId))
+	setRetryAfter(w, timing.TimeEstimate)
+	writeResponse(w, http.StatusAccepted, BatchProcessing{
+		Body:         "Batch Recieved. Please check back according to the time estimate (minutes).",
+		BatchId:      batch.BatchId,
+		RequestIds:   batch.RequestIds,
+		TimeEstimate: timing.TimeEstimate,
+		StatusCode:   http.StatusAccepted,
+	})
+}
+
+// batchStatusHandler handles inquiries about the progress of a batch to the /crypto/sign/batch/{batchId} endpoint.
+// Signatures are reported but left in place, so they remain retrievable through the single request endpoint
+func (application *Application) batchStatusHandler(w http.ResponseWriter, r *http.Request) {
+	batchId := pathVar(r, "batchId")
+	batch, ok := application.Batches.Get(batchId)
+	if ok && batch.TenantId == "" {
+		batch.TenantId = DefaultTenant
+	}
+	if !ok || batch.TenantId != tenantFromRequest(r) {
+		logFromRequest(r).Debugf("Batch id invalid")
+		writeDenied(w, http.StatusNotFound, ErrorNotFound, "The batchId is not recognized. Please use the 'crypto/sign/batch' endpoint to generate a new batch.")
+		return
+	}
+	progress := BatchProgress{
+		BatchId:    batch.BatchId,
+		Total:      len(batch.RequestIds),
+		Items:      make([]BatchItem, len(batch.RequestIds)),
+		StatusCode: http.StatusOK,
+	}
+	for i, requestId := range batch.RequestIds {
+		item := BatchItem{RequestId: requestId, Status: BatchItemUnknown}
+		if signature, ok := application.lookupSignature(requestId); ok {
+			item.Status = BatchItemSigned
+			item.Signature = signature
+			progress.Signed++
+		} else if request, ok := application.lookupRequest(requestId); ok && request.State == StateCancelled {
+			item.Status = BatchItemCancelled
+			progress.Cancelled++
+		} else if ok && request.State == StateExpired {
+			item.Status = BatchItemExpired
+			progress.Expired++
+		} else if ok && request.State == StateFailed {
+			item.Status = BatchItemFailed
+			progress.Failed++
+		} else if ok {
+			item.Status = BatchItemPending
+			progress.Pending++
+			minutesRemaining := request.TimeEstimate - time.Since(request.TimeAdded).Minutes()
+			if minutesRemaining > progress.TimeEstimate {
+				progress.TimeEstimate = minutesRemaining
+			}
+		} else {
+			progress.Unknown++
+		}
+		progress.Items[i] = item
+	}
+	if progress.Pending > 0 {
+		progress.Body = "Batch is still being processed. Please check back according to the time estimate (minutes)."
+		if progress.TimeEstimate <= 0 {
+			// Naive default, matching the single request endpoint
+			progress.TimeEstimate = 5
+		}
+		setRetryAfter(w, progress.TimeEstimate)
+	} else {
+		progress.Body = "Batch processing complete."
+	}
+	// The progress carries signatures, which must not be cached
+	setNoStore(w)
+	writeResponse(w, http.StatusOK, progress)
+}
+
+// readBatch retrieves a batch from a JSON request body, enforcing the body, batch and message size limits
+func readBatch(w http.ResponseWriter, r *http.Request, maxBatchSize int, maxMessageBytes int64, maxBatchBytes int64) (BatchBody, *MessageError) {
+	var body BatchBody
+	// The reader fails once the limit has been read, and has the connection closed rather than drained
+	bodyBytes, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBatchBytes))
+	if err != nil && int64(len(bodyBytes)) >= maxBatchBytes {
+		return BatchBody{}, &MessageError{StatusCode: http.StatusRequestEntityTooLarge, Reason: fmt.Sprintf("The batch exceeds the maximum request size of %d bytes.", maxBatchBytes)}
+	}
+	if err != nil {
+		return BatchBody{}, &MessageError{StatusCode: http.StatusBadRequest, Reason: "The request body could not be read."}
+	}
+	if err := json.Unmarshal(bodyBytes, &body); err != nil {
+		return BatchBody{}, &MessageError{StatusCode: http.StatusBadRequest, Reason: "The request body is not valid JSON. Expected {\"messages\": [string]}."}
+	}
+	if len(body.Messages) == 0 {
+		return BatchBody{}, &MessageError{StatusCode: http.StatusBadRequest, Reason: "The batch must contain at least one message."}
+	}
+	if len(body.Messages) > maxBatchSize {
+		return BatchBody{}, &MessageError{StatusCode: http.StatusRequestEntityTooLarge, Reason: "The batch contains more messages than the maximum batch size."}
+	}
+	for _, message := range body.Messages {
+		if int64(len(message)) > maxMessageBytes {
+			return BatchBody{}, messageTooLarge(maxMessageBytes)
+		}
+	}
+	return body, nil
+}
@@ -0,0 +1,268 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+// mockSequentialUUIDs mocks generateUUID to hand out predictable, distinct ids
+func mockSequentialUUIDs(t *testing.T) {
+	count := 0
+	generateUUID = func() uuid.UUID {
+		count++
+		requestId, err := uuid.FromBytes([]byte(fmt.Sprintf("requestId-%06d", count)))
+		if err != nil {
+			t.Fatalf("Unable to generate mock UUID. Details: %v", err.Error())
+		}
+		return requestId
+	}
+}
+
+func TestApp_newBatchHandler(t *testing.T) {
+	tests := []struct {
+		name          string
+		queueSize     int
+		queued        int
+		maxBatchBytes int64
+		body          string
+		statusCode    int
+		wantRequests  int
+		wantBatches   int
+		wantTrackings int
+	}{
+		{
+			name:          "Accepts batch within capacity",
+			queueSize:     3,
+			body:          `{"messages":["taco","chicken","burrito"]}`,
+			statusCode:    202,
+			wantRequests:  3,
+			wantBatches:   1,
+			wantTrackings: 3,
+		},
+		{
+			name:       "Rejects whole batch when capacity is short",
+			queueSize:  3,
+			queued:     1,
+			body:       `{"messages":["taco","chicken","burrito"]}`,
+			statusCode: 503,
+		},
+		{
+			name:          "Accepts batch at the body limit",
+			queueSize:     3,
+			maxBatchBytes: int64(len(`{"messages":["taco","chicken","burrito"]}`)),
+			body:          `{"messages":["taco","chicken","burrito"]}`,
+			statusCode:    202,
+			wantRequests:  3,
+			wantBatches:   1,
+			wantTrackings: 3,
+		},
+		{
+			name:          "Rejects batch over the body limit",
+			queueSize:     3,
+			maxBatchBytes: int64(len(`{"messages":["taco","chicken","burrito"]}`)) - 1,
+			body:          `{"messages":["taco","chicken","burrito"]}`,
+			statusCode:    413,
+		},
+		{
+			name:       "Rejects empty batch",
+			queueSize:  3,
+			body:       `{"messages":[]}`,
+			statusCode: 400,
+		},
+		{
+			name:       "Rejects malformed batch",
+			queueSize:  3,
+			body:       `{"messages":"taco"}`,
+			statusCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSequentialUUIDs(t)
+			application := Application{
+				Queue:         NewFairQueue(tt.queueSize, nil),
+				Store:         make(chan SignedRequest, 1),
+				Signatures:    make(map[string]string),
+				Track:         make(chan PendingRequest, tt.queueSize),
+				Requests:      make(map[string]PendingRequest),
+				ServerPort:    ":8080",
+				MaxBatchBytes: tt.maxBatchBytes,
+				Batches:       &BatchStore{Batches: make(map[string]Batch)},
+			}
+			for i := 0; i < tt.queued; i++ {
+				application.Queue.Push(Request{RequestId: "requestId", Message: "message"})
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest("POST", "/crypto/sign/batch", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if got := application.Queue.Len() - tt.queued; got != tt.wantRequests {
+				t.Errorf("Unexpected number of requests queued. Wanted: %v, Got: %v", tt.wantRequests, got)
+			}
+			if got := len(application.Batches.Batches); got != tt.wantBatches {
+				t.Errorf("Unexpected number of batches stored. Wanted: %v, Got: %v", tt.wantBatches, got)
+			}
+			if got := len(application.Track); got != tt.wantTrackings {
+				t.Errorf("Unexpected number of requests tracked. Wanted: %v, Got: %v", tt.wantTrackings, got)
+			}
+			if rr.Code == http.StatusAccepted {
+				var batchProcessing BatchProcessing
+				if err := json.Unmarshal(rr.Body.Bytes(), &batchProcessing); err != nil {
+					t.Fatalf("Unable to unmarshal response body. Details: %v", err.Error())
+				}
+				batch, ok := application.Batches.Get(batchProcessing.BatchId)
+				if !ok {
+					t.Fatalf("Batch %v was not stored", batchProcessing.BatchId)
+				}
+				if !cmp.Equal(batch.RequestIds, batchProcessing.RequestIds) {
+					t.Errorf("Response request ids do not match stored batch. Wanted: %v, Got: %v", batch.RequestIds, batchProcessing.RequestIds)
+				}
+			}
+		})
+	}
+}
+
+func TestApp_batchStatusHandler(t *testing.T) {
+	application := Application{
+		Queue:      NewFairQueue(1, nil),
+		Store:      make(chan SignedRequest, 1),
+		Signatures: map[string]string{"signed": "signature"},
+		Track:      make(chan PendingRequest, 1),
+		Requests: map[string]PendingRequest{
+			"pending": {
+				Request: Request{RequestId: "pending", Message: "message"},
+				Timing:  Timing{time.Now(), 0.0},
+				Add:     true,
+			},
+		},
+		ServerPort: ":8080",
+		Batches: &BatchStore{Batches: map[string]Batch{
+			"inProgress": {BatchId: "inProgress", RequestIds: []string{"signed", "pending", "retrieved"}},
+			"complete":   {BatchId: "complete", RequestIds: []string{"signed"}},
+		}},
+	}
+	mockInProgressBody := `{"Body":"Batch is still being processed. Please check back according to the time estimate (minutes).","BatchId":"inProgress","Total":3,"Pending":1,"Signed":1,"Cancelled":0,"Expired":0,"Failed":0,"Unknown":1,"TimeEstimate":5,"Items":[{"RequestId":"signed","Status":"signed","Signature":"signature"},{"RequestId":"pending","Status":"pending"},{"RequestId":"retrieved","Status":"unknown"}],"StatusCode":200}`
+	mockCompleteBody := `{"Body":"Batch processing complete.","BatchId":"complete","Total":1,"Pending":0,"Signed":1,"Cancelled":0,"Expired":0,"Failed":0,"Unknown":0,"TimeEstimate":0,"Items":[{"RequestId":"signed","Status":"signed","Signature":"signature"}],"StatusCode":200}`
+	mockNotFoundBody := `{"Body":"The batchId is not recognized. Please use the 'crypto/sign/batch' endpoint to generate a new batch.","StatusCode":404}`
+	tests := []struct {
+		name         string
+		batchId      string
+		bodyExpected string
+		statusCode   int
+	}{
+		{
+			name:         "Batch in progress",
+			batchId:      "inProgress",
+			bodyExpected: mockInProgressBody,
+			statusCode:   200,
+		},
+		{
+			name:         "Batch complete",
+			batchId:      "complete",
+			bodyExpected: mockCompleteBody,
+			statusCode:   200,
+		},
+		{
+			name:         "Batch not found",
+			batchId:      "missing",
+			bodyExpected: mockNotFoundBody,
+			statusCode:   404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(&application)
+			req := httptest.NewRequest("GET", fmt.Sprintf("/crypto/sign/batch/%v", tt.batchId), nil)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if !cmp.Equal(rr.Body.String(), tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
+			}
+		})
+	}
+}
+
+func TestInstantiateBatches(t *testing.T) {
+	populatedBatchesBytes, err := os.ReadFile("../../testdata/populatedBatchState.json")
+	if err != nil {
+		t.Errorf("Was unable to read test populated batches file. Details: %v", err)
+	}
+	var populatedBatches map[string]Batch
+	if err := json.Unmarshal(populatedBatchesBytes, &populatedBatches); err != nil {
+		t.Errorf("Was unable to unmarshal test populated batches into object. Details: %v", err)
+	}
+	tests := []struct {
+		name              string
+		inputFileLocation string
+		want              map[string]Batch
+	}{
+		{
+			name:              "Successful Load of populated state",
+			inputFileLocation: "../../testdata/populatedBatchState.json",
+			want:              populatedBatches,
+		},
+		{
+			name:              "Successful Load of empty state (fresh start)",
+			inputFileLocation: "../../testdata/emptyState.json",
+			want:              make(map[string]Batch),
+		},
+		{
+			name:              "Bad file location",
+			inputFileLocation: "../../testdata/fakeLocation.json",
+			want:              make(map[string]Batch),
+		},
+		{
+			name:              "Unmarshable state",
+			inputFileLocation: "../../testdata/unmarshableState.json",
+			want:              make(map[string]Batch),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches := InstantiateBatches(tt.inputFileLocation)
+			if !cmp.Equal(batches.Batches, tt.want) {
+				t.Errorf("Batches was not instantiated to the desired state. Want: %v, Recieved: %v", tt.want, batches.Batches)
+			}
+		})
+	}
+}
+
+func TestBatchStore_prune(t *testing.T) {
+	now := time.Now()
+	requests := map[string]PendingRequest{
+		"pending":   {Request: Request{RequestId: "pending"}, State: StateQueued},
+		"signed":    {Request: Request{RequestId: "signed"}, State: StateSigned},
+		"cancelled": {Request: Request{RequestId: "cancelled"}, State: StateCancelled},
+	}
+	store := &BatchStore{Batches: map[string]Batch{
+		"forgotten":  {BatchId: "forgotten", RequestIds: []string{"retrieved"}, TimeAdded: now},
+		"recent":     {BatchId: "recent", RequestIds: []string{"signed", "cancelled", "retrieved"}, TimeAdded: now},
+		"old":        {BatchId: "old", RequestIds: []string{"signed", "cancelled"}, TimeAdded: now.Add(-2 * time.Hour)},
+		"oldPending": {BatchId: "oldPending", RequestIds: []string{"pending", "signed"}, TimeAdded: now.Add(-2 * time.Hour)},
+	}}
+	store.prune(now, time.Hour, requests)
+	var kept []string
+	for batchId := range store.Batches {
+		kept = append(kept, batchId)
+	}
+	sort.Strings(kept)
+	if want := []string{"oldPending", "recent"}; !cmp.Equal(kept, want) {
+		t.Errorf("Wrong batches were pruned. Want kept: %v, Recieved: %v", want, kept)
+	}
+}
@@ -0,0 +1,411 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMaxCallbackAttempts is the number of times delivery of a callback is attempted when no limit has been configured
+const DefaultMaxCallbackAttempts = 10
+
+// DefaultCallbackSecretClient is the entry in the callback secrets file used for clients without a secret of their own
+const DefaultCallbackSecretClient = "default"
+
+// Callback status values reported in a callback payload
+const (
+	CallbackSigned    = "signed"
+	CallbackFailed    = "failed"
+	CallbackCancelled = "cancelled"
+	CallbackExpired   = "expired"
+)
+
+// DefaultCallbackWorkers is the number of callbacks delivered at once when no number has been configured
+const DefaultCallbackWorkers = 4
+
+// Initial and maximum delay between callback delivery attempts, doubling with each failed attempt
+const (
+	callbackInitialRetryDelay = 5 * time.Second
+	callbackMaxRetryDelay     = 10 * time.Minute
+)
+
+// For mocking in tests
+var callbackPollInterval = 1 * time.Second
+
+// sharedAddressSpace is the carrier-grade NAT range, which like the private ranges isn't reachable from the internet
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// CallbackPayload represents the body POSTed to a client's callback url once a request is complete
+type CallbackPayload struct {
+	RequestId string
+	Status    string
+	Signature string            `json:",omitempty"`
+	Metadata  map[string]string `json:",omitempty"`
+	Timestamp time.Time
+}
+
+// CallbackDelivery is an entry in the outbox, holding a payload waiting to be delivered to a callback url
+type CallbackDelivery struct {
+	CallbackUrl string
+	// ClientId is the submitting client's id scoped to its tenant, which its callback secret is kept under
+	ClientId    string
+	Payload     CallbackPayload
+	Attempts    int
+	NextAttempt time.Time
+}
+
+// Outbox durably holds callbacks until they have been delivered, retrying failed deliveries with backoff.
+// Callbacks are never delivered to private, loopback or link-local addresses, so the server can't be used to reach
+// its own network, unless the address is within one of the AllowedNetworks
+type Outbox struct {
+	mu          sync.Mutex
+	Deliveries  map[string]CallbackDelivery
+	Secrets     map[string]string
+	MaxAttempts int
+	Client      *http.Client
+	// AllowedNetworks are the private networks callbacks may still be delivered to, such as 127.0.0.0/8 for local
+	// development
+	AllowedNetworks []*net.IPNet
+	// Workers is the number of callbacks delivered at once, DefaultCallbackWorkers when unset
+	Workers int
+}
+
+// HasSecret reports whether callbacks for a client, identified by its scoped id, can be signed
+func (outbox *Outbox) HasSecret(scopedClientId string) bool {
+	_, ok := outbox.secret(scopedClientId)
+	return ok
+}
+
+// secret retrieves the signing secret for a client, identified by its scoped id so that clients of different tenants
+// sharing an id don't share a secret, falling back to the default secret
+func (outbox *Outbox) secret(scopedClientId string) (string, bool) {
+	if outbox == nil {
+		return "", false
+	}
+	if secret, ok := outbox.Secrets[scopedClientId]; ok && secret != "" {
+		return secret, true
+	}
+	secret, ok := outbox.Secrets[DefaultCallbackSecretClient]
+	return secret, ok && secret != ""
+}
+
+// Enqueue adds a callback to the outbox to be delivered as soon as possible, signed with the secret of the client
+// with the given scoped id
+func (outbox *Outbox) Enqueue(callbackUrl string, scopedClientId string, payload CallbackPayload) {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	outbox.Deliveries[payload.RequestId] = CallbackDelivery{
+		CallbackUrl: callbackUrl,
+		ClientId:    scopedClientId,
+		Payload:     payload,
+		NextAttempt: time.Now(),
+	}
+}
+
+// Len is the number of callbacks waiting to be delivered
+func (outbox *Outbox) Len() int {
+	if outbox == nil {
+		return 0
+	}
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	return len(outbox.Deliveries)
+}
+
+// MarshalJSON marshals the undelivered callbacks for persistence
+func (outbox *Outbox) MarshalJSON() ([]byte, error) {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	return json.Marshal(outbox.Deliveries)
+}
+
+// DeliverCallbacks forever polls the outbox for callbacks that are due, and attempts to deliver them
+func (outbox *Outbox) DeliverCallbacks(ctx context.Context) error {
+	ticker := time.NewTicker(callbackPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			outbox.deliverDue(ctx, now)
+		}
+	}
+}
+
+// deliverDue attempts to deliver every callback that is due, up to Workers at once, so a slow callback url doesn't
+// hold up the rest. Returns once every attempt is complete, so no callback is attempted twice at the same time
+func (outbox *Outbox) deliverDue(ctx context.Context, now time.Time) {
+	due := outbox.due(now)
+	workers := outbox.Workers
+	if workers <= 0 {
+		workers = DefaultCallbackWorkers
+	}
+	if workers > len(due) {
+		workers = len(due)
+	}
+	requestIds := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for requestId := range requestIds {
+				err := outbox.deliver(ctx, due[requestId])
+				outbox.complete(requestId, due[requestId], err)
+			}
+		}()
+	}
+	for requestId := range due {
+		requestIds <- requestId
+	}
+	close(requestIds)
+	wg.Wait()
+}
+
+// due takes a snapshot of the callbacks whose next attempt has come around
+func (outbox *Outbox) due(now time.Time) map[string]CallbackDelivery {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	due := make(map[string]CallbackDelivery)
+	for requestId, delivery := range outbox.Deliveries {
+		if !delivery.NextAttempt.After(now) {
+			due[requestId] = delivery
+		}
+	}
+	return due
+}
+
+// complete records the outcome of a delivery attempt, removing the callback once delivered or out of attempts
+func (outbox *Outbox) complete(requestId string, delivery CallbackDelivery, err error) {
+	outbox.mu.Lock()
+	defer outbox.mu.Unlock()
+	if err == nil {
+		logrus.Debugf("Callback delivered for requestId: %v", requestId)
+		delete(outbox.Deliveries, requestId)
+		return
+	}
+	delivery.Attempts++
+	maxAttempts := outbox.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultMaxCallbackAttempts
+	}
+	if delivery.Attempts >= maxAttempts {
+		logrus.Errorf("Giving up on callback for requestId: %v after %v attempts. Details: %v", requestId, delivery.Attempts, err.Error())
+		delete(outbox.Deliveries, requestId)
+		return
+	}
+	logrus.Debugf("Callback delivery failed for requestId: %v, will try again... Details: %v", requestId, err.Error())
+	delivery.NextAttempt = time.Now().Add(callbackRetryDelay(delivery.Attempts))
+	outbox.Deliveries[requestId] = delivery
+}
+
+// deliver POSTs a callback payload, signed with the client's secret, to its callback url
+func (outbox *Outbox) deliver(ctx context.Context, delivery CallbackDelivery) error {
+	body, err := json.Marshal(delivery.Payload)
+	if err != nil {
+		return err
+	}
+	secret, ok := outbox.secret(delivery.ClientId)
+	if !ok {
+		return fmt.Errorf("no callback secret configured for client %q", delivery.ClientId)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", delivery.CallbackUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Signature-Timestamp", timestamp)
+	req.Header.Set("X-Signature", "sha256="+SignCallback(secret, timestamp, body))
+
+	client := outbox.Client
+	if client == nil {
+		// Addresses are checked once resolved, so a callback url can't be pointed at a private address through DNS
+		// or a redirect
+		dialer := &net.Dialer{Timeout: 10 * time.Second, Control: outbox.checkDial}
+		client = &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{DialContext: dialer.DialContext}}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback url responded with status code %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// SignCallback computes the hex encoded HMAC-SHA256 of a callback timestamp and body. Receivers verify a callback
+// by computing the same value over the X-Signature-Timestamp header, a '.', and the raw request body
+func SignCallback(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// callbackRetryDelay is the delay before the next delivery attempt, doubling after every failed attempt
+func callbackRetryDelay(attempts int) time.Duration {
+	delay := callbackInitialRetryDelay
+	for i := 1; i < attempts && delay < callbackMaxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > callbackMaxRetryDelay {
+		delay = callbackMaxRetryDelay
+	}
+	return delay
+}
+
+// validateCallbackUrl checks that a callback url is an absolute http(s) url, which doesn't point at a private address
+// outside of the allowed networks. Host names are checked again once resolved, when the callback is delivered
+func validateCallbackUrl(callbackUrl string, allowed []*net.IPNet) *MessageError {
+	parsed, err := url.Parse(callbackUrl)
+	if err != nil || !parsed.IsAbs() || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return &MessageError{StatusCode: http.StatusBadRequest, Reason: "The callbackUrl must be an absolute http or https url."}
+	}
+	host := strings.ToLower(parsed.Hostname())
+	var addresses []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		addresses = []net.IP{ip}
+	} else if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		addresses = []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}
+	}
+	for _, address := range addresses {
+		if !callbackAddressAllowed(address, allowed) {
+			return &MessageError{StatusCode: http.StatusBadRequest, Reason: "The callbackUrl must not point at a private, loopback or link-local address."}
+		}
+	}
+	return nil
+}
+
+// checkDial refuses connections for callbacks to private addresses outside of the allowed networks
+func (outbox *Outbox) checkDial(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !callbackAddressAllowed(ip, outbox.AllowedNetworks) {
+		return fmt.Errorf("callback address %v is private, loopback or link-local", host)
+	}
+	return nil
+}
+
+// callbackAddressAllowed reports whether callbacks can be delivered to an address, which they can to public addresses
+// and to those within the allowed networks
+func callbackAddressAllowed(ip net.IP, allowed []*net.IPNet) bool {
+	for _, network := range allowed {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	private := ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip)
+	return !private
+}
+
+// allowedNetworks are the private networks callbacks may be delivered to, which are none when callbacks are disabled
+func (outbox *Outbox) allowedNetworks() []*net.IPNet {
+	if outbox == nil {
+		return nil
+	}
+	return outbox.AllowedNetworks
+}
+
+// ParseAllowedNetworks reads a comma separated list of addresses and CIDR ranges that callbacks may be delivered to
+// even though they are private. Entries that can't be parsed are skipped
+func ParseAllowedNetworks(networks string) []*net.IPNet {
+	var allowed []*net.IPNet
+	for _, entry := range strings.Split(networks, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			allowed = append(allowed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			logrus.Errorf("Was unable to parse allowed callback network %q. Details: %v", entry, err)
+			continue
+		}
+		allowed = append(allowed, network)
+	}
+	return allowed
+}
+
+// validateCallback checks that a callback requested by a client can be delivered and signed
+func (application *Application) validateCallback(callbackUrl string, scopedClientId string) *MessageError {
+	if callbackUrl == "" {
+		return nil
+	}
+	if err := validateCallbackUrl(callbackUrl, application.Outbox.allowedNetworks()); err != nil {
+		return err
+	}
+	if !application.Outbox.HasSecret(scopedClientId) {
+		return &MessageError{StatusCode: http.StatusBadRequest, Code: ErrorCallbacksUnavailable, Reason: "Callbacks are not available, no callback secret is configured for this client."}
+	}
+	return nil
+}
+
+// LoadCallbackSecrets reads the per client callback signing secrets from a JSON file mapping scoped client id to secret
+func LoadCallbackSecrets(callbackSecretsLocation string) map[string]string {
+	secrets := make(map[string]string)
+	if callbackSecretsLocation == "" {
+		return secrets
+	}
+	secretsBytes, err := os.ReadFile(callbackSecretsLocation)
+	if err != nil {
+		logrus.Errorf("Was unable to read callback secrets file. Details: %v", err)
+		return secrets
+	}
+	if err := json.Unmarshal(secretsBytes, &secrets); err != nil {
+		logrus.Errorf("Was unable to unmarshal callback secrets into object. Details: %v", err)
+		return make(map[string]string)
+	}
+	return secrets
+}
+
+// InstantiateOutbox creates a new outbox for callbacks and recreates previous state if applicable
+func InstantiateOutbox(outboxPersistenceLocation string, secrets map[string]string, maxAttempts int) *Outbox {
+	outbox := &Outbox{Deliveries: make(map[string]CallbackDelivery), Secrets: secrets, MaxAttempts: maxAttempts}
+	outboxBytes, err := os.ReadFile(outboxPersistenceLocation)
+	if err != nil {
+		logrus.Errorf("Was unable to read outbox file. Details: %v", err)
+		return outbox
+	}
+	if len(outboxBytes) > 0 {
+		var deliveries map[string]CallbackDelivery
+		if err := json.Unmarshal(outboxBytes, &deliveries); err != nil {
+			logrus.Errorf("Was unable to unmarshal outbox into object. Details: %v", err)
+			return outbox
+		}
+		if deliveries != nil {
+			outbox.Deliveries = deliveries
+		}
+	}
+	return outbox
+}
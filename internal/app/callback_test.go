@@ -0,0 +1,324 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOutbox_DeliverCallbacks(t *testing.T) {
+	callbackPollInterval = 10 * time.Millisecond
+	tests := []struct {
+		name         string
+		statusCode   int
+		wantAttempts int
+		wantInOutbox bool
+	}{
+		{
+			name:         "Successful delivery removes callback from outbox",
+			statusCode:   http.StatusOK,
+			wantInOutbox: false,
+		},
+		{
+			name:         "Failed delivery is kept for retry",
+			statusCode:   http.StatusInternalServerError,
+			wantAttempts: 1,
+			wantInOutbox: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan *http.Request, 1)
+			receivedBodies := make(chan []byte, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				received <- r
+				receivedBodies <- body
+				w.WriteHeader(tt.statusCode)
+			}))
+			defer server.Close()
+			outbox := &Outbox{
+				Deliveries: make(map[string]CallbackDelivery),
+				Secrets:    map[string]string{"client": "secret"},
+				Client:     server.Client(),
+			}
+			payload := CallbackPayload{RequestId: "requestId", Status: CallbackSigned, Signature: "signature", Timestamp: time.Now()}
+			outbox.Enqueue(server.URL, "client", payload)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			outboxErrors := make(chan error, 1)
+			go func() {
+				outboxErrors <- outbox.DeliverCallbacks(ctx)
+			}()
+			var r *http.Request
+			var body []byte
+			select {
+			case r = <-received:
+				body = <-receivedBodies
+			case <-time.After(2 * time.Second):
+				t.Fatal("Callback was not delivered in time")
+			}
+			// Give the worker a moment to record the outcome before inspecting the outbox
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+			if err := <-outboxErrors; err != nil {
+				t.Errorf("Unexpected Error in test for DeliverCallbacks. Details: %v", err.Error())
+			}
+
+			wantSignature := "sha256=" + SignCallback("secret", r.Header.Get("X-Signature-Timestamp"), body)
+			if !cmp.Equal(r.Header.Get("X-Signature"), wantSignature) {
+				t.Errorf("Callback signature not as expected. Wanted: %v, Got: %v", wantSignature, r.Header.Get("X-Signature"))
+			}
+			var gotPayload CallbackPayload
+			if err := json.Unmarshal(body, &gotPayload); err != nil {
+				t.Fatalf("Unable to unmarshal callback payload. Details: %v", err.Error())
+			}
+			if !cmp.Equal(gotPayload, payload) {
+				t.Errorf("Callback payload not as expected. Wanted: %v, Got: %v", payload, gotPayload)
+			}
+			outbox.mu.Lock()
+			delivery, ok := outbox.Deliveries["requestId"]
+			outbox.mu.Unlock()
+			if ok != tt.wantInOutbox {
+				t.Errorf("Unexpected outbox state. Wanted callback in outbox: %v, Got: %v", tt.wantInOutbox, ok)
+			}
+			if ok && delivery.Attempts != tt.wantAttempts {
+				t.Errorf("Unexpected attempts recorded. Wanted: %v, Got: %v", tt.wantAttempts, delivery.Attempts)
+			}
+		})
+	}
+}
+
+func TestOutbox_complete(t *testing.T) {
+	tests := []struct {
+		name         string
+		attempts     int
+		maxAttempts  int
+		wantInOutbox bool
+	}{
+		{
+			name:         "Retries while attempts remain",
+			attempts:     1,
+			maxAttempts:  3,
+			wantInOutbox: true,
+		},
+		{
+			name:         "Gives up once attempts are exhausted",
+			attempts:     2,
+			maxAttempts:  3,
+			wantInOutbox: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delivery := CallbackDelivery{CallbackUrl: "https://example.com", Attempts: tt.attempts}
+			outbox := &Outbox{Deliveries: map[string]CallbackDelivery{"requestId": delivery}, MaxAttempts: tt.maxAttempts}
+			outbox.complete("requestId", delivery, io.EOF)
+			if _, ok := outbox.Deliveries["requestId"]; ok != tt.wantInOutbox {
+				t.Errorf("Unexpected outbox state. Wanted callback in outbox: %v, Got: %v", tt.wantInOutbox, ok)
+			}
+		})
+	}
+}
+
+func TestCallbackRetryDelay(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int
+		want     time.Duration
+	}{
+		{name: "First retry", attempts: 1, want: 5 * time.Second},
+		{name: "Doubles per attempt", attempts: 3, want: 20 * time.Second},
+		{name: "Capped at maximum", attempts: 20, want: 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := callbackRetryDelay(tt.attempts); got != tt.want {
+				t.Errorf("Retry delay not as expected. Wanted: %v, Got: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestApp_validateCallback(t *testing.T) {
+	application := &Application{Outbox: &Outbox{Secrets: map[string]string{"client": "secret"}}}
+	tests := []struct {
+		name        string
+		application *Application
+		callbackUrl string
+		clientId    string
+		wantError   bool
+	}{
+		{name: "No callback requested", application: &Application{}, callbackUrl: "", wantError: false},
+		{name: "Valid callback for client with secret", application: application, callbackUrl: "https://example.com/hook", clientId: "client", wantError: false},
+		{name: "Relative callback url", application: application, callbackUrl: "/hook", clientId: "client", wantError: true},
+		{name: "Unsupported scheme", application: application, callbackUrl: "ftp://example.com/hook", clientId: "client", wantError: true},
+		{name: "Client without secret", application: application, callbackUrl: "https://example.com/hook", clientId: "stranger", wantError: true},
+		{name: "Callbacks disabled", application: &Application{}, callbackUrl: "https://example.com/hook", clientId: "client", wantError: true},
+		{name: "Loopback address", application: application, callbackUrl: "http://127.0.0.1/hook", clientId: "client", wantError: true},
+		{name: "Localhost", application: application, callbackUrl: "http://localhost:8080/hook", clientId: "client", wantError: true},
+		{name: "Metadata address", application: application, callbackUrl: "http://169.254.169.254/latest/meta-data", clientId: "client", wantError: true},
+		{name: "Private address", application: application, callbackUrl: "https://10.0.0.1/hook", clientId: "client", wantError: true},
+		{name: "IPv6 loopback address", application: application, callbackUrl: "http://[::1]/hook", clientId: "client", wantError: true},
+		{name: "Public address", application: application, callbackUrl: "https://93.184.216.34/hook", clientId: "client", wantError: false},
+		{name: "Tenant client with secret", application: &Application{Outbox: &Outbox{Secrets: map[string]string{"client": "secret", "acme/client": "secret"}}}, callbackUrl: "https://example.com/hook", clientId: "acme/client", wantError: false},
+		{name: "Tenant client sharing an id with a client with secret", application: application, callbackUrl: "https://example.com/hook", clientId: "acme/client", wantError: true},
+		{name: "Allowed private address", application: &Application{Outbox: &Outbox{Secrets: map[string]string{"client": "secret"}, AllowedNetworks: ParseAllowedNetworks("127.0.0.0/8,::1")}}, callbackUrl: "http://localhost/hook", clientId: "client", wantError: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.application.validateCallback(tt.callbackUrl, tt.clientId)
+			if (err != nil) != tt.wantError {
+				t.Errorf("Unexpected validation result. Wanted error: %v, Got: %v", tt.wantError, err)
+			}
+		})
+	}
+}
+
+func TestStorer_callbackSecretByTenant(t *testing.T) {
+	secrets := map[string]string{"client": "defaultSecret", "acme/client": "acmeSecret"}
+	tests := []struct {
+		name       string
+		tenant     string
+		wantClient string
+		wantSecret string
+	}{
+		{name: "Default tenant", tenant: "", wantClient: "client", wantSecret: "defaultSecret"},
+		{name: "Tenant with its own secret", tenant: "acme", wantClient: "acme/client", wantSecret: "acmeSecret"},
+		{name: "Tenant without a secret", tenant: "other", wantClient: "other/client", wantSecret: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := make(chan SignedRequest)
+			track := make(chan PendingRequest, 1)
+			outbox := &Outbox{Deliveries: make(map[string]CallbackDelivery), Secrets: secrets}
+			storer := Storer{Store: store, Track: track, Signatures: make(map[string]string), SignaturesLock: &sync.RWMutex{}, Outbox: outbox}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				_ = storer.StoreSignedRequests(ctx)
+			}()
+			store <- SignedRequest{RequestId: "requestId", Signature: "signature", Add: true, CallbackUrl: "https://example.com/hook", ClientId: "client", TenantId: tt.tenant}
+			<-track
+			outbox.mu.Lock()
+			delivery, ok := outbox.Deliveries["requestId"]
+			outbox.mu.Unlock()
+			if !ok || !cmp.Equal(delivery.ClientId, tt.wantClient) {
+				t.Errorf("Callback not queued for the scoped client. Wanted: %v, Recieved: %v", tt.wantClient, delivery.ClientId)
+			}
+			if secret, _ := outbox.secret(delivery.ClientId); !cmp.Equal(secret, tt.wantSecret) {
+				t.Errorf("Callback secret not as expected. Wanted: %v, Recieved: %v", tt.wantSecret, secret)
+			}
+		})
+	}
+}
+
+func TestOutbox_deliverPrivateAddress(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	tests := []struct {
+		name      string
+		allowed   []*net.IPNet
+		wantError bool
+	}{
+		{name: "Private address refused", allowed: nil, wantError: true},
+		{name: "Other network allowed", allowed: ParseAllowedNetworks("10.0.0.0/8"), wantError: true},
+		{name: "Allowed network delivered to", allowed: ParseAllowedNetworks("127.0.0.0/8"), wantError: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The default client, rather than the test server's, so the dialer checks the address
+			outbox := Outbox{Secrets: map[string]string{DefaultCallbackSecretClient: "secret"}, AllowedNetworks: tt.allowed}
+			err := outbox.deliver(context.Background(), CallbackDelivery{CallbackUrl: server.URL, Payload: CallbackPayload{RequestId: "requestId"}})
+			if (err != nil) != tt.wantError {
+				t.Errorf("Unexpected delivery result. Wanted error: %v, Recieved: %v", tt.wantError, err)
+			}
+		})
+	}
+}
+
+func TestParseAllowedNetworks(t *testing.T) {
+	tests := []struct {
+		name     string
+		networks string
+		want     []string
+	}{
+		{name: "None", networks: "", want: nil},
+		{name: "Ranges and addresses", networks: "127.0.0.0/8, 10.1.2.3,::1", want: []string{"127.0.0.0/8", "10.1.2.3/32", "::1/128"}},
+		{name: "Invalid entries skipped", networks: "not-a-network,192.168.0.0/16", want: []string{"192.168.0.0/16"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, network := range ParseAllowedNetworks(tt.networks) {
+				got = append(got, network.String())
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Allowed networks not as expected. Diff: %v", diff)
+			}
+		})
+	}
+}
+
+func TestOutbox_deliverDue(t *testing.T) {
+	var lock sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		inFlight--
+		lock.Unlock()
+	}))
+	defer server.Close()
+	outbox := Outbox{Deliveries: map[string]CallbackDelivery{}, Secrets: map[string]string{DefaultCallbackSecretClient: "secret"}, MaxAttempts: 3, Client: server.Client(), Workers: 2}
+	for _, requestId := range []string{"first", "second", "third", "fourth", "fifth"} {
+		outbox.Enqueue(server.URL, "client", CallbackPayload{RequestId: requestId})
+	}
+	outbox.deliverDue(context.Background(), time.Now().Add(time.Second))
+	if outbox.Len() != 0 {
+		t.Errorf("Expected every due callback to be delivered. Recieved: %v left in the outbox", outbox.Len())
+	}
+	if maxInFlight != 2 {
+		t.Errorf("Expected callbacks to be delivered by 2 workers at once. Recieved: %v", maxInFlight)
+	}
+}
+
+func TestStorer_StoreSignedRequestsCallback(t *testing.T) {
+	outbox := &Outbox{Deliveries: make(map[string]CallbackDelivery)}
+	metadata := &MetadataStore{Metadata: map[string]map[string]string{"requestId": {"job": "1234"}}}
+	storer := Storer{Store: make(chan SignedRequest), Track: make(chan PendingRequest, 1), Signatures: make(map[string]string), SignaturesLock: &sync.RWMutex{}, Outbox: outbox, Metadata: metadata}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = storer.StoreSignedRequests(ctx)
+	}()
+	storer.Store <- SignedRequest{RequestId: "requestId", Signature: "signature", Add: true, CallbackUrl: "https://example.com/hook", ClientId: "client"}
+	// The tracker update is sent once the callback has been placed in the outbox
+	<-storer.Track
+	outbox.mu.Lock()
+	delivery, ok := outbox.Deliveries["requestId"]
+	outbox.mu.Unlock()
+	if !ok {
+		t.Fatal("Expected callback to be placed in the outbox")
+	}
+	if delivery.CallbackUrl != "https://example.com/hook" || delivery.ClientId != "client" || delivery.Payload.Signature != "signature" {
+		t.Errorf("Callback not as expected. Got: %v", delivery)
+	}
+	if !cmp.Equal(delivery.Payload.Metadata, map[string]string{"job": "1234"}) {
+		t.Errorf("Callback metadata not as expected. Got: %v", delivery.Payload.Metadata)
+	}
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestCancelled represents a response body for a cancelled request
+type RequestCancelled struct {
+	Body       string
+	RequestId  string
+	State      string
+	StatusCode int
+}
+
+// Canceller keeps track of the requests taken off the encrypt queue, so their encryption can be interrupted.
+// Requests cancelled while still queued are removed from the queue instead
+type Canceller struct {
+	mu sync.Mutex
+	// running maps requests to the cancel function of their encryption, which is nil for a request that has been
+	// taken off the queue but not yet started
+	running map[string]context.CancelFunc
+}
+
+// NewCanceller creates a canceller without any running requests
+func NewCanceller() *Canceller {
+	return &Canceller{running: make(map[string]context.CancelFunc)}
+}
+
+// Cancel withdraws a request taken off the encrypt queue. A running request has its context cancelled, while a
+// request yet to start never does. Reports whether the request had been taken off the queue
+func (canceller *Canceller) Cancel(requestId string) bool {
+	if canceller == nil {
+		return false
+	}
+	canceller.mu.Lock()
+	defer canceller.mu.Unlock()
+	cancel, ok := canceller.running[requestId]
+	if !ok {
+		return false
+	}
+	if cancel != nil {
+		cancel()
+	}
+	delete(canceller.running, requestId)
+	return true
+}
+
+// Take marks a request as taken off the encrypt queue. It is called while the queue is locked, so a request being
+// cancelled is always found either in the queue or here
+func (canceller *Canceller) Take(requestId string) {
+	if canceller == nil {
+		return
+	}
+	canceller.mu.Lock()
+	defer canceller.mu.Unlock()
+	canceller.running[requestId] = nil
+}
+
+// Start marks a request taken off the encrypt queue as running, returning the context its encryption runs under.
+// Returns false if the request was cancelled since it was taken, in which case it must not be encrypted
+func (canceller *Canceller) Start(ctx context.Context, requestId string) (context.Context, bool) {
+	if canceller == nil {
+		return ctx, true
+	}
+	canceller.mu.Lock()
+	defer canceller.mu.Unlock()
+	if _, ok := canceller.running[requestId]; !ok {
+		return nil, false
+	}
+	requestCtx, cancel := context.WithCancel(ctx)
+	canceller.running[requestId] = cancel
+	return requestCtx, true
+}
+
+// Finish marks a request as no longer running
+func (canceller *Canceller) Finish(requestId string) {
+	if canceller == nil {
+		return
+	}
+	canceller.mu.Lock()
+	defer canceller.mu.Unlock()
+	if cancel, ok := canceller.running[requestId]; ok {
+		if cancel != nil {
+			cancel()
+		}
+		delete(canceller.running, requestId)
+	}
+}
+
+// cancelRequestHandler handles withdrawing a request through the DELETE /crypto/sign/request/{requestId} endpoint
+func (application *Application) cancelRequestHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := pathVar(r, "requestId")
+	if !application.checkRequestTenant(w, r, requestId) {
+		return
+	}
+	if _, ok := application.lookupSignature(requestId); ok {
+		logFromRequest(r).Debugf("Request already signed, unable to cancel")
+		writeDenied(w, http.StatusConflict, ErrorAlreadySigned, "The request has already been signed and can no longer be cancelled. Please use the 'crypto/sign/request/{requestId}' endpoint to retrieve the signature.")
+		return
+	}
+	request, ok := application.lookupRequest(requestId)
+	if !ok {
+		logFromRequest(r).Debugf("Request id invalid")
+		writeDenied(w, http.StatusNotFound, ErrorNotFound, "The requestId is not recognized. Please use the 'crypto/sign' endpoint to generate a new request.")
+		return
+	}
+	if request.State == StateExpired {
+		logFromRequest(r).Debugf("Request already expired, unable to cancel")
+		writeDenied(w, http.StatusGone, ErrorRequestExpired, "The deadline of the request passed before it could be signed, so there is nothing left to cancel.")
+		return
+	}
+	if request.State != StateCancelled {
+		// The request is looked for where it would be next, so one moving along the pipeline is always found
+		if application.Schedule.Remove(requestId) {
+			logFromRequest(r).Debugf("Cancelled scheduled requestId: %v", requestId)
+		} else if request.State == StateFailed {
+			logFromRequest(r).Debugf("Cancelled failed requestId: %v", requestId)
+		} else if application.Queue.Remove(requestId) {
+			logFromRequest(r).Debugf("Cancelled queued requestId: %v", requestId)
+		} else if application.Cancellations.Cancel(requestId) {
+			logFromRequest(r).Debugf("Cancelled in-flight encryption for requestId: %v", requestId)
+		} else {
+			logFromRequest(r).Debugf("Cancelled requestId no longer in the pipeline: %v", requestId)
+		}
+		request.State = StateCancelled
+		request.Add = true
+		application.Track <- request
+		application.Events.Publish(Event{RequestId: requestId, State: EventCancelled})
+		if request.CallbackUrl != "" && application.Outbox != nil {
+			application.Outbox.Enqueue(request.CallbackUrl, requestScopedId(request.Request), CallbackPayload{
+				RequestId: requestId,
+				Status:    CallbackCancelled,
+				Metadata:  application.Metadata.Get(requestId),
+				Timestamp: time.Now(),
+			})
+		}
+	}
+	writeResponse(w, http.StatusOK, RequestCancelled{
+		Body:       "Request cancelled.",
+		RequestId:  requestId,
+		State:      StateCancelled,
+		StatusCode: http.StatusOK,
+	})
+}
@@ -0,0 +1,193 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCanceller(t *testing.T) {
+	canceller := NewCanceller()
+
+	// A request still queued isn't known to the canceller
+	if taken := canceller.Cancel("queued"); taken {
+		t.Error("Expected queued request to not be reported as taken")
+	}
+
+	// A request cancelled once taken off the queue is never started
+	canceller.Take("taken")
+	if taken := canceller.Cancel("taken"); !taken {
+		t.Error("Expected request taken off the queue to be reported as taken")
+	}
+	if _, ok := canceller.Start(context.Background(), "taken"); ok {
+		t.Error("Expected cancelled request to not be started")
+	}
+	if _, ok := canceller.running["taken"]; ok {
+		t.Error("Expected cancelled request to be forgotten")
+	}
+
+	// A running request has its context cancelled
+	canceller.Take("running")
+	ctx, ok := canceller.Start(context.Background(), "running")
+	if !ok {
+		t.Fatal("Expected request to be started")
+	}
+	if running := canceller.Cancel("running"); !running {
+		t.Error("Expected started request to be reported as running")
+	}
+	select {
+	case <-ctx.Done():
+	default:
+		t.Error("Expected running request's context to be cancelled")
+	}
+
+	// A finished request is no longer tracked
+	canceller.Take("finished")
+	_, _ = canceller.Start(context.Background(), "finished")
+	canceller.Finish("finished")
+	if _, ok := canceller.running["finished"]; ok {
+		t.Error("Expected finished request to no longer be tracked as running")
+	}
+}
+
+func TestApp_cancelRequestHandler(t *testing.T) {
+	pendingRequest := PendingRequest{
+		Request: Request{RequestId: "requestId", Message: "message"},
+		Timing:  Timing{time.Now(), 1},
+		State:   StateQueued,
+		Add:     true,
+	}
+	cancelledRequest := pendingRequest
+	cancelledRequest.State = StateCancelled
+	mockCancelledBody := `{"Body":"Request cancelled.","RequestId":"requestId","State":"cancelled","StatusCode":200}`
+	mockSignedBody := `{"Body":"The request has already been signed and can no longer be cancelled. Please use the 'crypto/sign/request/{requestId}' endpoint to retrieve the signature.","StatusCode":409}`
+	mockNotFoundBody := `{"Body":"The requestId is not recognized. Please use the 'crypto/sign' endpoint to generate a new request.","StatusCode":404}`
+	tests := []struct {
+		name         string
+		signatures   map[string]string
+		requests     map[string]PendingRequest
+		bodyExpected string
+		statusCode   int
+		wantTracked  bool
+	}{
+		{
+			name:         "Cancels pending request",
+			signatures:   make(map[string]string),
+			requests:     map[string]PendingRequest{"requestId": pendingRequest},
+			bodyExpected: mockCancelledBody,
+			statusCode:   200,
+			wantTracked:  true,
+		},
+		{
+			name:         "Cancelling twice is a no-op",
+			signatures:   make(map[string]string),
+			requests:     map[string]PendingRequest{"requestId": cancelledRequest},
+			bodyExpected: mockCancelledBody,
+			statusCode:   200,
+			wantTracked:  false,
+		},
+		{
+			name:         "Signed request can't be cancelled",
+			signatures:   map[string]string{"requestId": "signature"},
+			requests:     make(map[string]PendingRequest),
+			bodyExpected: mockSignedBody,
+			statusCode:   409,
+		},
+		{
+			name:         "Unknown request",
+			signatures:   make(map[string]string),
+			requests:     make(map[string]PendingRequest),
+			bodyExpected: mockNotFoundBody,
+			statusCode:   404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Queue:         NewFairQueue(1, nil),
+				Signatures:    tt.signatures,
+				Requests:      tt.requests,
+				Track:         make(chan PendingRequest, 1),
+				Cancellations: NewCanceller(),
+			}
+			application.Queue.Push(Request{RequestId: "requestId", Message: "message"})
+			router := NewRouter(&application)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest("DELETE", "/crypto/sign/request/requestId", nil))
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if !cmp.Equal(rr.Body.String(), tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
+			}
+			if tracked := len(application.Track) == 1; tracked != tt.wantTracked {
+				t.Fatalf("Unexpected tracker update. Wanted update: %v, Got: %v", tt.wantTracked, tracked)
+			}
+			if tt.wantTracked {
+				update := <-application.Track
+				if update.State != StateCancelled || !update.Add {
+					t.Errorf("Expected tracker to be told the request is cancelled. Got: %v", update)
+				}
+				if application.Queue.Len() != 0 {
+					t.Error("Expected cancelled request to be removed from the queue")
+				}
+			}
+		})
+	}
+}
+
+func TestApp_currentRequestHandlerCancelled(t *testing.T) {
+	application := Application{
+		Signatures: make(map[string]string),
+		Requests: map[string]PendingRequest{"requestId": {
+			Request: Request{RequestId: "requestId", Message: "message"},
+			Timing:  Timing{time.Now(), 1},
+			State:   StateCancelled,
+			Add:     true,
+		}},
+	}
+	mockGoneBody := `{"Body":"The request was cancelled before it was signed. Please use the 'crypto/sign' endpoint to generate a new request.","StatusCode":410}`
+	router := NewRouter(&application)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/crypto/sign/request/requestId?wait=1m", nil))
+	if status := rr.Code; status != 410 {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, 410)
+	}
+	if !cmp.Equal(rr.Body.String(), mockGoneBody) {
+		t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), mockGoneBody)
+	}
+}
+
+func TestEncryptorHandler_HandleEncryptRequestsCancelledWaiting(t *testing.T) {
+	scheduler := EncryptorHandler{
+		Queue:         NewFairQueue(1, nil),
+		Store:         make(chan SignedRequest),
+		Encryptors:    make(chan struct{}),
+		Cancellations: NewCanceller(),
+	}
+	scheduler.Queue.Push(Request{RequestId: "first", Message: "message"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = scheduler.HandleEncryptRequests(ctx)
+	}()
+	// No encryptors are available, so each request waits after leaving the queue, where it can still be cancelled
+	// and the handler moves on to the next
+	for _, requestId := range []string{"first", "second"} {
+		cancelled := false
+		deadline := time.Now().Add(2 * time.Second)
+		for !cancelled && time.Now().Before(deadline) {
+			cancelled = scheduler.Queue.Len() == 0 && scheduler.Cancellations.Cancel(requestId)
+			time.Sleep(5 * time.Millisecond)
+		}
+		if !cancelled {
+			t.Fatalf("Expected request waiting for an encryptor to be cancellable: %v", requestId)
+		}
+		if requestId == "first" {
+			scheduler.Queue.Push(Request{RequestId: "second", Message: "message"})
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package app
+
+import (
+	"net/http"
+	"sync"
+)
+
+// QueueControl lets operators pause the encryptor handler, so no calls are made upstream, and drain the service, so
+// new submissions are turned away while the requests already accepted are finished. Safe for concurrent use by
+// handlers and the encryptor handler
+type QueueControl struct {
+	mu       sync.Mutex
+	paused   bool
+	draining bool
+	// resumed is closed while the encryptor handler runs, and replaced with an open channel when it is paused
+	resumed chan struct{}
+}
+
+// QueueStatus represents a response body describing the state of the encrypt queue
+type QueueStatus struct {
+	Body     string
+	Paused   bool
+	Draining bool
+	// Drained is set once a draining service has finished every request it accepted
+	Drained    bool
+	Queued     int
+	Scheduled  int
+	Running    int
+	StatusCode int
+}
+
+// NewQueueControl creates a queue control with the encryptor handler running and submissions accepted
+func NewQueueControl() *QueueControl {
+	resumed := make(chan struct{})
+	close(resumed)
+	return &QueueControl{resumed: resumed}
+}
+
+// Pause stops the encryptor handler from sending requests upstream. Requests keep being accepted and queued
+func (control *QueueControl) Pause() {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if !control.paused {
+		control.paused = true
+		control.resumed = make(chan struct{})
+	}
+}
+
+// Resume restarts the encryptor handler, and accepts submissions again if the service was draining
+func (control *QueueControl) Resume() {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	control.draining = false
+	control.resume()
+}
+
+// Drain turns away new submissions, while the requests already accepted are finished. A paused encryptor handler is
+// restarted, as the queue could never drain otherwise
+func (control *QueueControl) Drain() {
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	control.draining = true
+	control.resume()
+}
+
+// resume restarts the encryptor handler. Callers must hold the lock
+func (control *QueueControl) resume() {
+	if control.paused {
+		control.paused = false
+		close(control.resumed)
+	}
+}
+
+// Paused reports whether the encryptor handler is paused
+func (control *QueueControl) Paused() bool {
+	if control == nil {
+		return false
+	}
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	return control.paused
+}
+
+// Draining reports whether new submissions are being turned away
+func (control *QueueControl) Draining() bool {
+	if control == nil {
+		return false
+	}
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	return control.draining
+}
+
+// waitResumed returns a channel closed once the encryptor handler is resumed, or nil when it isn't paused
+func (control *QueueControl) waitResumed() <-chan struct{} {
+	if control == nil {
+		return nil
+	}
+	control.mu.Lock()
+	defer control.mu.Unlock()
+	if !control.paused {
+		return nil
+	}
+	return control.resumed
+}
+
+// checkDraining turns away a submission while the service is draining
+func (application *Application) checkDraining() *MessageError {
+	if !application.Control.Draining() {
+		return nil
+	}
+	return &MessageError{
+		StatusCode: http.StatusServiceUnavailable,
+		Code:       ErrorDraining,
+		Reason:     "The server is draining and not accepting new requests. Please try again later.",
+	}
+}
+
+// queueStatusHandler reports the state of the encrypt queue through the /admin/queue endpoint
+func (application *Application) queueStatusHandler(w http.ResponseWriter, r *http.Request) {
+	application.writeQueueStatus(w, "State of the encrypt queue.")
+}
+
+// pauseQueueHandler pauses the encryptor handler through the /admin/queue/pause endpoint
+func (application *Application) pauseQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if !application.checkQueueControl(w, r) {
+		return
+	}
+	application.Control.Pause()
+	logFromRequest(r).Infof("Encryptor handler paused")
+	application.writeQueueStatus(w, "The encrypt queue is paused.")
+}
+
+// resumeQueueHandler resumes the encryptor handler and accepts submissions again through the /admin/queue/resume
+// endpoint
+func (application *Application) resumeQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if !application.checkQueueControl(w, r) {
+		return
+	}
+	application.Control.Resume()
+	logFromRequest(r).Infof("Encryptor handler resumed")
+	application.writeQueueStatus(w, "The encrypt queue is running.")
+}
+
+// drainQueueHandler turns away new submissions until the queue is resumed through the /admin/queue/drain endpoint
+func (application *Application) drainQueueHandler(w http.ResponseWriter, r *http.Request) {
+	if !application.checkQueueControl(w, r) {
+		return
+	}
+	application.Control.Drain()
+	logFromRequest(r).Infof("Draining the encrypt queue")
+	application.writeQueueStatus(w, "The encrypt queue is draining.")
+}
+
+// checkQueueControl only lets admins overseeing every tenant control the queue, as it is shared by them all
+func (application *Application) checkQueueControl(w http.ResponseWriter, r *http.Request) bool {
+	if application.Control == nil {
+		writeDenied(w, http.StatusForbidden, ErrorForbidden, "Queue control is disabled.")
+		return false
+	}
+	if _, scoped := adminTenant(r); scoped {
+		writeDenied(w, http.StatusForbidden, ErrorForbidden, "Only admins overseeing every tenant can control the queue.")
+		return false
+	}
+	return true
+}
+
+// writeQueueStatus writes a 200 response describing the state of the encrypt queue
+func (application *Application) writeQueueStatus(w http.ResponseWriter, body string) {
+	status := QueueStatus{
+		Body:       body,
+		Paused:     application.Control.Paused(),
+		Draining:   application.Control.Draining(),
+		Queued:     application.Queue.Len(),
+		Scheduled:  application.Schedule.Len(),
+		StatusCode: http.StatusOK,
+	}
+	application.requestsLock.RLock()
+	for _, request := range application.Requests {
+		if request.State == StateRunning || request.State == StateRetrying {
+			status.Running++
+		}
+	}
+	application.requestsLock.RUnlock()
+	status.Drained = status.Draining && status.Queued == 0 && status.Scheduled == 0 && status.Running == 0
+	writeResponse(w, http.StatusOK, status)
+}
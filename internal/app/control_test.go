@@ -0,0 +1,213 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestQueueControl(t *testing.T) {
+	control := NewQueueControl()
+	if control.Paused() || control.Draining() || control.waitResumed() != nil {
+		t.Fatalf("New queue control should be running and accepting submissions")
+	}
+	control.Pause()
+	resumed := control.waitResumed()
+	if !control.Paused() || resumed == nil {
+		t.Fatalf("Paused queue control should hold the encryptor handler")
+	}
+	control.Drain()
+	select {
+	case <-resumed:
+	default:
+		t.Errorf("Draining should resume a paused encryptor handler")
+	}
+	if control.Paused() || !control.Draining() {
+		t.Errorf("Queue control should be draining and running")
+	}
+	control.Resume()
+	if control.Paused() || control.Draining() {
+		t.Errorf("Resumed queue control should be running and accepting submissions")
+	}
+	var disabled *QueueControl
+	if disabled.Paused() || disabled.Draining() || disabled.waitResumed() != nil {
+		t.Errorf("Missing queue control should never hold the encryptor handler")
+	}
+}
+
+func TestEncryptorHandler_HandleEncryptRequestsPaused(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("signature"))
+	}))
+	defer upstream.Close()
+	defer func(url string) {
+		signingServiceUrl = url
+	}(signingServiceUrl)
+	signingServiceUrl = upstream.URL
+
+	scheduler := EncryptorHandler{
+		Queue:         NewFairQueue(1, nil),
+		Encryptors:    make(chan struct{}, 1),
+		Store:         make(chan SignedRequest, 1),
+		Track:         make(chan PendingRequest, 1),
+		Cancellations: NewCanceller(),
+		Control:       NewQueueControl(),
+	}
+	scheduler.Control.Pause()
+	scheduler.Encryptors <- struct{}{}
+	scheduler.Queue.Push(Request{RequestId: "requestId", Message: "message"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = scheduler.HandleEncryptRequests(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if len(scheduler.Encryptors) != 1 {
+		t.Fatalf("Paused encryptor handler took an encryptor")
+	}
+	scheduler.Control.Resume()
+	select {
+	case tracked := <-scheduler.Track:
+		if tracked.RequestId != "requestId" || tracked.State != StateRunning {
+			t.Errorf("Request was not assigned once resumed. Recieved: %v", tracked)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected resumed encryptor handler to assign the request")
+	}
+	if signed := <-scheduler.Store; signed.Signature != "signature" {
+		t.Errorf("Request was not signed once resumed. Recieved: %v", signed)
+	}
+}
+
+func TestApp_queueControlHandlers(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		apiKey       string
+		control      bool
+		statusCode   int
+		bodyExpected string
+	}{
+		{
+			name:         "Queue status",
+			method:       "GET",
+			target:       "/admin/queue",
+			apiKey:       "admin-key",
+			control:      true,
+			statusCode:   200,
+			bodyExpected: `{"Body":"State of the encrypt queue.","Paused":false,"Draining":false,"Drained":false,"Queued":1,"Scheduled":0,"Running":1,"StatusCode":200}`,
+		},
+		{
+			name:         "Pause",
+			method:       "POST",
+			target:       "/admin/queue/pause",
+			apiKey:       "admin-key",
+			control:      true,
+			statusCode:   200,
+			bodyExpected: `{"Body":"The encrypt queue is paused.","Paused":true,"Draining":false,"Drained":false,"Queued":1,"Scheduled":0,"Running":1,"StatusCode":200}`,
+		},
+		{
+			name:         "Drain",
+			method:       "POST",
+			target:       "/v1/admin/queue/drain",
+			apiKey:       "admin-key",
+			control:      true,
+			statusCode:   200,
+			bodyExpected: `{"data":{"paused":false,"draining":true,"drained":false,"queued":1,"scheduled":0,"running":1}}`,
+		},
+		{
+			name:         "Resume",
+			method:       "POST",
+			target:       "/admin/queue/resume",
+			apiKey:       "admin-key",
+			control:      true,
+			statusCode:   200,
+			bodyExpected: `{"Body":"The encrypt queue is running.","Paused":false,"Draining":false,"Drained":false,"Queued":1,"Scheduled":0,"Running":1,"StatusCode":200}`,
+		},
+		{
+			name:         "Admin restricted to a tenant",
+			method:       "POST",
+			target:       "/admin/queue/pause",
+			apiKey:       "acme-admin-key",
+			control:      true,
+			statusCode:   403,
+			bodyExpected: `{"Body":"Only admins overseeing every tenant can control the queue.","StatusCode":403}`,
+		},
+		{
+			name:         "Queue control disabled",
+			method:       "POST",
+			target:       "/v1/admin/queue/pause",
+			apiKey:       "admin-key",
+			statusCode:   403,
+			bodyExpected: `{"error":{"code":"forbidden","message":"Queue control is disabled."}}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Queue: NewFairQueue(2, nil),
+				Requests: map[string]PendingRequest{
+					"running": {Request: Request{RequestId: "running"}, Timing: Timing{time.Now(), 1}, State: StateRunning, Add: true},
+				},
+				APIKeys: &KeyStore{Clients: map[string]Client{
+					hashAPIKey("admin-key"):      {Id: "admin", Admin: true},
+					hashAPIKey("acme-admin-key"): {Id: "acmeAdmin", Admin: true, Tenant: "acme"},
+				}},
+			}
+			if tt.control {
+				application.Control = NewQueueControl()
+			}
+			application.Queue.Push(Request{RequestId: "queued"})
+			router := NewRouter(&application)
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			req.Header.Set("X-API-Key", tt.apiKey)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; status != tt.statusCode {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); !cmp.Equal(body, tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", body, tt.bodyExpected)
+			}
+		})
+	}
+}
+
+func TestApp_drainingSubmission(t *testing.T) {
+	application := Application{
+		Queue:    NewFairQueue(2, nil),
+		Track:    make(chan PendingRequest, 2),
+		Requests: make(map[string]PendingRequest),
+		Batches:  &BatchStore{Batches: make(map[string]Batch)},
+		Control:  NewQueueControl(),
+	}
+	application.Control.Drain()
+	router := NewRouter(&application)
+	requests := []struct {
+		method string
+		target string
+		body   string
+	}{
+		{method: "GET", target: "/crypto/sign?message=taco"},
+		{method: "POST", target: "/v1/requests", body: `{"message":"taco"}`},
+		{method: "POST", target: "/v1/batches", body: `{"messages":["taco"]}`},
+	}
+	for _, submission := range requests {
+		req := httptest.NewRequest(submission.method, submission.target, strings.NewReader(submission.body))
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != 503 || !strings.Contains(rr.Body.String(), "The server is draining and not accepting new requests. Please try again later.") {
+			t.Errorf("Draining server accepted a submission to %v: got %v %v", submission.target, rr.Code, rr.Body.String())
+		}
+	}
+	if application.Queue.Len() != 0 {
+		t.Errorf("Draining server queued submissions. Length: %v", application.Queue.Len())
+	}
+}
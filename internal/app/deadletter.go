@@ -0,0 +1,157 @@
+package app
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DefaultMaxEncryptAttempts is the number of upstream attempts made before a request is dead-lettered, when no limit
+// has been configured
+const DefaultMaxEncryptAttempts = 10
+
+// RequeueResult represents a response body listing the dead-lettered requests placed back on the encrypt queue
+type RequeueResult struct {
+	Body       string
+	RequestIds []string
+	StatusCode int
+}
+
+// maxAttempts returns the configured attempt limit, falling back to the default when unset
+func (scheduler *EncryptorHandler) maxAttempts() int {
+	if scheduler.MaxAttempts <= 0 {
+		return DefaultMaxEncryptAttempts
+	}
+	return scheduler.MaxAttempts
+}
+
+// deadLetter reports a request the upstream service could not sign within the attempts allowed, to the tracker,
+// event subscribers and its callback url. It stays tracked as failed until it is requeued or cancelled
+func (scheduler *EncryptorHandler) deadLetter(request Request, attempts int, err error) {
+	request.log().Errorf("Dead-lettering requestId: %v after %v attempts. Details: %v", request.RequestId, attempts, err.Error())
+	scheduler.Metrics.ObserveDeadLetter(request)
+	if scheduler.Track != nil {
+		scheduler.Track <- PendingRequest{Request: Request{RequestId: request.RequestId}, State: StateFailed, Attempts: attempts, Add: true}
+	}
+	scheduler.Events.Publish(Event{RequestId: request.RequestId, State: EventFailed, Attempt: attempts, Detail: err.Error(), Timestamp: time.Now()})
+	if request.CallbackUrl != "" && scheduler.Outbox != nil {
+		scheduler.Outbox.Enqueue(request.CallbackUrl, requestScopedId(request), CallbackPayload{
+			RequestId: request.RequestId,
+			Status:    CallbackFailed,
+			Metadata:  scheduler.Metadata.Get(request.RequestId),
+			Timestamp: time.Now(),
+		})
+	}
+}
+
+// requeueRequestHandler places a single dead-lettered request back on the encrypt queue through the
+// /admin/requests/{requestId}/requeue endpoint
+func (application *Application) requeueRequestHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := pathVar(r, "requestId")
+	request, ok := application.lookupRequest(requestId)
+	if tenant, scoped := adminTenant(r); ok && scoped && requestTenant(request.Request) != tenant {
+		ok = false
+	}
+	if !ok {
+		logFromRequest(r).Debugf("Request id invalid")
+		writeDenied(w, http.StatusNotFound, ErrorNotFound, "The requestId is not recognized.")
+		return
+	}
+	claimed := application.claimFailed([]string{requestId})
+	if len(claimed) == 0 {
+		writeDenied(w, http.StatusConflict, ErrorNotRequeueable, "Only requests that failed can be requeued.")
+		return
+	}
+	if !application.requeueFailed(claimed) {
+		setRetryAfter(w, application.queueFullRetryMinutes(1))
+		writeDenied(w, http.StatusServiceUnavailable, ErrorQueueFull, "The request could not be requeued, server is at capacity. Please try again shortly.")
+		return
+	}
+	writeResponse(w, http.StatusOK, RequeueResult{Body: "Request requeued.", RequestIds: []string{requestId}, StatusCode: http.StatusOK})
+}
+
+// requeueRequestsHandler places every dead-lettered request matching the filters of the /admin/requests endpoint back
+// on the encrypt queue, oldest first, through the /admin/requests/requeue endpoint. Like a batch, either every one
+// of them is requeued or, when the queue lacks capacity for them all, none of them are
+func (application *Application) requeueRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	query, err := readRequestQuery(r)
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	query.states = map[string]bool{StateFailed: true}
+	if tenant, scoped := adminTenant(r); scoped {
+		query.tenant = tenant
+	}
+	now := time.Now()
+	var summaries []RequestSummary
+	application.requestsLock.RLock()
+	for requestId, request := range application.Requests {
+		if summary := summarizeRequest(requestId, request, now); query.matches(summary) {
+			summaries = append(summaries, summary)
+		}
+	}
+	application.requestsLock.RUnlock()
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].TimeAdded.Before(summaries[j].TimeAdded)
+	})
+	requestIds := make([]string, 0, len(summaries))
+	for _, summary := range summaries {
+		requestIds = append(requestIds, summary.RequestId)
+	}
+	claimed := application.claimFailed(requestIds)
+	if !application.requeueFailed(claimed) {
+		setRetryAfter(w, application.queueFullRetryMinutes(len(claimed)))
+		writeDenied(w, http.StatusServiceUnavailable, ErrorQueueFull, "The requests could not be requeued, server does not have capacity for every one of them. Please try again shortly or requeue fewer requests.")
+		return
+	}
+	result := RequeueResult{Body: "Requests requeued.", RequestIds: []string{}, StatusCode: http.StatusOK}
+	for _, request := range claimed {
+		result.RequestIds = append(result.RequestIds, request.RequestId)
+	}
+	logFromRequest(r).Infof("Requeued %v failed requests", len(result.RequestIds))
+	writeResponse(w, http.StatusOK, result)
+}
+
+// claimFailed moves those of the requests that are still failed to queued, keeping their order. Checking and moving
+// them under a single hold of the lock means a request requeued by two admins at once is only claimed, and queued, once
+func (application *Application) claimFailed(requestIds []string) []Request {
+	application.requestsLock.Lock()
+	defer application.requestsLock.Unlock()
+	var claimed []Request
+	for _, requestId := range requestIds {
+		request, ok := application.Requests[requestId]
+		if !ok || request.State != StateFailed {
+			continue
+		}
+		request.State = StateQueued
+		application.Requests[requestId] = request
+		request.RequestId = requestId
+		claimed = append(claimed, request.Request)
+	}
+	return claimed
+}
+
+// requeueFailed places claimed requests at the back of the encrypt queue with their attempts reset. When the queue
+// lacks capacity for them all, none are queued and they are returned to failed
+func (application *Application) requeueFailed(requests []Request) bool {
+	if !application.Queue.PushAll(requests) {
+		application.requestsLock.Lock()
+		for _, request := range requests {
+			if tracked, ok := application.Requests[request.RequestId]; ok && tracked.State == StateQueued {
+				tracked.State = StateFailed
+				application.Requests[request.RequestId] = tracked
+			}
+		}
+		application.requestsLock.Unlock()
+		return false
+	}
+	now := time.Now()
+	for _, request := range requests {
+		timing := application.GetEncryptionTiming(now, request)
+		application.Track <- PendingRequest{Request: request, Timing: timing, State: StateQueued, Add: true}
+		application.Events.Publish(Event{RequestId: request.RequestId, State: EventQueued, Timestamp: now})
+		request.log().Debugf("Requeued failed requestId: %v", request.RequestId)
+	}
+	return true
+}
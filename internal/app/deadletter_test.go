@@ -0,0 +1,241 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEncryptorParent_deadLetter(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+	defer func(url string, delay time.Duration) {
+		signingServiceUrl, encryptRetryDelay = url, delay
+	}(signingServiceUrl, encryptRetryDelay)
+	signingServiceUrl, encryptRetryDelay = upstream.URL, time.Millisecond
+
+	scheduler := EncryptorHandler{
+		Encryptors:    make(chan struct{}, 1),
+		Track:         make(chan PendingRequest, 8),
+		Cancellations: NewCanceller(),
+		Outbox:        &Outbox{Deliveries: make(map[string]CallbackDelivery)},
+		MaxAttempts:   2,
+	}
+	go encryptorParent(context.Background(), &scheduler, Request{RequestId: "requestId", Message: "message", CallbackUrl: "http://localhost/callback"})
+	var states []string
+	for {
+		select {
+		case tracked := <-scheduler.Track:
+			states = append(states, tracked.State)
+			if tracked.State != StateFailed {
+				continue
+			}
+			if tracked.Attempts != 2 {
+				t.Errorf("Request was dead-lettered after the wrong number of attempts. Want: %v, Recieved: %v", 2, tracked.Attempts)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected request to be dead-lettered. Tracked: %v", states)
+		}
+		break
+	}
+	want := []string{StateRunning, StateRetrying, StateRunning, StateFailed}
+	if !cmp.Equal(states, want) {
+		t.Errorf("Request was not tracked as expected. Want: %v, Recieved: %v", want, states)
+	}
+	scheduler.Outbox.mu.Lock()
+	delivery, ok := scheduler.Outbox.Deliveries["requestId"]
+	scheduler.Outbox.mu.Unlock()
+	if !ok || delivery.Payload.Status != CallbackFailed {
+		t.Errorf("Failed request was not reported to its callback url. Recieved: %v", delivery)
+	}
+}
+
+func TestApp_requeueHandlers(t *testing.T) {
+	mockRequest := func(requestId string, tenantId string, state string, age time.Duration) PendingRequest {
+		return PendingRequest{
+			Request:  Request{RequestId: requestId, Message: "taco", TenantId: tenantId},
+			Timing:   Timing{time.Now().Add(-age), 1},
+			State:    state,
+			Attempts: 10,
+			Add:      true,
+		}
+	}
+	tests := []struct {
+		name         string
+		target       string
+		apiKey       string
+		capacity     int
+		statusCode   int
+		bodyExpected string
+		wantQueued   []string
+		wantFailed   []string
+	}{
+		{
+			name:         "Requeue a failed request",
+			capacity:     1,
+			target:       "/admin/requests/a/requeue",
+			apiKey:       "admin-key",
+			statusCode:   200,
+			bodyExpected: `{"Body":"Request requeued.","RequestIds":["a"],"StatusCode":200}`,
+			wantQueued:   []string{"a"},
+		},
+		{
+			name:         "Requeue a request that has not failed",
+			capacity:     1,
+			target:       "/v1/admin/requests/c/requeue",
+			apiKey:       "admin-key",
+			statusCode:   409,
+			bodyExpected: `{"error":{"code":"not_requeueable","message":"Only requests that failed can be requeued."}}`,
+		},
+		{
+			name:         "Requeue a request of another tenant",
+			capacity:     1,
+			target:       "/admin/requests/a/requeue",
+			apiKey:       "acme-admin-key",
+			statusCode:   404,
+			bodyExpected: `{"Body":"The requestId is not recognized.","StatusCode":404}`,
+		},
+		{
+			name:         "Requeue every failed request, oldest first",
+			capacity:     2,
+			target:       "/v1/admin/requests/requeue",
+			apiKey:       "admin-key",
+			statusCode:   200,
+			bodyExpected: `{"data":{"requestIds":["b","a"]}}`,
+			wantQueued:   []string{"b", "a"},
+		},
+		{
+			name:         "Requeue the failed requests of a tenant",
+			capacity:     1,
+			target:       "/admin/requests/requeue",
+			apiKey:       "acme-admin-key",
+			statusCode:   200,
+			bodyExpected: `{"Body":"Requests requeued.","RequestIds":["b"],"StatusCode":200}`,
+			wantQueued:   []string{"b"},
+		},
+		{
+			name:         "Requeue a failed request with the queue full",
+			target:       "/admin/requests/a/requeue",
+			apiKey:       "admin-key",
+			capacity:     0,
+			statusCode:   503,
+			bodyExpected: `{"Body":"The request could not be requeued, server is at capacity. Please try again shortly.","StatusCode":503}`,
+			wantFailed:   []string{"a", "b"},
+		},
+		{
+			name:         "Requeue every failed request without capacity for them all",
+			target:       "/v1/admin/requests/requeue",
+			apiKey:       "admin-key",
+			capacity:     1,
+			statusCode:   503,
+			bodyExpected: `{"error":{"code":"queue_full","message":"The requests could not be requeued, server does not have capacity for every one of them. Please try again shortly or requeue fewer requests."}}`,
+			wantFailed:   []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Queue: NewFairQueue(tt.capacity, nil),
+				Track: make(chan PendingRequest, 2),
+				Requests: map[string]PendingRequest{
+					"a": mockRequest("a", "", StateFailed, 1*time.Minute),
+					"b": mockRequest("b", "acme", StateFailed, 2*time.Minute),
+					"c": mockRequest("c", "", StateRunning, 3*time.Minute),
+				},
+				APIKeys: &KeyStore{Clients: map[string]Client{
+					hashAPIKey("admin-key"):      {Id: "admin", Admin: true},
+					hashAPIKey("acme-admin-key"): {Id: "acmeAdmin", Admin: true, Tenant: "acme"},
+				}},
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest("POST", tt.target, nil)
+			req.Header.Set("X-API-Key", tt.apiKey)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; status != tt.statusCode {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if body := strings.TrimSpace(rr.Body.String()); !cmp.Equal(body, tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", body, tt.bodyExpected)
+			}
+			var queued []string
+			for application.Queue.Len() > 0 {
+				request, _ := application.Queue.Pop(context.Background())
+				queued = append(queued, request.RequestId)
+				if tracked := <-application.Track; tracked.RequestId != request.RequestId || tracked.State != StateQueued {
+					t.Errorf("Requeued request was not tracked as queued. Recieved: %v", tracked)
+				}
+			}
+			if !cmp.Equal(queued, tt.wantQueued) {
+				t.Errorf("Requeued the wrong requests. Want: %v, Recieved: %v", tt.wantQueued, queued)
+			}
+			// Requests that could not be requeued are left failed, to be requeued once there's capacity
+			for _, requestId := range tt.wantFailed {
+				if state := application.Requests[requestId].State; state != StateFailed {
+					t.Errorf("Request was not left failed. Recieved: %v", state)
+				}
+			}
+		})
+	}
+}
+
+func TestApp_requeueConcurrently(t *testing.T) {
+	tests := []struct {
+		name    string
+		targets []string
+	}{
+		{name: "Requeue a request twice", targets: []string{"/admin/requests/a/requeue", "/admin/requests/a/requeue"}},
+		{name: "Requeue a request alongside every request", targets: []string{"/admin/requests/a/requeue", "/admin/requests/requeue"}},
+		{name: "Requeue every request twice", targets: []string{"/admin/requests/requeue", "/admin/requests/requeue"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Queue: NewFairQueue(10, nil),
+				Track: make(chan PendingRequest, 10),
+				Requests: map[string]PendingRequest{
+					"a": {Request: Request{Message: "taco"}, Timing: Timing{time.Now(), 1}, State: StateFailed, Attempts: 10},
+				},
+				APIKeys: &KeyStore{Clients: map[string]Client{hashAPIKey("admin-key"): {Id: "admin", Admin: true}}},
+			}
+			router := NewRouter(&application)
+			var wg sync.WaitGroup
+			for _, target := range tt.targets {
+				wg.Add(1)
+				go func(target string) {
+					defer wg.Done()
+					req := httptest.NewRequest("POST", target, nil)
+					req.Header.Set("X-API-Key", "admin-key")
+					router.ServeHTTP(httptest.NewRecorder(), req)
+				}(target)
+			}
+			wg.Wait()
+			if length := application.Queue.Len(); length != 1 {
+				t.Errorf("Request was not queued exactly once. Recieved: %v", length)
+			}
+		})
+	}
+}
+
+func TestApp_failedRequestStatus(t *testing.T) {
+	application := Application{
+		Requests: map[string]PendingRequest{
+			"failed": {Request: Request{RequestId: "failed", Message: "taco"}, Timing: Timing{TimeAdded: time.Now()}, State: StateFailed, Attempts: 10, Add: true},
+		},
+	}
+	router := NewRouter(&application)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/requests/failed", nil))
+	bodyExpected := `{"error":{"code":"upstream_unavailable","message":"The signing service could not sign the request. It may be requeued once the service recovers, or please use the 'crypto/sign' endpoint to generate a new request."}}`
+	if rr.Code != 503 || strings.TrimSpace(rr.Body.String()) != bodyExpected {
+		t.Errorf("Handler returned unexpected response: got %v %v want %v %v", rr.Code, rr.Body.String(), 503, bodyExpected)
+	}
+}
@@ -0,0 +1,61 @@
+package app
+
+import (
+	"net/http"
+	"time"
+)
+
+// For mocking in tests
+var expirySweepInterval = 5 * time.Second
+
+// parseDeadline reads the time after which a submission is no longer worth signing, if it gave one at all. The
+// deadline must still be to come, and after the submission's notBefore time if it is scheduled
+func parseDeadline(deadline string, notBefore *time.Time, now time.Time) (*time.Time, *MessageError) {
+	parsed, err := parseTimestamp("deadline", deadline)
+	if err != nil || parsed == nil {
+		return nil, err
+	}
+	if !parsed.After(now) {
+		return nil, &MessageError{StatusCode: http.StatusBadRequest, Reason: "The deadline has already passed."}
+	}
+	if notBefore != nil && !parsed.After(*notBefore) {
+		return nil, &MessageError{StatusCode: http.StatusBadRequest, Reason: "The deadline must be after the notBefore time."}
+	}
+	return parsed, nil
+}
+
+// expired reports whether a request's deadline has passed
+func (request Request) expired(now time.Time) bool {
+	return request.Deadline != nil && !request.Deadline.After(now)
+}
+
+// isFinalState reports whether a tracked request has left the pipeline, signed or not, after which no progress
+// update can change its state
+func isFinalState(state string) bool {
+	return state == StateSigned || state == StateCancelled || state == StateExpired || state == StateFailed
+}
+
+// expireOverdue drops the queued requests whose deadline has passed, so they never take up an encryptor
+func (scheduler *EncryptorHandler) expireOverdue(now time.Time) {
+	for _, request := range scheduler.Queue.RemoveExpired(now) {
+		scheduler.expire(request, 0)
+	}
+}
+
+// expire reports a request whose deadline passed before it could be signed, to the tracker, event subscribers and
+// its callback url
+func (scheduler *EncryptorHandler) expire(request Request, attempts int) {
+	request.log().Debugf("Deadline passed for requestId: %v", request.RequestId)
+	if scheduler.Track != nil {
+		scheduler.Track <- PendingRequest{Request: Request{RequestId: request.RequestId}, State: StateExpired, Attempts: attempts, Add: true}
+	}
+	scheduler.Events.Publish(Event{RequestId: request.RequestId, State: EventExpired, Attempt: attempts, Timestamp: time.Now()})
+	if request.CallbackUrl != "" && scheduler.Outbox != nil {
+		scheduler.Outbox.Enqueue(request.CallbackUrl, requestScopedId(request), CallbackPayload{
+			RequestId: request.RequestId,
+			Status:    CallbackExpired,
+			Metadata:  scheduler.Metadata.Get(request.RequestId),
+			Timestamp: time.Now(),
+		})
+	}
+}
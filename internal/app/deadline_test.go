@@ -0,0 +1,207 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseDeadline(t *testing.T) {
+	now := time.Date(2030, 1, 2, 15, 0, 0, 0, time.UTC)
+	notBefore := time.Date(2030, 1, 2, 16, 0, 0, 0, time.UTC)
+	deadline := time.Date(2030, 1, 2, 17, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		deadline  string
+		notBefore *time.Time
+		want      *time.Time
+		wantErr   string
+	}{
+		{
+			name: "No deadline",
+		},
+		{
+			name:     "Deadline to come",
+			deadline: "2030-01-02T17:00:00Z",
+			want:     &deadline,
+		},
+		{
+			name:      "Deadline after notBefore",
+			deadline:  "2030-01-02T17:00:00Z",
+			notBefore: &notBefore,
+			want:      &deadline,
+		},
+		{
+			name:     "Not a timestamp",
+			deadline: "in an hour",
+			wantErr:  "The deadline must be an RFC 3339 timestamp, such as '2030-01-02T15:04:05Z'.",
+		},
+		{
+			name:     "Deadline passed",
+			deadline: "2030-01-02T15:00:00Z",
+			wantErr:  "The deadline has already passed.",
+		},
+		{
+			name:      "Deadline before notBefore",
+			deadline:  "2030-01-02T15:30:00Z",
+			notBefore: &notBefore,
+			wantErr:   "The deadline must be after the notBefore time.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDeadline(tt.deadline, tt.notBefore, now)
+			if err != nil && err.Error() != tt.wantErr || err == nil && tt.wantErr != "" {
+				t.Errorf("Unexpected error. Want: %v, Recieved: %v", tt.wantErr, err)
+			}
+			if !cmp.Equal(got, tt.want) {
+				t.Errorf("Deadline not parsed as expected. Want: %v, Recieved: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestApp_deadlineSubmission(t *testing.T) {
+	application := Application{
+		Queue:    NewFairQueue(2, nil),
+		Track:    make(chan PendingRequest, 2),
+		Requests: make(map[string]PendingRequest),
+		Batches:  &BatchStore{Batches: make(map[string]Batch)},
+	}
+	router := NewRouter(&application)
+	requests := []*httptest.ResponseRecorder{httptest.NewRecorder(), httptest.NewRecorder()}
+	router.ServeHTTP(requests[0], httptest.NewRequest("GET", "/crypto/sign?message=taco&wait=0&deadline=2030-01-02T15:04:05Z", nil))
+	req := httptest.NewRequest("POST", "/v1/batches", strings.NewReader(`{"messages":["chicken"],"deadline":"2030-01-02T15:04:05Z"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(requests[1], req)
+	for _, rr := range requests {
+		if rr.Code != 202 {
+			t.Errorf("Handler returned wrong status code: got %v want %v", rr.Code, 202)
+		}
+	}
+	want := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		request, _ := application.Queue.Pop(context.Background())
+		if request.Deadline == nil || !request.Deadline.Equal(want) {
+			t.Errorf("Request was queued without its deadline. Want: %v, Recieved: %v", want, request.Deadline)
+		}
+	}
+	rr := httptest.NewRecorder()
+	req = httptest.NewRequest("POST", "/v1/requests", strings.NewReader(`{"message":"taco","deadline":"2020-01-02T15:04:05Z"}`))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(rr, req)
+	bodyExpected := `{"error":{"code":"invalid_request","message":"The deadline has already passed."}}`
+	if rr.Code != 400 || !strings.Contains(rr.Body.String(), bodyExpected) {
+		t.Errorf("Handler accepted a passed deadline: got %v %v want %v %v", rr.Code, rr.Body.String(), 400, bodyExpected)
+	}
+}
+
+func TestApp_expiredRequest(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		statusCode   int
+		bodyExpected string
+	}{
+		{
+			name:         "Status of an expired request",
+			method:       "GET",
+			target:       "/v1/requests/expired",
+			statusCode:   410,
+			bodyExpected: `{"error":{"code":"request_expired","message":"The deadline of the request passed before it could be signed. Please use the 'crypto/sign' endpoint to generate a new request."}}`,
+		},
+		{
+			name:         "Cancelling an expired request",
+			method:       "DELETE",
+			target:       "/crypto/sign/request/expired",
+			statusCode:   410,
+			bodyExpected: `{"Body":"The deadline of the request passed before it could be signed, so there is nothing left to cancel.","StatusCode":410}`,
+		},
+		{
+			name:         "Batch with an expired request",
+			method:       "GET",
+			target:       "/v1/batches/batch",
+			statusCode:   200,
+			bodyExpected: `"pending":0,"signed":0,"cancelled":0,"expired":1,"failed":0,"unknown":0,"timeEstimate":0,"items":[{"requestId":"expired","status":"expired"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Track: make(chan PendingRequest, 1),
+				Requests: map[string]PendingRequest{
+					"expired": {Request: Request{RequestId: "expired", Message: "taco"}, Timing: Timing{TimeAdded: time.Now()}, State: StateExpired, Add: true},
+				},
+				Batches: &BatchStore{Batches: map[string]Batch{"batch": {BatchId: "batch", RequestIds: []string{"expired"}}}},
+			}
+			router := NewRouter(&application)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.target, nil))
+			if status := rr.Code; status != tt.statusCode {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
+			}
+		})
+	}
+}
+
+func TestEncryptorHandler_HandleEncryptRequestsExpires(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	scheduler := EncryptorHandler{
+		Queue:         NewFairQueue(1, nil),
+		Store:         make(chan SignedRequest),
+		Encryptors:    make(chan struct{}),
+		Track:         make(chan PendingRequest, 1),
+		Cancellations: NewCanceller(),
+		Outbox:        &Outbox{Deliveries: make(map[string]CallbackDelivery)},
+	}
+	scheduler.Queue.Push(Request{RequestId: "requestId", Message: "message", CallbackUrl: "http://localhost/callback", Deadline: &past})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = scheduler.HandleEncryptRequests(ctx)
+	}()
+	// No encryptors are available, so the handler can only move past the request by expiring it
+	select {
+	case tracked := <-scheduler.Track:
+		want := PendingRequest{Request: Request{RequestId: "requestId"}, State: StateExpired, Add: true}
+		if !cmp.Equal(tracked, want) {
+			t.Errorf("Request was not tracked as expired. Want: %v, Recieved: %v", want, tracked)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected request past its deadline to be expired")
+	}
+	scheduler.Outbox.mu.Lock()
+	delivery, ok := scheduler.Outbox.Deliveries["requestId"]
+	scheduler.Outbox.mu.Unlock()
+	if !ok || delivery.Payload.Status != CallbackExpired {
+		t.Errorf("Expired request was not reported to its callback url. Recieved: %v", delivery)
+	}
+}
+
+func TestEncryptorHandler_expireOverdue(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	scheduler := EncryptorHandler{
+		Queue: NewFairQueue(2, nil),
+		Track: make(chan PendingRequest, 2),
+	}
+	scheduler.Queue.PushAll([]Request{{RequestId: "cancelled", Deadline: &past}, {RequestId: "expired", Deadline: &past}})
+	scheduler.Queue.Remove("cancelled")
+	scheduler.expireOverdue(time.Now())
+	if scheduler.Queue.Len() != 0 {
+		t.Errorf("Overdue requests were left in the queue. Length: %v", scheduler.Queue.Len())
+	}
+	if tracked := <-scheduler.Track; tracked.RequestId != "expired" || tracked.State != StateExpired {
+		t.Errorf("Overdue request was not tracked as expired. Recieved: %v", tracked)
+	}
+	if len(scheduler.Track) != 0 {
+		t.Errorf("Cancelled request was reported as expired")
+	}
+}
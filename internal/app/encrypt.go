@@ -6,36 +6,112 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"time"
+)
 
-	"github.com/sirupsen/logrus"
+// For mocking in tests
+var (
+	signingServiceUrl = "https://hiring.api.synthesia.io/crypto/sign"
+	encryptRetryDelay = 1 * time.Minute
 )
 
 // Encrypt Handler object holds connections for a stream of requests for encryption,
 // connection to storage, and a set of available encrypt workers
 type EncryptorHandler struct {
-	Encrypt    chan Request
+	Queue      *FairQueue
 	Store      chan SignedRequest
 	Encryptors chan struct{}
+	Events     *EventBroker
+	Track      chan PendingRequest
+	// Cancellations is consulted as requests leave the queue, so cancelled requests are never encrypted
+	Cancellations *Canceller
+	// Outbox and Metadata are used to report requests whose deadline passed, or that failed, to their callback url
+	Outbox   *Outbox
+	Metadata *MetadataStore
+	// Control pauses the handler, holding requests back from the upstream service while paused
+	Control *QueueControl
+	// MaxAttempts is the number of upstream attempts made before a request is dead-lettered,
+	// DefaultMaxEncryptAttempts when unset
+	MaxAttempts int
+	// Metrics counts the upstream calls, retries and encryptors in use
+	Metrics *Metrics
+	// Tracer times the wait for an encryptor and each upstream attempt as spans, which is disabled when unset
+	Tracer *Tracer
 }
 
-// HandleEncryptRequests forever listens for a request, and when found waits for a worker
-// to be availavle and assigns the task
+// HandleEncryptRequests forever takes the next request due from the encrypt queue, and when found waits for a worker
+// to be availavle and assigns the task. No tasks are assigned while the handler is paused. Requests whose deadline
+// passes before they get a worker are expired instead, and while they wait the rest of the queue is regularly swept
+// for such requests
 func (scheduler *EncryptorHandler) HandleEncryptRequests(ctx context.Context) error {
+	sweep := time.NewTicker(expirySweepInterval)
+	defer sweep.Stop()
+Requests:
 	for {
-		select {
-		case <-ctx.Done():
+		queued, ok := scheduler.Queue.pop(ctx, scheduler.Cancellations.Take)
+		if !ok {
 			return nil
-		default:
-			request := <-scheduler.Encrypt
-			<-scheduler.Encryptors
-			go encryptorParent(scheduler, request)
 		}
+		request := queued.Request
+		requestCtx, ok := scheduler.Cancellations.Start(ctx, request.RequestId)
+		if !ok {
+			request.log().Debugf("Skipping cancelled requestId: %v", request.RequestId)
+			continue
+		}
+		for !request.expired(time.Now()) {
+			// Workers aren't taken until the handler is resumed
+			encryptors := scheduler.Encryptors
+			resumed := scheduler.Control.waitResumed()
+			if resumed != nil {
+				encryptors = nil
+			}
+			select {
+			case <-ctx.Done():
+				scheduler.Cancellations.Finish(request.RequestId)
+				return nil
+			case <-requestCtx.Done():
+				request.log().Debugf("Skipping requestId cancelled while waiting for an encryptor: %v", request.RequestId)
+				scheduler.Cancellations.Finish(request.RequestId)
+				continue Requests
+			case <-sweep.C:
+				scheduler.expireOverdue(time.Now())
+			case <-resumed:
+			case <-encryptors:
+				scheduler.traceQueueWait(queued, "assigned")
+				go encryptorParent(requestCtx, scheduler, request)
+				continue Requests
+			}
+		}
+		scheduler.Cancellations.Finish(request.RequestId)
+		scheduler.traceQueueWait(queued, "expired")
+		scheduler.expire(request, 0)
 	}
 }
 
-// encryptor handles calling the encryption service and reporting the results. If successful, persist to storage
-func encryptor(scheduler *EncryptorHandler, request Request) error {
+// traceQueueWait records the time a request waited from being queued until it was assigned an encryptor, or expired
+func (scheduler *EncryptorHandler) traceQueueWait(queued queuedRequest, outcome string) {
+	parent, _ := parseTraceparent(queued.Traceparent)
+	span := scheduler.Tracer.Start(parent, "queue wait", SpanKindInternal, queued.queued)
+	span.SetAttribute("request.id", queued.RequestId)
+	span.SetAttribute("request.priority", requestPriority(queued.Request))
+	span.SetAttribute("queue.outcome", outcome)
+	span.End()
+}
+
+// encryptor handles calling the encryption service and reporting the results. If successful, persist to storage.
+// Reports whether the call was made, which it isn't once the request's context is done. The attempt is traced as a
+// span, whose context is passed upstream in the traceparent header
+func encryptor(ctx context.Context, scheduler *EncryptorHandler, request Request, attempt int) (called bool, err error) {
+	span := scheduler.Tracer.StartFrom(request.Traceparent, "upstream attempt", SpanKindClient)
+	span.SetAttribute("request.id", request.RequestId)
+	span.SetAttribute("attempt", attempt)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+
 	// SSL Certs seem expired for synthesias endpoint
 	transport := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
@@ -45,61 +121,159 @@ func encryptor(scheduler *EncryptorHandler, request Request) error {
 		Timeout:   1 * time.Minute,
 	}
 
-	req, err := http.NewRequest("GET", "https://hiring.api.synthesia.io/crypto/sign?message="+request.Message, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", signingServiceUrl+"?message="+url.QueryEscape(request.Message), nil)
 	if err != nil {
-		logrus.Errorf("Error forming HTTP request. Details %v", err.Error())
-		return err
+		request.log().Errorf("Error forming HTTP request. Details %v", err.Error())
+		return false, err
 	}
 
 	req.Header.Set("Authorization", "d553641c25b216da081629334a9e6fb8")
+	if traceparent := span.Context().Traceparent(); traceparent != "" {
+		req.Header.Set("traceparent", traceparent)
+	}
 
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
 	resp, err := client.Do(req)
 	if err != nil {
-		logrus.Errorf("Error response from HTTP request. Details %v", err.Error())
-		return err
+		scheduler.Metrics.ObserveUpstreamCall(request, "error")
+		request.log().Errorf("Error response from HTTP request. Details %v", err.Error())
+		return true, err
 	}
 	defer resp.Body.Close()
+	scheduler.Metrics.ObserveUpstreamCall(request, strconv.Itoa(resp.StatusCode))
+	span.SetAttribute("http.status_code", resp.StatusCode)
 
 	if resp.StatusCode != http.StatusOK {
-		logrus.Debugf("Did not recieve a OK response from HTTP request for requestId: %v. Response code: %v", request.RequestId, resp.StatusCode)
-		return errors.New("Did not recieve a OK response from HTTP request")
+		request.log().Debugf("Did not recieve a OK response from HTTP request for requestId: %v. Response code: %v", request.RequestId, resp.StatusCode)
+		return true, errors.New("Did not recieve a OK response from HTTP request")
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		logrus.Errorf("Failed to read response body for requestId: %v. Details %v", request.RequestId, err.Error())
-		return errors.New("Failed to read response body.")
+		request.log().Errorf("Failed to read response body for requestId: %v. Details %v", request.RequestId, err.Error())
+		return true, errors.New("Failed to read response body.")
 	}
 
+	if ctx.Err() != nil {
+		return true, ctx.Err()
+	}
 	signature := string(body)
-	SignedRequest := SignedRequest{RequestId: request.RequestId, Signature: signature, Add: true}
+	SignedRequest := SignedRequest{
+		RequestId:     request.RequestId,
+		Signature:     signature,
+		Add:           true,
+		CallbackUrl:   request.CallbackUrl,
+		ClientId:      request.ClientId,
+		TenantId:      request.TenantId,
+		Traceparent:   request.Traceparent,
+		CorrelationId: request.CorrelationId,
+	}
 	scheduler.Store <- SignedRequest
-	return nil
+	return true, nil
+}
+
+// encryptorResult is the outcome of an attempt, and whether it was sent upstream
+type encryptorResult struct {
+	called bool
+	err    error
 }
 
-// encryptorParent creates a child routine to handle the encryption and monitors and handles failure(s)
-func encryptorParent(scheduler *EncryptorHandler, request Request) {
-	encryptorErrors := make(chan error, 1)
+// encryptorParent creates a child routine to handle the encryption and monitors and handles failure(s).
+// Retries stop as soon as the request's context is cancelled, or its deadline passes, and wait while the handler is
+// paused. The request is dead-lettered once the attempts allowed have all failed
+func encryptorParent(ctx context.Context, scheduler *EncryptorHandler, request Request) {
+	defer scheduler.Cancellations.Finish(request.RequestId)
+	scheduler.Metrics.StartEncryption()
+	defer scheduler.Metrics.FinishEncryption()
+	if request.Deadline != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, *request.Deadline)
+		defer cancel()
+	}
+	// The worker is held for a minute after each upstream call, keeping within the upstream rate limit. Attempts
+	// stopped before they were sent upstream don't count as calls
+	var lastCall time.Time
+	releaseEncryptor := func() {
+		time.Sleep(time.Until(lastCall.Add(1 * time.Minute)))
+		scheduler.Encryptors <- struct{}{}
+	}
+	attempt := 1
+	stop := func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			scheduler.expire(request, attempt)
+		} else {
+			request.log().Debugf("Encryption cancelled for requestId: %v", request.RequestId)
+		}
+		releaseEncryptor()
+	}
+	scheduler.trackProgress(request, StateRunning, attempt)
+	scheduler.Events.Publish(Event{RequestId: request.RequestId, State: EventAttempt, Attempt: attempt})
+	encryptorResults := make(chan encryptorResult, 1)
 	go func() {
-		encryptorErrors <- encryptor(scheduler, request)
+		called, err := encryptor(ctx, scheduler, request, attempt)
+		encryptorResults <- encryptorResult{called: called, err: err}
 	}()
 	for {
-		encryptorError := <-encryptorErrors
+		result := <-encryptorResults
+		encryptorError := result.err
+		if result.called {
+			lastCall = time.Now()
+		}
+		// A signature that was stored is kept, even if the request was stopped in the meantime
+		if encryptorError != nil && ctx.Err() != nil {
+			stop()
+			return
+		}
+		if encryptorError != nil && attempt >= scheduler.maxAttempts() {
+			scheduler.deadLetter(request, attempt, encryptorError)
+			releaseEncryptor()
+			return
+		}
 		if encryptorError != nil {
-			logrus.Debug("Encryptor failed to sign request, will try again...")
-			time.Sleep(1 * time.Minute)
+			request.log().Debug("Encryptor failed to sign request, will try again...")
+			scheduler.Metrics.ObserveRetry(request)
+			scheduler.trackProgress(request, StateRetrying, attempt)
+			scheduler.Events.Publish(Event{RequestId: request.RequestId, State: EventRetrying, Attempt: attempt, Detail: encryptorError.Error()})
+			select {
+			case <-time.After(encryptRetryDelay):
+			case <-ctx.Done():
+				stop()
+				return
+			}
+			if resumed := scheduler.Control.waitResumed(); resumed != nil {
+				request.log().Debugf("Holding retry of requestId until the encryptor handler is resumed: %v", request.RequestId)
+				select {
+				case <-resumed:
+				case <-ctx.Done():
+					stop()
+					return
+				}
+			}
+			attempt++
+			scheduler.trackProgress(request, StateRunning, attempt)
+			scheduler.Events.Publish(Event{RequestId: request.RequestId, State: EventAttempt, Attempt: attempt})
 			go func() {
-				encryptorErrors <- encryptor(scheduler, request)
+				called, err := encryptor(ctx, scheduler, request, attempt)
+				encryptorResults <- encryptorResult{called: called, err: err}
 			}()
 		} else {
-			logrus.Debugf("Signature Successful for requestId: %v", request.RequestId)
-			time.Sleep(1 * time.Minute)
-			scheduler.Encryptors <- struct{}{}
+			request.log().Debugf("Signature Successful for requestId: %v", request.RequestId)
+			releaseEncryptor()
 			break
 		}
 	}
 }
 
+// trackProgress tells the tracker about the state and attempts of a request being encrypted
+func (scheduler *EncryptorHandler) trackProgress(request Request, state string, attempts int) {
+	if scheduler.Track == nil {
+		return
+	}
+	scheduler.Track <- PendingRequest{Request: Request{RequestId: request.RequestId}, State: state, Attempts: attempts, Add: true}
+}
+
 // InstantiateEncryptors starts our set of encyptors with the max number of workers
 // akin to the load capability our downstream service can handle
 func InstantiateEncryptors(maxNumberOfEncryptors int, encryptors chan struct{}) {
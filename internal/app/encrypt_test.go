@@ -3,6 +3,7 @@ package app
 import (
 	"context"
 	"testing"
+	"time"
 )
 
 func TestInstantiateEncryptors(t *testing.T) {
@@ -40,7 +41,7 @@ func TestEncryptorHandler_HandleEncryptRequests(t *testing.T) {
 	}{
 		{
 			name:      "Successful Context Cancellation",
-			scheduler: EncryptorHandler{Encrypt: make(chan Request), Store: make(chan SignedRequest), Encryptors: make(chan struct{})},
+			scheduler: EncryptorHandler{Queue: NewFairQueue(0, nil), Store: make(chan SignedRequest), Encryptors: make(chan struct{})},
 			want:      nil,
 		},
 	}
@@ -59,3 +60,26 @@ func TestEncryptorHandler_HandleEncryptRequests(t *testing.T) {
 		})
 	}
 }
+
+func TestEncryptorParent_cancelledBeforeCall(t *testing.T) {
+	scheduler := EncryptorHandler{
+		Encryptors:    make(chan struct{}, 1),
+		Cancellations: NewCanceller(),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		encryptorParent(ctx, &scheduler, Request{RequestId: "requestId", Message: "message"})
+		close(done)
+	}()
+	// Nothing was sent upstream, so the encryptor is released without waiting out the rate limit
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected encryptor to be released straight away")
+	}
+	if len(scheduler.Encryptors) != 1 {
+		t.Errorf("Encryptor was not released")
+	}
+}
@@ -0,0 +1,214 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Request states reported as events while a request moves through the pipeline
+const (
+	EventQueued    = "queued"
+	EventAttempt   = "attempt"
+	EventRetrying  = "retrying"
+	EventSigned    = "signed"
+	EventCancelled = "cancelled"
+	EventExpired   = "expired"
+	EventFailed    = "failed"
+)
+
+// eventBufferSize is the number of events held for a slow subscriber before further events are dropped
+const eventBufferSize = 64
+
+// eventKeepAliveInterval is how often a comment is written to idle streams, so proxies don't close them
+const eventKeepAliveInterval = 15 * time.Second
+
+// Event describes a state transition of a request
+type Event struct {
+	Sequence  uint64
+	RequestId string
+	State     string
+	Attempt   int    `json:",omitempty"`
+	Detail    string `json:",omitempty"`
+	Timestamp time.Time
+}
+
+// EventBroker fans out published events to subscribers. Subscribers either follow a single request, or every request
+type EventBroker struct {
+	mu          sync.Mutex
+	sequence    uint64
+	subscribers map[*EventSubscription]struct{}
+}
+
+// EventSubscription receives the events for a single request, or every request when RequestId is empty
+type EventSubscription struct {
+	RequestId string
+	Events    chan Event
+}
+
+// NewEventBroker creates a broker without any subscribers
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[*EventSubscription]struct{})}
+}
+
+// Publish sends an event to every interested subscriber. Events are dropped for subscribers that are not keeping up,
+// rather than holding up the pipeline
+func (broker *EventBroker) Publish(event Event) {
+	if broker == nil {
+		return
+	}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.sequence++
+	event.Sequence = broker.sequence
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	for subscription := range broker.subscribers {
+		if subscription.RequestId != "" && subscription.RequestId != event.RequestId {
+			continue
+		}
+		select {
+		case subscription.Events <- event:
+		default:
+			logrus.Debugf("Event subscriber is not keeping up, dropping event %v for requestId: %v", event.Sequence, event.RequestId)
+		}
+	}
+}
+
+// Subscribe registers interest in the events of a request, or of every request when requestId is empty
+func (broker *EventBroker) Subscribe(requestId string) *EventSubscription {
+	subscription := &EventSubscription{RequestId: requestId, Events: make(chan Event, eventBufferSize)}
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	broker.subscribers[subscription] = struct{}{}
+	return subscription
+}
+
+// Unsubscribe stops events being sent to a subscription
+func (broker *EventBroker) Unsubscribe(subscription *EventSubscription) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	delete(broker.subscribers, subscription)
+}
+
+// requestEventsHandler streams the state transitions of a request to the /crypto/sign/request/{requestId}/events
+// endpoint as Server-Sent Events, closing the stream once the request is signed, cancelled, expired or failed
+func (application *Application) requestEventsHandler(w http.ResponseWriter, r *http.Request) {
+	requestId := pathVar(r, "requestId")
+	if !application.checkRequestTenant(w, r, requestId) {
+		return
+	}
+	// Subscribe before looking at the current state, so no transition can slip by in between
+	subscription := application.Events.Subscribe(requestId)
+	defer application.Events.Unsubscribe(subscription)
+
+	var current Event
+	if _, ok := application.lookupSignature(requestId); ok {
+		current = Event{RequestId: requestId, State: EventSigned, Timestamp: time.Now()}
+	} else if request, ok := application.lookupRequest(requestId); ok && request.State == StateCancelled {
+		current = Event{RequestId: requestId, State: EventCancelled, Timestamp: time.Now()}
+	} else if ok && request.State == StateExpired {
+		current = Event{RequestId: requestId, State: EventExpired, Timestamp: time.Now()}
+	} else if ok && request.State == StateFailed {
+		current = Event{RequestId: requestId, State: EventFailed, Attempt: request.Attempts, Timestamp: time.Now()}
+	} else if ok {
+		current = Event{RequestId: requestId, State: EventQueued, Timestamp: request.TimeAdded}
+	} else {
+		logFromRequest(r).Debugf("Request id invalid")
+		writeDenied(w, http.StatusNotFound, ErrorNotFound, "The requestId is not recognized. Please use the 'crypto/sign' endpoint to generate a new request.")
+		return
+	}
+	streamEvents(w, r, subscription, &current, nil)
+}
+
+// eventsHandler streams the state transitions of every request to the /admin/events endpoint as Server-Sent Events
+func (application *Application) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	subscription := application.Events.Subscribe("")
+	defer application.Events.Unsubscribe(subscription)
+	var include func(Event) bool
+	if tenant, scoped := adminTenant(r); scoped {
+		include = func(event Event) bool {
+			return application.trackedTenant(event.RequestId) == tenant
+		}
+	}
+	streamEvents(w, r, subscription, nil, include)
+}
+
+// streamEvents writes events from a subscription until the client disconnects, or the followed request is complete.
+// An optional initial event describing the current state is written first, and an optional filter leaves out the
+// events it doesn't include
+func streamEvents(w http.ResponseWriter, r *http.Request, subscription *EventSubscription, initial *Event, include func(Event) bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logFromRequest(r).Errorf("Response writer does not support streaming, unable to send events")
+		writeDenied(w, http.StatusInternalServerError, ErrorInternal, "Streaming is not supported.")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	if initial != nil {
+		if err := writeEvent(w, *initial); err != nil || isFinalEvent(subscription, *initial) {
+			flusher.Flush()
+			return
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case event := <-subscription.Events:
+			if include != nil && !include(event) {
+				continue
+			}
+			if err := writeEvent(w, event); err != nil {
+				logFromRequest(r).Debugf("Unable to write event, closing stream. Details: %v", err.Error())
+				return
+			}
+			flusher.Flush()
+			if isFinalEvent(subscription, event) {
+				return
+			}
+		}
+	}
+}
+
+// isFinalEvent reports whether an event ends a stream following a single request
+func isFinalEvent(subscription *EventSubscription, event Event) bool {
+	return subscription.RequestId != "" && (event.State == EventSigned || event.State == EventCancelled || event.State == EventExpired || event.State == EventFailed)
+}
+
+// writeEvent writes an event in the Server-Sent Events format
+func writeEvent(w http.ResponseWriter, event Event) error {
+	var payload interface{} = event
+	if isV1(w) {
+		payload = event.v1Data()
+	}
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if event.Sequence != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", event.Sequence); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.State, data)
+	return err
+}
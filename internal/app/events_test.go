@@ -0,0 +1,166 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEventBroker_Publish(t *testing.T) {
+	broker := NewEventBroker()
+	single := broker.Subscribe("requestId")
+	firehose := broker.Subscribe("")
+	unsubscribed := broker.Subscribe("requestId")
+	broker.Unsubscribe(unsubscribed)
+
+	broker.Publish(Event{RequestId: "requestId", State: EventQueued})
+	broker.Publish(Event{RequestId: "otherRequestId", State: EventQueued})
+
+	if got := len(single.Events); got != 1 {
+		t.Errorf("Single request subscriber received unexpected number of events. Wanted: 1, Got: %v", got)
+	}
+	if got := len(firehose.Events); got != 2 {
+		t.Errorf("Firehose subscriber received unexpected number of events. Wanted: 2, Got: %v", got)
+	}
+	if got := len(unsubscribed.Events); got != 0 {
+		t.Errorf("Unsubscribed subscriber received unexpected number of events. Wanted: 0, Got: %v", got)
+	}
+	first, second := <-firehose.Events, <-firehose.Events
+	if first.Sequence >= second.Sequence {
+		t.Errorf("Expected event sequence numbers to increase. Got: %v then %v", first.Sequence, second.Sequence)
+	}
+	if first.Timestamp.IsZero() {
+		t.Error("Expected published event to be timestamped")
+	}
+}
+
+func TestApp_requestEventsHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		signatures   map[string]string
+		requests     map[string]PendingRequest
+		publish      []Event
+		statusCode   int
+		wantStates   []string
+		wantNotFound bool
+	}{
+		{
+			name:       "Signed request ends stream immediately",
+			signatures: map[string]string{"requestId": "signature"},
+			requests:   make(map[string]PendingRequest),
+			statusCode: 200,
+			wantStates: []string{EventSigned},
+		},
+		{
+			name:       "Pending request streams until signed",
+			signatures: make(map[string]string),
+			requests:   map[string]PendingRequest{"requestId": {Request: Request{RequestId: "requestId"}, Timing: Timing{time.Now(), 1}, Add: true}},
+			publish: []Event{
+				{RequestId: "otherRequestId", State: EventAttempt, Attempt: 1},
+				{RequestId: "requestId", State: EventAttempt, Attempt: 1},
+				{RequestId: "requestId", State: EventRetrying, Attempt: 1},
+				{RequestId: "requestId", State: EventAttempt, Attempt: 2},
+				{RequestId: "requestId", State: EventSigned},
+			},
+			statusCode: 200,
+			wantStates: []string{EventQueued, EventAttempt, EventRetrying, EventAttempt, EventSigned},
+		},
+		{
+			name:         "Unknown request",
+			signatures:   make(map[string]string),
+			requests:     make(map[string]PendingRequest),
+			statusCode:   404,
+			wantNotFound: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{Signatures: tt.signatures, Requests: tt.requests, Events: NewEventBroker()}
+			router := NewRouter(&application)
+			req := httptest.NewRequest("GET", "/crypto/sign/request/requestId/events", nil)
+			rr := httptest.NewRecorder()
+			done := make(chan struct{})
+			go func() {
+				router.ServeHTTP(rr, req)
+				close(done)
+			}()
+			if len(tt.publish) > 0 {
+				waitForSubscribers(t, application.Events, 1)
+				for _, event := range tt.publish {
+					application.Events.Publish(event)
+				}
+			}
+			select {
+			case <-done:
+			case <-time.After(2 * time.Second):
+				t.Fatal("Event stream did not end in time")
+			}
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if tt.wantNotFound {
+				return
+			}
+			if got := rr.Header().Get("Content-Type"); got != "text/event-stream" {
+				t.Errorf("Unexpected Content-Type. Wanted: text/event-stream, Got: %v", got)
+			}
+			var states []string
+			for _, line := range strings.Split(rr.Body.String(), "\n") {
+				if strings.HasPrefix(line, "event: ") {
+					states = append(states, strings.TrimPrefix(line, "event: "))
+				}
+			}
+			if !cmp.Equal(states, tt.wantStates) {
+				t.Errorf("Streamed events not as expected. Wanted: %v, Got: %v", tt.wantStates, states)
+			}
+		})
+	}
+}
+
+func TestApp_eventsHandler(t *testing.T) {
+	application := Application{Events: NewEventBroker(), AdminToken: "token"}
+	router := NewRouter(&application)
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/admin/events", nil).WithContext(ctx)
+	req.Header.Set("Authorization", "Bearer token")
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(rr, req)
+		close(done)
+	}()
+	waitForSubscribers(t, application.Events, 1)
+	application.Events.Publish(Event{RequestId: "requestId", State: EventSigned})
+	application.Events.Publish(Event{RequestId: "otherRequestId", State: EventQueued})
+	// Give the stream a moment to write the events before disconnecting
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, `"RequestId":"requestId"`) || !strings.Contains(body, `"RequestId":"otherRequestId"`) {
+		t.Errorf("Expected firehose to stream events of every request. Got: %v", body)
+	}
+}
+
+// waitForSubscribers blocks until a broker has the given number of subscribers
+func waitForSubscribers(t *testing.T, broker *EventBroker, want int) {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		broker.mu.Lock()
+		got := len(broker.subscribers)
+		broker.mu.Unlock()
+		if got == want {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %v event subscribers", want)
+}
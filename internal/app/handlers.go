@@ -5,24 +5,29 @@ import (
 	"net/http"
 	"time"
 
-	"github.com/cenkalti/backoff"
 	"github.com/google/uuid"
-	"github.com/gorilla/mux"
 	"github.com/sirupsen/logrus"
 )
 
 // RequestFulfilled represents a 200 response body
 type RequestFulfilled struct {
-	Body       string
+	Body string
+	// RequestId is only reported by the /v1 API, the legacy body predates it
+	RequestId  string `json:"-"`
 	Signature  string
+	Metadata   map[string]string `json:",omitempty"`
 	StatusCode int
 }
 
 // RequestFulfilled represents a 202 response body
 type RequestProcessing struct {
-	Body         string
-	RequestId    string
+	Body      string
+	RequestId string
+	// State and NotBefore are only reported for scheduled requests
+	State        string     `json:",omitempty"`
+	NotBefore    *time.Time `json:",omitempty"`
 	TimeEstimate float64
+	Metadata     map[string]string `json:",omitempty"`
 	StatusCode   int
 }
 
@@ -30,6 +35,8 @@ type RequestProcessing struct {
 type RequestDenied struct {
 	Body       string
 	StatusCode int
+	// Code is the machine-readable error code, only reported by the /v1 API
+	Code string `json:"-"`
 }
 
 // RequestFulfilled represents a 200 response body for health check
@@ -43,103 +50,180 @@ var generateUUID = uuid.New
 
 // healthHandler react to calls to the /health endpoint
 func (application *Application) healthHandler(w http.ResponseWriter, r *http.Request) {
-	logrus.Debugf("Handling Health Check")
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	healthRequest := HealthRequest{Body: "Server is running", StatusCode: http.StatusOK}
-	resp, err := json.Marshal(healthRequest)
-	if err != nil {
-		logrus.Errorf("Unable to marshal response body. Details: %v", err.Error())
-	} else {
-		_, err := w.Write(resp)
-		if err != nil {
-			writeErrorResponse(w)
-		}
-	}
+	logFromRequest(r).Debugf("Handling Health Check")
+	writeResponse(w, http.StatusOK, HealthRequest{Body: "Server is running", StatusCode: http.StatusOK})
 }
 
-// newRequestHandler handles calls to the /crypto/sign?message=<> endpoint with new encryption requests
+// newRequestHandler handles calls to the /crypto/sign endpoint with new encryption requests. The message is
+// read from the 'message' query parameter on GET, or from a JSON or plain text body on POST. The signature is
+// returned if it arrives within the 'wait' parameter, or DefaultSignatureWait. Submissions repeating an
+// Idempotency-Key report on the original request instead of enqueuing the message again
 func (application *Application) newRequestHandler(w http.ResponseWriter, r *http.Request) {
-	// Generate unique id for the request
-	requestId := generateUUID().String()
 	// Retrieve message and submit it for encryption, if possible
-	queryItems := r.URL.Query()
-	message := queryItems.Get("message")
-	request := Request{RequestId: requestId, Message: message}
-	select {
-	case application.Encrypt <- request:
-		logrus.Debugf("Encryption queue accepted the request")
-		timing := application.GetEncryptionTiming(time.Now())
-		application.Track <- PendingRequest{Request: request, Timing: timing, Add: true}
-		signature, err := retrieveSignature(application, requestId)
-		if err != nil {
-			logrus.Debugf("Request not processed in time, but was recieved successfully")
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusAccepted)
-			requestProcessing := RequestProcessing{
-				Body:         "Request Recieved. Please check back according to the time estimate (minutes).",
-				RequestId:    requestId,
-				TimeEstimate: timing.TimeEstimate,
-				StatusCode:   http.StatusAccepted,
-			}
-			resp, err := json.Marshal(requestProcessing)
-			if err != nil {
-				logrus.Errorf("Unable to marshal response body. Details: %v", err.Error())
-			} else {
-				_, err := w.Write(resp)
-				if err != nil {
-					writeErrorResponse(w)
-				}
-			}
-		} else {
-			logrus.Debugf("Request processed in time, returning signature")
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			requestFulfilled := RequestFulfilled{
-				Body:       "Request processed successfully!",
-				Signature:  signature,
-				StatusCode: http.StatusOK,
+	messageBody, err := readMessage(r, application.maxMessageBytes())
+	if err == nil {
+		err = application.checkDraining()
+	}
+	if err == nil {
+		err = application.validateCallback(messageBody.CallbackUrl, scopedClientFromRequest(r))
+	}
+	wait := DefaultSignatureWait
+	if err == nil {
+		wait, err = readWait(r, DefaultSignatureWait, application.maxWait())
+	}
+	idempotencyKey := ""
+	if err == nil {
+		idempotencyKey, err = readIdempotencyKey(r)
+	}
+	if err == nil {
+		err = validateRequestDetails(messageBody)
+	}
+	if err == nil {
+		err = application.checkPriority(r, messageBody.Priority)
+	}
+	var notBefore, deadline *time.Time
+	if err == nil {
+		notBefore, err = parseNotBefore(messageBody.NotBefore)
+	}
+	if err == nil {
+		deadline, err = parseDeadline(messageBody.Deadline, notBefore, time.Now())
+	}
+	if err != nil {
+		logFromRequest(r).Debugf("Unable to read message from request. Details: %v", err.Error())
+		writeMessageError(w, err)
+		return
+	}
+	client, _ := clientFromContext(r)
+	// Generate unique id for the request, unless the client supplied its own
+	requestId := generateUUID().String()
+	if messageBody.RequestId != "" {
+		requestId = namespaceRequestId(client, messageBody.RequestId)
+	}
+	request := Request{
+		RequestId:      requestId,
+		Message:        messageBody.Message,
+		ClientId:       client.Id,
+		CallbackUrl:    messageBody.CallbackUrl,
+		TenantId:       client.tenant(),
+		Priority:       messageBody.Priority,
+		Deadline:       deadline,
+		Traceparent:    traceparentFromRequest(r),
+		CorrelationId:  correlationIdFromRequest(r),
+		IdempotencyKey: idempotencyKey,
+	}
+	// A retried submission reports on the request created the first time around, rather than enqueuing it again
+	if idempotencyKey != "" && application.Idempotency != nil {
+		record := IdempotencyRecord{RequestId: requestId, MessageHash: hashMessage(request.Message), TimeAdded: time.Now()}
+		original, reserved := application.Idempotency.Reserve(client.scopedId(), idempotencyKey, record)
+		if !reserved {
+			if original.MessageHash != record.MessageHash {
+				logFromRequest(r).Debugf("Idempotency-Key reused for a different message")
+				writeDenied(w, http.StatusUnprocessableEntity, ErrorIdempotencyKeyReused, "The Idempotency-Key has already been used for a different message. Please use a new key for a new message.")
+				return
 			}
-			resp, err := json.Marshal(requestFulfilled)
-			if err != nil {
-				logrus.Errorf("Unable to marshal response body. Details: %v", err.Error())
-			} else {
-				_, err := w.Write(resp)
-				if err != nil {
-					writeErrorResponse(w)
-				}
+			logFromRequest(r).Debugf("Idempotency-Key already used, reporting on original requestId: %v", original.RequestId)
+			w.Header().Set("Idempotent-Replayed", "true")
+			if original.Signature != "" {
+				// The signature was already retrieved, so is answered with again rather than found in the store
+				writeFulfilled(w, original.RequestId, original.Signature, original.Metadata)
+				return
 			}
-			application.Store <- SignedRequest{RequestId: requestId, Signature: signature, Add: false}
+			application.writeRequestStatus(w, r, original.RequestId, wait)
+			return
 		}
-	default:
-		logrus.Debugf("Encryption queue at capacity, unable to process request")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusServiceUnavailable)
-		requestDenied := RequestDenied{
-			Body:       "The request could not be processed, server is at capacity. Please try again shortly.",
-			StatusCode: http.StatusServiceUnavailable,
+	}
+	submitted := time.Now()
+	if err := application.checkClientLimits(r, 1, submitted); err != nil {
+		application.Idempotency.Release(client.scopedId(), idempotencyKey, requestId)
+		logFromRequest(r).Debugf("Client %v is over its limits. Details: %v", request.ClientId, err.Error())
+		writeMessageError(w, err)
+		return
+	}
+	if messageBody.RequestId != "" {
+		if !application.claimRequestId(requestId) {
+			application.Idempotency.Release(client.scopedId(), idempotencyKey, requestId)
+			application.refundQuota(r, 1, submitted)
+			logFromRequest(r).Debugf("Client supplied requestId already in use: %v", requestId)
+			writeDenied(w, http.StatusConflict, ErrorRequestIdConflict, "The requestId is already in use. Please supply a different requestId, or retrieve the existing request with the 'crypto/sign/request/{requestId}' endpoint.")
+			return
 		}
-		resp, err := json.Marshal(requestDenied)
-		if err != nil {
-			logrus.Errorf("Unable to marshal response body. Details: %v", err.Error())
+		defer application.releaseRequestId(requestId)
+	}
+	// Metadata is stored before enqueuing, so it is there however quickly the request is signed
+	application.Metadata.Set(requestId, messageBody.Metadata)
+	if application.scheduled(notBefore, submitted) {
+		// Scheduled requests can't be signed within the wait, so are answered straight away. The queue holds
+		// capacity back for them, so they fit once they are due
+		if application.Queue.Reserve(1) {
+			request.NotBefore = notBefore
+			timing := application.GetScheduledTiming(time.Now(), *notBefore)
+			application.scheduleRequests([]Request{request}, timing)
+			logFromRequest(r).Debugf("Request scheduled for %v", notBefore)
+			writeScheduled(w, requestId, *notBefore, timing.TimeEstimate, messageBody.Metadata)
+			return
+		}
+	} else if application.Queue.Push(request) {
+		logFromRequest(r).Debugf("Encryption queue accepted the request")
+		timing := application.GetEncryptionTiming(time.Now(), request)
+		application.Track <- PendingRequest{Request: request, Timing: timing, State: StateQueued, Add: true}
+		application.Events.Publish(Event{RequestId: requestId, State: EventQueued, Timestamp: timing.TimeAdded})
+		signature, ok := retrieveSignature(r.Context(), application, requestId, wait)
+		if !ok {
+			logFromRequest(r).Debugf("Request not processed in time, but was recieved successfully")
+			writeProcessing(w, "Request Recieved. Please check back according to the time estimate (minutes).", requestId, timing.TimeEstimate, messageBody.Metadata)
 		} else {
-			_, err := w.Write(resp)
-			if err != nil {
-				writeErrorResponse(w)
-			}
+			logFromRequest(r).Debugf("Request processed in time, returning signature")
+			writeFulfilled(w, requestId, signature, messageBody.Metadata)
+			application.Idempotency.Fulfil(client.scopedId(), idempotencyKey, requestId, signature, messageBody.Metadata)
+			application.Store <- SignedRequest{RequestId: requestId, Signature: signature, Add: false}
 		}
+		return
 	}
+	application.Metadata.Delete(requestId)
+	application.Idempotency.Release(client.scopedId(), idempotencyKey, requestId)
+	application.refundQuota(r, 1, submitted)
+	logFromRequest(r).Debugf("Encryption queue at capacity, unable to process request")
+	setRetryAfter(w, application.queueFullRetryMinutes(1))
+	writeDenied(w, http.StatusServiceUnavailable, ErrorQueueFull, "The request could not be processed, server is at capacity. Please try again shortly.")
 }
 
-// currentRequestHandler handles inquiries about ongoing requests to the /crypto/sign/request/{requestId} endpoint
+// currentRequestHandler handles inquiries about ongoing requests to the /crypto/sign/request/{requestId} endpoint.
+// Pending requests respond straight away, unless the 'wait' parameter asks to wait for the signature
 func (application *Application) currentRequestHandler(w http.ResponseWriter, r *http.Request) {
 	// Retrieve request id for the signature the user is interested in
-	params := mux.Vars(r)
-	requestId := params["requestId"]
-	signature, ok := application.Signatures[requestId]
+	requestId := pathVar(r, "requestId")
+	wait, err := readWait(r, 0, application.maxWait())
+	if err != nil {
+		writeMessageError(w, err)
+		return
+	}
+	application.writeRequestStatus(w, r, requestId, wait)
+}
+
+// writeRequestStatus responds with the signature of a request if it has been signed within the given wait,
+// or otherwise with how far along the request is
+func (application *Application) writeRequestStatus(w http.ResponseWriter, r *http.Request, requestId string, wait time.Duration) {
+	if !application.checkRequestTenant(w, r, requestId) {
+		return
+	}
+	signature, ok := application.lookupSignature(requestId)
+	if !ok && wait > 0 {
+		if request, pending := application.lookupRequest(requestId); pending && !isFinalState(request.State) {
+			signature, ok = retrieveSignature(r.Context(), application, requestId, wait)
+		}
+	}
 	if !ok {
-		if request, ok := application.Requests[requestId]; ok {
-			logrus.Debugf("Request still being processed")
+		if request, ok := application.lookupRequest(requestId); ok && request.State == StateCancelled {
+			logFromRequest(r).Debugf("Request was cancelled")
+			writeDenied(w, http.StatusGone, ErrorRequestCancelled, "The request was cancelled before it was signed. Please use the 'crypto/sign' endpoint to generate a new request.")
+		} else if ok && request.State == StateFailed {
+			logFromRequest(r).Debugf("Request failed")
+			writeDenied(w, http.StatusServiceUnavailable, ErrorUpstreamUnavailable, "The signing service could not sign the request. It may be requeued once the service recovers, or please use the 'crypto/sign' endpoint to generate a new request.")
+		} else if ok && request.State == StateExpired {
+			logFromRequest(r).Debugf("Request expired")
+			writeDenied(w, http.StatusGone, ErrorRequestExpired, "The deadline of the request passed before it could be signed. Please use the 'crypto/sign' endpoint to generate a new request.")
+		} else if ok {
+			logFromRequest(r).Debugf("Request still being processed")
 			// See how much time is estimated to be remaining, and if past deadline set to default estimate
 			timeElapsed := time.Since(request.TimeAdded)
 			minutesRemaining := request.TimeEstimate - timeElapsed.Minutes()
@@ -147,99 +231,126 @@ func (application *Application) currentRequestHandler(w http.ResponseWriter, r *
 				// Naive default
 				minutesRemaining = 5
 			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusAccepted)
-			requestProcessing := RequestProcessing{
-				Body:         "Request is still being processed. Please check back according to the time estimate (minutes).",
-				RequestId:    requestId,
-				TimeEstimate: float64(minutesRemaining),
-				StatusCode:   http.StatusAccepted,
+			// Pollers that already have the current state get an empty 304 instead
+			etag := requestETag(request)
+			w.Header().Set("ETag", etag)
+			if etagMatches(r.Header.Get("If-None-Match"), etag) {
+				w.Header().Set("Location", requestLocation(w, requestId))
+				setRetryAfter(w, minutesRemaining)
+				w.WriteHeader(http.StatusNotModified)
+				return
 			}
-			resp, err := json.Marshal(requestProcessing)
-			if err != nil {
-				logrus.Errorf("Unable to marshal response body. Details: %v", err.Error())
-			} else {
-				_, err := w.Write(resp)
-				if err != nil {
-					writeErrorResponse(w)
-				}
+			if request.State == StateScheduled && request.NotBefore != nil {
+				writeScheduled(w, requestId, *request.NotBefore, minutesRemaining, application.Metadata.Get(requestId))
+				return
 			}
-
+			writeProcessing(w, "Request is still being processed. Please check back according to the time estimate (minutes).", requestId, minutesRemaining, application.Metadata.Get(requestId))
 		} else {
-			logrus.Debugf("Request id invalid")
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusNotFound)
-			requestDenied := RequestDenied{
-				Body:       "The requestId is not recognized. Please use the 'crypto/sign' endpoint to generate a new request.",
-				StatusCode: http.StatusNotFound,
-			}
-			resp, err := json.Marshal(requestDenied)
-			if err != nil {
-				logrus.Errorf("Unable to marshal response body. Details: %v", err.Error())
-			} else {
-				_, err := w.Write(resp)
-				if err != nil {
-					writeErrorResponse(w)
-				}
-			}
+			logFromRequest(r).Debugf("Request id invalid")
+			writeDenied(w, http.StatusNotFound, ErrorNotFound, "The requestId is not recognized. Please use the 'crypto/sign' endpoint to generate a new request.")
 		}
 	} else {
-		logrus.Debugf("Request completed processing, returning signature")
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		requestFulfilled := RequestFulfilled{
-			Body:       "Request processed successfully!",
-			Signature:  signature,
-			StatusCode: http.StatusOK,
-		}
-		resp, err := json.Marshal(requestFulfilled)
-		if err != nil {
-			logrus.Errorf("Unable to marshal response body. Details: %v", err.Error())
-		} else {
-			_, err := w.Write(resp)
-			if err != nil {
-				writeErrorResponse(w)
-			}
+		logFromRequest(r).Debugf("Request completed processing, returning signature")
+		metadata := application.Metadata.Get(requestId)
+		writeFulfilled(w, requestId, signature, metadata)
+		if request, ok := application.lookupRequest(requestId); ok {
+			application.Idempotency.Fulfil(requestScopedId(request.Request), request.IdempotencyKey, requestId, signature, metadata)
 		}
 		application.Store <- SignedRequest{RequestId: requestId, Signature: signature, Add: false}
 	}
+}
+
+// writeFulfilled writes a 200 response containing the signature of a request, along with its metadata
+func writeFulfilled(w http.ResponseWriter, requestId string, signature string, metadata map[string]string) {
+	setNoStore(w)
+	writeResponse(w, http.StatusOK, RequestFulfilled{
+		Body:       "Request processed successfully!",
+		RequestId:  requestId,
+		Signature:  signature,
+		Metadata:   metadata,
+		StatusCode: http.StatusOK,
+	})
+}
+
+// writeProcessing writes a 202 response for a request that is still waiting on a signature, along with its metadata.
+// The Location and Retry-After headers tell pollers where and when to check back
+func writeProcessing(w http.ResponseWriter, body string, requestId string, timeEstimate float64, metadata map[string]string) {
+	writePending(w, RequestProcessing{
+		Body:         body,
+		RequestId:    requestId,
+		TimeEstimate: timeEstimate,
+		Metadata:     metadata,
+		StatusCode:   http.StatusAccepted,
+	})
+}
+
+// writeScheduled writes a 202 response for a request held back until its notBefore time, along with its metadata
+func writeScheduled(w http.ResponseWriter, requestId string, notBefore time.Time, timeEstimate float64, metadata map[string]string) {
+	writePending(w, RequestProcessing{
+		Body:         "Request scheduled. Please check back according to the time estimate (minutes).",
+		RequestId:    requestId,
+		State:        StateScheduled,
+		NotBefore:    &notBefore,
+		TimeEstimate: timeEstimate,
+		Metadata:     metadata,
+		StatusCode:   http.StatusAccepted,
+	})
+}
+
+// writePending writes a 202 response for a request that is still waiting on a signature. The Location and
+// Retry-After headers tell pollers where and when to check back
+func writePending(w http.ResponseWriter, response RequestProcessing) {
+	w.Header().Set("Location", requestLocation(w, response.RequestId))
+	setRetryAfter(w, response.TimeEstimate)
+	writeResponse(w, http.StatusAccepted, response)
+}
+
+// writeDenied writes a response for a request that could not be served with the given status code and error code
+func writeDenied(w http.ResponseWriter, statusCode int, code string, body string) {
+	writeResponse(w, statusCode, RequestDenied{
+		Body:       body,
+		StatusCode: statusCode,
+		Code:       code,
+	})
+}
+
+// writeMessageError writes a response for a request that could not be read
+func writeMessageError(w http.ResponseWriter, err *MessageError) {
+	if err.RetryAfter > 0 {
+		setRetryAfter(w, err.RetryAfter)
+	}
+	writeDenied(w, err.StatusCode, err.ErrorCode(), err.Error())
+}
 
+// writeResponse is a helper function for marshalling a response body and writing it with the given status code.
+// Responses for the /v1 API are wrapped in the /v1 envelope
+func writeResponse(w http.ResponseWriter, statusCode int, body interface{}) {
+	if isV1(w) {
+		body = envelope(body)
+	}
+	resp, err := json.Marshal(body)
+	if err != nil {
+		logrus.Errorf("Unable to marshal response body. Details: %v", err.Error())
+		writeErrorResponse(w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if _, err := w.Write(resp); err != nil {
+		logrus.Errorf("Error writing HTTP response. Closing request. Error Detail: %v", err.Error())
+	}
 }
 
 // writeErrorResponse is a helper function for writing a generic error response
 func writeErrorResponse(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusInternalServerError)
-	_, err := w.Write([]byte("Error writing http response. The request may need to be reprocessed entirely. Please try again"))
+	body := "Error writing http response. The request may need to be reprocessed entirely. Please try again"
+	if isV1(w) {
+		body = `{"error":{"code":"` + ErrorInternal + `","message":"` + body + `"}}`
+	}
+	_, err := w.Write([]byte(body))
 	if err != nil {
 		logrus.Errorf("Error writing HTTP response. Closing request. Error Detail: %v", err.Error())
 	}
 }
-
-// retrieveSignature attempts to retrieve the signature for a request Id for 2 seconds,
-// using exponential backoff when polling the store
-func retrieveSignature(application *Application, requestId string) (string, error) {
-	// Create channel to listen for signature
-	resp := make(chan string)
-	// Create a signature retriever (using object to pass state rather than func parameters due to backoff library req.)
-	retriever := Retriever{Signatures: application.Signatures, RequestId: requestId, Response: resp}
-	// Create channel to see if retrieval failed
-	retrievalFailed := make(chan error)
-	// Create a background operations that checks for 2 seconds (SLA req) with exponential backoff for signature
-	// After 2 seconds, it will notify the retrival failed channel
-	retry := backoff.NewExponentialBackOff()
-	retry.InitialInterval = 50 * time.Millisecond
-	retry.MaxElapsedTime = 2 * time.Second
-	go func() {
-		retrievalFailed <- backoff.Retry(retriever.RetrieveSignature, retry)
-	}()
-	// Wait until retrieval time window is exhausted, or signature recieved
-	select {
-	case e := <-retrievalFailed:
-		logrus.Debugf("Signature not found, may still be processing")
-		return "", e
-	case signature := <-resp:
-		logrus.Debugf("Signature recieved successfully!")
-		return signature, nil
-	}
-}
@@ -1,11 +1,14 @@
 package app
 
 import (
+	"context"
 	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,24 +21,40 @@ func TestApp_newRequestHandler(t *testing.T) {
 		}
 		return requestId
 	}
-	mockSuccessApplication := Application{
-		Encrypt:    make(chan Request, 1),
+	mockSuccessApplication := &Application{
+		Queue:      NewFairQueue(1, nil),
 		Store:      make(chan SignedRequest, 1),
 		Signatures: map[string]string{generateUUID().String(): "signature"},
 		Track:      make(chan PendingRequest, 1),
 		Requests:   make(map[string]PendingRequest),
 		ServerPort: ":8080",
 	}
-	mockCapacityApplication := Application{
-		Encrypt:    make(chan Request),
+	mockCapacityApplication := &Application{
+		Queue:      NewFairQueue(0, nil),
 		Store:      make(chan SignedRequest, 1),
 		Signatures: make(map[string]string),
 		Track:      make(chan PendingRequest, 1),
 		Requests:   make(map[string]PendingRequest),
 		ServerPort: ":8080",
 	}
-	mockAcceptedApplication := Application{
-		Encrypt:    make(chan Request, 1),
+	mockAcceptedApplication := &Application{
+		Queue:      NewFairQueue(1, nil),
+		Store:      make(chan SignedRequest, 1),
+		Signatures: make(map[string]string),
+		Track:      make(chan PendingRequest, 1),
+		Requests:   make(map[string]PendingRequest),
+		ServerPort: ":8080",
+	}
+	mockGetMessageApplication := &Application{
+		Queue:      NewFairQueue(1, nil),
+		Store:      make(chan SignedRequest, 1),
+		Signatures: make(map[string]string),
+		Track:      make(chan PendingRequest, 1),
+		Requests:   make(map[string]PendingRequest),
+		ServerPort: ":8080",
+	}
+	mockPostMessageApplication := &Application{
+		Queue:      NewFairQueue(1, nil),
 		Store:      make(chan SignedRequest, 1),
 		Signatures: make(map[string]string),
 		Track:      make(chan PendingRequest, 1),
@@ -47,10 +66,15 @@ func TestApp_newRequestHandler(t *testing.T) {
 	mockAcceptedBody := fmt.Sprintf(`{"Body":"Request Recieved. Please check back according to the time estimate (minutes).","RequestId":"%v","TimeEstimate":1,"StatusCode":202}`, generateUUID().String())
 	tests := []struct {
 		name         string
-		application  Application
+		application  *Application
 		mockFunc     func()
+		method       string
+		target       string
+		body         string
 		bodyExpected string
 		statusCode   int
+		// messageQueued is the message expected on the encrypt queue, which isn't checked when empty
+		messageQueued string
 	}{
 		{
 			name:        "Success new request, processed",
@@ -79,13 +103,42 @@ func TestApp_newRequestHandler(t *testing.T) {
 			bodyExpected: mockCapacityBody,
 			statusCode:   503,
 		},
+		{
+			name:          "Success new request with message in query, accepted",
+			application:   mockGetMessageApplication,
+			mockFunc:      func() {},
+			method:        "GET",
+			target:        "/crypto/sign?message=taco",
+			bodyExpected:  mockAcceptedBody,
+			statusCode:    202,
+			messageQueued: "taco",
+		},
+		{
+			name:          "Success new request with message in body, accepted",
+			application:   mockPostMessageApplication,
+			mockFunc:      func() {},
+			method:        "POST",
+			target:        "/crypto/sign",
+			body:          "taco",
+			bodyExpected:  mockAcceptedBody,
+			statusCode:    202,
+			messageQueued: "taco",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.mockFunc()
-			router := NewRouter(&tt.application)
+			router := NewRouter(tt.application)
 
-			req, err := http.NewRequest("GET", "/crypto/sign", nil)
+			method, target := "GET", "/crypto/sign"
+			if tt.method != "" {
+				method, target = tt.method, tt.target
+			}
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req, err := http.NewRequest(method, target, body)
 			if err != nil {
 				t.Fatalf("Failed to create API request for tests. Details: %v", err)
 			}
@@ -97,29 +150,35 @@ func TestApp_newRequestHandler(t *testing.T) {
 			if !cmp.Equal(rr.Body.String(), tt.bodyExpected) {
 				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
 			}
+			if tt.messageQueued != "" {
+				request, _ := tt.application.Queue.Pop(context.Background())
+				if !cmp.Equal(request.Message, tt.messageQueued) {
+					t.Errorf("Queued message not as expected. Wanted: %v, Got: %v", tt.messageQueued, request.Message)
+				}
+			}
 		})
 	}
 }
 
 func TestApp_currentRequestHandler(t *testing.T) {
-	mockSuccessApplication := Application{
-		Encrypt:    make(chan Request, 1),
+	mockSuccessApplication := &Application{
+		Queue:      NewFairQueue(1, nil),
 		Store:      make(chan SignedRequest, 1),
 		Signatures: map[string]string{generateUUID().String(): "signature"},
 		Track:      make(chan PendingRequest, 1),
 		Requests:   make(map[string]PendingRequest),
 		ServerPort: ":8080",
 	}
-	mockNotFoundApplication := Application{
-		Encrypt:    make(chan Request),
+	mockNotFoundApplication := &Application{
+		Queue:      NewFairQueue(0, nil),
 		Store:      make(chan SignedRequest, 1),
 		Signatures: make(map[string]string),
 		Track:      make(chan PendingRequest, 1),
 		Requests:   make(map[string]PendingRequest),
 		ServerPort: ":8080",
 	}
-	mockAcceptedApplication := Application{
-		Encrypt:    make(chan Request, 1),
+	mockAcceptedApplication := &Application{
+		Queue:      NewFairQueue(1, nil),
 		Store:      make(chan SignedRequest, 1),
 		Signatures: make(map[string]string),
 		Track:      make(chan PendingRequest, 1),
@@ -143,7 +202,7 @@ func TestApp_currentRequestHandler(t *testing.T) {
 	mockAcceptedBody := fmt.Sprintf(`{"Body":"Request is still being processed. Please check back according to the time estimate (minutes).","RequestId":"%v","TimeEstimate":5,"StatusCode":202}`, generateUUID().String())
 	tests := []struct {
 		name         string
-		application  Application
+		application  *Application
 		mockFunc     func()
 		bodyExpected string
 		statusCode   int
@@ -179,7 +238,7 @@ func TestApp_currentRequestHandler(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			tt.mockFunc()
-			router := NewRouter(&tt.application)
+			router := NewRouter(tt.application)
 
 			req, err := http.NewRequest("GET", fmt.Sprintf("/crypto/sign/request/%v", generateUUID().String()), nil)
 			if err != nil {
@@ -0,0 +1,68 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// setRetryAfter sets the Retry-After header from a time estimate in minutes, rounded up to a whole second
+func setRetryAfter(w http.ResponseWriter, minutes float64) {
+	seconds := int(math.Ceil(minutes * 60))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
+
+// setNoStore keeps responses containing signatures out of caches
+func setNoStore(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// requestLocation is the status resource of a request, on the API the response is being written for
+func requestLocation(w http.ResponseWriter, requestId string) string {
+	if isV1(w) {
+		return "/v1/requests/" + url.PathEscape(requestId)
+	}
+	return "/crypto/sign/request/" + url.PathEscape(requestId)
+}
+
+// batchLocation is the status resource of a batch, on the API the response is being written for
+func batchLocation(w http.ResponseWriter, batchId string) string {
+	if isV1(w) {
+		return "/v1/batches/" + url.PathEscape(batchId)
+	}
+	return "/crypto/sign/batch/" + url.PathEscape(batchId)
+}
+
+// requestETag is a weak entity tag for the status of a pending request. It changes whenever the request moves
+// along the pipeline, but not as its time estimate counts down, so pollers only get a new body on progress
+func requestETag(request PendingRequest) string {
+	state := request.State
+	if state == "" {
+		state = StateQueued
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", request.RequestId, state, request.Attempts)))
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches an entity tag, using the weak comparison
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	opaque := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == opaque {
+			return true
+		}
+	}
+	return false
+}
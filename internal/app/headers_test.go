@@ -0,0 +1,176 @@
+package app
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApp_responseHeaders(t *testing.T) {
+	mockSequentialUUIDs(t)
+	firstUUID := generateUUID().String()
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		body        string
+		queueSize   int
+		statusCode  int
+		wantHeaders map[string]string
+	}{
+		{
+			name:        "Accepted request points at its status",
+			method:      "GET",
+			target:      "/crypto/sign?wait=0&message=taco&requestId=job-1234",
+			queueSize:   1,
+			statusCode:  202,
+			wantHeaders: map[string]string{"Location": "/crypto/sign/request/job-1234", "Retry-After": "60"},
+		},
+		{
+			name:        "Accepted /v1 request points at its /v1 status",
+			method:      "POST",
+			target:      "/v1/requests?wait=0",
+			body:        `{"message":"taco","requestId":"job-1234"}`,
+			queueSize:   1,
+			statusCode:  202,
+			wantHeaders: map[string]string{"Location": "/v1/requests/job-1234", "Retry-After": "60"},
+		},
+		{
+			name:        "Full queue says when to retry",
+			method:      "GET",
+			target:      "/crypto/sign?message=taco",
+			statusCode:  503,
+			wantHeaders: map[string]string{"Retry-After": "12", "Location": ""},
+		},
+		{
+			name:        "Signature is not cached",
+			method:      "GET",
+			target:      "/crypto/sign/request/signed",
+			statusCode:  200,
+			wantHeaders: map[string]string{"Cache-Control": "no-store", "ETag": ""},
+		},
+		{
+			name:        "Pending request has an entity tag",
+			method:      "GET",
+			target:      "/crypto/sign/request/pending",
+			statusCode:  202,
+			wantHeaders: map[string]string{"ETag": requestETag(PendingRequest{Request: Request{RequestId: "pending"}, State: StateRunning, Attempts: 1}), "Location": "/crypto/sign/request/pending"},
+		},
+		{
+			name:        "Accepted batch points at its status",
+			method:      "POST",
+			target:      "/crypto/sign/batch",
+			body:        `{"messages":["taco"]}`,
+			queueSize:   1,
+			statusCode:  202,
+			wantHeaders: map[string]string{"Location": "/crypto/sign/batch/" + firstUUID, "Retry-After": "60"},
+		},
+		{
+			name:        "Batch progress is not cached",
+			method:      "GET",
+			target:      "/v1/batches/batch",
+			statusCode:  200,
+			wantHeaders: map[string]string{"Cache-Control": "no-store", "Retry-After": "300"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSequentialUUIDs(t)
+			application := Application{
+				Queue:      NewFairQueue(tt.queueSize, nil),
+				Store:      make(chan SignedRequest, 1),
+				Signatures: map[string]string{"signed": "signature"},
+				Track:      make(chan PendingRequest, 1),
+				Requests: map[string]PendingRequest{
+					"pending": {Request: Request{RequestId: "pending", Message: "taco"}, Timing: Timing{time.Now().Add(-time.Hour), 1}, State: StateRunning, Attempts: 1, Add: true},
+				},
+				ServerPort: ":8080",
+				Batches: &BatchStore{Batches: map[string]Batch{
+					"batch": {BatchId: "batch", RequestIds: []string{"signed", "pending"}},
+				}},
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			for header, want := range tt.wantHeaders {
+				if got := rr.Header().Get(header); got != want {
+					t.Errorf("%v header not as expected. Wanted: %q, Got: %q", header, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestApp_currentRequestHandlerNotModified(t *testing.T) {
+	pending := PendingRequest{Request: Request{RequestId: "pending", Message: "taco"}, Timing: Timing{time.Now(), 1}, State: StateQueued, Add: true}
+	application := Application{
+		Queue:      NewFairQueue(1, nil),
+		Store:      make(chan SignedRequest, 1),
+		Signatures: make(map[string]string),
+		Track:      make(chan PendingRequest, 1),
+		Requests:   map[string]PendingRequest{"pending": pending},
+		ServerPort: ":8080",
+	}
+	router := NewRouter(&application)
+	poll := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/crypto/sign/request/pending", nil)
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := poll("")
+	etag := first.Header().Get("ETag")
+	if first.Code != 202 || etag == "" {
+		t.Fatalf("Expected a 202 with an ETag, got %v with ETag %q", first.Code, etag)
+	}
+	unchanged := poll(etag)
+	if unchanged.Code != 304 || unchanged.Body.Len() != 0 {
+		t.Errorf("Expected an empty 304 while the request is unchanged, got %v: %v", unchanged.Code, unchanged.Body.String())
+	}
+	if unchanged.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected Retry-After on the 304")
+	}
+
+	pending.State = StateRunning
+	pending.Attempts = 1
+	application.Requests["pending"] = pending
+	progressed := poll(etag)
+	if progressed.Code != 202 || progressed.Header().Get("ETag") == etag {
+		t.Errorf("Expected a 202 with a new ETag once the request progressed, got %v with ETag %q", progressed.Code, progressed.Header().Get("ETag"))
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	etag := `W/"abc"`
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		want        bool
+	}{
+		{name: "No header", ifNoneMatch: "", want: false},
+		{name: "Same tag", ifNoneMatch: `W/"abc"`, want: true},
+		{name: "Strong form of the tag", ifNoneMatch: `"abc"`, want: true},
+		{name: "Tag within a list", ifNoneMatch: `"xyz", W/"abc"`, want: true},
+		{name: "Any tag", ifNoneMatch: `*`, want: true},
+		{name: "Different tag", ifNoneMatch: `W/"xyz"`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.ifNoneMatch, etag); got != tt.want {
+				t.Errorf("Unexpected match result. Wanted: %v, Got: %v", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultIdempotencyRetention is how long an Idempotency-Key is remembered when no retention has been configured
+const DefaultIdempotencyRetention = 24 * time.Hour
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key header accepted
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyRecord remembers the request created for an Idempotency-Key, and a hash of its
+// message so the key can't be reused for a different message. Once the signature has been retrieved it is kept,
+// along with the request's metadata, so a retry within the retention window gets the same answer
+type IdempotencyRecord struct {
+	RequestId   string
+	MessageHash string
+	TimeAdded   time.Time
+	Signature   string            `json:",omitempty"`
+	Metadata    map[string]string `json:",omitempty"`
+}
+
+// IdempotencyStore maps the Idempotency-Keys of each client onto the requests they created, safe for
+// concurrent use by handlers. Keys are forgotten once they are older than the retention window
+type IdempotencyStore struct {
+	mu        sync.Mutex
+	Keys      map[string]map[string]IdempotencyRecord
+	Retention time.Duration
+}
+
+// Reserve claims a key for a client's new request. If the key was already used within the retention window
+// the original record is returned along with false, and the new request must not be enqueued
+func (store *IdempotencyStore) Reserve(clientId string, key string, record IdempotencyRecord) (IdempotencyRecord, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if existing, ok := store.Keys[clientId][key]; ok && !store.expired(existing, record.TimeAdded) {
+		return existing, false
+	}
+	if store.Keys[clientId] == nil {
+		store.Keys[clientId] = make(map[string]IdempotencyRecord)
+	}
+	store.Keys[clientId][key] = record
+	return record, true
+}
+
+// Release gives up a key reserved for a request that could not be enqueued, so the client can retry with it
+func (store *IdempotencyStore) Release(clientId string, key string, requestId string) {
+	if store == nil || key == "" {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if existing, ok := store.Keys[clientId][key]; ok && existing.RequestId == requestId {
+		delete(store.Keys[clientId], key)
+		if len(store.Keys[clientId]) == 0 {
+			delete(store.Keys, clientId)
+		}
+	}
+}
+
+// Fulfil keeps the signature of the request a key created, as it is retrieved and so no longer stored elsewhere
+func (store *IdempotencyStore) Fulfil(clientId string, key string, requestId string, signature string, metadata map[string]string) {
+	if store == nil || key == "" {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if existing, ok := store.Keys[clientId][key]; ok && existing.RequestId == requestId {
+		existing.Signature = signature
+		existing.Metadata = metadata
+		store.Keys[clientId][key] = existing
+	}
+}
+
+// Len is the number of keys remembered across every client, including any that have outlived the retention window
+// but are yet to be pruned
+func (store *IdempotencyStore) Len() int {
+	if store == nil {
+		return 0
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	length := 0
+	for _, keys := range store.Keys {
+		length += len(keys)
+	}
+	return length
+}
+
+// MarshalJSON marshals the keys still within the retention window for persistence
+func (store *IdempotencyStore) MarshalJSON() ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.prune(time.Now())
+	return json.Marshal(store.Keys)
+}
+
+// expired reports whether a record has outlived the retention window
+func (store *IdempotencyStore) expired(record IdempotencyRecord, now time.Time) bool {
+	retention := store.Retention
+	if retention <= 0 {
+		retention = DefaultIdempotencyRetention
+	}
+	return now.Sub(record.TimeAdded) > retention
+}
+
+// prune forgets every key that has outlived the retention window. Callers must hold the lock
+func (store *IdempotencyStore) prune(now time.Time) {
+	for clientId, keys := range store.Keys {
+		for key, record := range keys {
+			if store.expired(record, now) {
+				delete(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			delete(store.Keys, clientId)
+		}
+	}
+}
+
+// readIdempotencyKey retrieves the optional Idempotency-Key header of a submission
+func readIdempotencyKey(r *http.Request) (string, *MessageError) {
+	key := r.Header.Get("Idempotency-Key")
+	if len(key) > maxIdempotencyKeyLength {
+		return "", &MessageError{StatusCode: http.StatusBadRequest, Reason: "The Idempotency-Key header must be at most 255 characters."}
+	}
+	for _, c := range key {
+		if c < ' ' || c > '~' {
+			return "", &MessageError{StatusCode: http.StatusBadRequest, Reason: "The Idempotency-Key header must only contain printable ASCII characters."}
+		}
+	}
+	return key, nil
+}
+
+// InstantiateIdempotencyKeys creates a new store for Idempotency-Keys and recreates previous state if applicable,
+// dropping keys that expired while the server was down
+func InstantiateIdempotencyKeys(idempotencyPersistenceLocation string, retention time.Duration) *IdempotencyStore {
+	store := &IdempotencyStore{Keys: make(map[string]map[string]IdempotencyRecord), Retention: retention}
+	keysBytes, err := os.ReadFile(idempotencyPersistenceLocation)
+	if err != nil {
+		logrus.Errorf("Was unable to read idempotency keys file. Details: %v", err)
+		return store
+	}
+	if len(keysBytes) > 0 {
+		var keys map[string]map[string]IdempotencyRecord
+		if err := json.Unmarshal(keysBytes, &keys); err != nil {
+			logrus.Errorf("Was unable to unmarshal idempotency keys into object. Details: %v", err)
+			return store
+		}
+		if keys != nil {
+			store.Keys = keys
+		}
+	}
+	store.prune(time.Now())
+	return store
+}
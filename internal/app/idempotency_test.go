@@ -0,0 +1,304 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/uuid"
+)
+
+func TestApp_newRequestHandlerIdempotency(t *testing.T) {
+	type submission struct {
+		message    string
+		clientId   string
+		key        string
+		statusCode int
+		replayed   bool
+		sameAs     int
+	}
+	tests := []struct {
+		name        string
+		queueSize   int
+		retention   time.Duration
+		submissions []submission
+		wantQueued  int
+	}{
+		{
+			name:      "Repeated key reports on the original request",
+			queueSize: 2,
+			submissions: []submission{
+				{message: "taco", key: "key", statusCode: 202, sameAs: -1},
+				{message: "taco", key: "key", statusCode: 202, replayed: true, sameAs: 0},
+			},
+			wantQueued: 1,
+		},
+		{
+			name:      "Key reused for a different message",
+			queueSize: 2,
+			submissions: []submission{
+				{message: "taco", key: "key", statusCode: 202, sameAs: -1},
+				{message: "chicken", key: "key", statusCode: 422, sameAs: -1},
+			},
+			wantQueued: 1,
+		},
+		{
+			name:      "Keys are scoped to the client",
+			queueSize: 2,
+			submissions: []submission{
+				{message: "taco", clientId: "a", key: "key", statusCode: 202, sameAs: -1},
+				{message: "taco", clientId: "b", key: "key", statusCode: 202, sameAs: -1},
+			},
+			wantQueued: 2,
+		},
+		{
+			name:      "Submissions without a key are never deduplicated",
+			queueSize: 2,
+			submissions: []submission{
+				{message: "taco", statusCode: 202, sameAs: -1},
+				{message: "taco", statusCode: 202, sameAs: -1},
+			},
+			wantQueued: 2,
+		},
+		{
+			name:      "Key is released when the queue is full",
+			queueSize: 0,
+			submissions: []submission{
+				{message: "taco", key: "key", statusCode: 503, sameAs: -1},
+				{message: "chicken", key: "key", statusCode: 503, sameAs: -1},
+			},
+		},
+		{
+			name:      "Key is forgotten after the retention window",
+			queueSize: 2,
+			retention: time.Nanosecond,
+			submissions: []submission{
+				{message: "taco", key: "key", statusCode: 202, sameAs: -1},
+				{message: "taco", key: "key", statusCode: 202, sameAs: -1},
+			},
+			wantQueued: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSequentialUUIDs(t)
+			application := Application{
+				Queue:       NewFairQueue(tt.queueSize, nil),
+				Store:       make(chan SignedRequest, 1),
+				Signatures:  make(map[string]string),
+				Track:       make(chan PendingRequest, 2),
+				Requests:    make(map[string]PendingRequest),
+				ServerPort:  ":8080",
+				Idempotency: &IdempotencyStore{Keys: make(map[string]map[string]IdempotencyRecord), Retention: tt.retention},
+			}
+			router := NewRouter(&application)
+			var requestIds []string
+			for i, submission := range tt.submissions {
+				// The tracker isn't running, so apply the tracked request for replays to find
+				for len(application.Track) > 0 {
+					pendingRequest := <-application.Track
+					application.Requests[pendingRequest.RequestId] = pendingRequest
+				}
+				req := httptest.NewRequest("GET", "/crypto/sign?wait=0&message="+submission.message, nil)
+				req.Header.Set("X-Client-Id", submission.clientId)
+				if submission.key != "" {
+					req.Header.Set("Idempotency-Key", submission.key)
+				}
+				if tt.retention > 0 {
+					time.Sleep(2 * tt.retention)
+				}
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				if status := rr.Code; !cmp.Equal(status, submission.statusCode) {
+					t.Fatalf("Submission %v returned wrong status code: got %v want %v", i, status, submission.statusCode)
+				}
+				if replayed := rr.Header().Get("Idempotent-Replayed") == "true"; replayed != submission.replayed {
+					t.Errorf("Submission %v replay header not as expected. Wanted: %v, Got: %v", i, submission.replayed, replayed)
+				}
+				var processing RequestProcessing
+				if err := json.Unmarshal(rr.Body.Bytes(), &processing); err != nil {
+					t.Fatalf("Unable to unmarshal response body. Details: %v", err.Error())
+				}
+				requestIds = append(requestIds, processing.RequestId)
+				if submission.sameAs >= 0 && processing.RequestId != requestIds[submission.sameAs] {
+					t.Errorf("Submission %v should report on requestId %v, got %v", i, requestIds[submission.sameAs], processing.RequestId)
+				}
+				if submission.sameAs < 0 && submission.statusCode == http.StatusAccepted {
+					for j, requestId := range requestIds[:i] {
+						if requestId == processing.RequestId {
+							t.Errorf("Submission %v should be a new request, but matches submission %v", i, j)
+						}
+					}
+				}
+			}
+			if got := application.Queue.Len(); got != tt.wantQueued {
+				t.Errorf("Unexpected number of requests queued. Wanted: %v, Got: %v", tt.wantQueued, got)
+			}
+		})
+	}
+}
+
+func TestApp_idempotentReplayAfterRetrieval(t *testing.T) {
+	tests := []struct {
+		name             string
+		signedInWait     bool
+		firstStatusCode  int
+		retrievalTarget  string
+		wantReplayStatus int
+	}{
+		{name: "Signature retrieved from the status endpoint", firstStatusCode: 202, retrievalTarget: "/crypto/sign/request/", wantReplayStatus: 200},
+		{name: "Signature retrieved within the wait", signedInWait: true, firstStatusCode: 200, wantReplayStatus: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mockSequentialUUIDs(t)
+			requestId := uuid.Must(uuid.FromBytes([]byte("requestId-000001"))).String()
+			application := Application{
+				Queue:       NewFairQueue(2, nil),
+				Store:       make(chan SignedRequest, 1),
+				Signatures:  make(map[string]string),
+				Track:       make(chan PendingRequest, 2),
+				Requests:    make(map[string]PendingRequest),
+				ServerPort:  ":8080",
+				Idempotency: &IdempotencyStore{Keys: make(map[string]map[string]IdempotencyRecord), Retention: time.Hour},
+			}
+			if tt.signedInWait {
+				application.Signatures[requestId] = "signature"
+			}
+			router := NewRouter(&application)
+			submit := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest("GET", "/crypto/sign?wait=0&message=taco", nil)
+				req.Header.Set("Idempotency-Key", "key")
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				return rr
+			}
+			// The tracker and storer aren't running, so apply what they would have done
+			if rr := submit(); rr.Code != tt.firstStatusCode {
+				t.Fatalf("Submission returned wrong status code: got %v want %v", rr.Code, tt.firstStatusCode)
+			}
+			pendingRequest := <-application.Track
+			application.Requests[pendingRequest.RequestId] = pendingRequest
+			if tt.retrievalTarget != "" {
+				application.Signatures[requestId] = "signature"
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, httptest.NewRequest("GET", tt.retrievalTarget+requestId, nil))
+				if rr.Code != 200 {
+					t.Fatalf("Retrieval returned wrong status code: got %v want %v", rr.Code, 200)
+				}
+			}
+			if retrieved := <-application.Store; retrieved.Add || retrieved.RequestId != requestId {
+				t.Fatalf("Signature was not retrieved. Recieved: %v", retrieved)
+			}
+			delete(application.Signatures, requestId)
+			delete(application.Requests, requestId)
+
+			rr := submit()
+			if rr.Code != tt.wantReplayStatus {
+				t.Errorf("Replay returned wrong status code: got %v want %v", rr.Code, tt.wantReplayStatus)
+			}
+			if replayed := rr.Header().Get("Idempotent-Replayed"); replayed != "true" {
+				t.Errorf("Replay was not marked as replayed. Recieved: %v", replayed)
+			}
+			var fulfilled RequestFulfilled
+			if err := json.Unmarshal(rr.Body.Bytes(), &fulfilled); err != nil {
+				t.Fatalf("Unable to unmarshal response body. Details: %v", err.Error())
+			}
+			if fulfilled.Signature != "signature" {
+				t.Errorf("Replay did not answer with the original signature. Recieved: %v", fulfilled)
+			}
+		})
+	}
+}
+
+func TestReadIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name           string
+		key            string
+		wantStatusCode int
+	}{
+		{name: "No key", key: ""},
+		{name: "Printable key", key: "order-1234:retry"},
+		{name: "Key too long", key: string(make([]byte, 256)), wantStatusCode: 400},
+		{name: "Key with control characters", key: "order\t1234", wantStatusCode: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/crypto/sign?message=taco", nil)
+			req.Header.Set("Idempotency-Key", tt.key)
+			key, err := readIdempotencyKey(req)
+			if tt.wantStatusCode != 0 {
+				if err == nil {
+					t.Fatalf("Was expecting an error to occur but none did. Got key: %v", key)
+				}
+				if !cmp.Equal(err.StatusCode, tt.wantStatusCode) {
+					t.Errorf("Wrong status code for error: got %v want %v", err.StatusCode, tt.wantStatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error reading key. Details: %v", err.Error())
+			}
+			if !cmp.Equal(key, tt.key) {
+				t.Errorf("Key not as expected. Wanted: %v, Got: %v", tt.key, key)
+			}
+		})
+	}
+}
+
+func TestInstantiateIdempotencyKeys(t *testing.T) {
+	populatedKeysBytes, err := os.ReadFile("../../testdata/populatedIdempotencyState.json")
+	if err != nil {
+		t.Errorf("Was unable to read test populated idempotency keys file. Details: %v", err)
+	}
+	var populatedKeys map[string]map[string]IdempotencyRecord
+	if err := json.Unmarshal(populatedKeysBytes, &populatedKeys); err != nil {
+		t.Errorf("Was unable to unmarshal test populated idempotency keys into object. Details: %v", err)
+	}
+	tests := []struct {
+		name              string
+		inputFileLocation string
+		retention         time.Duration
+		want              map[string]map[string]IdempotencyRecord
+	}{
+		{
+			name:              "Successful Load of populated state",
+			inputFileLocation: "../../testdata/populatedIdempotencyState.json",
+			retention:         100 * 365 * 24 * time.Hour,
+			want:              populatedKeys,
+		},
+		{
+			name:              "Keys past retention are dropped",
+			inputFileLocation: "../../testdata/populatedIdempotencyState.json",
+			retention:         DefaultIdempotencyRetention,
+			want:              make(map[string]map[string]IdempotencyRecord),
+		},
+		{
+			name:              "Successful Load of empty state (fresh start)",
+			inputFileLocation: "../../testdata/emptyState.json",
+			want:              make(map[string]map[string]IdempotencyRecord),
+		},
+		{
+			name:              "Bad file location",
+			inputFileLocation: "../../testdata/fakeLocation.json",
+			want:              make(map[string]map[string]IdempotencyRecord),
+		},
+		{
+			name:              "Unmarshable state",
+			inputFileLocation: "../../testdata/unmarshableState.json",
+			want:              make(map[string]map[string]IdempotencyRecord),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := InstantiateIdempotencyKeys(tt.inputFileLocation, tt.retention)
+			if !cmp.Equal(store.Keys, tt.want) {
+				t.Errorf("Idempotency keys were not instantiated to the desired state. Want: %v, Recieved: %v", tt.want, store.Keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+package app
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Signing algorithms accepted on bearer tokens
+const (
+	AlgorithmHS256 = "HS256"
+	AlgorithmRS256 = "RS256"
+	AlgorithmEdDSA = "EdDSA"
+)
+
+// AdminScope is the token scope granting access to the admin endpoints
+const AdminScope = "admin"
+
+// jwtLeeway allows for clock skew between the identity provider and the server when checking token lifetimes
+const jwtLeeway = time.Minute
+
+// JWTConfig configures the verification of bearer tokens
+type JWTConfig struct {
+	// Secret verifies HS256 tokens
+	Secret string
+	// JWKSLocation is a JSON Web Key Set file holding the keys that verify tokens
+	JWKSLocation string
+	// Issuer and Audience, when set, must match the iss and aud claims of every token
+	Issuer   string
+	Audience string
+}
+
+// jwtKey is a key tokens can be verified against, along with the algorithm it verifies
+type jwtKey struct {
+	Id        string
+	Algorithm string
+	Key       interface{}
+}
+
+// JWTVerifier verifies bearer tokens issued by an identity provider and maps their claims onto clients
+type JWTVerifier struct {
+	Keys     []jwtKey
+	Issuer   string
+	Audience string
+}
+
+// jwtHeader is the header of a token
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyId     string `json:"kid"`
+}
+
+// jwtClaims are the claims of a token the server makes use of
+type jwtClaims struct {
+	Subject    string          `json:"sub"`
+	Tenant     string          `json:"tenant"`
+	Scope      string          `json:"scope"`
+	Scopes     []string        `json:"scp"`
+	Priorities []string        `json:"priorities"`
+	Issuer     string          `json:"iss"`
+	Audience   json.RawMessage `json:"aud"`
+	ExpiresAt  *float64        `json:"exp"`
+	NotBefore  *float64        `json:"nbf"`
+}
+
+// jsonWebKey is an entry of a JSON Web Key Set. Only the members of symmetric, RSA and Ed25519 keys are read
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyId     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv"`
+	K         string `json:"k"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	X         string `json:"x"`
+}
+
+// Verify checks the signature and lifetime of a token, returning the client its claims describe. The subject
+// becomes the client id, and the scopes the endpoints the client may call
+func (verifier *JWTVerifier) Verify(token string, now time.Time) (Client, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Client{}, errors.New("token is not a JWT")
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return Client{}, fmt.Errorf("token header is invalid: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Client{}, fmt.Errorf("token signature is invalid: %v", err)
+	}
+	if !verifier.verifySignature(header, []byte(parts[0]+"."+parts[1]), signature) {
+		return Client{}, fmt.Errorf("no %v key with id %q verifies the token signature", header.Algorithm, header.KeyId)
+	}
+	var claims jwtClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Client{}, fmt.Errorf("token claims are invalid: %v", err)
+	}
+	if err := verifier.validateClaims(claims, now); err != nil {
+		return Client{}, err
+	}
+	scopes := claims.Scopes
+	if claims.Scope != "" {
+		scopes = strings.Fields(claims.Scope)
+	}
+	client := Client{Id: claims.Subject, Tenant: claims.Tenant, Priorities: claims.Priorities, Scopes: scopes}
+	for _, scope := range scopes {
+		if scope == AdminScope {
+			client.Admin = true
+		} else {
+			client.Endpoints = append(client.Endpoints, scope)
+		}
+	}
+	return client, nil
+}
+
+// verifySignature checks the signature of a token against the keys for its algorithm, narrowed to its key id when
+// it names one. The algorithm has to match the key, so a public key can never be used as an HMAC secret
+func (verifier *JWTVerifier) verifySignature(header jwtHeader, signingInput []byte, signature []byte) bool {
+	for _, key := range verifier.Keys {
+		if key.Algorithm != header.Algorithm || (header.KeyId != "" && key.Id != header.KeyId) {
+			continue
+		}
+		switch publicKey := key.Key.(type) {
+		case []byte:
+			mac := hmac.New(sha256.New, publicKey)
+			mac.Write(signingInput)
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return true
+			}
+		case *rsa.PublicKey:
+			digest := sha256.Sum256(signingInput)
+			if rsa.VerifyPKCS1v15(publicKey, crypto.SHA256, digest[:], signature) == nil {
+				return true
+			}
+		case ed25519.PublicKey:
+			if ed25519.Verify(publicKey, signingInput, signature) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validateClaims checks a token is within its lifetime, was issued for this server, and names a subject
+func (verifier *JWTVerifier) validateClaims(claims jwtClaims, now time.Time) error {
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	if now.Add(-jwtLeeway).After(unixTime(*claims.ExpiresAt)) {
+		return errors.New("token has expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(unixTime(*claims.NotBefore)) {
+		return errors.New("token is not valid yet")
+	}
+	if claims.Subject == "" {
+		return errors.New("token has no subject")
+	}
+	if verifier.Issuer != "" && claims.Issuer != verifier.Issuer {
+		return fmt.Errorf("token issuer %q is not trusted", claims.Issuer)
+	}
+	if verifier.Audience != "" && !audienceContains(claims.Audience, verifier.Audience) {
+		return errors.New("token was not issued for this audience")
+	}
+	return nil
+}
+
+// audienceContains reports whether an aud claim, either a single string or a list, holds an audience
+func audienceContains(raw json.RawMessage, audience string) bool {
+	var single string
+	if json.Unmarshal(raw, &single) == nil {
+		return single == audience
+	}
+	var list []string
+	if json.Unmarshal(raw, &list) == nil {
+		for _, candidate := range list {
+			if candidate == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// unixTime converts a NumericDate claim to a time
+func unixTime(seconds float64) time.Time {
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token
+func decodeSegment(segment string, into interface{}) error {
+	segmentBytes, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(segmentBytes, into)
+}
+
+// parseJSONWebKey converts an entry of a key set into a key tokens can be verified against
+func parseJSONWebKey(jwk jsonWebKey) (jwtKey, error) {
+	key := jwtKey{Id: jwk.KeyId}
+	switch jwk.KeyType {
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil || len(secret) == 0 {
+			return jwtKey{}, errors.New("symmetric key has no valid 'k'")
+		}
+		key.Algorithm, key.Key = AlgorithmHS256, secret
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil || len(n) == 0 {
+			return jwtKey{}, errors.New("RSA key has no valid 'n'")
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return jwtKey{}, errors.New("RSA key has no valid 'e'")
+		}
+		key.Algorithm = AlgorithmRS256
+		key.Key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if jwk.Curve != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+			return jwtKey{}, errors.New("OKP key is not a valid Ed25519 key")
+		}
+		key.Algorithm, key.Key = AlgorithmEdDSA, ed25519.PublicKey(x)
+	default:
+		return jwtKey{}, fmt.Errorf("key type %q is not supported", jwk.KeyType)
+	}
+	if jwk.Algorithm != "" && jwk.Algorithm != key.Algorithm {
+		return jwtKey{}, fmt.Errorf("algorithm %q is not supported for key type %q", jwk.Algorithm, jwk.KeyType)
+	}
+	return key, nil
+}
+
+// LoadJWTVerifier creates a verifier for bearer tokens from a secret and a JSON Web Key Set file. Bearer tokens
+// are not accepted, and nil returned, when neither is configured. A key set that can't be read leaves its keys
+// out, rejecting the tokens they would have verified
+func LoadJWTVerifier(config JWTConfig) *JWTVerifier {
+	if config.Secret == "" && config.JWKSLocation == "" {
+		return nil
+	}
+	verifier := &JWTVerifier{Issuer: config.Issuer, Audience: config.Audience}
+	if config.Secret != "" {
+		verifier.Keys = append(verifier.Keys, jwtKey{Algorithm: AlgorithmHS256, Key: []byte(config.Secret)})
+	}
+	if config.JWKSLocation == "" {
+		return verifier
+	}
+	jwksBytes, err := os.ReadFile(config.JWKSLocation)
+	if err != nil {
+		logrus.Errorf("Was unable to read JWKS file. Details: %v", err)
+		return verifier
+	}
+	var jwks struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(jwksBytes, &jwks); err != nil {
+		logrus.Errorf("Was unable to unmarshal JWKS into object. Details: %v", err)
+		return verifier
+	}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseJSONWebKey(jwk)
+		if err != nil {
+			logrus.Errorf("Skipping JWKS key %q. Details: %v", jwk.KeyId, err)
+			continue
+		}
+		verifier.Keys = append(verifier.Keys, key)
+	}
+	return verifier
+}
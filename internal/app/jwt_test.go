@@ -0,0 +1,346 @@
+package app
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testJWTKeys are the private keys tokens are signed with in tests, whose public parts writeJWKS writes
+type testJWTKeys struct {
+	secret     []byte
+	rsaKey     *rsa.PrivateKey
+	ed25519Key ed25519.PrivateKey
+}
+
+func newTestJWTKeys(t *testing.T) testJWTKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Was unable to generate RSA key. Details: %v", err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Was unable to generate Ed25519 key. Details: %v", err)
+	}
+	return testJWTKeys{secret: []byte("secret"), rsaKey: rsaKey, ed25519Key: ed25519Key}
+}
+
+// writeJWKS writes the public parts of the keys to a JWKS file, returning its location
+func (keys testJWTKeys) writeJWKS(t *testing.T) string {
+	encode := base64.RawURLEncoding.EncodeToString
+	jwks := map[string][]map[string]string{"keys": {
+		{"kty": "oct", "kid": "hmac", "k": encode(keys.secret)},
+		{"kty": "RSA", "kid": "rsa", "alg": "RS256", "use": "sig", "n": encode(keys.rsaKey.N.Bytes()), "e": encode(big.NewInt(int64(keys.rsaKey.E)).Bytes())},
+		{"kty": "OKP", "kid": "ed25519", "crv": "Ed25519", "x": encode(keys.ed25519Key.Public().(ed25519.PublicKey))},
+		{"kty": "RSA", "kid": "encryption", "use": "enc", "n": encode(keys.rsaKey.N.Bytes()), "e": "AQAB"},
+		{"kty": "EC", "kid": "unsupported", "crv": "P-256"},
+	}}
+	jwksBytes, err := json.Marshal(jwks)
+	if err != nil {
+		t.Fatalf("Was unable to marshal JWKS. Details: %v", err)
+	}
+	location := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(location, jwksBytes, 0600); err != nil {
+		t.Fatalf("Was unable to write JWKS. Details: %v", err)
+	}
+	return location
+}
+
+// sign creates a token with the given algorithm and key id, signed by the matching test key
+func (keys testJWTKeys) sign(t *testing.T, algorithm string, keyId string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": algorithm, "kid": keyId, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var signature []byte
+	switch algorithm {
+	case AlgorithmHS256:
+		mac := hmac.New(sha256.New, keys.secret)
+		mac.Write([]byte(signingInput))
+		signature = mac.Sum(nil)
+	case AlgorithmRS256:
+		digest := sha256.Sum256([]byte(signingInput))
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, keys.rsaKey, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("Was unable to sign token. Details: %v", err)
+		}
+	case AlgorithmEdDSA:
+		signature = ed25519.Sign(keys.ed25519Key, []byte(signingInput))
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerifier_Verify(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	verifier := LoadJWTVerifier(JWTConfig{JWKSLocation: keys.writeJWKS(t), Issuer: "idp", Audience: "synthesia"})
+	now := time.Now()
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{"sub": "alpha", "iss": "idp", "aud": "synthesia", "exp": now.Add(time.Hour).Unix()}
+		for claim, value := range overrides {
+			if value == nil {
+				delete(claims, claim)
+			} else {
+				claims[claim] = value
+			}
+		}
+		return claims
+	}
+	tamper := func(token string, claims map[string]interface{}) string {
+		parts := strings.Split(token, ".")
+		payload, _ := json.Marshal(claims)
+		parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+		return strings.Join(parts, ".")
+	}
+	tests := []struct {
+		name  string
+		token string
+		want  Client
+		valid bool
+	}{
+		{
+			name:  "HS256",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(nil)),
+			want:  Client{Id: "alpha"},
+			valid: true,
+		},
+		{
+			name:  "RS256",
+			token: keys.sign(t, AlgorithmRS256, "rsa", claims(nil)),
+			want:  Client{Id: "alpha"},
+			valid: true,
+		},
+		{
+			name:  "EdDSA without a key id",
+			token: keys.sign(t, AlgorithmEdDSA, "", claims(nil)),
+			want:  Client{Id: "alpha"},
+			valid: true,
+		},
+		{
+			name:  "Tenant, scope and priorities claims",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(map[string]interface{}{"tenant": "acme", "scope": "sign status admin", "priorities": []string{"high"}})),
+			want:  Client{Id: "alpha", Tenant: "acme", Priorities: []string{"high"}, Scopes: []string{"sign", "status", "admin"}, Endpoints: []string{"sign", "status"}, Admin: true},
+			valid: true,
+		},
+		{
+			name:  "Scopes as a list",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(map[string]interface{}{"scp": []string{"batch"}})),
+			want:  Client{Id: "alpha", Scopes: []string{"batch"}, Endpoints: []string{"batch"}},
+			valid: true,
+		},
+		{
+			name:  "Audience as a list",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(map[string]interface{}{"aud": []string{"other", "synthesia"}})),
+			want:  Client{Id: "alpha"},
+			valid: true,
+		},
+		{
+			name:  "Expired within leeway",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()})),
+			want:  Client{Id: "alpha"},
+			valid: true,
+		},
+		{
+			name:  "Expired",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()})),
+		},
+		{
+			name:  "No expiry",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(map[string]interface{}{"exp": nil})),
+		},
+		{
+			name:  "Not valid yet",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()})),
+		},
+		{
+			name:  "No subject",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(map[string]interface{}{"sub": nil})),
+		},
+		{
+			name:  "Untrusted issuer",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(map[string]interface{}{"iss": "other"})),
+		},
+		{
+			name:  "Wrong audience",
+			token: keys.sign(t, AlgorithmHS256, "hmac", claims(map[string]interface{}{"aud": "other"})),
+		},
+		{
+			name:  "Unknown key id",
+			token: keys.sign(t, AlgorithmHS256, "missing", claims(nil)),
+		},
+		{
+			name:  "Algorithm not matching the key",
+			token: keys.sign(t, AlgorithmHS256, "rsa", claims(nil)),
+		},
+		{
+			name:  "Keys meant for encryption are ignored",
+			token: keys.sign(t, AlgorithmRS256, "encryption", claims(nil)),
+		},
+		{
+			name:  "Unsigned",
+			token: keys.sign(t, "none", "", claims(nil)),
+		},
+		{
+			name:  "Tampered claims",
+			token: tamper(keys.sign(t, AlgorithmEdDSA, "ed25519", claims(nil)), claims(map[string]interface{}{"sub": "beta"})),
+		},
+		{
+			name:  "Not a JWT",
+			token: "token",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := verifier.Verify(tt.token, now)
+			if (err == nil) != tt.valid {
+				t.Errorf("Token validity was not as expected. Want: %v, Recieved error: %v", tt.valid, err)
+			}
+			if tt.valid && !cmp.Equal(client, tt.want) {
+				t.Errorf("Token mapped onto the wrong client. Want: %v, Recieved: %v", tt.want, client)
+			}
+		})
+	}
+}
+
+func TestLoadJWTVerifier(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	tests := []struct {
+		name   string
+		config JWTConfig
+		want   []string
+	}{
+		{
+			name:   "Bearer tokens disabled",
+			config: JWTConfig{},
+			want:   nil,
+		},
+		{
+			name:   "Secret",
+			config: JWTConfig{Secret: "secret"},
+			want:   []string{AlgorithmHS256},
+		},
+		{
+			name:   "Successful Load of JWKS",
+			config: JWTConfig{JWKSLocation: keys.writeJWKS(t)},
+			want:   []string{AlgorithmHS256, AlgorithmRS256, AlgorithmEdDSA},
+		},
+		{
+			name:   "Bad file location rejects every token",
+			config: JWTConfig{JWKSLocation: "../../testdata/fakeLocation.json"},
+			want:   []string{},
+		},
+		{
+			name:   "Unmarshable JWKS rejects every token",
+			config: JWTConfig{JWKSLocation: "../../testdata/unmarshableState.json"},
+			want:   []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verifier := LoadJWTVerifier(tt.config)
+			if (verifier == nil) != (tt.want == nil) {
+				t.Fatalf("Verifier was not instantiated as expected. Want keys: %v, Recieved: %v", tt.want, verifier)
+			}
+			if verifier == nil {
+				return
+			}
+			algorithms := []string{}
+			for _, key := range verifier.Keys {
+				algorithms = append(algorithms, key.Algorithm)
+			}
+			if !cmp.Equal(algorithms, tt.want) {
+				t.Errorf("Verifier was not loaded with the desired keys. Want: %v, Recieved: %v", tt.want, algorithms)
+			}
+		})
+	}
+}
+
+func TestApp_authenticateBearerToken(t *testing.T) {
+	keys := newTestJWTKeys(t)
+	exp := time.Now().Add(time.Hour).Unix()
+	tests := []struct {
+		name          string
+		target        string
+		authorization string
+		adminToken    string
+		statusCode    int
+		bodyExpected  string
+	}{
+		{
+			name:          "Valid token",
+			target:        "/v1/requests/signed",
+			authorization: "Bearer " + keys.sign(t, AlgorithmHS256, "", map[string]interface{}{"sub": "alpha", "exp": exp}),
+			statusCode:    200,
+		},
+		{
+			name:          "Token scoped to the endpoint",
+			target:        "/v1/requests/signed",
+			authorization: "Bearer " + keys.sign(t, AlgorithmHS256, "", map[string]interface{}{"sub": "alpha", "exp": exp, "scope": "status"}),
+			statusCode:    200,
+		},
+		{
+			name:          "Token scoped to other endpoints",
+			target:        "/v1/requests/signed",
+			authorization: "Bearer " + keys.sign(t, AlgorithmHS256, "", map[string]interface{}{"sub": "alpha", "exp": exp, "scope": "sign"}),
+			statusCode:    403,
+			bodyExpected:  `{"error":{"code":"forbidden","message":"The credentials are not allowed to call this endpoint."}}`,
+		},
+		{
+			name:          "Invalid token",
+			target:        "/v1/requests/signed",
+			authorization: "Bearer token",
+			statusCode:    401,
+			bodyExpected:  `{"error":{"code":"unauthorized","message":"A valid bearer token is required in the Authorization header."}}`,
+		},
+		{
+			name:          "Token with the admin scope",
+			target:        "/v1/admin/requests",
+			authorization: "Bearer " + keys.sign(t, AlgorithmHS256, "", map[string]interface{}{"sub": "alpha", "exp": exp, "scope": "admin"}),
+			statusCode:    200,
+		},
+		{
+			name:          "Admin token",
+			target:        "/v1/admin/requests",
+			authorization: "Bearer token",
+			adminToken:    "token",
+			statusCode:    200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Store:      make(chan SignedRequest, 1),
+				Signatures: map[string]string{"signed": "signature"},
+				Requests:   make(map[string]PendingRequest),
+				AdminToken: tt.adminToken,
+				JWT:        LoadJWTVerifier(JWTConfig{Secret: string(keys.secret)}),
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.Header.Set("Authorization", tt.authorization)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
+			}
+			if tt.statusCode == 401 && rr.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("Handler did not set WWW-Authenticate")
+			}
+		})
+	}
+}
@@ -0,0 +1,306 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// maxIdleBuckets is how many rate limit buckets are kept before the ones that have refilled are forgotten, as a
+// full bucket behaves the same as a missing one
+const maxIdleBuckets = 10000
+
+// Limits are the inbound rate limit and rolling quotas of a client. Limits left at zero fall back to the server
+// defaults, and are off when those are zero too
+type Limits struct {
+	// RatePerSecond is the sustained rate of calls a client can make, and Burst how many it can make at once
+	RatePerSecond float64
+	Burst         int
+	// HourlyQuota and DailyQuota cap the messages a client can submit over the last hour and the last day
+	HourlyQuota int
+	DailyQuota  int
+}
+
+// tokenBucket is the rate limit state of a single client
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	// full is when the bucket will have refilled, if no more calls are made
+	full time.Time
+}
+
+// ClientLimiter enforces the rate limits and quotas of each client, safe for concurrent use by handlers. Rate
+// limits are kept in memory, while quota usage is persisted so a restart doesn't reset it
+type ClientLimiter struct {
+	mu       sync.Mutex
+	Defaults Limits
+	buckets  map[string]*tokenBucket
+	// Usage counts the messages each client, by tenant scoped id, submitted in each minute (since the epoch) of the
+	// last day
+	Usage map[string]map[int64]int
+}
+
+// limitsFor merges the limits of a client with the defaults
+func (limiter *ClientLimiter) limitsFor(client Client) Limits {
+	limits := client.Limits
+	if limits.RatePerSecond <= 0 {
+		limits.RatePerSecond = limiter.Defaults.RatePerSecond
+	}
+	if limits.Burst <= 0 {
+		limits.Burst = limiter.Defaults.Burst
+	}
+	if limits.Burst <= 0 {
+		limits.Burst = int(math.Ceil(limits.RatePerSecond))
+	}
+	if limits.HourlyQuota <= 0 {
+		limits.HourlyQuota = limiter.Defaults.HourlyQuota
+	}
+	if limits.DailyQuota <= 0 {
+		limits.DailyQuota = limiter.Defaults.DailyQuota
+	}
+	return limits
+}
+
+// Allow takes a call out of the client's rate limit. When the client is over its limit, the time until it can
+// call again is returned along with false
+func (limiter *ClientLimiter) Allow(client Client, now time.Time) (time.Duration, bool) {
+	if limiter == nil {
+		return 0, true
+	}
+	limits := limiter.limitsFor(client)
+	if limits.RatePerSecond <= 0 {
+		return 0, true
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	bucket, ok := limiter.buckets[client.scopedId()]
+	if !ok {
+		limiter.pruneBuckets(now)
+		bucket = &tokenBucket{tokens: float64(limits.Burst), updated: now}
+		limiter.buckets[client.scopedId()] = bucket
+	}
+	bucket.tokens = math.Min(float64(limits.Burst), bucket.tokens+now.Sub(bucket.updated).Seconds()*limits.RatePerSecond)
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return secondsDuration((1 - bucket.tokens) / limits.RatePerSecond), false
+	}
+	bucket.tokens--
+	bucket.full = now.Add(secondsDuration((float64(limits.Burst) - bucket.tokens) / limits.RatePerSecond))
+	return 0, true
+}
+
+// pruneBuckets forgets the buckets that have refilled once there are too many. Callers must hold the lock
+func (limiter *ClientLimiter) pruneBuckets(now time.Time) {
+	if len(limiter.buckets) < maxIdleBuckets {
+		return
+	}
+	for clientId, bucket := range limiter.buckets {
+		if !now.Before(bucket.full) {
+			delete(limiter.buckets, clientId)
+		}
+	}
+}
+
+// secondsDuration converts fractional seconds to a duration
+func secondsDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Consume takes submitted messages out of the client's quotas. When a quota would be exceeded nothing is taken,
+// and the exceeded quota is returned along with the time until there is room for the messages again
+func (limiter *ClientLimiter) Consume(client Client, messages int, now time.Time) (*QuotaExceeded, bool) {
+	if limiter == nil {
+		return nil, true
+	}
+	limits := limiter.limitsFor(client)
+	if limits.HourlyQuota <= 0 && limits.DailyQuota <= 0 {
+		return nil, true
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	usage := limiter.Usage[client.scopedId()]
+	for _, quota := range []QuotaExceeded{{Window: "hourly", Quota: limits.HourlyQuota, period: time.Hour}, {Window: "daily", Quota: limits.DailyQuota, period: 24 * time.Hour}} {
+		if quota.Quota <= 0 {
+			continue
+		}
+		if retryAfter, ok := quotaRoom(usage, quota.Quota, quota.period, messages, now); !ok {
+			quota.RetryAfter = retryAfter
+			return &quota, false
+		}
+	}
+	if usage == nil {
+		usage = make(map[int64]int)
+		limiter.Usage[client.scopedId()] = usage
+	}
+	usage[unixMinute(now)] += messages
+	return nil, true
+}
+
+// Refund gives back messages taken out of a client's quotas at the given time, for submissions that could not be
+// enqueued after all
+func (limiter *ClientLimiter) Refund(client Client, messages int, at time.Time) {
+	if limiter == nil {
+		return
+	}
+	if limits := limiter.limitsFor(client); limits.HourlyQuota <= 0 && limits.DailyQuota <= 0 {
+		return
+	}
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	usage := limiter.Usage[client.scopedId()]
+	minute := unixMinute(at)
+	if usage[minute] <= messages {
+		delete(usage, minute)
+	} else {
+		usage[minute] -= messages
+	}
+	if len(usage) == 0 {
+		delete(limiter.Usage, client.scopedId())
+	}
+}
+
+// MarshalJSON marshals the quota usage of the last day for persistence
+func (limiter *ClientLimiter) MarshalJSON() ([]byte, error) {
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+	limiter.pruneUsage(time.Now())
+	return json.Marshal(limiter.Usage)
+}
+
+// pruneUsage forgets the usage older than the longest quota window. Callers must hold the lock
+func (limiter *ClientLimiter) pruneUsage(now time.Time) {
+	oldest := unixMinute(now.Add(-24 * time.Hour))
+	for clientId, usage := range limiter.Usage {
+		for minute := range usage {
+			if minute <= oldest {
+				delete(usage, minute)
+			}
+		}
+		if len(usage) == 0 {
+			delete(limiter.Usage, clientId)
+		}
+	}
+}
+
+// QuotaExceeded describes the quota a submission would have exceeded
+type QuotaExceeded struct {
+	Window     string
+	Quota      int
+	RetryAfter time.Duration
+	period     time.Duration
+}
+
+// quotaRoom reports whether a quota over a rolling period has room for more messages. When it doesn't, the time
+// until enough of the usage has rolled out of the period is returned too
+func quotaRoom(usage map[int64]int, quota int, period time.Duration, messages int, now time.Time) (time.Duration, bool) {
+	oldest := unixMinute(now.Add(-period))
+	minutes := make([]int64, 0, len(usage))
+	used := 0
+	for minute, count := range usage {
+		if minute > oldest {
+			minutes = append(minutes, minute)
+			used += count
+		}
+	}
+	if used+messages <= quota {
+		return 0, true
+	}
+	sort.Slice(minutes, func(i, j int) bool { return minutes[i] < minutes[j] })
+	for _, minute := range minutes {
+		used -= usage[minute]
+		if used+messages <= quota {
+			// The usage of a minute rolls out of the period a period after the minute began
+			return time.Unix(minute*60, 0).Add(period).Sub(now), false
+		}
+	}
+	// The messages exceed the quota on their own, so waiting can't help. Report a whole period regardless
+	return period, false
+}
+
+// unixMinute is the minute since the epoch a time falls in
+func unixMinute(t time.Time) int64 {
+	return t.Unix() / 60
+}
+
+// rateLimit is a middleware applying the rate limit of the calling client. The public endpoints, and admin calls
+// made with the admin token, have no client and aren't limited
+func (application *Application) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, ok := clientFromContext(r)
+		if route := mux.CurrentRoute(r); !ok || route == nil || publicEndpoints[route.GetName()] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if retryAfter, ok := application.Limits.Allow(client, time.Now()); !ok {
+			logFromRequest(r).Debugf("Client %v is over its rate limit", client.Id)
+			writeMessageError(v1Writer(w, r), &MessageError{
+				StatusCode: http.StatusTooManyRequests,
+				Code:       ErrorRateLimited,
+				Reason:     "Too many requests. Please slow down, and try again after the Retry-After interval.",
+				RetryAfter: retryAfter.Minutes(),
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkClientLimits checks a submission of the given number of messages against the calling client's limits on
+// queued requests and quotas, taking the messages out of its quotas when it is within them
+func (application *Application) checkClientLimits(r *http.Request, messages int, now time.Time) *MessageError {
+	if err := application.checkQueuedLimit(r, messages); err != nil {
+		return err
+	}
+	return application.consumeQuota(r, messages, now)
+}
+
+// consumeQuota takes the submitted messages out of the calling client's quotas
+func (application *Application) consumeQuota(r *http.Request, messages int, now time.Time) *MessageError {
+	client, _ := clientFromContext(r)
+	if exceeded, ok := application.Limits.Consume(client, messages, now); !ok {
+		return &MessageError{
+			StatusCode: http.StatusTooManyRequests,
+			Code:       ErrorQuotaExceeded,
+			Reason:     fmt.Sprintf("The %s quota of %d messages has been used up. Please try again after the Retry-After interval.", exceeded.Window, exceeded.Quota),
+			RetryAfter: exceeded.RetryAfter.Minutes(),
+		}
+	}
+	return nil
+}
+
+// refundQuota gives back messages taken out of the calling client's quotas for a submission that wasn't enqueued
+func (application *Application) refundQuota(r *http.Request, messages int, at time.Time) {
+	client, _ := clientFromContext(r)
+	application.Limits.Refund(client, messages, at)
+}
+
+// InstantiateClientLimiter creates a new limiter with the default limits and recreates previous quota usage
+// if applicable, dropping usage that has aged out of every quota
+func InstantiateClientLimiter(quotasPersistenceLocation string, defaults Limits) *ClientLimiter {
+	limiter := &ClientLimiter{Defaults: defaults, buckets: make(map[string]*tokenBucket), Usage: make(map[string]map[int64]int)}
+	usageBytes, err := os.ReadFile(quotasPersistenceLocation)
+	if err != nil {
+		logrus.Errorf("Was unable to read quotas file. Details: %v", err)
+		return limiter
+	}
+	if len(usageBytes) > 0 {
+		var usage map[string]map[int64]int
+		if err := json.Unmarshal(usageBytes, &usage); err != nil {
+			logrus.Errorf("Was unable to unmarshal quotas into object. Details: %v", err)
+			return limiter
+		}
+		if usage != nil {
+			limiter.Usage = usage
+		}
+	}
+	limiter.pruneUsage(time.Now())
+	return limiter
+}
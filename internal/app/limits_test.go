@@ -0,0 +1,345 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClientLimiter_Allow(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		defaults   Limits
+		client     Client
+		calls      []time.Duration
+		want       []bool
+		retryAfter time.Duration
+	}{
+		{
+			name:  "Unlimited",
+			calls: []time.Duration{0, 0, 0},
+			want:  []bool{true, true, true},
+		},
+		{
+			name:       "Burst then rate",
+			defaults:   Limits{RatePerSecond: 2, Burst: 2},
+			calls:      []time.Duration{0, 0, 0, 500 * time.Millisecond, 500 * time.Millisecond},
+			want:       []bool{true, true, false, true, false},
+			retryAfter: 500 * time.Millisecond,
+		},
+		{
+			name:       "Burst defaults to the rate",
+			defaults:   Limits{RatePerSecond: 0.5},
+			calls:      []time.Duration{0, time.Second},
+			want:       []bool{true, false},
+			retryAfter: time.Second,
+		},
+		{
+			name:     "Client limits override the defaults",
+			defaults: Limits{RatePerSecond: 1, Burst: 1},
+			client:   Client{Limits: Limits{Burst: 3}},
+			calls:    []time.Duration{0, 0, 0},
+			want:     []bool{true, true, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := InstantiateClientLimiter("", tt.defaults)
+			var retryAfter time.Duration
+			for i, offset := range tt.calls {
+				var ok bool
+				retryAfter, ok = limiter.Allow(tt.client, now.Add(offset))
+				if ok != tt.want[i] {
+					t.Errorf("Call %v was not limited as expected. Want: %v, Recieved: %v", i, tt.want[i], ok)
+				}
+			}
+			if !cmp.Equal(retryAfter, tt.retryAfter) {
+				t.Errorf("Retry after was not as expected. Want: %v, Recieved: %v", tt.retryAfter, retryAfter)
+			}
+		})
+	}
+}
+
+func TestClientLimiter_Consume(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	tests := []struct {
+		name       string
+		defaults   Limits
+		usage      map[int64]int
+		messages   int
+		want       *QuotaExceeded
+		wantUsage  map[string]map[int64]int
+		refundedAt time.Time
+	}{
+		{
+			name:      "Unlimited",
+			messages:  5,
+			wantUsage: map[string]map[int64]int{},
+		},
+		{
+			name:      "Within quota",
+			defaults:  Limits{HourlyQuota: 5},
+			usage:     map[int64]int{unixMinute(now) - 10: 2},
+			messages:  3,
+			wantUsage: map[string]map[int64]int{"alpha": {unixMinute(now) - 10: 2, unixMinute(now): 3}},
+		},
+		{
+			name:      "Usage rolled out of the hour",
+			defaults:  Limits{HourlyQuota: 5},
+			usage:     map[int64]int{unixMinute(now) - 60: 5},
+			messages:  5,
+			wantUsage: map[string]map[int64]int{"alpha": {unixMinute(now) - 60: 5, unixMinute(now): 5}},
+		},
+		{
+			name:      "Hourly quota exceeded",
+			defaults:  Limits{HourlyQuota: 5, DailyQuota: 100},
+			usage:     map[int64]int{unixMinute(now) - 50: 2, unixMinute(now) - 40: 2},
+			messages:  3,
+			want:      &QuotaExceeded{Window: "hourly", Quota: 5, RetryAfter: time.Unix((unixMinute(now)-50)*60, 0).Add(time.Hour).Sub(now), period: time.Hour},
+			wantUsage: map[string]map[int64]int{"alpha": {unixMinute(now) - 50: 2, unixMinute(now) - 40: 2}},
+		},
+		{
+			name:      "Daily quota exceeded",
+			defaults:  Limits{HourlyQuota: 5, DailyQuota: 6},
+			usage:     map[int64]int{unixMinute(now) - 120: 5},
+			messages:  2,
+			want:      &QuotaExceeded{Window: "daily", Quota: 6, RetryAfter: time.Unix((unixMinute(now)-120)*60, 0).Add(24 * time.Hour).Sub(now), period: 24 * time.Hour},
+			wantUsage: map[string]map[int64]int{"alpha": {unixMinute(now) - 120: 5}},
+		},
+		{
+			name:      "More messages than the quota",
+			defaults:  Limits{HourlyQuota: 5},
+			messages:  6,
+			want:      &QuotaExceeded{Window: "hourly", Quota: 5, RetryAfter: time.Hour, period: time.Hour},
+			wantUsage: map[string]map[int64]int{},
+		},
+		{
+			name:       "Refunded",
+			defaults:   Limits{HourlyQuota: 5},
+			usage:      map[int64]int{unixMinute(now) - 10: 2},
+			messages:   3,
+			wantUsage:  map[string]map[int64]int{"alpha": {unixMinute(now) - 10: 2}},
+			refundedAt: now,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := InstantiateClientLimiter("", tt.defaults)
+			if tt.usage != nil {
+				limiter.Usage["alpha"] = tt.usage
+			}
+			client := Client{Id: "alpha"}
+			exceeded, ok := limiter.Consume(client, tt.messages, now)
+			if ok != (tt.want == nil) || !cmp.Equal(exceeded, tt.want, cmp.AllowUnexported(QuotaExceeded{})) {
+				t.Errorf("Quota was not consumed as expected. Want: %v, Recieved: %v", tt.want, exceeded)
+			}
+			if !tt.refundedAt.IsZero() {
+				limiter.Refund(client, tt.messages, tt.refundedAt)
+			}
+			if !cmp.Equal(limiter.Usage, tt.wantUsage) {
+				t.Errorf("Usage was not as expected. Want: %v, Recieved: %v", tt.wantUsage, limiter.Usage)
+			}
+		})
+	}
+}
+
+func TestApp_rateLimit(t *testing.T) {
+	application := Application{
+		Store:      make(chan SignedRequest, 2),
+		Signatures: map[string]string{"signed": "signature"},
+		Requests:   make(map[string]PendingRequest),
+		Limits:     InstantiateClientLimiter("", Limits{RatePerSecond: 0.1, Burst: 1}),
+	}
+	router := NewRouter(&application)
+	tests := []struct {
+		name         string
+		target       string
+		clientId     string
+		statusCode   int
+		bodyExpected string
+	}{
+		{
+			name:       "First call",
+			target:     "/v1/requests/signed",
+			clientId:   "alpha",
+			statusCode: 200,
+		},
+		{
+			name:         "Over the rate limit",
+			target:       "/v1/requests/signed",
+			clientId:     "alpha",
+			statusCode:   429,
+			bodyExpected: `{"error":{"code":"rate_limited","message":"Too many requests. Please slow down, and try again after the Retry-After interval."}}`,
+		},
+		{
+			name:         "Legacy route over the rate limit",
+			target:       "/crypto/sign/request/signed",
+			clientId:     "alpha",
+			statusCode:   429,
+			bodyExpected: `"StatusCode":429`,
+		},
+		{
+			name:       "Other clients are unaffected",
+			target:     "/v1/requests/signed",
+			clientId:   "beta",
+			statusCode: 200,
+		},
+		{
+			name:       "Health checks are not limited",
+			target:     "/v1/health",
+			clientId:   "alpha",
+			statusCode: 200,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.Header.Set("X-Client-Id", tt.clientId)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
+			}
+			if tt.statusCode == 429 && rr.Header().Get("Retry-After") != "10" {
+				t.Errorf("Handler returned wrong Retry-After: got %v want %v", rr.Header().Get("Retry-After"), "10")
+			}
+		})
+	}
+}
+
+func TestApp_quotas(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		queueSize  int
+		statusCode int
+		wantUsed   int
+	}{
+		{
+			name:       "Submission within quota",
+			target:     "/v1/requests?wait=0",
+			body:       `{"message":"taco"}`,
+			queueSize:  1,
+			statusCode: 202,
+			wantUsed:   3,
+		},
+		{
+			name:       "Batch over quota",
+			target:     "/v1/batches",
+			body:       `{"messages":["taco","burrito"]}`,
+			queueSize:  2,
+			statusCode: 429,
+			wantUsed:   2,
+		},
+		{
+			name:       "Submission refunded when the queue is full",
+			target:     "/v1/requests",
+			body:       `{"message":"taco"}`,
+			statusCode: 503,
+			wantUsed:   2,
+		},
+		{
+			name:       "Batch refunded when the queue is full",
+			target:     "/v1/batches",
+			body:       `{"messages":["taco"]}`,
+			queueSize:  0,
+			statusCode: 503,
+			wantUsed:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := InstantiateClientLimiter("", Limits{HourlyQuota: 3})
+			limiter.Usage["alpha"] = map[int64]int{unixMinute(time.Now()) - 1: 2}
+			application := Application{
+				Queue:    NewFairQueue(tt.queueSize, nil),
+				Track:    make(chan PendingRequest, 2),
+				Requests: make(map[string]PendingRequest),
+				Batches:  &BatchStore{Batches: make(map[string]Batch)},
+				Events:   NewEventBroker(),
+				Limits:   limiter,
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest("POST", tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Client-Id", "alpha")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if tt.statusCode == 429 && (!strings.Contains(rr.Body.String(), `"code":"quota_exceeded"`) || rr.Header().Get("Retry-After") == "") {
+				t.Errorf("Handler returned unexpected quota rejection: got %v with Retry-After %v", rr.Body.String(), rr.Header().Get("Retry-After"))
+			}
+			used := 0
+			for _, count := range limiter.Usage["alpha"] {
+				used += count
+			}
+			if used != tt.wantUsed {
+				t.Errorf("Quota usage was not as expected. Want: %v, Recieved: %v", tt.wantUsed, used)
+			}
+		})
+	}
+}
+
+func TestInstantiateClientLimiter(t *testing.T) {
+	current := map[string]map[int64]int{"alpha": {unixMinute(time.Now()): 3}}
+	currentBytes, err := json.Marshal(current)
+	if err != nil {
+		t.Errorf("Was unable to marshal current quota usage. Details: %v", err)
+	}
+	currentLocation := filepath.Join(t.TempDir(), "quotas.json")
+	if err := os.WriteFile(currentLocation, currentBytes, 0600); err != nil {
+		t.Errorf("Was unable to write current quota usage. Details: %v", err)
+	}
+	tests := []struct {
+		name              string
+		inputFileLocation string
+		want              map[string]map[int64]int
+	}{
+		{
+			name:              "Successful Load of current usage",
+			inputFileLocation: currentLocation,
+			want:              current,
+		},
+		{
+			name:              "Usage older than a day is dropped",
+			inputFileLocation: "../../testdata/populatedQuotasState.json",
+			want:              make(map[string]map[int64]int),
+		},
+		{
+			name:              "Successful Load of empty state (fresh start)",
+			inputFileLocation: "../../testdata/emptyState.json",
+			want:              make(map[string]map[int64]int),
+		},
+		{
+			name:              "Bad file location",
+			inputFileLocation: "../../testdata/fakeLocation.json",
+			want:              make(map[string]map[int64]int),
+		},
+		{
+			name:              "Unmarshable state",
+			inputFileLocation: "../../testdata/unmarshableState.json",
+			want:              make(map[string]map[int64]int),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := InstantiateClientLimiter(tt.inputFileLocation, Limits{})
+			if !cmp.Equal(limiter.Usage, tt.want) {
+				t.Errorf("Quota usage was not instantiated to the desired state. Want: %v, Recieved: %v", tt.want, limiter.Usage)
+			}
+		})
+	}
+}
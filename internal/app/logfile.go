@@ -0,0 +1,185 @@
+package app
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// backupTimeFormat names rotated log files after the time they were rotated, so they sort in the order they were
+// written
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// For mocking in tests
+var logClock = time.Now
+
+// RotatingFile is a log file rotated once it grows past its max size, or has been written to for its max age.
+// Rotated files are named after the time they were rotated, optionally compressed with gzip, and the oldest are
+// deleted beyond the number kept
+type RotatingFile struct {
+	Path string
+	// MaxSize is the size in bytes the file is rotated at, never when 0
+	MaxSize int64
+	// MaxAge is how long the file is written to before it is rotated, never when 0
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated files kept, all of them when 0
+	MaxBackups int
+	// Compress gzips rotated files
+	Compress bool
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	opened   time.Time
+	// Rotated files are compressed and pruned in the background, one rotation at a time, so logging isn't held up
+	maintenance     sync.WaitGroup
+	maintenanceLock sync.Mutex
+}
+
+// Write appends a log line to the file, first rotating it when the line would take it past its max size, or it has
+// reached its max age
+func (file *RotatingFile) Write(p []byte) (int, error) {
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if file.file == nil {
+		if err := file.open(); err != nil {
+			return 0, err
+		}
+	}
+	now := logClock()
+	tooBig := file.MaxSize > 0 && file.size+int64(len(p)) > file.MaxSize
+	tooOld := file.MaxAge > 0 && now.Sub(file.opened) >= file.MaxAge
+	if file.size > 0 && (tooBig || tooOld) {
+		if err := file.rotate(now); err != nil {
+			return 0, err
+		}
+	}
+	n, err := file.file.Write(p)
+	file.size += int64(n)
+	return n, err
+}
+
+// Close closes the file once rotated files are compressed and pruned. Writing again reopens it
+func (file *RotatingFile) Close() error {
+	if file == nil {
+		return nil
+	}
+	// Compressing and pruning may log, so is waited on before taking the lock writing needs
+	file.maintenance.Wait()
+	file.mu.Lock()
+	defer file.mu.Unlock()
+	if file.file == nil {
+		return nil
+	}
+	err := file.file.Close()
+	file.file = nil
+	return err
+}
+
+// open opens the file for appending, creating it and its directory when missing
+func (file *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(file.Path), 0755); err != nil {
+		return err
+	}
+	opened, err := os.OpenFile(file.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := opened.Stat()
+	if err != nil {
+		opened.Close()
+		return err
+	}
+	file.file, file.size, file.opened = opened, info.Size(), logClock()
+	return nil
+}
+
+// rotate moves the file aside, named after the time it was rotated, and opens a new one in its place
+func (file *RotatingFile) rotate(now time.Time) error {
+	if err := file.file.Close(); err != nil {
+		return err
+	}
+	file.file = nil
+	backup := file.Path + "." + now.UTC().Format(backupTimeFormat)
+	if err := os.Rename(file.Path, backup); err != nil {
+		return err
+	}
+	if err := file.open(); err != nil {
+		return err
+	}
+	file.maintenance.Add(1)
+	go func() {
+		defer file.maintenance.Done()
+		file.maintain(backup)
+	}()
+	return nil
+}
+
+// maintain compresses a newly rotated file, and deletes the oldest rotated files beyond the number kept
+func (file *RotatingFile) maintain(backup string) {
+	file.maintenanceLock.Lock()
+	defer file.maintenanceLock.Unlock()
+	if file.Compress {
+		if err := compressFile(backup); err != nil {
+			logrus.Errorf("Was unable to compress rotated log file %v. Details: %v", backup, err)
+		}
+	}
+	if file.MaxBackups <= 0 {
+		return
+	}
+	backups := file.backups()
+	if len(backups) <= file.MaxBackups {
+		return
+	}
+	for _, old := range backups[:len(backups)-file.MaxBackups] {
+		if err := os.Remove(old); err != nil {
+			logrus.Errorf("Was unable to delete rotated log file %v. Details: %v", old, err)
+		}
+	}
+}
+
+// backups lists the rotated files, oldest first
+func (file *RotatingFile) backups() []string {
+	matches, _ := filepath.Glob(file.Path + ".*")
+	var backups []string
+	for _, match := range matches {
+		rotated := strings.TrimSuffix(strings.TrimPrefix(match, file.Path+"."), ".gz")
+		if _, err := time.Parse(backupTimeFormat, rotated); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups
+}
+
+// compressFile gzips a file, replacing it with the compressed copy
+func compressFile(path string) error {
+	source, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	compressed, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(compressed)
+	_, err = io.Copy(writer, source)
+	if err == nil {
+		err = writer.Close()
+	}
+	if closeErr := compressed.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
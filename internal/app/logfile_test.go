@@ -0,0 +1,121 @@
+package app
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRotatingFile_Write(t *testing.T) {
+	start := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		file     *RotatingFile
+		advance  time.Duration
+		current  string
+		rotated  []string
+		contents []string
+	}{
+		{
+			name:     "Rotated by size",
+			file:     &RotatingFile{MaxSize: 12},
+			advance:  time.Millisecond,
+			current:  "line 3\n",
+			rotated:  []string{"app.log.2030-01-02T15-04-05.001", "app.log.2030-01-02T15-04-05.002"},
+			contents: []string{"line 1\n", "line 2\n"},
+		},
+		{
+			name:     "Rotated by age",
+			file:     &RotatingFile{MaxAge: 2 * time.Hour},
+			advance:  time.Hour,
+			current:  "line 3\n",
+			rotated:  []string{"app.log.2030-01-02T17-04-05.000"},
+			contents: []string{"line 1\nline 2\n"},
+		},
+		{
+			name:     "Rotated files compressed",
+			file:     &RotatingFile{MaxSize: 12, Compress: true},
+			advance:  time.Millisecond,
+			current:  "line 3\n",
+			rotated:  []string{"app.log.2030-01-02T15-04-05.001.gz", "app.log.2030-01-02T15-04-05.002.gz"},
+			contents: []string{"line 1\n", "line 2\n"},
+		},
+		{
+			name:     "Oldest rotated files deleted",
+			file:     &RotatingFile{MaxSize: 12, MaxBackups: 1},
+			advance:  time.Millisecond,
+			current:  "line 3\n",
+			rotated:  []string{"app.log.2030-01-02T15-04-05.002"},
+			contents: []string{"line 2\n"},
+		},
+		{
+			name:    "Not rotated",
+			file:    &RotatingFile{MaxSize: 1024, MaxAge: 24 * time.Hour},
+			advance: time.Hour,
+			current: "line 1\nline 2\nline 3\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now := start
+			logClock = func() time.Time { return now }
+			defer func() { logClock = time.Now }()
+			dir := t.TempDir()
+			file := tt.file
+			file.Path = filepath.Join(dir, "app.log")
+			for _, line := range []string{"line 1\n", "line 2\n", "line 3\n"} {
+				if _, err := file.Write([]byte(line)); err != nil {
+					t.Fatalf("Unable to write to log file. Details: %v", err.Error())
+				}
+				now = now.Add(tt.advance)
+			}
+			if err := file.Close(); err != nil {
+				t.Fatalf("Unable to close log file. Details: %v", err.Error())
+			}
+			current, _ := os.ReadFile(file.Path)
+			if string(current) != tt.current {
+				t.Errorf("Unexpected log file. Want: %q, Recieved: %q", tt.current, current)
+			}
+			rotated := file.backups()
+			for i := range rotated {
+				rotated[i] = filepath.Base(rotated[i])
+			}
+			if !cmp.Equal(rotated, tt.rotated) {
+				t.Errorf("Unexpected rotated files. Want: %v, Recieved: %v", tt.rotated, rotated)
+			}
+			for i, name := range rotated {
+				if i >= len(tt.contents) {
+					break
+				}
+				if contents := readLogFile(t, filepath.Join(dir, name), file.Compress); contents != tt.contents[i] {
+					t.Errorf("Unexpected contents of %v. Want: %q, Recieved: %q", name, tt.contents[i], contents)
+				}
+			}
+		})
+	}
+}
+
+// readLogFile reads a rotated log file, decompressing it when compressed
+func readLogFile(t *testing.T, path string, compressed bool) string {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Unable to open rotated log file. Details: %v", err.Error())
+	}
+	defer file.Close()
+	var reader io.Reader = file
+	if compressed {
+		if reader, err = gzip.NewReader(file); err != nil {
+			t.Fatalf("Rotated log file is not compressed. Details: %v", err.Error())
+		}
+	}
+	contents, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Unable to read rotated log file. Details: %v", err.Error())
+	}
+	return string(contents)
+}
@@ -0,0 +1,229 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Formats of log lines
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// redactedValue takes the place of secrets and message content redacted from logs
+const redactedValue = "[REDACTED]"
+
+// sensitiveLogFields are the fields whose values are always redacted from logs, in lower case
+var sensitiveLogFields = map[string]bool{"apikey": true, "x-api-key": true, "authorization": true, "token": true, "secret": true, "password": true}
+
+// credentialPatterns match credentials within log lines, capturing what precedes the credential so it is kept
+var credentialPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[^\s"',]+`),
+	regexp.MustCompile(`(?i)(x-api-key["']?\s*[:=]\s*["']?)[^\s"',&]+`),
+	regexp.MustCompile(`(?i)([?&](?:api_?key|token)=)[^\s"&]+`),
+}
+
+// messageParamPattern matches message content sent to the signing service within a url, such as in the errors of
+// upstream calls, which is redacted in privacy mode
+var messageParamPattern = regexp.MustCompile(`([?&]message=)[^\s"&]*`)
+
+// LogConfig sets how logs are formatted, where they are written and what is redacted from them
+type LogConfig struct {
+	// Format is either text or json, text when unset
+	Format string
+	// File is the path logs are written to, stderr when unset
+	File string
+	// MaxSize is the size in bytes the log file is rotated at, never when 0
+	MaxSize int64
+	// MaxAge is how long the log file is written to before it is rotated, never when 0
+	MaxAge time.Duration
+	// MaxBackups is the number of rotated log files kept, all of them when 0
+	MaxBackups int
+	// Compress gzips rotated log files
+	Compress bool
+	// Privacy redacts message content from logs
+	Privacy bool
+	// Secrets are redacted wherever they appear in logs, such as the admin token
+	Secrets []string
+}
+
+// ConfigureLogging sets the format and output of a logger, and redacts secrets from every line it writes. The log
+// file is returned so it can be closed on shutdown, and is nil when logging to stderr, which logs stay on when the
+// file can't be opened
+func ConfigureLogging(logger *logrus.Logger, config LogConfig) *RotatingFile {
+	var formatter logrus.Formatter = &logrus.TextFormatter{}
+	switch config.Format {
+	case "", LogFormatText:
+	case LogFormatJSON:
+		formatter = &logrus.JSONFormatter{}
+	default:
+		logger.Errorf("Unrecognized log format %q, logging as text", config.Format)
+	}
+	logger.SetFormatter(&redactingFormatter{Formatter: formatter, redactor: NewRedactor(config.Privacy, config.Secrets)})
+	if config.File == "" {
+		return nil
+	}
+	file := &RotatingFile{
+		Path:       config.File,
+		MaxSize:    config.MaxSize,
+		MaxAge:     config.MaxAge,
+		MaxBackups: config.MaxBackups,
+		Compress:   config.Compress,
+	}
+	if err := file.open(); err != nil {
+		logger.Errorf("Was unable to open log file, logging to stderr. Details: %v", err)
+		return nil
+	}
+	logger.SetOutput(file)
+	return file
+}
+
+// Redactor removes credentials and configured secrets from log lines, and message content in privacy mode
+type Redactor struct {
+	privacy bool
+	secrets []string
+}
+
+// NewRedactor creates a redactor of the given secrets, also redacting message content in privacy mode
+func NewRedactor(privacy bool, secrets []string) *Redactor {
+	redactor := &Redactor{privacy: privacy}
+	for _, secret := range secrets {
+		if secret != "" {
+			redactor.secrets = append(redactor.secrets, secret)
+		}
+	}
+	return redactor
+}
+
+// Redact replaces the secrets within text
+func (redactor *Redactor) Redact(text string) string {
+	for _, secret := range redactor.secrets {
+		text = strings.ReplaceAll(text, secret, redactedValue)
+	}
+	for _, pattern := range credentialPatterns {
+		text = pattern.ReplaceAllString(text, "${1}"+redactedValue)
+	}
+	if redactor.privacy {
+		text = messageParamPattern.ReplaceAllString(text, "${1}"+redactedValue)
+	}
+	return text
+}
+
+// redactField replaces the value of a sensitive field, or the secrets within it
+func (redactor *Redactor) redactField(key string, value interface{}) interface{} {
+	key = strings.ToLower(key)
+	if sensitiveLogFields[key] || redactor.privacy && key == "message" {
+		return redactedValue
+	}
+	switch typed := value.(type) {
+	case string:
+		return redactor.Redact(typed)
+	case error:
+		return redactor.Redact(typed.Error())
+	default:
+		return value
+	}
+}
+
+// redactingFormatter redacts every log line before formatting it, so nothing logged can leak a secret
+type redactingFormatter struct {
+	logrus.Formatter
+	redactor *Redactor
+}
+
+// Format redacts the message and fields of a log line. Each line is a copy made for the formatter, which can be
+// changed freely
+func (formatter *redactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	entry.Message = formatter.redactor.Redact(entry.Message)
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		data[key] = formatter.redactor.redactField(key, value)
+	}
+	entry.Data = data
+	return formatter.Formatter.Format(entry)
+}
+
+// CorrelationIdHeader carries the id tying a call to the log lines of the work it leads to. Callers may supply their
+// own, and it is echoed back on every response
+const CorrelationIdHeader = "X-Request-ID"
+
+// correlationIdPattern matches the correlation ids accepted from callers, which are replaced with a new id otherwise.
+// New ids are generated apart from request ids, so they never take the place of one
+var correlationIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:/+=-]{0,127}$`)
+
+// callLog gathers what the access log line of a call reports, as the handlers learn it
+type callLog struct {
+	correlationId string
+	clientId      string
+}
+
+// callLogContextKey is the context key the access log entry of a call is stored under
+type callLogContextKey struct{}
+
+// logRequests is a middleware writing an access log line for every call, and tying the call to the log lines of the
+// work it leads to with a correlation id. The id is taken from the X-Request-ID header when valid, and generated
+// otherwise
+func (application *Application) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		call := &callLog{correlationId: r.Header.Get(CorrelationIdHeader)}
+		if !correlationIdPattern.MatchString(call.correlationId) {
+			call.correlationId = uuid.New().String()
+		}
+		w.Header().Set(CorrelationIdHeader, call.correlationId)
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), callLogContextKey{}, call)))
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		logrus.WithFields(logrus.Fields{
+			"correlationId": call.correlationId,
+			"method":        r.Method,
+			"path":          r.URL.Path,
+			"route":         route,
+			"status":        recorder.statusCode,
+			"latencyMs":     float64(time.Since(start).Microseconds()) / 1000,
+			"client":        call.clientId,
+		}).Info("Handled call")
+	})
+}
+
+// recordClient notes the client making a call for its access log line
+func recordClient(r *http.Request, client Client) {
+	if call, ok := r.Context().Value(callLogContextKey{}).(*callLog); ok {
+		call.clientId = client.Id
+	}
+}
+
+// correlationIdFromRequest is the correlation id of a call, carried by the requests it queues so the log lines of the
+// work done on them can be tied back to the call
+func correlationIdFromRequest(r *http.Request) string {
+	if call, ok := r.Context().Value(callLogContextKey{}).(*callLog); ok {
+		return call.correlationId
+	}
+	return ""
+}
+
+// logFromRequest is a logger whose lines carry the correlation id of a call
+func logFromRequest(r *http.Request) *logrus.Entry {
+	return logrus.WithField("correlationId", correlationIdFromRequest(r))
+}
+
+// log is a logger whose lines carry the id of a request, and the correlation id of the call that submitted it
+func (request Request) log() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{"requestId": request.RequestId, "correlationId": request.CorrelationId})
+}
+
+// log is a logger whose lines carry the id of a signed request, and the correlation id of the call that submitted it
+func (signedRequest SignedRequest) log() *logrus.Entry {
+	return logrus.WithFields(logrus.Fields{"requestId": signedRequest.RequestId, "correlationId": signedRequest.CorrelationId})
+}
@@ -0,0 +1,142 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultMaxMessageBytes is the largest message (or POST body) accepted when no limit has been configured
+const DefaultMaxMessageBytes int64 = 64 * 1024
+
+// MessageBody represents a JSON request body for a new encryption request
+type MessageBody struct {
+	Message     string            `json:"message"`
+	CallbackUrl string            `json:"callbackUrl"`
+	RequestId   string            `json:"requestId"`
+	Metadata    map[string]string `json:"metadata"`
+	Priority    string            `json:"priority"`
+	NotBefore   string            `json:"notBefore"`
+	Deadline    string            `json:"deadline"`
+}
+
+// MessageError describes why a message could not be read from a request, and the status code to respond with
+type MessageError struct {
+	StatusCode int
+	// Code is the machine-readable error code, derived from the status code when unset
+	Code   string
+	Reason string
+	// RetryAfter is the time, in minutes, after which the request may succeed if retried
+	RetryAfter float64
+}
+
+func (e *MessageError) Error() string {
+	return e.Reason
+}
+
+// ErrorCode returns the machine-readable error code of the error
+func (e *MessageError) ErrorCode() string {
+	if e.Code != "" {
+		return e.Code
+	}
+	switch e.StatusCode {
+	case http.StatusRequestEntityTooLarge:
+		return ErrorPayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return ErrorUnsupportedMediaType
+	default:
+		return ErrorInvalidRequest
+	}
+}
+
+// maxMessageBytes returns the configured message size limit, falling back to the default when unset
+func (application *Application) maxMessageBytes() int64 {
+	if application.MaxMessageBytes <= 0 {
+		return DefaultMaxMessageBytes
+	}
+	return application.MaxMessageBytes
+}
+
+// readMessage retrieves the message candidate for encryption from a request. GET requests carry the message
+// as a query parameter, while POST requests carry it in an 'application/json' or 'text/plain' body. Outside of
+// a JSON body, the optional callback url, request id, priority, notBefore time and deadline are read from the query
+// parameters of the same names, and metadata can't be supplied
+func readMessage(r *http.Request, maxBytes int64) (MessageBody, *MessageError) {
+	queryItems := r.URL.Query()
+	if r.Method != http.MethodPost {
+		message := queryItems.Get("message")
+		if int64(len(message)) > maxBytes {
+			return MessageBody{}, messageTooLarge(maxBytes)
+		}
+		return queryMessageBody(message, queryItems), nil
+	}
+
+	mediaType := "text/plain"
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		parsed, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return MessageBody{}, &MessageError{StatusCode: http.StatusBadRequest, Reason: "The Content-Type header could not be parsed."}
+		}
+		mediaType = parsed
+	}
+
+	// Read one byte past the limit so oversized bodies can be told apart from bodies exactly at the limit
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBytes+1))
+	if err != nil {
+		return MessageBody{}, &MessageError{StatusCode: http.StatusBadRequest, Reason: "The request body could not be read."}
+	}
+
+	if int64(len(body)) > maxBytes {
+		return MessageBody{}, messageTooLarge(maxBytes)
+	}
+
+	switch mediaType {
+	case "application/json":
+		var messageBody MessageBody
+		if err := json.Unmarshal(body, &messageBody); err != nil {
+			return MessageBody{}, &MessageError{StatusCode: http.StatusBadRequest, Reason: "The request body is not valid JSON. Expected {\"message\": string}."}
+		}
+		return messageBody, nil
+	case "text/plain":
+		return queryMessageBody(string(body), queryItems), nil
+	default:
+		return MessageBody{}, &MessageError{StatusCode: http.StatusUnsupportedMediaType, Reason: "Unsupported Content-Type. Use 'application/json' or 'text/plain'."}
+	}
+}
+
+// queryMessageBody creates the body of a message supplied outside of a JSON body, with the optional fields read from
+// the query parameters
+func queryMessageBody(message string, queryItems url.Values) MessageBody {
+	return MessageBody{
+		Message:     message,
+		CallbackUrl: queryItems.Get("callbackUrl"),
+		RequestId:   queryItems.Get("requestId"),
+		Priority:    queryItems.Get("priority"),
+		NotBefore:   queryItems.Get("notBefore"),
+		Deadline:    queryItems.Get("deadline"),
+	}
+}
+
+// parseTimestamp reads an optional RFC 3339 timestamp supplied with a submission under the given name
+func parseTimestamp(name string, timestamp string) (*time.Time, *MessageError) {
+	if timestamp == "" {
+		return nil, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return nil, &MessageError{StatusCode: http.StatusBadRequest, Reason: fmt.Sprintf("The %s must be an RFC 3339 timestamp, such as '2030-01-02T15:04:05Z'.", name)}
+	}
+	return &parsed, nil
+}
+
+// messageTooLarge creates the error returned when a message exceeds the configured size limit
+func messageTooLarge(maxBytes int64) *MessageError {
+	return &MessageError{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Reason:     fmt.Sprintf("The message exceeds the maximum size of %d bytes.", maxBytes),
+	}
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name            string
+		method          string
+		target          string
+		contentType     string
+		body            string
+		maxBytes        int64
+		want            string
+		wantCallbackUrl string
+		wantStatusCode  int
+	}{
+		{
+			name:     "GET message from query parameter",
+			method:   "GET",
+			target:   "/crypto/sign?message=taco",
+			maxBytes: DefaultMaxMessageBytes,
+			want:     "taco",
+		},
+		{
+			name:            "GET message with callback url",
+			method:          "GET",
+			target:          "/crypto/sign?message=taco&callbackUrl=https%3A%2F%2Fexample.com%2Fhook",
+			maxBytes:        DefaultMaxMessageBytes,
+			want:            "taco",
+			wantCallbackUrl: "https://example.com/hook",
+		},
+		{
+			name:           "GET message over size limit",
+			method:         "GET",
+			target:         "/crypto/sign?message=chicken",
+			maxBytes:       4,
+			wantStatusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "POST JSON body",
+			method:      "POST",
+			target:      "/crypto/sign",
+			contentType: "application/json",
+			body:        `{"message": "taco & chicken"}`,
+			maxBytes:    DefaultMaxMessageBytes,
+			want:        "taco & chicken",
+		},
+		{
+			name:            "POST JSON body with callback url",
+			method:          "POST",
+			target:          "/crypto/sign",
+			contentType:     "application/json",
+			body:            `{"message": "taco", "callbackUrl": "https://example.com/hook"}`,
+			maxBytes:        DefaultMaxMessageBytes,
+			want:            "taco",
+			wantCallbackUrl: "https://example.com/hook",
+		},
+		{
+			name:        "POST plain text body with charset",
+			method:      "POST",
+			target:      "/crypto/sign",
+			contentType: "text/plain; charset=utf-8",
+			body:        "taco?message=chicken",
+			maxBytes:    DefaultMaxMessageBytes,
+			want:        "taco?message=chicken",
+		},
+		{
+			name:     "POST defaults to plain text without Content-Type",
+			method:   "POST",
+			target:   "/crypto/sign",
+			body:     "taco",
+			maxBytes: DefaultMaxMessageBytes,
+			want:     "taco",
+		},
+		{
+			name:        "POST body exactly at size limit",
+			method:      "POST",
+			target:      "/crypto/sign",
+			contentType: "text/plain",
+			body:        "taco",
+			maxBytes:    4,
+			want:        "taco",
+		},
+		{
+			name:           "POST body over size limit",
+			method:         "POST",
+			target:         "/crypto/sign",
+			contentType:    "text/plain",
+			body:           "chicken",
+			maxBytes:       4,
+			wantStatusCode: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:           "POST malformed JSON",
+			method:         "POST",
+			target:         "/crypto/sign",
+			contentType:    "application/json",
+			body:           `{"message": `,
+			maxBytes:       DefaultMaxMessageBytes,
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "POST unsupported Content-Type",
+			method:         "POST",
+			target:         "/crypto/sign",
+			contentType:    "application/xml",
+			body:           "<message>taco</message>",
+			maxBytes:       DefaultMaxMessageBytes,
+			wantStatusCode: http.StatusUnsupportedMediaType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			message, err := readMessage(req, tt.maxBytes)
+			if tt.wantStatusCode != 0 {
+				if err == nil {
+					t.Fatalf("Was expecting an error to occur but none did. Got message: %v", message)
+				}
+				if !cmp.Equal(err.StatusCode, tt.wantStatusCode) {
+					t.Errorf("Wrong status code for error: got %v want %v", err.StatusCode, tt.wantStatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error reading message. Details: %v", err.Error())
+			}
+			if !cmp.Equal(message.Message, tt.want) {
+				t.Errorf("Message not as expected. Wanted: %v, Got: %v", tt.want, message.Message)
+			}
+			if !cmp.Equal(message.CallbackUrl, tt.wantCallbackUrl) {
+				t.Errorf("Callback url not as expected. Wanted: %v, Got: %v", tt.wantCallbackUrl, message.CallbackUrl)
+			}
+		})
+	}
+}
+
+func TestApp_newRequestHandlerPost(t *testing.T) {
+	mockApplication := Application{
+		Queue:           NewFairQueue(1, nil),
+		Store:           make(chan SignedRequest, 1),
+		Signatures:      make(map[string]string),
+		Track:           make(chan PendingRequest, 1),
+		Requests:        make(map[string]PendingRequest),
+		ServerPort:      ":8080",
+		MaxMessageBytes: 24,
+	}
+	mockTooLargeBody := `{"Body":"The message exceeds the maximum size of 24 bytes.","StatusCode":413}`
+	tests := []struct {
+		name         string
+		body         string
+		want         string
+		bodyExpected string
+		statusCode   int
+	}{
+		{
+			name:       "Queues message from JSON body",
+			body:       `{"message":"taco"}`,
+			want:       "taco",
+			statusCode: 202,
+		},
+		{
+			name:         "Rejects body over configured limit",
+			body:         `{"message":"chicken and taco"}`,
+			bodyExpected: mockTooLargeBody,
+			statusCode:   413,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(&mockApplication)
+			req := httptest.NewRequest("POST", "/crypto/sign", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if tt.bodyExpected != "" && !cmp.Equal(rr.Body.String(), tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
+			}
+			if tt.want != "" && rr.Code == http.StatusAccepted {
+				request, _ := mockApplication.Queue.Pop(context.Background())
+				if !cmp.Equal(request.Message, tt.want) {
+					t.Errorf("Queued message not as expected. Wanted: %v, Got: %v", tt.want, request.Message)
+				}
+			}
+		})
+	}
+}
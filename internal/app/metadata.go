@@ -0,0 +1,176 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Limits on the free-form metadata a client can attach to a request
+const (
+	maxMetadataEntries     = 16
+	maxMetadataKeyLength   = 64
+	maxMetadataValueLength = 256
+)
+
+// clientRequestIdPattern is the shape of a request id supplied by a client. Colons are left out so the
+// namespaced form, '<scoped client id>:<requestId>', can always be told apart from the id itself
+var clientRequestIdPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// RequestIdClaims holds the client supplied request ids currently being enqueued, so two submissions
+// racing with the same id can't both be accepted before either is tracked
+type RequestIdClaims struct {
+	mu     sync.Mutex
+	Claims map[string]struct{}
+}
+
+// NewRequestIdClaims creates an empty set of request id claims
+func NewRequestIdClaims() *RequestIdClaims {
+	return &RequestIdClaims{Claims: make(map[string]struct{})}
+}
+
+// MetadataStore maintains the metadata clients attached to their requests until the signature is retrieved,
+// safe for concurrent use by handlers and workers
+type MetadataStore struct {
+	mu       sync.RWMutex
+	Metadata map[string]map[string]string
+}
+
+// Set stores the metadata of a request. Requests without metadata aren't stored
+func (store *MetadataStore) Set(requestId string, metadata map[string]string) {
+	if store == nil || len(metadata) == 0 {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.Metadata[requestId] = metadata
+}
+
+// Get retrieves the metadata of a request, which is nil when the request has none
+func (store *MetadataStore) Get(requestId string) map[string]string {
+	if store == nil {
+		return nil
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.Metadata[requestId]
+}
+
+// Delete forgets the metadata of a request
+func (store *MetadataStore) Delete(requestId string) {
+	if store == nil {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.Metadata, requestId)
+}
+
+// Len is the number of requests with metadata held
+func (store *MetadataStore) Len() int {
+	if store == nil {
+		return 0
+	}
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return len(store.Metadata)
+}
+
+// MarshalJSON marshals the metadata of every request for persistence
+func (store *MetadataStore) MarshalJSON() ([]byte, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return json.Marshal(store.Metadata)
+}
+
+// validateRequestDetails checks the optional request id and metadata supplied with a submission
+func validateRequestDetails(messageBody MessageBody) *MessageError {
+	if messageBody.RequestId != "" && !clientRequestIdPattern.MatchString(messageBody.RequestId) {
+		return &MessageError{StatusCode: http.StatusBadRequest, Reason: "The requestId must be 1 to 64 letters, digits, '.', '_' or '-', starting with a letter or digit."}
+	}
+	if err := validatePriority(messageBody.Priority); err != nil {
+		return err
+	}
+	if len(messageBody.Metadata) > maxMetadataEntries {
+		return &MessageError{StatusCode: http.StatusBadRequest, Reason: fmt.Sprintf("The metadata must have at most %d entries.", maxMetadataEntries)}
+	}
+	for key, value := range messageBody.Metadata {
+		if key == "" || len(key) > maxMetadataKeyLength {
+			return &MessageError{StatusCode: http.StatusBadRequest, Reason: fmt.Sprintf("Metadata keys must be 1 to %d bytes.", maxMetadataKeyLength)}
+		}
+		if len(value) > maxMetadataValueLength {
+			return &MessageError{StatusCode: http.StatusBadRequest, Reason: fmt.Sprintf("Metadata values must be at most %d bytes.", maxMetadataValueLength)}
+		}
+	}
+	return nil
+}
+
+// namespaceRequestId scopes a client supplied request id to the client, and the client's tenant, so clients
+// can't collide with each other
+func namespaceRequestId(client Client, requestId string) string {
+	if client.Id == "" {
+		return requestId
+	}
+	return client.scopedId() + ":" + requestId
+}
+
+// claimRequestId reserves a client supplied request id while its request is enqueued, reporting false if
+// the id already belongs to a request that is pending, awaiting retrieval or being enqueued. Without
+// RequestIdClaims only ids that are pending or awaiting retrieval are refused
+func (application *Application) claimRequestId(requestId string) bool {
+	claims := application.RequestIdClaims
+	if claims != nil {
+		claims.mu.Lock()
+		defer claims.mu.Unlock()
+		if _, ok := claims.Claims[requestId]; ok {
+			return false
+		}
+	}
+	if _, ok := application.lookupSignature(requestId); ok {
+		return false
+	}
+	if _, ok := application.lookupRequest(requestId); ok {
+		return false
+	}
+	if claims != nil {
+		claims.Claims[requestId] = struct{}{}
+	}
+	return true
+}
+
+// releaseRequestId gives up the claim on a request id once its request is tracked, or failed to be enqueued
+func (application *Application) releaseRequestId(requestId string) {
+	claims := application.RequestIdClaims
+	if claims == nil {
+		return
+	}
+	claims.mu.Lock()
+	defer claims.mu.Unlock()
+	delete(claims.Claims, requestId)
+}
+
+// InstantiateMetadata creates a new store for request metadata and recreates previous state if applicable
+func InstantiateMetadata(metadataPersistenceLocation string) *MetadataStore {
+	store := &MetadataStore{Metadata: make(map[string]map[string]string)}
+	metadataBytes, err := os.ReadFile(metadataPersistenceLocation)
+	if err != nil {
+		logrus.Errorf("Was unable to read metadata file. Details: %v", err)
+		return store
+	}
+	if len(metadataBytes) > 0 {
+		var metadata map[string]map[string]string
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			logrus.Errorf("Was unable to unmarshal metadata into object. Details: %v", err)
+			return store
+		}
+		if metadata != nil {
+			store.Metadata = metadata
+		}
+	}
+	return store
+}
@@ -0,0 +1,296 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApp_newRequestHandlerClientRequestId(t *testing.T) {
+	tests := []struct {
+		name          string
+		clientId      string
+		body          string
+		existing      string
+		claimed       string
+		statusCode    int
+		wantRequestId string
+		wantMetadata  map[string]string
+	}{
+		{
+			name:          "Request id is namespaced to the client",
+			clientId:      "client",
+			body:          `{"message":"taco","requestId":"job-1234","metadata":{"team":"payments"}}`,
+			statusCode:    202,
+			wantRequestId: "client:job-1234",
+			wantMetadata:  map[string]string{"team": "payments"},
+		},
+		{
+			name:          "Request id without a client",
+			body:          `{"message":"taco","requestId":"job-1234"}`,
+			statusCode:    202,
+			wantRequestId: "job-1234",
+		},
+		{
+			name:          "Same request id for another client",
+			clientId:      "other",
+			body:          `{"message":"taco","requestId":"job-1234"}`,
+			existing:      "client:job-1234",
+			statusCode:    202,
+			wantRequestId: "other:job-1234",
+		},
+		{
+			name:       "Request id already pending",
+			clientId:   "client",
+			body:       `{"message":"taco","requestId":"job-1234"}`,
+			existing:   "client:job-1234",
+			statusCode: 409,
+		},
+		{
+			name:       "Request id being enqueued",
+			clientId:   "client",
+			body:       `{"message":"taco","requestId":"job-1234"}`,
+			claimed:    "client:job-1234",
+			statusCode: 409,
+		},
+		{
+			name:       "Invalid request id",
+			clientId:   "client",
+			body:       `{"message":"taco","requestId":"job:1234"}`,
+			statusCode: 400,
+		},
+		{
+			name:       "Too much metadata",
+			body:       `{"message":"taco","metadata":{"1":"","2":"","3":"","4":"","5":"","6":"","7":"","8":"","9":"","10":"","11":"","12":"","13":"","14":"","15":"","16":"","17":""}}`,
+			statusCode: 400,
+		},
+		{
+			name:       "Metadata value too long",
+			body:       `{"message":"taco","metadata":{"team":"` + strings.Repeat("a", maxMetadataValueLength+1) + `"}}`,
+			statusCode: 400,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Queue:      NewFairQueue(1, nil),
+				Store:      make(chan SignedRequest, 1),
+				Signatures: make(map[string]string),
+				Track:      make(chan PendingRequest, 1),
+				Requests:   make(map[string]PendingRequest),
+				ServerPort: ":8080",
+				Metadata:   &MetadataStore{Metadata: make(map[string]map[string]string)},
+				// Claims are released once the handler returns
+				RequestIdClaims: NewRequestIdClaims(),
+			}
+			if tt.claimed != "" {
+				application.RequestIdClaims.Claims[tt.claimed] = struct{}{}
+			}
+			if tt.existing != "" {
+				application.Requests[tt.existing] = PendingRequest{Request: Request{RequestId: tt.existing, Message: "taco"}, Timing: Timing{time.Now(), 1}, Add: true}
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest("POST", "/crypto/sign?wait=0", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Client-Id", tt.clientId)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Fatalf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if tt.wantRequestId == "" {
+				if application.Queue.Len() != 0 {
+					t.Errorf("Request should not have been queued")
+				}
+				return
+			}
+			var processing RequestProcessing
+			if err := json.Unmarshal(rr.Body.Bytes(), &processing); err != nil {
+				t.Fatalf("Unable to unmarshal response body. Details: %v", err.Error())
+			}
+			if !cmp.Equal(processing.RequestId, tt.wantRequestId) {
+				t.Errorf("RequestId not as expected. Wanted: %v, Got: %v", tt.wantRequestId, processing.RequestId)
+			}
+			if !cmp.Equal(processing.Metadata, tt.wantMetadata) {
+				t.Errorf("Metadata not as expected. Wanted: %v, Got: %v", tt.wantMetadata, processing.Metadata)
+			}
+			if request, _ := application.Queue.Pop(context.Background()); request.RequestId != tt.wantRequestId {
+				t.Errorf("Queued requestId not as expected. Wanted: %v, Got: %v", tt.wantRequestId, request.RequestId)
+			}
+			if !cmp.Equal(application.Metadata.Get(tt.wantRequestId), tt.wantMetadata) {
+				t.Errorf("Stored metadata not as expected. Wanted: %v, Got: %v", tt.wantMetadata, application.Metadata.Get(tt.wantRequestId))
+			}
+		})
+	}
+}
+
+func TestNamespaceRequestId(t *testing.T) {
+	tests := []struct {
+		name      string
+		client    Client
+		requestId string
+		want      string
+	}{
+		{name: "No client", client: Client{}, requestId: "job-1234", want: "job-1234"},
+		{name: "Client of the default tenant", client: Client{Id: "client", Tenant: DefaultTenant}, requestId: "job-1234", want: "client:job-1234"},
+		{name: "Client of another tenant", client: Client{Id: "client", Tenant: "acme"}, requestId: "job-1234", want: "acme/client:job-1234"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := namespaceRequestId(tt.client, tt.requestId); got != tt.want {
+				t.Errorf("Namespaced requestId not as expected. Wanted: %v, Recieved: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestApp_currentRequestHandlerMetadata(t *testing.T) {
+	metadata := map[string]string{"team": "payments"}
+	application := Application{
+		Queue:      NewFairQueue(1, nil),
+		Store:      make(chan SignedRequest, 1),
+		Signatures: map[string]string{"client:signed": "signature"},
+		Track:      make(chan PendingRequest, 1),
+		Requests: map[string]PendingRequest{
+			"client:pending": {Request: Request{RequestId: "client:pending", Message: "taco"}, Timing: Timing{time.Now(), 1}, Add: true},
+		},
+		ServerPort: ":8080",
+		Metadata: &MetadataStore{Metadata: map[string]map[string]string{
+			"client:signed":  metadata,
+			"client:pending": metadata,
+		}},
+	}
+	tests := []struct {
+		name      string
+		requestId string
+		wantBody  string
+	}{
+		{
+			name:      "Signed request echoes metadata",
+			requestId: "client:signed",
+			wantBody:  `{"Body":"Request processed successfully!","Signature":"signature","Metadata":{"team":"payments"},"StatusCode":200}`,
+		},
+		{
+			name:      "Pending request echoes metadata",
+			requestId: "client:pending",
+			wantBody:  `"Metadata":{"team":"payments"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(&application)
+			req := httptest.NewRequest("GET", "/crypto/sign/request/"+tt.requestId, nil)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if !strings.Contains(rr.Body.String(), tt.wantBody) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestInstantiateMetadata(t *testing.T) {
+	populatedMetadataBytes, err := os.ReadFile("../../testdata/populatedMetadataState.json")
+	if err != nil {
+		t.Errorf("Was unable to read test populated metadata file. Details: %v", err)
+	}
+	var populatedMetadata map[string]map[string]string
+	if err := json.Unmarshal(populatedMetadataBytes, &populatedMetadata); err != nil {
+		t.Errorf("Was unable to unmarshal test populated metadata into object. Details: %v", err)
+	}
+	tests := []struct {
+		name              string
+		inputFileLocation string
+		want              map[string]map[string]string
+	}{
+		{
+			name:              "Successful Load of populated state",
+			inputFileLocation: "../../testdata/populatedMetadataState.json",
+			want:              populatedMetadata,
+		},
+		{
+			name:              "Successful Load of empty state (fresh start)",
+			inputFileLocation: "../../testdata/emptyState.json",
+			want:              make(map[string]map[string]string),
+		},
+		{
+			name:              "Bad file location",
+			inputFileLocation: "../../testdata/fakeLocation.json",
+			want:              make(map[string]map[string]string),
+		},
+		{
+			name:              "Unmarshable state",
+			inputFileLocation: "../../testdata/unmarshableState.json",
+			want:              make(map[string]map[string]string),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := InstantiateMetadata(tt.inputFileLocation)
+			if !cmp.Equal(store.Metadata, tt.want) {
+				t.Errorf("Metadata was not instantiated to the desired state. Want: %v, Recieved: %v", tt.want, store.Metadata)
+			}
+		})
+	}
+}
+
+func TestApp_clientRequestIdLocation(t *testing.T) {
+	tests := []struct {
+		name          string
+		target        string
+		tenantId      string
+		wantRequestId string
+	}{
+		{name: "Default tenant", target: "/crypto/sign?wait=0", tenantId: "", wantRequestId: "acme:job1"},
+		{name: "Other tenant", target: "/crypto/sign?wait=0", tenantId: "t1", wantRequestId: "t1/acme:job1"},
+		{name: "Other tenant on v1", target: "/v1/requests?wait=0", tenantId: "t1", wantRequestId: "t1/acme:job1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Queue:           NewFairQueue(1, nil),
+				Store:           make(chan SignedRequest, 1),
+				Signatures:      make(map[string]string),
+				Track:           make(chan PendingRequest, 1),
+				Requests:        make(map[string]PendingRequest),
+				ServerPort:      ":8080",
+				Metadata:        &MetadataStore{Metadata: make(map[string]map[string]string)},
+				RequestIdClaims: NewRequestIdClaims(),
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest("POST", tt.target, strings.NewReader(`{"message":"taco","requestId":"job1"}`))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("X-Client-Id", "acme")
+			req.Header.Set("X-Tenant-Id", tt.tenantId)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != 202 {
+				t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, 202)
+			}
+			// The tracker would have recorded the request by the time the caller follows the Location
+			tracked := <-application.Track
+			application.Requests[tracked.RequestId] = tracked
+			if tracked.RequestId != tt.wantRequestId {
+				t.Errorf("RequestId not as expected. Wanted: %v, Recieved: %v", tt.wantRequestId, tracked.RequestId)
+			}
+
+			req = httptest.NewRequest("GET", rr.Header().Get("Location"), nil)
+			req.Header.Set("X-Client-Id", "acme")
+			req.Header.Set("X-Tenant-Id", tt.tenantId)
+			rr = httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != 202 {
+				t.Errorf("Following the Location returned wrong status code: got %v want %v. Body: %v", rr.Code, 202, rr.Body.String())
+			}
+			if !strings.Contains(rr.Body.String(), tt.wantRequestId) {
+				t.Errorf("Following the Location returned another request. Recieved: %v", rr.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package app
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SigningSLA is the end-to-end latency signatures are expected to be stored within
+const SigningSLA = 2 * time.Second
+
+// latencyBuckets are the upper bounds, in seconds, of the end-to-end latency histogram. A request waiting out the
+// back of a full queue takes up to half an hour
+var latencyBuckets = []float64{0.5, 1, 2, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// upstreamCallKey identifies the upstream calls made for a tenant that were answered with a status code
+type upstreamCallKey struct {
+	tenant string
+	code   string
+}
+
+// histogram counts observations into latencyBuckets. Counts are per bucket, and only made cumulative when written
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// Metrics counts what happens to requests on their way through the pipeline, by tenant, to be exposed alongside the
+// state of the service by the /metrics endpoint. Safe for concurrent use by the encryptors and the tracker
+type Metrics struct {
+	mu            sync.Mutex
+	inFlight      int
+	upstreamCalls map[upstreamCallKey]uint64
+	retries       map[string]uint64
+	deadLettered  map[string]uint64
+	latency       map[string]*histogram
+	slaHits       map[string]uint64
+}
+
+// NewMetrics creates metrics with nothing counted yet
+func NewMetrics() *Metrics {
+	return &Metrics{
+		upstreamCalls: make(map[upstreamCallKey]uint64),
+		retries:       make(map[string]uint64),
+		deadLettered:  make(map[string]uint64),
+		latency:       make(map[string]*histogram),
+		slaHits:       make(map[string]uint64),
+	}
+}
+
+// StartEncryption counts an encryptor taken by a request
+func (metrics *Metrics) StartEncryption() {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.inFlight++
+}
+
+// FinishEncryption counts an encryptor given back by a request
+func (metrics *Metrics) FinishEncryption() {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.inFlight--
+}
+
+// ObserveUpstreamCall counts a call to the signing service for a request, by the status code it was answered with,
+// or 'error' when it wasn't answered at all
+func (metrics *Metrics) ObserveUpstreamCall(request Request, code string) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.upstreamCalls[upstreamCallKey{tenant: requestTenant(request), code: code}]++
+}
+
+// ObserveRetry counts a failed attempt at signing a request that will be tried again
+func (metrics *Metrics) ObserveRetry(request Request) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.retries[requestTenant(request)]++
+}
+
+// ObserveDeadLetter counts a request that failed every attempt allowed
+func (metrics *Metrics) ObserveDeadLetter(request Request) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	metrics.deadLettered[requestTenant(request)]++
+}
+
+// ObserveSigned records the time a request of a tenant took from being queued to its signature being stored
+func (metrics *Metrics) ObserveSigned(tenant string, latency time.Duration) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	observed, ok := metrics.latency[tenant]
+	if !ok {
+		observed = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		metrics.latency[tenant] = observed
+	}
+	seconds := latency.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			observed.counts[i]++
+			break
+		}
+	}
+	observed.sum += seconds
+	observed.count++
+	if latency <= SigningSLA {
+		metrics.slaHits[tenant]++
+	}
+}
+
+// metricsHandler exposes the state of the service and the pipeline counters in the Prometheus text format through
+// the /metrics endpoint. Admins restricted to a tenant only see the series of their tenant
+func (application *Application) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, scoped := adminTenant(r)
+	var body bytes.Buffer
+	if !scoped {
+		application.writeServiceMetrics(&body)
+	}
+	application.writeRequestMetrics(&body, tenant, scoped)
+	application.Metrics.write(&body, tenant, scoped)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(body.Bytes()); err != nil {
+		logrus.Errorf("Error writing HTTP response. Closing request. Error Detail: %v", err.Error())
+	}
+}
+
+// writeServiceMetrics writes the state of the queues, encryptors and persisted state, which are shared by every tenant
+func (application *Application) writeServiceMetrics(body *bytes.Buffer) {
+	writeMetricHeader(body, "signer_queue_length", "gauge", "Requests waiting on an encryptor.")
+	writeSample(body, "signer_queue_length", nil, float64(application.Queue.Len()))
+	writeMetricHeader(body, "signer_queue_capacity", "gauge", "Requests the encrypt queue can hold.")
+	writeSample(body, "signer_queue_capacity", nil, float64(application.Queue.Capacity()))
+	writeMetricHeader(body, "signer_scheduled_requests", "gauge", "Requests held back until their notBefore time.")
+	writeSample(body, "signer_scheduled_requests", nil, float64(application.Schedule.Len()))
+	writeMetricHeader(body, "signer_queue_paused", "gauge", "Whether calls to the signing service are paused.")
+	writeSample(body, "signer_queue_paused", nil, boolValue(application.Control.Paused()))
+	writeMetricHeader(body, "signer_queue_draining", "gauge", "Whether new submissions are turned away.")
+	writeSample(body, "signer_queue_draining", nil, boolValue(application.Control.Draining()))
+	writeMetricHeader(body, "signer_encryptors_in_flight", "gauge", "Encryptors taken by a request, including while they wait out the upstream rate limit.")
+	writeSample(body, "signer_encryptors_in_flight", nil, float64(application.Metrics.inFlightCount()))
+
+	application.requestsLock.RLock()
+	pending := len(application.Requests)
+	application.requestsLock.RUnlock()
+	persisted := []struct {
+		store   string
+		entries int
+	}{
+		{"signatures", application.countSignatures()},
+		{"pending", pending},
+		{"batches", application.Batches.Len()},
+		{"outbox", application.Outbox.Len()},
+		{"idempotency", application.Idempotency.Len()},
+		{"metadata", application.Metadata.Len()},
+	}
+	writeMetricHeader(body, "signer_persisted_entries", "gauge", "Entries of each piece of state saved between runs.")
+	for _, state := range persisted {
+		writeSample(body, "signer_persisted_entries", []string{"store", state.store}, float64(state.entries))
+	}
+}
+
+// writeRequestMetrics writes the number of tracked requests in each state, by tenant
+func (application *Application) writeRequestMetrics(body *bytes.Buffer, tenant string, scoped bool) {
+	type stateKey struct {
+		tenant string
+		state  string
+	}
+	counts := make(map[stateKey]int)
+	application.requestsLock.RLock()
+	for _, request := range application.Requests {
+		key := stateKey{tenant: requestTenant(request.Request), state: request.State}
+		if key.state == "" {
+			key.state = StateQueued
+		}
+		if !scoped || key.tenant == tenant {
+			counts[key]++
+		}
+	}
+	application.requestsLock.RUnlock()
+	keys := make([]stateKey, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].tenant != keys[j].tenant {
+			return keys[i].tenant < keys[j].tenant
+		}
+		return keys[i].state < keys[j].state
+	})
+	writeMetricHeader(body, "signer_tracked_requests", "gauge", "Requests waiting on a signature or its retrieval, or that left the pipeline without one.")
+	for _, key := range keys {
+		writeSample(body, "signer_tracked_requests", []string{"tenant", key.tenant, "state", key.state}, float64(counts[key]))
+	}
+}
+
+// inFlightCount is the number of encryptors taken by a request
+func (metrics *Metrics) inFlightCount() int {
+	if metrics == nil {
+		return 0
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	return metrics.inFlight
+}
+
+// write writes the pipeline counters, restricted to a tenant when scoped
+func (metrics *Metrics) write(body *bytes.Buffer, tenant string, scoped bool) {
+	if metrics == nil {
+		return
+	}
+	metrics.mu.Lock()
+	defer metrics.mu.Unlock()
+	included := func(candidate string) bool {
+		return !scoped || candidate == tenant
+	}
+
+	calls := make([]upstreamCallKey, 0, len(metrics.upstreamCalls))
+	for key := range metrics.upstreamCalls {
+		if included(key.tenant) {
+			calls = append(calls, key)
+		}
+	}
+	sort.Slice(calls, func(i, j int) bool {
+		if calls[i].tenant != calls[j].tenant {
+			return calls[i].tenant < calls[j].tenant
+		}
+		return calls[i].code < calls[j].code
+	})
+	writeMetricHeader(body, "signer_upstream_calls_total", "counter", "Calls to the signing service, by the status code they were answered with.")
+	for _, key := range calls {
+		writeSample(body, "signer_upstream_calls_total", []string{"tenant", key.tenant, "code", key.code}, float64(metrics.upstreamCalls[key]))
+	}
+	writeMetricHeader(body, "signer_upstream_retries_total", "counter", "Failed attempts at signing a request that were tried again.")
+	for _, key := range sortedTenants(metrics.retries, included) {
+		writeSample(body, "signer_upstream_retries_total", []string{"tenant", key}, float64(metrics.retries[key]))
+	}
+	writeMetricHeader(body, "signer_dead_lettered_total", "counter", "Requests that failed every attempt allowed.")
+	for _, key := range sortedTenants(metrics.deadLettered, included) {
+		writeSample(body, "signer_dead_lettered_total", []string{"tenant", key}, float64(metrics.deadLettered[key]))
+	}
+
+	var tenants []string
+	for key := range metrics.latency {
+		if included(key) {
+			tenants = append(tenants, key)
+		}
+	}
+	sort.Strings(tenants)
+	writeMetricHeader(body, "signer_request_duration_seconds", "histogram", "Time from a request being queued to its signature being stored.")
+	for _, key := range tenants {
+		observed := metrics.latency[key]
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += observed.counts[i]
+			writeSample(body, "signer_request_duration_seconds_bucket", []string{"tenant", key, "le", formatMetricValue(bound)}, float64(cumulative))
+		}
+		writeSample(body, "signer_request_duration_seconds_bucket", []string{"tenant", key, "le", "+Inf"}, float64(observed.count))
+		writeSample(body, "signer_request_duration_seconds_sum", []string{"tenant", key}, observed.sum)
+		writeSample(body, "signer_request_duration_seconds_count", []string{"tenant", key}, float64(observed.count))
+	}
+	writeMetricHeader(body, "signer_sla_hits_total", "counter", fmt.Sprintf("Signatures stored within %v of the request being queued.", SigningSLA))
+	for _, key := range tenants {
+		writeSample(body, "signer_sla_hits_total", []string{"tenant", key}, float64(metrics.slaHits[key]))
+	}
+	writeMetricHeader(body, "signer_sla_hit_ratio", "gauge", fmt.Sprintf("Share of signatures stored within %v of the request being queued.", SigningSLA))
+	for _, key := range tenants {
+		writeSample(body, "signer_sla_hit_ratio", []string{"tenant", key}, float64(metrics.slaHits[key])/float64(metrics.latency[key].count))
+	}
+}
+
+// sortedTenants lists the tenants counted that are included, in order
+func sortedTenants(counts map[string]uint64, included func(string) bool) []string {
+	var tenants []string
+	for tenant := range counts {
+		if included(tenant) {
+			tenants = append(tenants, tenant)
+		}
+	}
+	sort.Strings(tenants)
+	return tenants
+}
+
+// writeMetricHeader writes the help text and type of a metric family
+func writeMetricHeader(body *bytes.Buffer, name string, metricType string, help string) {
+	fmt.Fprintf(body, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+// writeSample writes a single sample of a metric, with its labels given as name and value pairs
+func writeSample(body *bytes.Buffer, name string, labels []string, value float64) {
+	body.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+		}
+		body.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	body.WriteString(" " + formatMetricValue(value) + "\n")
+}
+
+// labelEscaper escapes the characters that can't appear as is in a label value
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatMetricValue formats a sample value or bucket bound as the Prometheus text format expects
+func formatMetricValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// boolValue is 1 for true and 0 for false
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,149 @@
+package app
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMetrics_ObserveSigned(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.ObserveSigned("acme", 1500*time.Millisecond)
+	metrics.ObserveSigned("acme", 2*time.Second)
+	metrics.ObserveSigned("acme", 45*time.Second)
+	metrics.ObserveSigned("acme", 2*time.Hour)
+	observed := metrics.latency["acme"]
+	want := []uint64{0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 0, 0}
+	if !cmp.Equal(observed.counts, want) {
+		t.Errorf("Latencies were not counted into the expected buckets. Want: %v, Recieved: %v", want, observed.counts)
+	}
+	if observed.count != 4 || observed.sum != 7248.5 {
+		t.Errorf("Unexpected count or sum. Want: %v %v, Recieved: %v %v", 4, 7248.5, observed.count, observed.sum)
+	}
+	if metrics.slaHits["acme"] != 2 {
+		t.Errorf("Signatures within the SLA were not counted. Want: %v, Recieved: %v", 2, metrics.slaHits["acme"])
+	}
+	var missing *Metrics
+	missing.ObserveSigned("acme", time.Second)
+	missing.ObserveUpstreamCall(Request{}, "200")
+}
+
+func TestTracker_applyObservesSigned(t *testing.T) {
+	added := time.Date(2030, 1, 2, 15, 0, 0, 0, time.UTC)
+	tracker := Tracker{
+		Requests: map[string]PendingRequest{
+			"requestId": {Request: Request{RequestId: "requestId", TenantId: "acme"}, Timing: Timing{TimeAdded: added}, State: StateRunning, Add: true},
+		},
+		Metrics: NewMetrics(),
+	}
+	tracker.apply(PendingRequest{Request: Request{RequestId: "requestId"}, Timing: Timing{TimeAdded: added.Add(time.Second)}, State: StateSigned, Add: true})
+	tracker.apply(PendingRequest{Request: Request{RequestId: "unknown"}, Timing: Timing{TimeAdded: added.Add(time.Second)}, State: StateSigned, Add: true})
+	observed, ok := tracker.Metrics.latency["acme"]
+	if !ok || observed.count != 1 || observed.sum != 1 {
+		t.Errorf("Signed request was not observed once with its latency. Recieved: %v", observed)
+	}
+}
+
+func TestApp_metricsHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		apiKey     string
+		statusCode int
+		want       []string
+		notWant    []string
+	}{
+		{
+			name:       "Every tenant",
+			apiKey:     "admin-key",
+			statusCode: 200,
+			want: []string{
+				"# TYPE signer_queue_length gauge\nsigner_queue_length 1\n",
+				"signer_queue_capacity 5\n",
+				"signer_queue_paused 1\n",
+				"signer_encryptors_in_flight 1\n",
+				`signer_persisted_entries{store="signatures"} 1` + "\n",
+				`signer_persisted_entries{store="pending"} 2` + "\n",
+				`signer_tracked_requests{tenant="acme",state="failed"} 1` + "\n",
+				`signer_tracked_requests{tenant="default",state="queued"} 1` + "\n",
+				`signer_upstream_calls_total{tenant="acme",code="503"} 2` + "\n",
+				`signer_upstream_calls_total{tenant="default",code="200"} 1` + "\n",
+				`signer_upstream_retries_total{tenant="acme"} 1` + "\n",
+				`signer_dead_lettered_total{tenant="acme"} 1` + "\n",
+				`signer_request_duration_seconds_bucket{tenant="default",le="2"} 1` + "\n",
+				`signer_request_duration_seconds_bucket{tenant="default",le="+Inf"} 2` + "\n",
+				`signer_request_duration_seconds_sum{tenant="default"} 31` + "\n",
+				`signer_request_duration_seconds_count{tenant="default"} 2` + "\n",
+				`signer_sla_hits_total{tenant="default"} 1` + "\n",
+				`signer_sla_hit_ratio{tenant="default"} 0.5` + "\n",
+			},
+		},
+		{
+			name:       "Admin restricted to a tenant",
+			apiKey:     "acme-admin-key",
+			statusCode: 200,
+			want: []string{
+				`signer_tracked_requests{tenant="acme",state="failed"} 1` + "\n",
+				`signer_upstream_calls_total{tenant="acme",code="503"} 2` + "\n",
+			},
+			notWant: []string{"signer_queue_length 1", `tenant="default"`},
+		},
+		{
+			name:       "Not an admin",
+			apiKey:     "client-key",
+			statusCode: 403,
+			notWant:    []string{"signer_"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metrics := NewMetrics()
+			metrics.StartEncryption()
+			metrics.ObserveUpstreamCall(Request{TenantId: "acme"}, "503")
+			metrics.ObserveUpstreamCall(Request{TenantId: "acme"}, "503")
+			metrics.ObserveRetry(Request{TenantId: "acme"})
+			metrics.ObserveDeadLetter(Request{TenantId: "acme"})
+			metrics.ObserveUpstreamCall(Request{}, "200")
+			metrics.ObserveSigned(DefaultTenant, time.Second)
+			metrics.ObserveSigned(DefaultTenant, 30*time.Second)
+			application := Application{
+				Queue:      NewFairQueue(5, nil),
+				Signatures: map[string]string{"signed": "signature"},
+				Requests: map[string]PendingRequest{
+					"queued": {Request: Request{RequestId: "queued"}, Timing: Timing{time.Now(), 1}, Add: true},
+					"failed": {Request: Request{RequestId: "failed", TenantId: "acme"}, Timing: Timing{time.Now(), 1}, State: StateFailed, Add: true},
+				},
+				Control: NewQueueControl(),
+				Metrics: metrics,
+				APIKeys: &KeyStore{Clients: map[string]Client{
+					hashAPIKey("admin-key"):      {Id: "admin", Admin: true},
+					hashAPIKey("acme-admin-key"): {Id: "acmeAdmin", Admin: true, Tenant: "acme"},
+					hashAPIKey("client-key"):     {Id: "client"},
+				}},
+			}
+			application.Queue.Push(Request{RequestId: "queued"})
+			application.Control.Pause()
+			router := NewRouter(&application)
+			req := httptest.NewRequest("GET", "/metrics", nil)
+			req.Header.Set("X-API-Key", tt.apiKey)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; status != tt.statusCode {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			body := rr.Body.String()
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("Metrics are missing %q. Recieved: %v", want, body)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(body, notWant) {
+					t.Errorf("Metrics unexpectedly contain %q. Recieved: %v", notWant, body)
+				}
+			}
+		})
+	}
+}
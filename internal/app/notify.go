@@ -0,0 +1,125 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultSignatureWait is how long a new request waits for its signature before responding, per the 2 second SLA
+const DefaultSignatureWait = 2 * time.Second
+
+// DefaultMaxWait caps the 'wait' parameter when no limit has been configured
+const DefaultMaxWait = 60 * time.Second
+
+// Notifier hands signatures to the requests waiting on them as soon as they are stored
+type Notifier struct {
+	mu      sync.Mutex
+	waiters map[string]map[chan string]struct{}
+}
+
+// NewNotifier creates a notifier without any waiters
+func NewNotifier() *Notifier {
+	return &Notifier{waiters: make(map[string]map[chan string]struct{})}
+}
+
+// Wait registers interest in the signature of a request. The returned channel receives the signature once it is
+// stored, and the returned function must be called to stop waiting
+func (notifier *Notifier) Wait(requestId string) (chan string, func()) {
+	waiter := make(chan string, 1)
+	if notifier == nil {
+		return waiter, func() {}
+	}
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	if notifier.waiters[requestId] == nil {
+		notifier.waiters[requestId] = make(map[chan string]struct{})
+	}
+	notifier.waiters[requestId][waiter] = struct{}{}
+	return waiter, func() {
+		notifier.mu.Lock()
+		defer notifier.mu.Unlock()
+		delete(notifier.waiters[requestId], waiter)
+		if len(notifier.waiters[requestId]) == 0 {
+			delete(notifier.waiters, requestId)
+		}
+	}
+}
+
+// Notify hands a signature to everything waiting on the request
+func (notifier *Notifier) Notify(requestId string, signature string) {
+	if notifier == nil {
+		return
+	}
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	for waiter := range notifier.waiters[requestId] {
+		// Waiters are buffered and only ever notified once, so this never blocks
+		select {
+		case waiter <- signature:
+		default:
+		}
+	}
+}
+
+// maxWait returns the configured cap on the 'wait' parameter, falling back to the default when unset
+func (application *Application) maxWait() time.Duration {
+	if application.MaxWait <= 0 {
+		return DefaultMaxWait
+	}
+	return application.MaxWait
+}
+
+// readWait retrieves how long a caller is willing to wait for a signature from the 'wait' query parameter, given
+// either as a duration ("30s") or a number of seconds ("30"). The wait is capped at maxWait
+func readWait(r *http.Request, defaultWait time.Duration, maxWait time.Duration) (time.Duration, *MessageError) {
+	waitParam := r.URL.Query().Get("wait")
+	if waitParam == "" {
+		return minDuration(defaultWait, maxWait), nil
+	}
+	wait, err := time.ParseDuration(waitParam)
+	if err != nil {
+		seconds, err := strconv.ParseFloat(waitParam, 64)
+		if err != nil {
+			return 0, &MessageError{StatusCode: http.StatusBadRequest, Reason: "The wait parameter must be a duration, such as '30s', or a number of seconds."}
+		}
+		wait = time.Duration(seconds * float64(time.Second))
+	}
+	if wait < 0 {
+		return 0, &MessageError{StatusCode: http.StatusBadRequest, Reason: "The wait parameter must not be negative."}
+	}
+	return minDuration(wait, maxWait), nil
+}
+
+// retrieveSignature waits up to the given duration for the signature of a request, returning as soon as it is
+// stored. Waiting stops early if the caller goes away
+func retrieveSignature(ctx context.Context, application *Application, requestId string, wait time.Duration) (string, bool) {
+	// Register before looking in the store, so a signature stored in between isn't missed
+	waiter, stopWaiting := application.Notifier.Wait(requestId)
+	defer stopWaiting()
+	if signature, ok := application.lookupSignature(requestId); ok {
+		return signature, true
+	}
+	if wait <= 0 {
+		return "", false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case signature := <-waiter:
+		return signature, true
+	case <-timer.C:
+		return "", false
+	case <-ctx.Done():
+		return "", false
+	}
+}
+
+func minDuration(a time.Duration, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,180 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNotifier_Notify(t *testing.T) {
+	notifier := NewNotifier()
+	waiter, stopWaiting := notifier.Wait("requestId")
+	otherWaiter, stopOtherWaiting := notifier.Wait("otherRequestId")
+	defer stopOtherWaiting()
+
+	notifier.Notify("requestId", "signature")
+	select {
+	case signature := <-waiter:
+		if !cmp.Equal(signature, "signature") {
+			t.Errorf("Waiter received unexpected signature. Wanted: signature, Got: %v", signature)
+		}
+	default:
+		t.Error("Expected waiter to be notified of its signature")
+	}
+	select {
+	case signature := <-otherWaiter:
+		t.Errorf("Waiter for another request was unexpectedly notified with: %v", signature)
+	default:
+	}
+
+	stopWaiting()
+	if _, ok := notifier.waiters["requestId"]; ok {
+		t.Error("Expected waiter to be removed once it stopped waiting")
+	}
+	// Notifying a request nobody waits on must not block
+	notifier.Notify("requestId", "signature")
+}
+
+func TestReadWait(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		defaultWait time.Duration
+		maxWait     time.Duration
+		want        time.Duration
+		wantError   bool
+	}{
+		{name: "Default when not given", target: "/", defaultWait: 2 * time.Second, maxWait: time.Minute, want: 2 * time.Second},
+		{name: "Duration", target: "/?wait=30s", defaultWait: 0, maxWait: time.Minute, want: 30 * time.Second},
+		{name: "Number of seconds", target: "/?wait=1.5", defaultWait: 0, maxWait: time.Minute, want: 1500 * time.Millisecond},
+		{name: "Capped at maximum", target: "/?wait=5m", defaultWait: 0, maxWait: time.Minute, want: time.Minute},
+		{name: "Invalid", target: "/?wait=soon", defaultWait: 0, maxWait: time.Minute, wantError: true},
+		{name: "Negative", target: "/?wait=-1s", defaultWait: 0, maxWait: time.Minute, wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wait, err := readWait(httptest.NewRequest("GET", tt.target, nil), tt.defaultWait, tt.maxWait)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("Unexpected result reading wait. Wanted error: %v, Got: %v", tt.wantError, err)
+			}
+			if !cmp.Equal(wait, tt.want) {
+				t.Errorf("Wait not as expected. Wanted: %v, Got: %v", tt.want, wait)
+			}
+		})
+	}
+}
+
+func TestRetrieveSignature(t *testing.T) {
+	tests := []struct {
+		name          string
+		signatures    map[string]string
+		notify        bool
+		wait          time.Duration
+		want          string
+		wantOk        bool
+		wantWithin    time.Duration
+		isContextDone bool
+	}{
+		{
+			name:       "Already stored",
+			signatures: map[string]string{"requestId": "signature"},
+			wait:       time.Minute,
+			want:       "signature",
+			wantOk:     true,
+			wantWithin: time.Second,
+		},
+		{
+			name:       "Notified while waiting",
+			signatures: make(map[string]string),
+			notify:     true,
+			wait:       time.Minute,
+			want:       "signature",
+			wantOk:     true,
+			wantWithin: time.Second,
+		},
+		{
+			name:       "Not stored within wait",
+			signatures: make(map[string]string),
+			wait:       50 * time.Millisecond,
+			wantOk:     false,
+			wantWithin: time.Second,
+		},
+		{
+			name:          "Caller goes away",
+			signatures:    make(map[string]string),
+			wait:          time.Minute,
+			wantOk:        false,
+			wantWithin:    time.Second,
+			isContextDone: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{Signatures: tt.signatures, Notifier: NewNotifier()}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			notify, isContextDone := tt.notify, tt.isContextDone
+			go func() {
+				// Wait for the retrieval to register before notifying or cancelling
+				for ctx.Err() == nil {
+					application.Notifier.mu.Lock()
+					registered := len(application.Notifier.waiters) > 0
+					application.Notifier.mu.Unlock()
+					if registered {
+						break
+					}
+					time.Sleep(5 * time.Millisecond)
+				}
+				if notify {
+					application.Notifier.Notify("requestId", "signature")
+				}
+				if isContextDone {
+					cancel()
+				}
+			}()
+			start := time.Now()
+			signature, ok := retrieveSignature(ctx, &application, "requestId", tt.wait)
+			if elapsed := time.Since(start); elapsed > tt.wantWithin {
+				t.Errorf("Retrieval took longer than expected. Wanted within: %v, Took: %v", tt.wantWithin, elapsed)
+			}
+			if ok != tt.wantOk || !cmp.Equal(signature, tt.want) {
+				t.Errorf("Retrieval not as expected. Wanted: %v %v, Got: %v %v", tt.want, tt.wantOk, signature, ok)
+			}
+		})
+	}
+}
+
+func TestRetrieveSignature_whileStoring(t *testing.T) {
+	signatures := make(map[string]string)
+	store := make(chan SignedRequest)
+	track := make(chan PendingRequest, 1)
+	application := Application{Signatures: signatures, Notifier: NewNotifier()}
+	storer := Storer{Store: store, Track: track, Signatures: signatures, SignaturesLock: application.SignaturesLock(), Notifier: application.Notifier}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = storer.StoreSignedRequests(ctx)
+	}()
+	go func() {
+		for range track {
+		}
+	}()
+	// Each read lines up with the write that wakes it, which must not race
+	for _, requestId := range []string{"first", "second", "third"} {
+		retrieved := make(chan string, 1)
+		go func(requestId string) {
+			signature, _ := retrieveSignature(context.Background(), &application, requestId, time.Second)
+			retrieved <- signature
+		}(requestId)
+		store <- SignedRequest{RequestId: requestId, Signature: requestId + "Signature", Add: true}
+		if signature := <-retrieved; signature != requestId+"Signature" {
+			t.Errorf("Unexpected signature. Wanted: %v, Got: %v", requestId+"Signature", signature)
+		}
+	}
+	if snapshot := application.SignaturesSnapshot(); len(snapshot) != 3 {
+		t.Errorf("Unexpected snapshot of signatures. Got: %v", snapshot)
+	}
+}
@@ -0,0 +1,23 @@
+package app
+
+import (
+	_ "embed"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+)
+
+// openAPISpec is the OpenAPI document describing every route of NewRouter. The tests fail if the two disagree,
+// so the document must be updated along with the routes
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// openAPIHandler serves the OpenAPI document through the /openapi.json endpoint
+func (application *Application) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(openAPISpec); err != nil {
+		logrus.Errorf("Error writing HTTP response. Closing request. Error Detail: %v", err.Error())
+	}
+}
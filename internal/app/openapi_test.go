@@ -0,0 +1,433 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/mux"
+)
+
+// openAPIDocument holds the parts of the OpenAPI document checked against the router
+type openAPIDocument struct {
+	OpenAPI    string                                 `json:"openapi"`
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Parameters map[string]openAPIParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	OperationId string                     `json:"operationId"`
+	Parameters  []openAPIParameter         `json:"parameters"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIResponse struct {
+	Headers map[string]json.RawMessage `json:"headers"`
+}
+
+type openAPIParameter struct {
+	Ref  string `json:"$ref"`
+	Name string `json:"name"`
+	In   string `json:"in"`
+}
+
+// loadOpenAPIDocument reads the OpenAPI document served at /openapi.json
+func loadOpenAPIDocument(t *testing.T) openAPIDocument {
+	var document openAPIDocument
+	if err := json.Unmarshal(openAPISpec, &document); err != nil {
+		t.Fatalf("Unable to unmarshal OpenAPI document. Details: %v", err.Error())
+	}
+	return document
+}
+
+// parameters resolves the parameters of an operation, reporting any references to unknown parameters
+func (document openAPIDocument) parameters(t *testing.T, key string, operation openAPIOperation) []openAPIParameter {
+	var parameters []openAPIParameter
+	for _, parameter := range operation.Parameters {
+		if strings.HasPrefix(parameter.Ref, "#/components/parameters/") {
+			resolved, ok := document.Components.Parameters[strings.TrimPrefix(parameter.Ref, "#/components/parameters/")]
+			if !ok {
+				t.Errorf("%v references unknown parameter %v", key, parameter.Ref)
+			}
+			parameter = resolved
+		}
+		parameters = append(parameters, parameter)
+	}
+	return parameters
+}
+
+func TestOpenAPISpecMatchesRouter(t *testing.T) {
+	document := loadOpenAPIDocument(t)
+	if !strings.HasPrefix(document.OpenAPI, "3.") {
+		t.Errorf("Expected an OpenAPI 3 document, got version %v", document.OpenAPI)
+	}
+
+	// Every operation the router serves, as 'METHOD /path/{var}'
+	routed := make(map[string]bool)
+	router := NewRouter(&Application{})
+	err := router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			// Path prefixes of subrouters don't serve anything themselves
+			return nil
+		}
+		for _, method := range methods {
+			routed[method+" "+path] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Unable to walk router. Details: %v", err.Error())
+	}
+
+	documented := make(map[string]bool)
+	pathVars := regexp.MustCompile(`{([^}]+)}`)
+	for path, operations := range document.Paths {
+		for method, operation := range operations {
+			key := strings.ToUpper(method) + " " + path
+			documented[key] = true
+			if operation.OperationId == "" {
+				t.Errorf("%v has no operationId", key)
+			}
+			if len(operation.Responses) == 0 {
+				t.Errorf("%v documents no responses", key)
+			}
+			// Path parameters must match the variables of the path template
+			var wantVars, gotVars []string
+			for _, match := range pathVars.FindAllStringSubmatch(path, -1) {
+				wantVars = append(wantVars, match[1])
+			}
+			for _, parameter := range document.parameters(t, key, operation) {
+				if parameter.In == "path" {
+					gotVars = append(gotVars, parameter.Name)
+				}
+			}
+			sort.Strings(wantVars)
+			sort.Strings(gotVars)
+			if !cmp.Equal(gotVars, wantVars) {
+				t.Errorf("%v path parameters not as expected. Wanted: %v, Got: %v", key, wantVars, gotVars)
+			}
+		}
+	}
+
+	for key := range routed {
+		if !documented[key] {
+			t.Errorf("%v is routed, but missing from the OpenAPI document", key)
+		}
+	}
+	for key := range documented {
+		if !routed[key] {
+			t.Errorf("%v is in the OpenAPI document, but not routed", key)
+		}
+	}
+}
+
+// openAPIPending is the request the handlers are called with that is still waiting on a signature
+var openAPIPending = PendingRequest{Request: Request{RequestId: "pending", Message: "taco"}, Timing: Timing{time.Now(), 1}, State: StateQueued, Add: true}
+
+// openAPIApplication creates an application with a request in every state, for the handlers to be called against
+func openAPIApplication() *Application {
+	events := NewEventBroker()
+	queue := NewFairQueue(5, nil)
+	track := make(chan PendingRequest, 16)
+	application := &Application{
+		Queue:      queue,
+		Schedule:   NewSchedule(queue, track, events),
+		Store:      make(chan SignedRequest, 16),
+		Signatures: map[string]string{"signed": "signature"},
+		Track:      track,
+		Requests: map[string]PendingRequest{
+			"pending":   openAPIPending,
+			"signed":    {Request: Request{RequestId: "signed", Message: "taco"}, Timing: Timing{time.Now(), 1}, State: StateSigned, Add: true},
+			"cancelled": {Request: Request{RequestId: "cancelled", Message: "taco"}, Timing: Timing{time.Now(), 1}, State: StateCancelled, Add: true},
+			"failed":    {Request: Request{RequestId: "failed", Message: "taco"}, Timing: Timing{time.Now(), 1}, State: StateFailed, Attempts: 3, Add: true},
+			"expired":   {Request: Request{RequestId: "expired", Message: "taco"}, Timing: Timing{time.Now(), 1}, State: StateExpired, Add: true},
+		},
+		ServerPort:      ":8080",
+		Batches:         &BatchStore{Batches: map[string]Batch{"batch": {BatchId: "batch", RequestIds: []string{"signed", "pending"}, TimeAdded: time.Now()}}},
+		Outbox:          &Outbox{Deliveries: make(map[string]CallbackDelivery), Secrets: map[string]string{DefaultCallbackSecretClient: "secret"}},
+		Events:          events,
+		Notifier:        NewNotifier(),
+		Cancellations:   NewCanceller(),
+		AdminToken:      "token",
+		Idempotency:     &IdempotencyStore{Keys: make(map[string]map[string]IdempotencyRecord), Retention: time.Hour},
+		Metadata:        &MetadataStore{Metadata: make(map[string]map[string]string)},
+		RequestIdClaims: NewRequestIdClaims(),
+		Control:         NewQueueControl(),
+		Metrics:         NewMetrics(),
+	}
+	queue.Push(openAPIPending.Request)
+	return application
+}
+
+// v1Target is the /v1 equivalent of a legacy route
+func v1Target(target string) string {
+	for _, prefix := range [][2]string{
+		{"/crypto/sign/request/", "/v1/requests/"},
+		{"/crypto/sign/batch", "/v1/batches"},
+		{"/crypto/sign", "/v1/requests"},
+		{"/admin/", "/v1/admin/"},
+	} {
+		if strings.HasPrefix(target, prefix[0]) {
+			return prefix[1] + strings.TrimPrefix(target, prefix[0])
+		}
+	}
+	return "/v1/health" + strings.TrimPrefix(target, "/")
+}
+
+// openAPIResponseHeaders are the response headers the handlers set that the OpenAPI document must declare
+var openAPIResponseHeaders = []string{"Location", "Retry-After", "ETag", "Cache-Control", "Idempotent-Replayed", CorrelationIdHeader}
+
+// openAPICredentialHeaders are covered by the security schemes of the document rather than its parameters
+var openAPICredentialHeaders = map[string]bool{"Authorization": true, "X-API-Key": true, "Content-Type": true}
+
+func TestOpenAPISpecMatchesHandlers(t *testing.T) {
+	document := loadOpenAPIDocument(t)
+	later := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	admin := map[string]string{"Authorization": "Bearer token"}
+	fullQueue := func(application *Application) {
+		application.Queue = NewFairQueue(1, nil)
+		application.Queue.Push(openAPIPending.Request)
+	}
+	replay := func(requestId string) func(application *Application) {
+		return func(application *Application) {
+			application.Idempotency.Reserve("client", "replayed", IdempotencyRecord{RequestId: requestId, MessageHash: hashMessage("taco"), TimeAdded: time.Now()})
+		}
+	}
+	// Every scenario but the legacy only ones is also run against the /v1 route
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		headers    map[string]string
+		body       string
+		setup      func(application *Application)
+		legacyOnly bool
+		statusCode int
+	}{
+		{name: "Health", method: "GET", target: "/", headers: map[string]string{CorrelationIdHeader: "call-1"}, statusCode: 200},
+		{name: "OpenAPI document", method: "GET", target: "/openapi.json", headers: map[string]string{CorrelationIdHeader: "call-1"}, legacyOnly: true, statusCode: 200},
+		{
+			name:       "Submit a message in the query",
+			method:     "GET",
+			target:     "/crypto/sign?message=taco&wait=0&requestId=job-1&priority=low&deadline=" + later + "&callbackUrl=https://example.com/hook",
+			headers:    map[string]string{"Idempotency-Key": "key-1", "X-Client-Id": "client", "X-Tenant-Id": "acme", CorrelationIdHeader: "call-1"},
+			legacyOnly: true,
+			statusCode: 202,
+		},
+		{name: "Schedule a message in the query", method: "GET", target: "/crypto/sign?message=taco&notBefore=" + later, legacyOnly: true, statusCode: 202},
+		{name: "Submit an invalid deadline in the query", method: "GET", target: "/crypto/sign?message=taco&deadline=soon", legacyOnly: true, statusCode: 400},
+		{
+			name:       "Submit to a full queue in the query",
+			method:     "GET",
+			target:     "/crypto/sign?message=taco",
+			setup:      fullQueue,
+			legacyOnly: true,
+			statusCode: 503,
+		},
+		{
+			name:       "Submit a message",
+			method:     "POST",
+			target:     "/crypto/sign?wait=0&requestId=job-1&priority=low&deadline=" + later + "&callbackUrl=https://example.com/hook",
+			headers:    map[string]string{"Content-Type": "text/plain", "Idempotency-Key": "key-1", "X-Client-Id": "client", "X-Tenant-Id": "acme", CorrelationIdHeader: "call-1"},
+			body:       "taco",
+			statusCode: 202,
+		},
+		{name: "Schedule a message", method: "POST", target: "/crypto/sign?notBefore=" + later, headers: map[string]string{"Content-Type": "text/plain"}, body: "taco", statusCode: 202},
+		{name: "Submit and wait for a signature", method: "POST", target: "/crypto/sign?wait=10ms", headers: map[string]string{"Content-Type": "text/plain"}, body: "taco", statusCode: 202},
+		{name: "Submit an unsupported body", method: "POST", target: "/crypto/sign", headers: map[string]string{"Content-Type": "text/xml"}, body: "<taco/>", statusCode: 415},
+		{
+			name:       "Submit a message too large",
+			method:     "POST",
+			target:     "/crypto/sign",
+			headers:    map[string]string{"Content-Type": "text/plain"},
+			body:       "taco",
+			setup:      func(application *Application) { application.MaxMessageBytes = 1 },
+			statusCode: 413,
+		},
+		{
+			name:       "Submit a request id in use",
+			method:     "POST",
+			target:     "/crypto/sign?requestId=pending",
+			headers:    map[string]string{"Content-Type": "text/plain"},
+			body:       "taco",
+			setup:      func(application *Application) { application.Requests["pending"] = openAPIPending },
+			statusCode: 409,
+		},
+		{name: "Submit to a full queue", method: "POST", target: "/crypto/sign", headers: map[string]string{"Content-Type": "text/plain"}, body: "taco", setup: fullQueue, statusCode: 503},
+		{name: "Replay a pending submission", method: "POST", target: "/crypto/sign", headers: map[string]string{"Content-Type": "text/plain", "Idempotency-Key": "replayed", "X-Client-Id": "client"}, body: "taco", setup: replay("pending"), statusCode: 202},
+		{name: "Replay a signed submission", method: "POST", target: "/crypto/sign", headers: map[string]string{"Content-Type": "text/plain", "Idempotency-Key": "replayed", "X-Client-Id": "client"}, body: "taco", setup: replay("signed"), statusCode: 200},
+		{name: "Replay a cancelled submission", method: "POST", target: "/crypto/sign", headers: map[string]string{"Content-Type": "text/plain", "Idempotency-Key": "replayed", "X-Client-Id": "client"}, body: "taco", setup: replay("cancelled"), statusCode: 410},
+		{name: "Replay a failed submission", method: "POST", target: "/crypto/sign", headers: map[string]string{"Content-Type": "text/plain", "Idempotency-Key": "replayed", "X-Client-Id": "client"}, body: "taco", setup: replay("failed"), statusCode: 503},
+		{name: "Replay a retrieved submission", method: "POST", target: "/crypto/sign", headers: map[string]string{"Content-Type": "text/plain", "Idempotency-Key": "replayed", "X-Client-Id": "client"}, body: "taco", setup: replay("retrieved"), statusCode: 404},
+		{name: "Replay with another message", method: "POST", target: "/crypto/sign", headers: map[string]string{"Content-Type": "text/plain", "Idempotency-Key": "replayed", "X-Client-Id": "client"}, body: "burrito", setup: replay("pending"), statusCode: 422},
+		{name: "Status of a pending request", method: "GET", target: "/crypto/sign/request/pending?wait=10ms", headers: map[string]string{"X-Tenant-Id": "default", CorrelationIdHeader: "call-1"}, statusCode: 202},
+		{name: "Status of an unchanged request", method: "GET", target: "/crypto/sign/request/pending", headers: map[string]string{"If-None-Match": requestETag(openAPIPending)}, statusCode: 304},
+		{name: "Status of a signed request", method: "GET", target: "/crypto/sign/request/signed", statusCode: 200},
+		{name: "Status of a cancelled request", method: "GET", target: "/crypto/sign/request/cancelled", statusCode: 410},
+		{name: "Status of a failed request", method: "GET", target: "/crypto/sign/request/failed", statusCode: 503},
+		{name: "Status of an unknown request", method: "GET", target: "/crypto/sign/request/unknown", statusCode: 404},
+		{name: "Status with an invalid wait", method: "GET", target: "/crypto/sign/request/pending?wait=soon", statusCode: 400},
+		{name: "Status of another tenant's request", method: "GET", target: "/crypto/sign/request/pending", headers: map[string]string{"X-Tenant-Id": "acme"}, statusCode: 404},
+		{name: "Cancel a pending request", method: "DELETE", target: "/crypto/sign/request/pending", headers: map[string]string{"X-Tenant-Id": "default", CorrelationIdHeader: "call-1"}, statusCode: 200},
+		{name: "Cancel a signed request", method: "DELETE", target: "/crypto/sign/request/signed", statusCode: 409},
+		{name: "Cancel an expired request", method: "DELETE", target: "/crypto/sign/request/expired", statusCode: 410},
+		{name: "Cancel an unknown request", method: "DELETE", target: "/crypto/sign/request/unknown", statusCode: 404},
+		{name: "Stream the events of a request", method: "GET", target: "/crypto/sign/request/pending/events", headers: map[string]string{"X-Tenant-Id": "default", CorrelationIdHeader: "call-1"}, statusCode: 200},
+		{name: "Stream the events of an unknown request", method: "GET", target: "/crypto/sign/request/unknown/events", statusCode: 404},
+		{
+			name:       "Submit a batch",
+			method:     "POST",
+			target:     "/crypto/sign/batch",
+			headers:    map[string]string{"Content-Type": "application/json", "X-Client-Id": "client", "X-Tenant-Id": "acme", CorrelationIdHeader: "call-1"},
+			body:       `{"messages":["taco","burrito"]}`,
+			statusCode: 202,
+		},
+		{name: "Submit an empty batch", method: "POST", target: "/crypto/sign/batch", headers: map[string]string{"Content-Type": "application/json"}, body: `{"messages":[]}`, statusCode: 400},
+		{name: "Submit a batch too large", method: "POST", target: "/crypto/sign/batch", headers: map[string]string{"Content-Type": "application/json"}, body: `{"messages":["taco","burrito"]}`, setup: func(application *Application) { application.MaxBatchBytes = 8 }, statusCode: 413},
+		{name: "Submit a batch to a full queue", method: "POST", target: "/crypto/sign/batch", headers: map[string]string{"Content-Type": "application/json"}, body: `{"messages":["taco","burrito"]}`, setup: fullQueue, statusCode: 503},
+		{name: "Status of a batch", method: "GET", target: "/crypto/sign/batch/batch", headers: map[string]string{"X-Tenant-Id": "default", CorrelationIdHeader: "call-1"}, statusCode: 200},
+		{name: "Status of an unknown batch", method: "GET", target: "/crypto/sign/batch/unknown", statusCode: 404},
+		{name: "Stream every event", method: "GET", target: "/admin/events", headers: map[string]string{"Authorization": "Bearer token", CorrelationIdHeader: "call-1"}, statusCode: 200},
+		{name: "Admin without a token", method: "GET", target: "/admin/events", statusCode: 401},
+		{name: "Admin endpoints disabled", method: "GET", target: "/admin/events", setup: func(application *Application) { application.AdminToken = "" }, statusCode: 403},
+		{
+			name:       "List requests",
+			method:     "GET",
+			target:     "/admin/requests?state=failed&minAge=0s&maxAge=2h&minAttempts=1&maxAttempts=10&messageHash=" + hashMessage("taco") + "&tenant=default&sort=attempts&order=desc&limit=10",
+			headers:    map[string]string{"Authorization": "Bearer token", CorrelationIdHeader: "call-1"},
+			statusCode: 200,
+		},
+		{name: "List requests with an invalid cursor", method: "GET", target: "/admin/requests?cursor=invalid", headers: admin, statusCode: 400},
+		{
+			name:       "Requeue failed requests",
+			method:     "POST",
+			target:     "/admin/requests/requeue?minAge=0s&maxAge=2h&minAttempts=1&maxAttempts=10&messageHash=" + hashMessage("taco") + "&tenant=default",
+			headers:    map[string]string{"Authorization": "Bearer token", CorrelationIdHeader: "call-1"},
+			statusCode: 200,
+		},
+		{name: "Requeue with an invalid filter", method: "POST", target: "/admin/requests/requeue?minAge=soon", headers: admin, statusCode: 400},
+		{name: "Requeue a failed request", method: "POST", target: "/admin/requests/failed/requeue", headers: map[string]string{"Authorization": "Bearer token", CorrelationIdHeader: "call-1"}, statusCode: 200},
+		{name: "Requeue a pending request", method: "POST", target: "/admin/requests/pending/requeue", headers: admin, statusCode: 409},
+		{name: "Requeue an unknown request", method: "POST", target: "/admin/requests/unknown/requeue", headers: admin, statusCode: 404},
+		{name: "Queue status", method: "GET", target: "/admin/queue", headers: map[string]string{"Authorization": "Bearer token", CorrelationIdHeader: "call-1"}, statusCode: 200},
+		{name: "Pause the queue", method: "POST", target: "/admin/queue/pause", headers: map[string]string{"Authorization": "Bearer token", CorrelationIdHeader: "call-1"}, statusCode: 200},
+		{name: "Resume the queue", method: "POST", target: "/admin/queue/resume", headers: map[string]string{"Authorization": "Bearer token", CorrelationIdHeader: "call-1"}, statusCode: 200},
+		{name: "Drain the queue", method: "POST", target: "/admin/queue/drain", headers: map[string]string{"Authorization": "Bearer token", CorrelationIdHeader: "call-1"}, statusCode: 200},
+		{name: "Metrics", method: "GET", target: "/metrics", headers: map[string]string{"Authorization": "Bearer token", CorrelationIdHeader: "call-1"}, legacyOnly: true, statusCode: 200},
+		{name: "Metrics without a token", method: "GET", target: "/metrics", legacyOnly: true, statusCode: 401},
+	}
+
+	// The query parameters and headers the handlers were called with, for each operation
+	called := make(map[string]map[string]bool)
+	for _, tt := range tests {
+		targets := []string{tt.target}
+		if !tt.legacyOnly {
+			targets = append(targets, v1Target(tt.target))
+		}
+		for _, target := range targets {
+			t.Run(tt.name+" "+target, func(t *testing.T) {
+				application := openAPIApplication()
+				if tt.setup != nil {
+					tt.setup(application)
+				}
+				router := NewRouter(application)
+				// Event streams are held open until the caller goes away
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				defer cancel()
+				req := httptest.NewRequest(tt.method, target, strings.NewReader(tt.body)).WithContext(ctx)
+				for header, value := range tt.headers {
+					req.Header.Set(header, value)
+				}
+				var match mux.RouteMatch
+				if !router.Match(req, &match) || match.Route == nil {
+					t.Fatalf("%v %v isn't routed", tt.method, target)
+				}
+				path, _ := match.Route.GetPathTemplate()
+				key := tt.method + " " + path
+				operation, ok := document.Paths[path][strings.ToLower(tt.method)]
+				if !ok {
+					t.Fatalf("%v is missing from the OpenAPI document", key)
+				}
+				if called[key] == nil {
+					called[key] = make(map[string]bool)
+				}
+				for name := range req.URL.Query() {
+					called[key]["query "+name] = true
+				}
+				for header := range tt.headers {
+					if !openAPICredentialHeaders[header] {
+						called[key]["header "+header] = true
+					}
+				}
+
+				rr := httptest.NewRecorder()
+				router.ServeHTTP(rr, req)
+				if rr.Code != tt.statusCode {
+					t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, tt.statusCode)
+				}
+				response, ok := operation.Responses[strconv.Itoa(rr.Code)]
+				if !ok {
+					t.Fatalf("%v responded %v, which the OpenAPI document doesn't declare", key, rr.Code)
+				}
+				for _, header := range openAPIResponseHeaders {
+					if _, declared := response.Headers[header]; rr.Header().Get(header) != "" && !declared {
+						t.Errorf("%v responded %v with a %v header, which the OpenAPI document doesn't declare", key, rr.Code, header)
+					}
+				}
+			})
+		}
+	}
+
+	for path, operations := range document.Paths {
+		for method, operation := range operations {
+			key := strings.ToUpper(method) + " " + path
+			// Every response carries the correlation id of the call
+			for statusCode, response := range operation.Responses {
+				if _, ok := response.Headers[CorrelationIdHeader]; !ok {
+					t.Errorf("%v response %v doesn't declare the %v header", key, statusCode, CorrelationIdHeader)
+				}
+			}
+			if called[key] == nil {
+				t.Errorf("%v is documented, but no handler was called for it", key)
+				continue
+			}
+			declared := make(map[string]bool)
+			for _, parameter := range document.parameters(t, key, operation) {
+				if parameter.In != "path" {
+					declared[parameter.In+" "+parameter.Name] = true
+				}
+			}
+			if diff := cmp.Diff(declared, called[key]); diff != "" {
+				t.Errorf("%v parameters not as called. Diff (-declared +called): %v", key, diff)
+			}
+		}
+	}
+}
+
+func TestApp_openAPIHandler(t *testing.T) {
+	router := NewRouter(&Application{})
+	req := httptest.NewRequest("GET", "/openapi.json", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if !json.Valid(rr.Body.Bytes()) {
+		t.Errorf("Handler did not return a valid JSON document")
+	}
+}
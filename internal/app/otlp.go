@@ -0,0 +1,164 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DefaultOTLPEndpoint is where spans are sent by the OTLP exporter when no endpoint has been configured, the
+// traces endpoint of a collector running alongside the service
+const DefaultOTLPEndpoint = "http://localhost:4318/v1/traces"
+
+// traceServiceName identifies the service in exported traces
+const traceServiceName = "synthesia-signer"
+
+// traceScopeName identifies the code that created the spans in exported traces
+const traceScopeName = "github.com/imikewhite/synthesia/internal/app"
+
+// otlpSpanKinds maps the kinds of span to their OTLP values
+var otlpSpanKinds = map[string]int{SpanKindInternal: 1, SpanKindServer: 2, SpanKindClient: 3}
+
+// otlpStatusError is the OTLP status code of a span whose work failed. Other spans leave their status unset
+const otlpStatusError = 2
+
+// OTLPExporter sends spans to an OpenTelemetry collector using the JSON encoding of OTLP over HTTP
+type OTLPExporter struct {
+	Endpoint string
+	Client   *http.Client
+}
+
+// NewOTLPExporter creates an exporter sending spans to the traces endpoint of a collector, DefaultOTLPEndpoint when
+// unset
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	if endpoint == "" {
+		endpoint = DefaultOTLPEndpoint
+	}
+	return &OTLPExporter{Endpoint: endpoint, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// otlpTraces is the body of an OTLP export request
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceId           string          `json:"traceId"`
+	SpanId            string          `json:"spanId"`
+	ParentSpanId      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue holds one of the kinds of attribute value. Ints are encoded as strings, as 64 bit ints are in JSON
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+// ExportSpans posts the spans to the collector
+func (exporter *OTLPExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	scope := otlpScopeSpans{Scope: otlpScope{Name: traceScopeName}, Spans: make([]otlpSpan, len(spans))}
+	for i, span := range spans {
+		scope.Spans[i] = otlpSpan{
+			TraceId:           span.TraceId,
+			SpanId:            span.SpanId,
+			ParentSpanId:      span.ParentSpanId,
+			Name:              span.Name,
+			Kind:              otlpSpanKinds[span.Kind],
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.Error != "" {
+			scope.Spans[i].Status = otlpStatus{Code: otlpStatusError, Message: span.Error}
+		}
+	}
+	body, err := json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: otlpAttributes(map[string]interface{}{"service.name": traceServiceName})},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", exporter.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := exporter.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with status code %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// otlpAttributes converts span attributes to their OTLP form, in order of their keys. Values other than strings,
+// ints and bools are formatted as strings
+func otlpAttributes(attributes map[string]interface{}) []otlpAttribute {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	converted := make([]otlpAttribute, len(keys))
+	for i, key := range keys {
+		var value otlpValue
+		switch typed := attributes[key].(type) {
+		case string:
+			value.StringValue = &typed
+		case int:
+			formatted := strconv.Itoa(typed)
+			value.IntValue = &formatted
+		case bool:
+			value.BoolValue = &typed
+		default:
+			formatted := fmt.Sprint(typed)
+			value.StringValue = &formatted
+		}
+		converted[i] = otlpAttribute{Key: key, Value: value}
+	}
+	return converted
+}
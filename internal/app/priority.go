@@ -0,0 +1,87 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Priorities a request can be submitted at. Each has its own lane in the encrypt queue, served from the highest
+// down. Requests submitted without a priority are normal
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+	PriorityLow    = "low"
+)
+
+// priorities lists the lanes of the encrypt queue from the highest priority down
+var priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// defaultPriorities are the priorities a client may submit at when its policy doesn't list any
+var defaultPriorities = []string{PriorityNormal, PriorityLow}
+
+// DefaultPriorityAging is how long a request waits before it is served as though it were a lane higher, when no
+// aging has been configured
+const DefaultPriorityAging = 5 * time.Minute
+
+// priorityLane is the lane of the encrypt queue a priority is served from
+func priorityLane(priority string) int {
+	for lane, candidate := range priorities {
+		if candidate == priority {
+			return lane
+		}
+	}
+	return priorityLane(PriorityNormal)
+}
+
+// requestPriority is the priority a request was submitted at
+func requestPriority(request Request) string {
+	if request.Priority == "" {
+		return PriorityNormal
+	}
+	return request.Priority
+}
+
+// validatePriority checks a submission names a known priority, if it names one at all
+func validatePriority(priority string) *MessageError {
+	if priority == "" {
+		return nil
+	}
+	for _, candidate := range priorities {
+		if candidate == priority {
+			return nil
+		}
+	}
+	return &MessageError{StatusCode: http.StatusBadRequest, Reason: fmt.Sprintf("The priority must be one of %s.", strings.Join(priorities, ", "))}
+}
+
+// allowsPriority reports whether a client's policy lets it submit at a priority
+func (client Client) allowsPriority(priority string) bool {
+	allowed := client.Priorities
+	if len(allowed) == 0 {
+		allowed = defaultPriorities
+	}
+	for _, candidate := range allowed {
+		if candidate == priority {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPriority checks the calling client may submit at a priority. Every priority is allowed when authentication
+// is disabled, as there are no policies to restrict it
+func (application *Application) checkPriority(r *http.Request, priority string) *MessageError {
+	if priority == "" || (application.APIKeys == nil && application.JWT == nil) {
+		return nil
+	}
+	if client, _ := clientFromContext(r); !client.allowsPriority(priority) {
+		return &MessageError{
+			StatusCode: http.StatusForbidden,
+			Code:       ErrorForbidden,
+			Reason:     fmt.Sprintf("The credentials are not allowed to submit at the '%s' priority.", priority),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApp_checkPriority(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		target       string
+		body         string
+		apiKey       string
+		statusCode   int
+		bodyExpected string
+		wantPriority string
+	}{
+		{
+			name:         "No priority",
+			method:       "POST",
+			target:       "/v1/requests?wait=0",
+			body:         `{"message":"taco"}`,
+			apiKey:       "admin-key",
+			statusCode:   202,
+			wantPriority: "",
+		},
+		{
+			name:         "Priority allowed by default",
+			method:       "POST",
+			target:       "/v1/requests?wait=0",
+			body:         `{"message":"taco","priority":"low"}`,
+			apiKey:       "admin-key",
+			statusCode:   202,
+			wantPriority: PriorityLow,
+		},
+		{
+			name:         "Priority not allowed by default",
+			method:       "POST",
+			target:       "/v1/requests",
+			body:         `{"message":"taco","priority":"high"}`,
+			apiKey:       "admin-key",
+			statusCode:   403,
+			bodyExpected: `{"error":{"code":"forbidden","message":"The credentials are not allowed to submit at the 'high' priority."}}`,
+		},
+		{
+			name:         "Priority allowed by the key's policy",
+			method:       "GET",
+			target:       "/crypto/sign?message=taco&priority=high&wait=0",
+			apiKey:       "alpha-key",
+			statusCode:   202,
+			wantPriority: PriorityHigh,
+		},
+		{
+			name:         "Priority not allowed by the key's policy",
+			method:       "POST",
+			target:       "/v1/batches",
+			body:         `{"messages":["taco"],"priority":"low"}`,
+			apiKey:       "alpha-key",
+			statusCode:   403,
+			bodyExpected: `"code":"forbidden"`,
+		},
+		{
+			name:         "Batch priority",
+			method:       "POST",
+			target:       "/v1/batches",
+			body:         `{"messages":["taco"],"priority":"high"}`,
+			apiKey:       "alpha-key",
+			statusCode:   202,
+			wantPriority: PriorityHigh,
+		},
+		{
+			name:         "Unknown priority",
+			method:       "POST",
+			target:       "/v1/requests",
+			body:         `{"message":"taco","priority":"urgent"}`,
+			apiKey:       "alpha-key",
+			statusCode:   400,
+			bodyExpected: `{"error":{"code":"invalid_request","message":"The priority must be one of high, normal, low."}}`,
+		},
+		{
+			name:         "Every priority allowed without authentication",
+			method:       "POST",
+			target:       "/v1/requests?wait=0",
+			body:         `{"message":"taco","priority":"high"}`,
+			statusCode:   202,
+			wantPriority: PriorityHigh,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Queue:    NewFairQueue(1, nil),
+				Track:    make(chan PendingRequest, 1),
+				Requests: make(map[string]PendingRequest),
+				Batches:  &BatchStore{Batches: make(map[string]Batch)},
+				Events:   NewEventBroker(),
+			}
+			if tt.apiKey != "" {
+				application.APIKeys = LoadAPIKeys("../../testdata/apiKeys.json")
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			if tt.apiKey != "" {
+				req.Header.Set("X-API-Key", tt.apiKey)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
+			}
+			if tt.statusCode != 202 {
+				if application.Queue.Len() != 0 {
+					t.Errorf("Rejected request was queued")
+				}
+				return
+			}
+			if request, _ := application.Queue.Pop(context.Background()); request.Priority != tt.wantPriority {
+				t.Errorf("Request was queued with the wrong priority. Want: %v, Recieved: %v", tt.wantPriority, request.Priority)
+			}
+		})
+	}
+}
@@ -0,0 +1,441 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultQueueWeight is the share of the encryptors a client gets when it isn't given a weight
+const DefaultQueueWeight = 1
+
+// signaturesPerMinute is the rate the time estimates assume requests leave the encrypt queue at
+const signaturesPerMinute = 5.0
+
+// queuedRequest is a request waiting in the encrypt queue, along with when it was queued
+type queuedRequest struct {
+	Request
+	queued time.Time
+}
+
+// clientQueue holds the queued requests of a single client, along with how many more it may send to the
+// encryptors in the current round
+type clientQueue struct {
+	requests []queuedRequest
+	deficit  int
+}
+
+// lane holds the queued requests of a single priority, with a queue for each client
+type lane struct {
+	queues map[string]*clientQueue
+	// active lists the clients with queued requests, in the order they are served
+	active []string
+}
+
+// oldest is when the longest waiting request at the front of a client's queue was queued
+func (lane *lane) oldest() time.Time {
+	var oldest time.Time
+	for _, key := range lane.active {
+		if queued := lane.queues[key].requests[0].queued; oldest.IsZero() || queued.Before(oldest) {
+			oldest = queued
+		}
+	}
+	return oldest
+}
+
+// For mocking in tests
+var queueClock = time.Now
+
+// FairQueue is the encrypt queue. Requests wait in the lane of their priority, and the highest lane with requests
+// is served first, though a request is served as though it were a lane higher for each Aging it has waited, so the
+// lower lanes are never starved. Within a lane each client, by tenant scoped id, has its own queue, and the queues
+// are drained by deficit round robin so a burst from one client doesn't hold up everyone else. Each round a client
+// may send as many requests as its weight. Safe for concurrent use by handlers and the scheduler
+type FairQueue struct {
+	mu       sync.Mutex
+	capacity int
+	// Weights maps client ids to their weight, with the 'default' entry standing in for clients that aren't listed
+	Weights map[string]int
+	// Aging is how long a request waits before it is served as though it were a lane higher, DefaultPriorityAging
+	// when unset
+	Aging  time.Duration
+	lanes  []*lane
+	length int
+	// reserved is the capacity held back for scheduled requests, which are queued once they are due
+	reserved int
+	// ready wakes the scheduler when requests are queued
+	ready chan struct{}
+}
+
+// NewFairQueue creates an encrypt queue holding up to capacity requests across every client
+func NewFairQueue(capacity int, weights map[string]int) *FairQueue {
+	queue := &FairQueue{
+		capacity: capacity,
+		Weights:  weights,
+		lanes:    make([]*lane, len(priorities)),
+		ready:    make(chan struct{}, 1),
+	}
+	for i := range queue.lanes {
+		queue.lanes[i] = &lane{queues: make(map[string]*clientQueue)}
+	}
+	return queue
+}
+
+// queueKey is the client a request is queued under
+func queueKey(request Request) string {
+	return requestScopedId(request)
+}
+
+// weight is the number of requests a client may send to the encryptors each round
+func (queue *FairQueue) weight(key string) int {
+	if weight, ok := queue.Weights[key]; ok && weight > 0 {
+		return weight
+	}
+	if weight, ok := queue.Weights["default"]; ok && weight > 0 {
+		return weight
+	}
+	return DefaultQueueWeight
+}
+
+// aging returns the configured aging, falling back to the default when unset
+func (queue *FairQueue) aging() time.Duration {
+	if queue.Aging <= 0 {
+		return DefaultPriorityAging
+	}
+	return queue.Aging
+}
+
+// Push queues a request, returning false when the queue is at capacity
+func (queue *FairQueue) Push(request Request) bool {
+	return queue.PushAll([]Request{request})
+}
+
+// PushAll queues every one of the requests, or none of them when the queue lacks capacity for them all
+func (queue *FairQueue) PushAll(requests []Request) bool {
+	if queue == nil {
+		return false
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.capacity-queue.length-queue.reserved < len(requests) {
+		return false
+	}
+	now := queueClock()
+	for _, request := range requests {
+		queue.push(request, now)
+	}
+	return true
+}
+
+// requeue queues a request regardless of capacity, for requests that were accepted before a restart. The request
+// keeps aging from when it was first queued
+func (queue *FairQueue) requeue(request Request, queued time.Time) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.push(request, queued)
+}
+
+// Reserve holds back capacity for requests to be queued later, returning false when the queue lacks capacity for
+// them all
+func (queue *FairQueue) Reserve(count int) bool {
+	if queue == nil {
+		return false
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.capacity-queue.length-queue.reserved < count {
+		return false
+	}
+	queue.reserved += count
+	return true
+}
+
+// reserve holds back capacity regardless of whether there is any, for requests that were accepted before a restart
+func (queue *FairQueue) reserve(count int) {
+	if queue == nil {
+		return
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.reserved += count
+}
+
+// unreserve gives back the capacity held for a request that will no longer be queued
+func (queue *FairQueue) unreserve() {
+	if queue == nil {
+		return
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.reserved > 0 {
+		queue.reserved--
+	}
+}
+
+// pushReserved queues a request into capacity held back for it. The request keeps aging from when it was due
+func (queue *FairQueue) pushReserved(request Request, queued time.Time) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	if queue.reserved > 0 {
+		queue.reserved--
+	}
+	queue.push(request, queued)
+}
+
+// push queues a request at the back of its client's queue in the lane of its priority. Callers must hold the lock
+func (queue *FairQueue) push(request Request, queued time.Time) {
+	lane := queue.lanes[priorityLane(requestPriority(request))]
+	key := queueKey(request)
+	pending, ok := lane.queues[key]
+	if !ok {
+		pending = &clientQueue{}
+		lane.queues[key] = pending
+	}
+	if len(pending.requests) == 0 {
+		lane.active = append(lane.active, key)
+	}
+	pending.requests = append(pending.requests, queuedRequest{Request: request, queued: queued})
+	queue.length++
+	queue.signal()
+}
+
+// signal wakes the scheduler, unless it has already been woken
+func (queue *FairQueue) signal() {
+	select {
+	case queue.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Pop waits for the next request due to be encrypted, returning false if the context is done first
+func (queue *FairQueue) Pop(ctx context.Context) (Request, bool) {
+	request, ok := queue.pop(ctx, nil)
+	return request.Request, ok
+}
+
+// pop waits for the next request due to be encrypted, along with when it was queued, returning false if the context
+// is done first. The request is handed to taken, if set, before the queue is unlocked, so there is never a moment it
+// is neither queued nor taken
+func (queue *FairQueue) pop(ctx context.Context, taken func(requestId string)) (queuedRequest, bool) {
+	if queue == nil {
+		<-ctx.Done()
+		return queuedRequest{}, false
+	}
+	for {
+		if request, ok := queue.next(taken); ok {
+			return request, true
+		}
+		select {
+		case <-queue.ready:
+		case <-ctx.Done():
+			return queuedRequest{}, false
+		}
+	}
+}
+
+// next takes the next request from the lane due to be served
+func (queue *FairQueue) next(taken func(requestId string)) (queuedRequest, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	lane := queue.dueLane(queueClock())
+	if lane == nil {
+		return queuedRequest{}, false
+	}
+	request := queue.nextInLane(lane)
+	if taken != nil {
+		taken(request.RequestId)
+	}
+	if queue.length > 0 {
+		// Whoever else is waiting gets a turn at the rest of the queue
+		queue.signal()
+	}
+	return request, true
+}
+
+// dueLane picks the lane to serve next, which is the highest lane with requests once each lane has been moved up
+// for every Aging its longest waiting request has waited. Callers must hold the lock
+func (queue *FairQueue) dueLane(now time.Time) *lane {
+	var due *lane
+	dueRank := 0
+	for i, lane := range queue.lanes {
+		if len(lane.active) == 0 {
+			continue
+		}
+		rank := i - int(now.Sub(lane.oldest())/queue.aging())
+		if due == nil || rank < dueRank {
+			due, dueRank = lane, rank
+		}
+	}
+	return due
+}
+
+// nextInLane takes the next request from the client at the front of a lane's round. A client starting its turn is
+// given its weight in requests, and goes to the back of the round once it has used them up or has none left.
+// Callers must hold the lock
+func (queue *FairQueue) nextInLane(lane *lane) queuedRequest {
+	key := lane.active[0]
+	pending := lane.queues[key]
+	if pending.deficit <= 0 {
+		pending.deficit = queue.weight(key)
+	}
+	request := pending.requests[0]
+	pending.requests = pending.requests[1:]
+	pending.deficit--
+	queue.length--
+	switch {
+	case len(pending.requests) == 0:
+		delete(lane.queues, key)
+		lane.active = lane.active[1:]
+	case pending.deficit <= 0:
+		lane.active = append(lane.active[1:], key)
+	}
+	return request
+}
+
+// RemoveExpired takes every queued request whose deadline has passed out of the queue
+func (queue *FairQueue) RemoveExpired(now time.Time) []Request {
+	return queue.removeWhere(func(queued queuedRequest) bool {
+		return queued.expired(now)
+	})
+}
+
+// Remove takes a request out of the queue, reporting whether it was queued
+func (queue *FairQueue) Remove(requestId string) bool {
+	return len(queue.removeWhere(func(queued queuedRequest) bool {
+		return queued.RequestId == requestId
+	})) > 0
+}
+
+// removeWhere takes every queued request matching remove out of the queue. Clients keep their place in the round,
+// unless they have no requests left
+func (queue *FairQueue) removeWhere(remove func(queuedRequest) bool) []Request {
+	if queue == nil {
+		return nil
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	var removed []Request
+	for _, lane := range queue.lanes {
+		active := lane.active[:0]
+		for _, key := range lane.active {
+			pending := lane.queues[key]
+			kept := pending.requests[:0]
+			for _, queued := range pending.requests {
+				if remove(queued) {
+					removed = append(removed, queued.Request)
+				} else {
+					kept = append(kept, queued)
+				}
+			}
+			pending.requests = kept
+			if len(kept) == 0 {
+				delete(lane.queues, key)
+				continue
+			}
+			active = append(active, key)
+		}
+		lane.active = active
+	}
+	queue.length -= len(removed)
+	return removed
+}
+
+// Len is the number of requests queued across every client
+func (queue *FairQueue) Len() int {
+	if queue == nil {
+		return 0
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	return queue.length
+}
+
+// Capacity is the number of requests the queue holds before turning submissions away
+func (queue *FairQueue) Capacity() int {
+	if queue == nil {
+		return 0
+	}
+	return queue.capacity
+}
+
+// Position is how many requests will be sent to the encryptors before a queued request is, counting the request
+// itself. The requests in the higher lanes are counted up to as many as are sent in the time aging takes to lift
+// the request's lane past them, and within the request's own lane, each turn its client waits on, every other client
+// sends up to its weight in requests. Requests that aren't queued have a position of zero
+func (queue *FairQueue) Position(request Request) int {
+	if queue == nil {
+		return 0
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	laneIndex := priorityLane(requestPriority(request))
+	lane := queue.lanes[laneIndex]
+	key := queueKey(request)
+	pending, ok := lane.queues[key]
+	if !ok {
+		return 0
+	}
+	index := -1
+	for i, queued := range pending.requests {
+		if queued.RequestId == request.RequestId {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return 0
+	}
+	// The client's remaining turn is used up first, then it needs a turn for each weight of requests left, with
+	// every other client taking its turn before each of them
+	turns := 0
+	if left := index + 1 - pending.deficit; left > 0 {
+		turns = int(math.Ceil(float64(left) / float64(queue.weight(key))))
+	}
+	position := index + 1
+	for otherKey, otherQueue := range lane.queues {
+		if otherKey == key {
+			continue
+		}
+		position += minInt(len(otherQueue.requests), turns*queue.weight(otherKey))
+	}
+	higherRequests := 0
+	for _, higher := range queue.lanes[:laneIndex] {
+		for _, otherQueue := range higher.queues {
+			higherRequests += len(otherQueue.requests)
+		}
+	}
+	// However busy the higher lanes are, aging lets the request's lane overtake each of them in time
+	return position + minInt(higherRequests, laneIndex*int(queue.aging().Minutes()*signaturesPerMinute))
+}
+
+// minInt is the smaller of two ints
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// LoadQueueWeights reads the weight of each client from a JSON file mapping client id to weight. Clients of
+// tenants other than the default are listed as '<tenant>/<clientId>'
+func LoadQueueWeights(queueWeightsLocation string) map[string]int {
+	weights := make(map[string]int)
+	if queueWeightsLocation == "" {
+		return weights
+	}
+	weightsBytes, err := os.ReadFile(queueWeightsLocation)
+	if err != nil {
+		logrus.Errorf("Was unable to read queue weights file. Details: %v", err)
+		return weights
+	}
+	if err := json.Unmarshal(weightsBytes, &weights); err != nil {
+		logrus.Errorf("Was unable to unmarshal queue weights into object. Details: %v", err)
+		return make(map[string]int)
+	}
+	return weights
+}
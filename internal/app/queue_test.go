@@ -0,0 +1,403 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFairQueue_Pop(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights map[string]int
+		// queued are the requests pushed, named '<clientId>-<n>' (or '<tenant>/<clientId>-<n>')
+		queued []string
+		want   []string
+	}{
+		{
+			name:   "Single client is first in first out",
+			queued: []string{"alpha-1", "alpha-2", "alpha-3"},
+			want:   []string{"alpha-1", "alpha-2", "alpha-3"},
+		},
+		{
+			name:   "Burst doesn't hold up other clients",
+			queued: []string{"alpha-1", "alpha-2", "alpha-3", "alpha-4", "beta-1", "gamma-1", "beta-2"},
+			want:   []string{"alpha-1", "beta-1", "gamma-1", "alpha-2", "beta-2", "alpha-3", "alpha-4"},
+		},
+		{
+			name:    "Clients are served by weight",
+			weights: map[string]int{"alpha": 3},
+			queued:  []string{"alpha-1", "alpha-2", "alpha-3", "alpha-4", "alpha-5", "beta-1", "beta-2", "beta-3"},
+			want:    []string{"alpha-1", "alpha-2", "alpha-3", "beta-1", "alpha-4", "alpha-5", "beta-2", "beta-3"},
+		},
+		{
+			name:    "Default weight applies to clients that aren't listed",
+			weights: map[string]int{"default": 2},
+			queued:  []string{"alpha-1", "alpha-2", "alpha-3", "beta-1", "beta-2"},
+			want:    []string{"alpha-1", "alpha-2", "beta-1", "beta-2", "alpha-3"},
+		},
+		{
+			name:   "Clients of different tenants are queued apart",
+			queued: []string{"alpha-1", "alpha-2", "acme/alpha-1"},
+			want:   []string{"alpha-1", "acme/alpha-1", "alpha-2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := NewFairQueue(len(tt.queued), tt.weights)
+			for _, requestId := range tt.queued {
+				queue.Push(mockQueuedRequest(requestId))
+			}
+			var popped []string
+			for range tt.queued {
+				request, ok := queue.Pop(context.Background())
+				if !ok {
+					t.Fatalf("Queue was unexpectedly empty")
+				}
+				popped = append(popped, request.RequestId)
+			}
+			if !cmp.Equal(popped, tt.want) {
+				t.Errorf("Requests were not taken in the expected order. Want: %v, Recieved: %v", tt.want, popped)
+			}
+			if queue.Len() != 0 {
+				t.Errorf("Queue was not emptied. Length: %v", queue.Len())
+			}
+		})
+	}
+}
+
+// mockQueuedRequest creates a request from a name of the form '<clientId>-<n>' or '<tenant>/<clientId>-<n>'
+func mockQueuedRequest(requestId string) Request {
+	request := Request{RequestId: requestId, Message: "message", ClientId: requestId[:strings.LastIndex(requestId, "-")]}
+	if i := strings.Index(request.ClientId, "/"); i >= 0 {
+		request.TenantId, request.ClientId = request.ClientId[:i], request.ClientId[i+1:]
+	}
+	return request
+}
+
+func TestFairQueue_PopLanes(t *testing.T) {
+	now := time.Now()
+	queueClock = func() time.Time { return now }
+	defer func() { queueClock = time.Now }()
+	tests := []struct {
+		name string
+		// queued are the requests pushed, named '<clientId>-<n>', at the given priority and how long ago
+		queued []struct {
+			requestId string
+			priority  string
+			age       time.Duration
+		}
+		want []string
+	}{
+		{
+			name: "Higher lanes are served first",
+			queued: []struct {
+				requestId string
+				priority  string
+				age       time.Duration
+			}{
+				{"alpha-1", PriorityLow, 0},
+				{"alpha-2", "", 0},
+				{"beta-1", PriorityHigh, 0},
+				{"alpha-3", PriorityHigh, 0},
+				{"beta-2", PriorityNormal, 0},
+			},
+			want: []string{"beta-1", "alpha-3", "alpha-2", "beta-2", "alpha-1"},
+		},
+		{
+			name: "Aged requests are served as though they were a lane higher, ties going to the higher lane",
+			queued: []struct {
+				requestId string
+				priority  string
+				age       time.Duration
+			}{
+				{"alpha-1", PriorityLow, 2 * time.Minute},
+				{"beta-1", PriorityNormal, 0},
+				{"gamma-1", PriorityHigh, 0},
+			},
+			want: []string{"gamma-1", "alpha-1", "beta-1"},
+		},
+		{
+			name: "Requests aged past every lane are served first",
+			queued: []struct {
+				requestId string
+				priority  string
+				age       time.Duration
+			}{
+				{"alpha-1", PriorityLow, 3 * time.Minute},
+				{"gamma-1", PriorityHigh, 0},
+			},
+			want: []string{"alpha-1", "gamma-1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := NewFairQueue(len(tt.queued), nil)
+			queue.Aging = time.Minute
+			for _, queued := range tt.queued {
+				request := mockQueuedRequest(queued.requestId)
+				request.Priority = queued.priority
+				queue.requeue(request, now.Add(-queued.age))
+			}
+			var popped []string
+			for range tt.queued {
+				request, _ := queue.Pop(context.Background())
+				popped = append(popped, request.RequestId)
+			}
+			if !cmp.Equal(popped, tt.want) {
+				t.Errorf("Requests were not taken in the expected order. Want: %v, Recieved: %v", tt.want, popped)
+			}
+		})
+	}
+}
+
+func TestFairQueue_PushAll(t *testing.T) {
+	queue := NewFairQueue(3, nil)
+	if !queue.PushAll([]Request{{RequestId: "a"}, {RequestId: "b"}}) {
+		t.Errorf("Queue rejected requests within its capacity")
+	}
+	if queue.PushAll([]Request{{RequestId: "c"}, {RequestId: "d"}}) {
+		t.Errorf("Queue accepted requests beyond its capacity")
+	}
+	if queue.Len() != 2 {
+		t.Errorf("Queue took part of the requests it rejected. Length: %v", queue.Len())
+	}
+	if !queue.Push(Request{RequestId: "c"}) {
+		t.Errorf("Queue rejected a request within its capacity")
+	}
+	var nilQueue *FairQueue
+	if nilQueue.Push(Request{RequestId: "a"}) || nilQueue.Len() != 0 {
+		t.Errorf("Missing queue accepted a request")
+	}
+}
+
+func TestFairQueue_Reserve(t *testing.T) {
+	queue := NewFairQueue(3, nil)
+	if !queue.Reserve(2) {
+		t.Errorf("Queue rejected a reservation within its capacity")
+	}
+	if queue.Push(Request{RequestId: "a"}) && queue.Push(Request{RequestId: "b"}) {
+		t.Errorf("Queue accepted requests into reserved capacity")
+	}
+	if queue.Reserve(1) {
+		t.Errorf("Queue accepted a reservation beyond its capacity")
+	}
+	// Reserved requests are queued into the capacity held back for them, even once the queue is full
+	queue.pushReserved(Request{RequestId: "b"}, time.Now())
+	queue.pushReserved(Request{RequestId: "c"}, time.Now())
+	if queue.Len() != 3 {
+		t.Errorf("Reserved requests were not queued. Want: %v, Recieved: %v", 3, queue.Len())
+	}
+	request, _ := queue.Pop(context.Background())
+	if !queue.Reserve(1) {
+		t.Errorf("Queue rejected a reservation once capacity was freed by %v", request.RequestId)
+	}
+	queue.unreserve()
+	if !queue.Push(Request{RequestId: "d"}) {
+		t.Errorf("Queue kept capacity that was no longer reserved")
+	}
+	var nilQueue *FairQueue
+	if nilQueue.Reserve(1) {
+		t.Errorf("Missing queue accepted a reservation")
+	}
+}
+
+func TestFairQueue_PopCancelled(t *testing.T) {
+	queue := NewFairQueue(1, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	popped := make(chan bool, 1)
+	go func() {
+		_, ok := queue.Pop(ctx)
+		popped <- ok
+	}()
+	cancel()
+	if <-popped {
+		t.Errorf("Pop returned a request from an empty queue")
+	}
+}
+
+func TestFairQueue_PopWaits(t *testing.T) {
+	queue := NewFairQueue(1, nil)
+	popped := make(chan Request, 1)
+	go func() {
+		request, _ := queue.Pop(context.Background())
+		popped <- request
+	}()
+	queue.Push(Request{RequestId: "requestId"})
+	if request := <-popped; request.RequestId != "requestId" {
+		t.Errorf("Pop returned the wrong request. Want: %v, Recieved: %v", "requestId", request.RequestId)
+	}
+}
+
+func TestFairQueue_RemoveExpired(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+	queue := NewFairQueue(5, nil)
+	queue.PushAll([]Request{
+		{RequestId: "a1", ClientId: "a", Deadline: &past},
+		{RequestId: "a2", ClientId: "a", Deadline: &future},
+		{RequestId: "b1", ClientId: "b", Deadline: &past},
+		{RequestId: "c1", ClientId: "c"},
+	})
+	expired := queue.RemoveExpired(now)
+	var expiredIds []string
+	for _, request := range expired {
+		expiredIds = append(expiredIds, request.RequestId)
+	}
+	if want := []string{"a1", "b1"}; !cmp.Equal(expiredIds, want) {
+		t.Errorf("Wrong requests were removed. Want: %v, Recieved: %v", want, expiredIds)
+	}
+	if queue.Len() != 2 {
+		t.Errorf("Queue length not updated. Want: %v, Recieved: %v", 2, queue.Len())
+	}
+	var popped []string
+	for queue.Len() > 0 {
+		request, _ := queue.Pop(context.Background())
+		popped = append(popped, request.RequestId)
+	}
+	if want := []string{"a2", "c1"}; !cmp.Equal(popped, want) {
+		t.Errorf("Remaining requests were not kept in order. Want: %v, Recieved: %v", want, popped)
+	}
+	var nilQueue *FairQueue
+	if nilQueue.RemoveExpired(now) != nil {
+		t.Errorf("Missing queue removed requests")
+	}
+}
+
+func TestFairQueue_Remove(t *testing.T) {
+	queue := NewFairQueue(5, nil)
+	queue.PushAll([]Request{
+		{RequestId: "a1", ClientId: "a"},
+		{RequestId: "a2", ClientId: "a"},
+		{RequestId: "b1", ClientId: "b"},
+	})
+	if !queue.Remove("a1") {
+		t.Errorf("Queued request was not removed")
+	}
+	if queue.Remove("a1") {
+		t.Errorf("Request no longer queued was removed again")
+	}
+	var popped []string
+	for queue.Len() > 0 {
+		request, _ := queue.Pop(context.Background())
+		popped = append(popped, request.RequestId)
+	}
+	if want := []string{"a2", "b1"}; !cmp.Equal(popped, want) {
+		t.Errorf("Remaining requests were not kept in order. Want: %v, Recieved: %v", want, popped)
+	}
+	var nilQueue *FairQueue
+	if nilQueue.Remove("a2") {
+		t.Errorf("Missing queue removed a request")
+	}
+}
+
+func TestFairQueue_Position(t *testing.T) {
+	queue := NewFairQueue(10, map[string]int{"beta": 2})
+	for _, requestId := range []string{"alpha-1", "alpha-2", "alpha-3", "beta-1", "beta-2", "beta-3", "gamma-1"} {
+		queue.Push(mockQueuedRequest(requestId))
+	}
+	tests := []struct {
+		requestId string
+		want      int
+	}{
+		// Each turn alpha waits on, beta sends two requests and gamma one
+		{requestId: "alpha-1", want: 4},
+		{requestId: "alpha-2", want: 6},
+		{requestId: "alpha-3", want: 7},
+		{requestId: "beta-2", want: 4},
+		{requestId: "gamma-1", want: 4},
+		{requestId: "unknown-1", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.requestId, func(t *testing.T) {
+			if got := queue.Position(mockQueuedRequest(tt.requestId)); got != tt.want {
+				t.Errorf("Position not as expected. Want: %v, Recieved: %v", tt.want, got)
+			}
+		})
+	}
+	// alpha goes to the back of the round once its turn is over
+	queue.Pop(context.Background())
+	if got := queue.Position(mockQueuedRequest("alpha-2")); got != 4 {
+		t.Errorf("Position not as expected. Want: %v, Recieved: %v", 4, got)
+	}
+	// The rest of a turn that has begun goes ahead of everyone else
+	queue = NewFairQueue(10, map[string]int{"alpha": 2})
+	for _, requestId := range []string{"alpha-1", "alpha-2", "alpha-3", "beta-1"} {
+		queue.Push(mockQueuedRequest(requestId))
+	}
+	queue.Pop(context.Background())
+	if got := queue.Position(mockQueuedRequest("alpha-2")); got != 1 {
+		t.Errorf("Position not as expected. Want: %v, Recieved: %v", 1, got)
+	}
+	if got := queue.Position(mockQueuedRequest("alpha-3")); got != 3 {
+		t.Errorf("Position not as expected. Want: %v, Recieved: %v", 3, got)
+	}
+}
+
+func TestFairQueue_PositionLanes(t *testing.T) {
+	queue := NewFairQueue(100, nil)
+	queue.Aging = 5 * time.Minute
+	for i := 0; i < 40; i++ {
+		queue.Push(Request{RequestId: fmt.Sprintf("beta-%v", i), ClientId: "beta", Priority: PriorityHigh})
+	}
+	tests := []struct {
+		priority string
+		want     int
+	}{
+		// The higher lanes are counted only as far as aging lets the request's lane overtake them, 25 requests a lane
+		{priority: PriorityHigh, want: 2},
+		{priority: PriorityNormal, want: 26},
+		{priority: PriorityLow, want: 43},
+	}
+	for _, tt := range tests {
+		t.Run(tt.priority, func(t *testing.T) {
+			request := Request{RequestId: "alpha-" + tt.priority, ClientId: "alpha", Priority: tt.priority}
+			queue.Push(request)
+			if got := queue.Position(request); got != tt.want {
+				t.Errorf("Position not as expected. Want: %v, Recieved: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLoadQueueWeights(t *testing.T) {
+	tests := []struct {
+		name              string
+		inputFileLocation string
+		want              map[string]int
+	}{
+		{
+			name:              "Every client weighs the same",
+			inputFileLocation: "",
+			want:              make(map[string]int),
+		},
+		{
+			name:              "Successful Load of weights",
+			inputFileLocation: "../../testdata/queueWeights.json",
+			want:              map[string]int{"default": 2, "alpha": 3, "acme/alpha": 1},
+		},
+		{
+			name:              "Bad file location",
+			inputFileLocation: "../../testdata/fakeLocation.json",
+			want:              make(map[string]int),
+		},
+		{
+			name:              "Unmarshable weights",
+			inputFileLocation: "../../testdata/unmarshableState.json",
+			want:              make(map[string]int),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			weights := LoadQueueWeights(tt.inputFileLocation)
+			if !cmp.Equal(weights, tt.want) {
+				t.Errorf("Queue weights were not loaded to the desired state. Want: %v, Recieved: %v", tt.want, weights)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package app
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// StateScheduled is the state of a request waiting for its notBefore time before it is queued
+const StateScheduled = "scheduled"
+
+// EventScheduled is reported when a request is held back until its notBefore time
+const EventScheduled = "scheduled"
+
+// Schedule holds the requests submitted with a notBefore time still to come, and releases each onto the encrypt
+// queue once it is due. Each scheduled request holds capacity reserved on the queue, so it always fits once due.
+// Scheduled requests are tracked as pending requests, which is how they survive restarts. Safe for concurrent use by
+// handlers and the releasing worker
+type Schedule struct {
+	mu       sync.Mutex
+	requests map[string]Request
+	// releasing are the due requests being tracked as queued, which are still on the schedule until they are queued
+	releasing map[string]Request
+	// wake tells the releasing worker the next due time may have changed
+	wake   chan struct{}
+	Queue  *FairQueue
+	Track  chan PendingRequest
+	Events *EventBroker
+}
+
+// NewSchedule creates a schedule without any requests, releasing onto the given queue
+func NewSchedule(queue *FairQueue, track chan PendingRequest, events *EventBroker) *Schedule {
+	return &Schedule{
+		requests:  make(map[string]Request),
+		releasing: make(map[string]Request),
+		wake:      make(chan struct{}, 1),
+		Queue:     queue,
+		Track:     track,
+		Events:    events,
+	}
+}
+
+// Add holds requests back until their notBefore time, reserving capacity for them even past the queue's capacity,
+// for requests that were accepted before a restart
+func (schedule *Schedule) Add(requests ...Request) {
+	schedule.Queue.reserve(len(requests))
+	schedule.hold(requests...)
+}
+
+// hold holds requests back until their notBefore time, for which capacity has already been reserved
+func (schedule *Schedule) hold(requests ...Request) {
+	schedule.mu.Lock()
+	defer schedule.mu.Unlock()
+	for _, request := range requests {
+		schedule.requests[request.RequestId] = request
+	}
+	select {
+	case schedule.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Remove withdraws a request that has yet to be released, reporting whether it was still scheduled
+func (schedule *Schedule) Remove(requestId string) bool {
+	if schedule == nil {
+		return false
+	}
+	schedule.mu.Lock()
+	defer schedule.mu.Unlock()
+	if _, ok := schedule.requests[requestId]; ok {
+		delete(schedule.requests, requestId)
+	} else if _, ok := schedule.releasing[requestId]; ok {
+		delete(schedule.releasing, requestId)
+	} else {
+		return false
+	}
+	schedule.Queue.unreserve()
+	return true
+}
+
+// Len is the number of requests waiting for their notBefore time
+func (schedule *Schedule) Len() int {
+	if schedule == nil {
+		return 0
+	}
+	schedule.mu.Lock()
+	defer schedule.mu.Unlock()
+	return len(schedule.requests) + len(schedule.releasing)
+}
+
+// releaseDue places the requests that are due on the encrypt queue, in the order they became due, and returns them
+// along with when the next request will be due. Each is tracked as queued without holding the schedule's lock, and
+// stays on the schedule until it is queued, so a request being cancelled is always found either on the schedule or
+// in the queue. The next due time is zero when nothing else is scheduled
+func (schedule *Schedule) releaseDue(now time.Time) ([]Request, time.Time) {
+	schedule.mu.Lock()
+	var due []Request
+	var next time.Time
+	for requestId, request := range schedule.requests {
+		if !request.NotBefore.After(now) {
+			due = append(due, request)
+			schedule.releasing[requestId] = request
+			delete(schedule.requests, requestId)
+		} else if next.IsZero() || request.NotBefore.Before(next) {
+			next = *request.NotBefore
+		}
+	}
+	schedule.mu.Unlock()
+	sort.Slice(due, func(i, j int) bool { return due[i].NotBefore.Before(*due[j].NotBefore) })
+	var released []Request
+	for _, request := range due {
+		request.log().Debugf("Scheduled requestId is due: %v", request.RequestId)
+		// Progress updates can't bring back a request cancelled in the meantime
+		schedule.Track <- PendingRequest{Request: Request{RequestId: request.RequestId}, State: StateQueued, Add: true}
+		schedule.mu.Lock()
+		if _, ok := schedule.releasing[request.RequestId]; ok {
+			delete(schedule.releasing, request.RequestId)
+			schedule.Queue.pushReserved(request, *request.NotBefore)
+			released = append(released, request)
+		}
+		schedule.mu.Unlock()
+	}
+	return released, next
+}
+
+// ReleaseDueRequests forever waits for scheduled requests to become due, and places them on the encrypt queue into
+// the capacity reserved for them when they were scheduled
+func (schedule *Schedule) ReleaseDueRequests(ctx context.Context) error {
+	for {
+		due, next := schedule.releaseDue(time.Now())
+		for _, request := range due {
+			schedule.Events.Publish(Event{RequestId: request.RequestId, State: EventQueued, Timestamp: time.Now()})
+		}
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-schedule.wake:
+		case <-timer:
+		}
+	}
+}
+
+// parseNotBefore reads the time a submission asked to be signed no earlier than, if it asked at all
+func parseNotBefore(notBefore string) (*time.Time, *MessageError) {
+	return parseTimestamp("notBefore", notBefore)
+}
+
+// scheduled reports whether a submission asking to be signed no earlier than notBefore has to be held back.
+// Times that have already passed are queued straight away, as is everything when there is no schedule
+func (application *Application) scheduled(notBefore *time.Time, now time.Time) bool {
+	return application.Schedule != nil && notBefore != nil && notBefore.After(now)
+}
+
+// GetScheduledTiming estimates the time for a scheduled message to be encrypted, which is the time until it is due
+// and a minute for the encryption itself
+func (application *Application) GetScheduledTiming(currentTime time.Time, notBefore time.Time) Timing {
+	timeEstimate := math.Ceil(notBefore.Sub(currentTime).Minutes()) + 1
+	return Timing{TimeAdded: currentTime, TimeEstimate: timeEstimate}
+}
+
+// scheduleRequests tracks requests as scheduled and holds them back until they are due, into capacity already
+// reserved on the queue. They are tracked first, so they can't be released before they are tracked
+func (application *Application) scheduleRequests(requests []Request, timing Timing) {
+	for _, request := range requests {
+		application.Track <- PendingRequest{Request: request, Timing: timing, State: StateScheduled, Add: true}
+	}
+	application.Schedule.hold(requests...)
+	for _, request := range requests {
+		application.Events.Publish(Event{RequestId: request.RequestId, State: EventScheduled, Timestamp: timing.TimeAdded})
+	}
+}
@@ -0,0 +1,280 @@
+package app
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApp_scheduledSubmission(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		target        string
+		body          string
+		queueFull     bool
+		statusCode    int
+		bodyExpected  string
+		wantScheduled int
+		wantQueued    int
+		wantState     string
+	}{
+		{
+			name:          "Scheduled request",
+			method:        "POST",
+			target:        "/v1/requests",
+			body:          `{"message":"taco","notBefore":"2030-01-02T15:04:05Z"}`,
+			statusCode:    202,
+			bodyExpected:  `"state":"scheduled","notBefore":"2030-01-02T15:04:05Z"`,
+			wantScheduled: 1,
+			wantState:     StateScheduled,
+		},
+		{
+			name:          "Scheduled request by query parameter",
+			method:        "GET",
+			target:        "/crypto/sign?message=taco&notBefore=2030-01-02T15:04:05Z",
+			statusCode:    202,
+			bodyExpected:  `"Body":"Request scheduled. Please check back according to the time estimate (minutes).","RequestId"`,
+			wantScheduled: 1,
+			wantState:     StateScheduled,
+		},
+		{
+			name:         "Past notBefore is queued straight away",
+			method:       "POST",
+			target:       "/v1/requests?wait=0",
+			body:         `{"message":"taco","notBefore":"2020-01-02T15:04:05Z"}`,
+			statusCode:   202,
+			bodyExpected: `"state":"pending"`,
+			wantQueued:   1,
+			wantState:    StateQueued,
+		},
+		{
+			name:         "Invalid notBefore",
+			method:       "POST",
+			target:       "/v1/requests",
+			body:         `{"message":"taco","notBefore":"tomorrow"}`,
+			statusCode:   400,
+			bodyExpected: `{"error":{"code":"invalid_request","message":"The notBefore must be an RFC 3339 timestamp, such as '2030-01-02T15:04:05Z'."}}`,
+		},
+		{
+			name:          "Scheduled batch",
+			method:        "POST",
+			target:        "/v1/batches",
+			body:          `{"messages":["taco"],"notBefore":"2030-01-02T15:04:05Z"}`,
+			statusCode:    202,
+			wantScheduled: 1,
+			wantState:     StateScheduled,
+		},
+		{
+			name:         "Scheduled request with the queue full",
+			method:       "POST",
+			target:       "/v1/requests",
+			body:         `{"message":"taco","notBefore":"2030-01-02T15:04:05Z"}`,
+			queueFull:    true,
+			statusCode:   503,
+			bodyExpected: `{"error":{"code":"queue_full","message":"The request could not be processed, server is at capacity. Please try again shortly."}}`,
+			wantQueued:   1,
+		},
+		{
+			name:         "Scheduled batch with the queue full",
+			method:       "POST",
+			target:       "/v1/batches",
+			body:         `{"messages":["taco"],"notBefore":"2030-01-02T15:04:05Z"}`,
+			queueFull:    true,
+			statusCode:   503,
+			bodyExpected: `"code":"queue_full"`,
+			wantQueued:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			queue := NewFairQueue(1, nil)
+			track := make(chan PendingRequest, 1)
+			application := Application{
+				Queue:    queue,
+				Schedule: NewSchedule(queue, track, nil),
+				Track:    track,
+				Requests: make(map[string]PendingRequest),
+				Batches:  &BatchStore{Batches: make(map[string]Batch)},
+				Events:   NewEventBroker(),
+			}
+			if tt.queueFull {
+				queue.Push(Request{RequestId: "queued"})
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if !strings.Contains(rr.Body.String(), tt.bodyExpected) {
+				t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), tt.bodyExpected)
+			}
+			if application.Schedule.Len() != tt.wantScheduled {
+				t.Errorf("Requests were not scheduled. Want: %v, Recieved: %v", tt.wantScheduled, application.Schedule.Len())
+			}
+			if queue.Len() != tt.wantQueued {
+				t.Errorf("Requests were not queued. Want: %v, Recieved: %v", tt.wantQueued, queue.Len())
+			}
+			if tt.wantState != "" {
+				if tracked := <-track; tracked.State != tt.wantState {
+					t.Errorf("Request was tracked in the wrong state. Want: %v, Recieved: %v", tt.wantState, tracked.State)
+				}
+			}
+		})
+	}
+}
+
+func TestApp_scheduledStatus(t *testing.T) {
+	notBefore := time.Date(2030, 1, 2, 15, 4, 5, 0, time.UTC)
+	application := Application{
+		Schedule: NewSchedule(nil, nil, nil),
+		Requests: map[string]PendingRequest{
+			"taco": {
+				Request: Request{RequestId: "taco", Message: "taco", NotBefore: &notBefore},
+				Timing:  Timing{TimeAdded: time.Now(), TimeEstimate: 60},
+				State:   StateScheduled,
+			},
+		},
+	}
+	router := NewRouter(&application)
+	req := httptest.NewRequest("GET", "/v1/requests/taco", nil)
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, req)
+	if status := rr.Code; status != 202 {
+		t.Errorf("Handler returned wrong status code: got %v want %v", status, 202)
+	}
+	bodyExpected := `"state":"scheduled","notBefore":"2030-01-02T15:04:05Z"`
+	if !strings.Contains(rr.Body.String(), bodyExpected) {
+		t.Errorf("Handler returned unexpected body: got %v want %v", rr.Body.String(), bodyExpected)
+	}
+}
+
+func TestSchedule_ReleaseDueRequests(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Hour)
+	queue := NewFairQueue(0, nil)
+	track := make(chan PendingRequest, 2)
+	schedule := NewSchedule(queue, track, NewEventBroker())
+	schedule.Add(
+		Request{RequestId: "due", Message: "taco", NotBefore: &past},
+		Request{RequestId: "later", Message: "chicken", NotBefore: &future},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go schedule.ReleaseDueRequests(ctx)
+	select {
+	case tracked := <-track:
+		want := PendingRequest{Request: Request{RequestId: "due"}, State: StateQueued, Add: true}
+		if !cmp.Equal(tracked, want) {
+			t.Errorf("Due request was not tracked as queued. Want: %v, Recieved: %v", want, tracked)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Due request was not released")
+	}
+	request, ok := queue.Pop(ctx)
+	if !ok || request.RequestId != "due" {
+		t.Errorf("Due request was not queued. Recieved: %v", request)
+	}
+	if schedule.Len() != 1 {
+		t.Errorf("Request that isn't due was released. Want: %v, Recieved: %v", 1, schedule.Len())
+	}
+	// Adding a request wakes the worker, which releases it straight away when it is due
+	schedule.Add(Request{RequestId: "now", Message: "burrito", NotBefore: &past})
+	select {
+	case tracked := <-track:
+		if tracked.RequestId != "now" {
+			t.Errorf("Wrong request was released. Want: %v, Recieved: %v", "now", tracked.RequestId)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Added due request was not released")
+	}
+}
+
+func TestApp_scheduledReservesCapacity(t *testing.T) {
+	queue := NewFairQueue(1, nil)
+	application := Application{
+		Queue:    queue,
+		Schedule: NewSchedule(queue, nil, nil),
+		Track:    make(chan PendingRequest, 1),
+		Events:   NewEventBroker(),
+	}
+	router := NewRouter(&application)
+	tests := []struct {
+		name       string
+		body       string
+		statusCode int
+	}{
+		{name: "Scheduled request", body: `{"message":"taco","notBefore":"2030-01-02T15:04:05Z"}`, statusCode: 202},
+		{name: "Request while the scheduled request holds the capacity", body: `{"message":"taco"}`, statusCode: 503},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/v1/requests?wait=0", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; status != tt.statusCode {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+		})
+	}
+}
+
+func TestSchedule_releaseDueCancelled(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	queue := NewFairQueue(1, nil)
+	track := make(chan PendingRequest)
+	schedule := NewSchedule(queue, track, nil)
+	schedule.Add(Request{RequestId: "due", Message: "taco", NotBefore: &past})
+	released := make(chan []Request, 1)
+	go func() {
+		due, _ := schedule.releaseDue(time.Now())
+		released <- due
+	}()
+	// The request is cancelled while it is being tracked as queued, without the schedule being held up
+	for releasing := 0; releasing == 0; {
+		schedule.mu.Lock()
+		releasing = len(schedule.releasing)
+		schedule.mu.Unlock()
+	}
+	if !schedule.Remove("due") {
+		t.Errorf("Request being released was not found on the schedule")
+	}
+	if tracked := <-track; tracked.RequestId != "due" {
+		t.Errorf("Wrong request was tracked as queued. Recieved: %v", tracked.RequestId)
+	}
+	if due := <-released; len(due) != 0 {
+		t.Errorf("Cancelled request was released. Recieved: %v", due)
+	}
+	if queue.Len() != 0 {
+		t.Errorf("Cancelled request was queued. Recieved: %v", queue.Len())
+	}
+	if !queue.Push(Request{RequestId: "next"}) {
+		t.Errorf("Capacity reserved for the cancelled request was not given back")
+	}
+}
+
+func TestSchedule_Remove(t *testing.T) {
+	notBefore := time.Now().Add(time.Hour)
+	schedule := NewSchedule(nil, nil, nil)
+	schedule.Add(Request{RequestId: "taco", NotBefore: &notBefore})
+	if !schedule.Remove("taco") {
+		t.Errorf("Scheduled request was not removed")
+	}
+	if schedule.Remove("taco") {
+		t.Errorf("Request removed twice")
+	}
+	var nilSchedule *Schedule
+	if nilSchedule.Remove("taco") || nilSchedule.Len() != 0 {
+		t.Errorf("Nil schedule reported requests")
+	}
+}
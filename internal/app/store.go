@@ -3,27 +3,29 @@ package app
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 // Storer object holds connections to the store channel,
-// tracking channel and maintains the set of signatures waiting retrieval
+// tracking channel and maintains the set of signatures waiting retrieval.
+// Callbacks for stored signatures are placed in the outbox, if there is one,
+// and the tracked request and metadata are forgotten along with the signature once it is retrieved.
+// Storing each signature is traced as a span, if there is a tracer
 type Storer struct {
 	Store      chan SignedRequest
 	Track      chan PendingRequest
 	Signatures map[string]string
-}
-
-// Retriever holds information about the application as well an instance of a requestId
-// attempting to be retrieved and a channel to communicate a response too
-type Retriever struct {
-	Signatures map[string]string
-	RequestId  string
-	Response   chan string
+	// SignaturesLock guards Signatures, which handlers read through the application while the storer writes them
+	SignaturesLock *sync.RWMutex
+	Outbox         *Outbox
+	Events         *EventBroker
+	Notifier       *Notifier
+	Metadata       *MetadataStore
+	Tracer         *Tracer
 }
 
 // StoreSignedRequests forever listens to a store channel for signed requests that can be stored
@@ -35,27 +37,83 @@ func (storer *Storer) StoreSignedRequests(ctx context.Context) error {
 		default:
 			signedRequest := <-storer.Store
 			if signedRequest.Add {
+				span := storer.Tracer.StartFrom(signedRequest.Traceparent, "store signature", SpanKindInternal)
+				span.SetAttribute("request.id", signedRequest.RequestId)
+				storer.SignaturesLock.Lock()
 				storer.Signatures[signedRequest.RequestId] = signedRequest.Signature
-				// Since we've stored the request, mark it as no longer pending
+				storer.SignaturesLock.Unlock()
+				signedRequest.log().Debugf("Stored signature for requestId: %v", signedRequest.RequestId)
+				storer.Notifier.Notify(signedRequest.RequestId, signedRequest.Signature)
+				storer.Events.Publish(Event{RequestId: signedRequest.RequestId, State: EventSigned})
+				if signedRequest.CallbackUrl != "" && storer.Outbox != nil {
+					storer.Outbox.Enqueue(signedRequest.CallbackUrl, Client{Id: signedRequest.ClientId, Tenant: signedRequest.TenantId}.scopedId(), CallbackPayload{
+						RequestId: signedRequest.RequestId,
+						Status:    CallbackSigned,
+						Signature: signedRequest.Signature,
+						Metadata:  storer.Metadata.Get(signedRequest.RequestId),
+						Timestamp: time.Now(),
+					})
+				}
+				// Since we've stored the request, mark it as signed until the signature is retrieved. The client and
+				// tenant are carried along, as the request can be signed before the handler that queued it tracks it
 				pendingRequest := PendingRequest{
 					Request: Request{
 						RequestId: signedRequest.RequestId,
 						Message:   "",
+						ClientId:  signedRequest.ClientId,
+						TenantId:  signedRequest.TenantId,
 					},
 					Timing: Timing{
 						time.Now(),
 						0.0,
 					},
-					Add: false,
+					State: StateSigned,
+					Add:   true,
 				}
 				storer.Track <- pendingRequest
+				span.End()
 			} else {
+				storer.SignaturesLock.Lock()
 				delete(storer.Signatures, signedRequest.RequestId)
+				storer.SignaturesLock.Unlock()
+				storer.Metadata.Delete(signedRequest.RequestId)
+				storer.Track <- PendingRequest{Request: Request{RequestId: signedRequest.RequestId}, Add: false}
 			}
 		}
 	}
 }
 
+// SignaturesLock is the lock guarding the application's signatures, for the storer writing them to share
+func (application *Application) SignaturesLock() *sync.RWMutex {
+	return &application.signaturesLock
+}
+
+// lookupSignature retrieves the signature of a request, if it has been stored and not yet retrieved
+func (application *Application) lookupSignature(requestId string) (string, bool) {
+	application.signaturesLock.RLock()
+	defer application.signaturesLock.RUnlock()
+	signature, ok := application.Signatures[requestId]
+	return signature, ok
+}
+
+// countSignatures is the number of signatures waiting to be retrieved
+func (application *Application) countSignatures() int {
+	application.signaturesLock.RLock()
+	defer application.signaturesLock.RUnlock()
+	return len(application.Signatures)
+}
+
+// SignaturesSnapshot copies the set of signatures, so it can be persisted while the storer keeps writing to it
+func (application *Application) SignaturesSnapshot() map[string]string {
+	application.signaturesLock.RLock()
+	defer application.signaturesLock.RUnlock()
+	snapshot := make(map[string]string, len(application.Signatures))
+	for requestId, signature := range application.Signatures {
+		snapshot[requestId] = signature
+	}
+	return snapshot
+}
+
 // InstantiateSignatures creates a new storage for signatures and recreates previous state if applicable
 func InstantiateSignatures(signaturesPersistenceLocation string) map[string]string {
 	signaturesBytes, err := os.ReadFile(signaturesPersistenceLocation)
@@ -73,13 +131,3 @@ func InstantiateSignatures(signaturesPersistenceLocation string) map[string]stri
 	}
 	return make(map[string]string)
 }
-
-// RetrieveSignature attempts to retrieve a requestId from the store
-func (retriever *Retriever) RetrieveSignature() error {
-	if signature, ok := retriever.Signatures[retriever.RequestId]; ok {
-		retriever.Response <- signature
-		return nil
-	} else {
-		return errors.New("Signature not available yet.")
-	}
-}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"github.com/google/go-cmp/cmp"
 	"os"
+	"sync"
 	"testing"
 )
 
@@ -55,7 +56,7 @@ func TestStorer_StoreSignedRequests(t *testing.T) {
 			mockStoreChan := make(chan SignedRequest)
 			mockTrackChan := make(chan PendingRequest)
 			ctx, cancel := context.WithCancel(context.Background())
-			mockStore := Storer{Store: mockStoreChan, Track: mockTrackChan, Signatures: tt.startingSignatures}
+			mockStore := Storer{Store: mockStoreChan, Track: mockTrackChan, Signatures: tt.startingSignatures, SignaturesLock: &sync.RWMutex{}}
 			mockStorerErrors := make(chan error, 1)
 			go func() {
 				mockStorerErrors <- mockStore.StoreSignedRequests(ctx)
@@ -135,55 +136,3 @@ func TestInstantiateSignatures(t *testing.T) {
 		})
 	}
 }
-
-func TestRetriever_RetrieveSignature(t *testing.T) {
-	tests := []struct {
-		name             string
-		retriever        Retriever
-		want             string
-		isTestingFailure bool
-	}{
-		{
-			name: "Successful Retrieval",
-			retriever: Retriever{
-				Signatures: map[string]string{"requestId": "signature"},
-				RequestId:  "requestId",
-				Response:   make(chan string),
-			},
-			want:             "signature",
-			isTestingFailure: false,
-		},
-		{
-			name: "Failed Retrieval",
-			retriever: Retriever{
-				Signatures: make(map[string]string),
-				RequestId:  "requestId",
-				Response:   make(chan string),
-			},
-			want:             "",
-			isTestingFailure: true,
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			retrievalErrors := make(chan error, 1)
-			go func() {
-				retrievalErrors <- tt.retriever.RetrieveSignature()
-			}()
-			select {
-			case err := <-retrievalErrors:
-				if err != nil && !tt.isTestingFailure {
-					t.Error("Failed to retrieve signature when requestId present")
-				}
-			case signature := <-tt.retriever.Response:
-				if !tt.isTestingFailure {
-					if !cmp.Equal(signature, tt.want) {
-						t.Error("Failed to retrieve signature when requestId present")
-					}
-				} else {
-					t.Error("Expected a failure but instead got a valid response")
-				}
-			}
-		})
-	}
-}
@@ -0,0 +1,60 @@
+package app
+
+import "net/http"
+
+// DefaultTenant is the tenant of clients that weren't given one, and of requests made before tenants were introduced
+const DefaultTenant = "default"
+
+// tenant is the tenant a client belongs to
+func (client Client) tenant() string {
+	if client.Tenant == "" {
+		return DefaultTenant
+	}
+	return client.Tenant
+}
+
+// scopedId is the client's id qualified by its tenant, keeping apart the state of clients of different tenants
+// that share an id. Clients of the default tenant keep their plain id
+func (client Client) scopedId() string {
+	if client.Tenant == "" || client.Tenant == DefaultTenant {
+		return client.Id
+	}
+	return client.Tenant + "/" + client.Id
+}
+
+// requestScopedId is the scoped id of the client that submitted a request
+func requestScopedId(request Request) string {
+	return Client{Id: request.ClientId, Tenant: request.TenantId}.scopedId()
+}
+
+// requestTenant is the tenant a request belongs to
+func requestTenant(request Request) string {
+	if request.TenantId == "" {
+		return DefaultTenant
+	}
+	return request.TenantId
+}
+
+// tenantFromRequest identifies the tenant of the client making a request
+func tenantFromRequest(r *http.Request) string {
+	client, _ := clientFromContext(r)
+	return client.tenant()
+}
+
+// trackedTenant is the tenant of a tracked request. Requests that aren't tracked, such as those signed before
+// tenants were introduced, belong to the default tenant
+func (application *Application) trackedTenant(requestId string) string {
+	request, _ := application.lookupRequest(requestId)
+	return requestTenant(request.Request)
+}
+
+// checkRequestTenant reports whether a request belongs to the tenant of the calling client, responding as if the
+// request didn't exist when it doesn't, so the ids of other tenants can't be probed for
+func (application *Application) checkRequestTenant(w http.ResponseWriter, r *http.Request, requestId string) bool {
+	if application.trackedTenant(requestId) == tenantFromRequest(r) {
+		return true
+	}
+	logFromRequest(r).Debugf("Request belongs to another tenant")
+	writeDenied(w, http.StatusNotFound, ErrorNotFound, "The requestId is not recognized. Please use the 'crypto/sign' endpoint to generate a new request.")
+	return false
+}
@@ -0,0 +1,285 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestApp_tenantIsolation(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		tenant     string
+		statusCode int
+	}{
+		{
+			name:       "Signature of own tenant",
+			method:     "GET",
+			target:     "/v1/requests/acmeSigned",
+			tenant:     "acme",
+			statusCode: 200,
+		},
+		{
+			name:       "Signature of another tenant",
+			method:     "GET",
+			target:     "/v1/requests/acmeSigned",
+			tenant:     "other",
+			statusCode: 404,
+		},
+		{
+			name:       "Signature of another tenant from the default tenant",
+			method:     "GET",
+			target:     "/crypto/sign/request/acmeSigned",
+			statusCode: 404,
+		},
+		{
+			name:       "Pending request of own tenant",
+			method:     "GET",
+			target:     "/v1/requests/acmePending",
+			tenant:     "acme",
+			statusCode: 202,
+		},
+		{
+			name:       "Requests made before tenants belong to the default tenant",
+			method:     "GET",
+			target:     "/v1/requests/legacySigned",
+			statusCode: 200,
+		},
+		{
+			name:       "Requests made before tenants are hidden from other tenants",
+			method:     "GET",
+			target:     "/v1/requests/legacySigned",
+			tenant:     "acme",
+			statusCode: 404,
+		},
+		{
+			name:       "Cancel a request of another tenant",
+			method:     "DELETE",
+			target:     "/v1/requests/acmePending",
+			tenant:     "other",
+			statusCode: 404,
+		},
+		{
+			name:       "Follow a request of another tenant",
+			method:     "GET",
+			target:     "/v1/requests/acmePending/events",
+			tenant:     "other",
+			statusCode: 404,
+		},
+		{
+			name:       "Batch of own tenant",
+			method:     "GET",
+			target:     "/v1/batches/acmeBatch",
+			tenant:     "acme",
+			statusCode: 200,
+		},
+		{
+			name:       "Batch of another tenant",
+			method:     "GET",
+			target:     "/v1/batches/acmeBatch",
+			tenant:     "other",
+			statusCode: 404,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Store:      make(chan SignedRequest, 1),
+				Track:      make(chan PendingRequest, 1),
+				Signatures: map[string]string{"acmeSigned": "signature", "legacySigned": "signature"},
+				Requests: map[string]PendingRequest{
+					"acmeSigned":  {Request: Request{RequestId: "acmeSigned", TenantId: "acme"}, Timing: Timing{time.Now(), 1}, State: StateSigned, Add: true},
+					"acmePending": {Request: Request{RequestId: "acmePending", TenantId: "acme"}, Timing: Timing{time.Now(), 1}, State: StateQueued, Add: true},
+				},
+				Batches: &BatchStore{Batches: map[string]Batch{
+					"acmeBatch": {BatchId: "acmeBatch", RequestIds: []string{"acmeSigned"}, TenantId: "acme"},
+				}},
+				Events: NewEventBroker(),
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.tenant != "" {
+				req.Header.Set("X-Tenant-Id", tt.tenant)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+			if tt.statusCode == 404 && !strings.Contains(rr.Body.String(), `"not_found"`) && !strings.Contains(rr.Body.String(), `"StatusCode":404`) {
+				t.Errorf("Handler returned unexpected body: got %v", rr.Body.String())
+			}
+		})
+	}
+}
+
+func TestStorer_signedBeforeTracked(t *testing.T) {
+	tests := []struct {
+		name       string
+		tenant     string
+		statusCode int
+	}{
+		{name: "Own tenant", tenant: "acme", statusCode: 200},
+		{name: "Default tenant", tenant: "", statusCode: 404},
+		{name: "Another tenant", tenant: "other", statusCode: 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := make(chan SignedRequest)
+			track := make(chan PendingRequest, 1)
+			application := Application{
+				Store:      make(chan SignedRequest, 1),
+				Track:      make(chan PendingRequest, 1),
+				Signatures: make(map[string]string),
+				Requests:   make(map[string]PendingRequest),
+				Events:     NewEventBroker(),
+			}
+			storer := Storer{Store: store, Track: track, Signatures: application.Signatures, SignaturesLock: application.SignaturesLock(), Events: application.Events}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				_ = storer.StoreSignedRequests(ctx)
+			}()
+			// The signature is stored before the handler that queued the request has tracked it
+			store <- SignedRequest{RequestId: "acmeSigned", Signature: "signature", ClientId: "client", TenantId: "acme", Add: true}
+			tracker := Tracker{Requests: application.Requests}
+			tracker.apply(<-track)
+
+			router := NewRouter(&application)
+			req := httptest.NewRequest("GET", "/v1/requests/acmeSigned", nil)
+			if tt.tenant != "" {
+				req.Header.Set("X-Tenant-Id", tt.tenant)
+			}
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if status := rr.Code; !cmp.Equal(status, tt.statusCode) {
+				t.Errorf("Handler returned wrong status code: got %v want %v", status, tt.statusCode)
+			}
+		})
+	}
+}
+
+func TestApp_newRequestHandlerTenant(t *testing.T) {
+	mockSequentialUUIDs(t)
+	application := Application{
+		Queue:    NewFairQueue(2, nil),
+		Track:    make(chan PendingRequest, 2),
+		Requests: make(map[string]PendingRequest),
+		Batches:  &BatchStore{Batches: make(map[string]Batch)},
+		Events:   NewEventBroker(),
+	}
+	router := NewRouter(&application)
+	for _, target := range []string{"/v1/requests?wait=0", "/v1/batches"} {
+		body := `{"message":"taco"}`
+		if target == "/v1/batches" {
+			body = `{"messages":["burrito"]}`
+		}
+		req := httptest.NewRequest("POST", target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Tenant-Id", "acme")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if status := rr.Code; !cmp.Equal(status, 202) {
+			t.Errorf("Handler returned wrong status code: got %v want %v", status, 202)
+		}
+		request, _ := application.Queue.Pop(context.Background())
+		tracked := <-application.Track
+		if request.TenantId != "acme" || requestTenant(tracked.Request) != "acme" {
+			t.Errorf("Request was not tracked against its tenant. Request: %v, Tracked: %v", request, tracked)
+		}
+	}
+	for _, batch := range application.Batches.Batches {
+		if batch.TenantId != "acme" {
+			t.Errorf("Batch was not recorded against its tenant. Batch: %v", batch)
+		}
+	}
+}
+
+func TestApp_listRequestsHandlerTenant(t *testing.T) {
+	mockRequest := func(requestId string, tenantId string) PendingRequest {
+		return PendingRequest{Request: Request{RequestId: requestId, TenantId: tenantId}, Timing: Timing{time.Now(), 1}, State: StateQueued, Add: true}
+	}
+	tests := []struct {
+		name   string
+		target string
+		apiKey string
+		want   []string
+	}{
+		{
+			name:   "Every tenant",
+			target: "/admin/requests",
+			apiKey: "admin-key",
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "Filtered by tenant",
+			target: "/admin/requests?tenant=default",
+			apiKey: "admin-key",
+			want:   []string{"a"},
+		},
+		{
+			name:   "Admin restricted to a tenant",
+			target: "/admin/requests?tenant=default",
+			apiKey: "acme-admin-key",
+			want:   []string{"b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			application := Application{
+				Requests: map[string]PendingRequest{
+					"a": mockRequest("a", ""),
+					"b": mockRequest("b", "acme"),
+					"c": mockRequest("c", "other"),
+				},
+				APIKeys: &KeyStore{Clients: map[string]Client{
+					hashAPIKey("admin-key"):      {Id: "admin", Admin: true},
+					hashAPIKey("acme-admin-key"): {Id: "acmeAdmin", Admin: true, Tenant: "acme"},
+				}},
+			}
+			router := NewRouter(&application)
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.Header.Set("X-API-Key", tt.apiKey)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			var list RequestList
+			if err := json.Unmarshal(rr.Body.Bytes(), &list); err != nil {
+				t.Fatalf("Was unable to unmarshal response. Details: %v", err)
+			}
+			var requestIds []string
+			for _, summary := range list.Requests {
+				requestIds = append(requestIds, summary.RequestId)
+			}
+			if !cmp.Equal(requestIds, tt.want) {
+				t.Errorf("Listed the wrong requests. Want: %v, Recieved: %v", tt.want, requestIds)
+			}
+		})
+	}
+}
+
+func TestClient_scopedId(t *testing.T) {
+	limiter := InstantiateClientLimiter("", Limits{HourlyQuota: 1})
+	now := time.Now()
+	for _, client := range []Client{{Id: "alpha"}, {Id: "alpha", Tenant: "acme"}, {Id: "alpha", Tenant: "other"}} {
+		if _, ok := limiter.Consume(client, 1, now); !ok {
+			t.Errorf("Client %v shared a quota with a client of another tenant", client)
+		}
+	}
+	want := []string{"acme/alpha", "alpha", "other/alpha"}
+	var scopedIds []string
+	for scopedId := range limiter.Usage {
+		scopedIds = append(scopedIds, scopedId)
+	}
+	sort.Strings(scopedIds)
+	if !cmp.Equal(scopedIds, want) {
+		t.Errorf("Usage was not kept per tenant. Want: %v, Recieved: %v", want, scopedIds)
+	}
+}
@@ -0,0 +1,327 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of span, telling the handling of a call apart from calls made to other services and work done in between
+const (
+	SpanKindServer   = "server"
+	SpanKindClient   = "client"
+	SpanKindInternal = "internal"
+)
+
+// spanBufferSize is the number of finished spans held for the exporter before further spans are dropped
+const spanBufferSize = 1024
+
+// spanExportBatchSize is the most spans sent to the exporter at once
+const spanExportBatchSize = 256
+
+// For mocking in tests
+var spanExportInterval = 5 * time.Second
+
+// traceparentPattern matches a W3C traceparent header, capturing the version, trace id, parent id and flags. Later
+// versions may append further fields
+var traceparentPattern = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+// SpanContext identifies a span within a trace, as carried between services by the traceparent header
+type SpanContext struct {
+	TraceId string
+	SpanId  string
+	Sampled bool
+}
+
+// parseTraceparent reads the span context of the caller from a traceparent header, reporting false when the header
+// is missing or invalid, in which case a new trace is started
+func parseTraceparent(traceparent string) (SpanContext, bool) {
+	match := traceparentPattern.FindStringSubmatch(traceparent)
+	if match == nil || match[1] == "ff" || match[1] == "00" && match[5] != "" {
+		return SpanContext{}, false
+	}
+	if match[2] == "00000000000000000000000000000000" || match[3] == "0000000000000000" {
+		return SpanContext{}, false
+	}
+	flags, _ := hex.DecodeString(match[4])
+	return SpanContext{TraceId: match[2], SpanId: match[3], Sampled: flags[0]&1 == 1}, true
+}
+
+// Traceparent formats the span context as a traceparent header, which is empty when there is no trace
+func (spanContext SpanContext) Traceparent() string {
+	if spanContext.TraceId == "" || spanContext.SpanId == "" {
+		return ""
+	}
+	flags := "00"
+	if spanContext.Sampled {
+		flags = "01"
+	}
+	return "00-" + spanContext.TraceId + "-" + spanContext.SpanId + "-" + flags
+}
+
+// SpanData is a finished span, as handed to the exporter
+type SpanData struct {
+	TraceId      string
+	SpanId       string
+	ParentSpanId string `json:",omitempty"`
+	Name         string
+	Kind         string
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]interface{} `json:",omitempty"`
+	// Error describes why the work failed, and is empty when it succeeded
+	Error string `json:",omitempty"`
+}
+
+// Span is a unit of work being timed. Spans of a disabled tracer, or of a trace the caller chose not to sample, are
+// not recorded, though their context is still passed on
+type Span struct {
+	SpanData
+	context SpanContext
+	tracer  *Tracer
+}
+
+// Context is the span context to pass on to the work the span leads to
+func (span *Span) Context() SpanContext {
+	if span == nil {
+		return SpanContext{}
+	}
+	return span.context
+}
+
+// SetAttribute records a string, int or bool describing the work
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil || span.tracer == nil {
+		return
+	}
+	if span.Attributes == nil {
+		span.Attributes = make(map[string]interface{})
+	}
+	span.Attributes[key] = value
+}
+
+// SetError marks the work as failed
+func (span *Span) SetError(err error) {
+	if span == nil || span.tracer == nil || err == nil {
+		return
+	}
+	span.Error = err.Error()
+}
+
+// End finishes the span now, handing it to the exporter
+func (span *Span) End() {
+	span.EndAt(time.Now())
+}
+
+// EndAt finishes the span at the given time, handing it to the exporter
+func (span *Span) EndAt(end time.Time) {
+	if span == nil || span.tracer == nil {
+		return
+	}
+	span.SpanData.End = end
+	span.tracer.finish(span.SpanData)
+}
+
+// SpanExporter sends finished spans on to wherever traces are collected
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []SpanData) error
+}
+
+// Tracer times the work done on each request as spans, continuing the trace of the caller, and hands them to its
+// exporter in the background so tracing never holds up the pipeline. Tracing is disabled on a nil tracer, which
+// passes the caller's span context on unchanged
+type Tracer struct {
+	Exporter SpanExporter
+	spans    chan SpanData
+	// exportLock keeps batches of spans in order when flushing while the export worker runs
+	exportLock sync.Mutex
+}
+
+// NewTracer creates a tracer handing its spans to an exporter
+func NewTracer(exporter SpanExporter) *Tracer {
+	return &Tracer{Exporter: exporter, spans: make(chan SpanData, spanBufferSize)}
+}
+
+// Start begins a span at the given time, as a child of the parent span context, or of a new trace when the parent
+// is invalid
+func (tracer *Tracer) Start(parent SpanContext, name string, kind string, start time.Time) *Span {
+	if tracer == nil {
+		return &Span{context: parent}
+	}
+	span := &Span{SpanData: SpanData{Name: name, Kind: kind, Start: start}}
+	if parent.TraceId == "" {
+		span.context = SpanContext{TraceId: randomHex(16), Sampled: true}
+	} else {
+		span.context = SpanContext{TraceId: parent.TraceId, Sampled: parent.Sampled}
+		span.ParentSpanId = parent.SpanId
+	}
+	span.context.SpanId = randomHex(8)
+	span.TraceId, span.SpanId = span.context.TraceId, span.context.SpanId
+	if span.context.Sampled {
+		span.tracer = tracer
+	}
+	return span
+}
+
+// StartFrom begins a span now as a child of the span context carried by a request
+func (tracer *Tracer) StartFrom(traceparent string, name string, kind string) *Span {
+	parent, _ := parseTraceparent(traceparent)
+	return tracer.Start(parent, name, kind, time.Now())
+}
+
+// finish queues a span for the exporter. Spans are dropped when the exporter is not keeping up
+func (tracer *Tracer) finish(span SpanData) {
+	select {
+	case tracer.spans <- span:
+	default:
+		logrus.Debugf("Dropping span %v of trace %v, the exporter is not keeping up", span.Name, span.TraceId)
+	}
+}
+
+// ExportSpans forever sends finished spans to the exporter, in batches, every spanExportInterval
+func (tracer *Tracer) ExportSpans(ctx context.Context) error {
+	if tracer == nil {
+		<-ctx.Done()
+		return nil
+	}
+	ticker := time.NewTicker(spanExportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			tracer.Flush(ctx)
+		}
+	}
+}
+
+// Flush sends every finished span waiting on the exporter, such as before shutting down
+func (tracer *Tracer) Flush(ctx context.Context) {
+	if tracer == nil {
+		return
+	}
+	tracer.exportLock.Lock()
+	defer tracer.exportLock.Unlock()
+	for {
+		var batch []SpanData
+	Collect:
+		for len(batch) < spanExportBatchSize {
+			select {
+			case span := <-tracer.spans:
+				batch = append(batch, span)
+			default:
+				break Collect
+			}
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := tracer.Exporter.ExportSpans(ctx, batch); err != nil {
+			logrus.Errorf("Was unable to export %v spans. Details: %v", len(batch), err)
+		}
+	}
+}
+
+// StdoutExporter writes each span as a line of JSON, for debugging or collection by a log shipper
+type StdoutExporter struct {
+	Writer io.Writer
+}
+
+// ExportSpans writes the spans
+func (exporter *StdoutExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	encoder := json.NewEncoder(exporter.Writer)
+	for _, span := range spans {
+		if err := encoder.Encode(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadTracer creates a tracer for the named exporter, either 'stdout' or 'otlp' sending to an OTLP/HTTP collector
+// endpoint. Tracing is disabled when no exporter is named, or it is not recognized
+func LoadTracer(exporter string, otlpEndpoint string) *Tracer {
+	switch exporter {
+	case "":
+		return nil
+	case "stdout":
+		return NewTracer(&StdoutExporter{Writer: os.Stdout})
+	case "otlp":
+		return NewTracer(NewOTLPExporter(otlpEndpoint))
+	default:
+		logrus.Errorf("Unrecognized trace exporter %q, tracing is disabled", exporter)
+		return nil
+	}
+}
+
+// traceContextKey is the context key the span of the call being handled is stored under
+type traceContextKey struct{}
+
+// traceparentFromRequest is the span context of the call being handled, carried by the requests it queues so the
+// work done on them joins the caller's trace
+func traceparentFromRequest(r *http.Request) string {
+	span, _ := r.Context().Value(traceContextKey{}).(*Span)
+	return span.Context().Traceparent()
+}
+
+// statusRecorder remembers the status code a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (w *statusRecorder) WriteHeader(statusCode int) {
+	w.statusCode = statusCode
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush lets event streams flush through the wrapped response writer
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// traceRequests is a middleware timing the handling of each call as a span, continuing the trace of an incoming
+// traceparent header
+func (application *Application) traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, _ := parseTraceparent(r.Header.Get("traceparent"))
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		span := application.Tracer.Start(parent, r.Method+" "+route, SpanKindServer, time.Now())
+		span.SetAttribute("http.method", r.Method)
+		span.SetAttribute("http.route", route)
+		recorder := &statusRecorder{ResponseWriter: w, statusCode: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), traceContextKey{}, span)))
+		span.SetAttribute("http.status_code", recorder.statusCode)
+		if recorder.statusCode >= http.StatusInternalServerError {
+			span.Error = http.StatusText(recorder.statusCode)
+		}
+		span.End()
+	})
+}
+
+// randomHex generates a random id of the given number of bytes, hex encoded
+func randomHex(size int) string {
+	id := make([]byte, size)
+	if _, err := rand.Read(id); err != nil {
+		logrus.Errorf("Was unable to generate a span id. Details: %v", err)
+	}
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,249 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// recordingExporter keeps the spans exported to it
+type recordingExporter struct {
+	mu    sync.Mutex
+	spans []SpanData
+}
+
+func (exporter *recordingExporter) ExportSpans(ctx context.Context, spans []SpanData) error {
+	exporter.mu.Lock()
+	defer exporter.mu.Unlock()
+	exporter.spans = append(exporter.spans, spans...)
+	return nil
+}
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name        string
+		traceparent string
+		want        SpanContext
+		wantOk      bool
+	}{
+		{
+			name:        "Sampled",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			want:        SpanContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7", Sampled: true},
+			wantOk:      true,
+		},
+		{
+			name:        "Not sampled",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00",
+			want:        SpanContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7"},
+			wantOk:      true,
+		},
+		{
+			name:        "Later version with further fields",
+			traceparent: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future",
+			want:        SpanContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7", Sampled: true},
+			wantOk:      true,
+		},
+		{
+			name: "Missing",
+		},
+		{
+			name:        "Version 00 with further fields",
+			traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future",
+		},
+		{
+			name:        "Invalid version",
+			traceparent: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "All zero trace id",
+			traceparent: "00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		},
+		{
+			name:        "Uppercase",
+			traceparent: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00F067AA0BA902B7-01",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseTraceparent(tt.traceparent)
+			if ok != tt.wantOk || !cmp.Equal(got, tt.want) {
+				t.Errorf("Traceparent not parsed as expected. Want: %v %v, Recieved: %v %v", tt.want, tt.wantOk, got, ok)
+			}
+			if tt.wantOk && tt.traceparent[:2] == "00" && got.Traceparent() != tt.traceparent {
+				t.Errorf("Span context not formatted as expected. Want: %v, Recieved: %v", tt.traceparent, got.Traceparent())
+			}
+		})
+	}
+}
+
+func TestTracer_Start(t *testing.T) {
+	parent := SpanContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7", Sampled: true}
+	var disabled *Tracer
+	if span := disabled.Start(parent, "span", SpanKindInternal, time.Now()); span.Context() != parent {
+		t.Errorf("Disabled tracer should pass the parent span context on. Recieved: %v", span.Context())
+	}
+
+	exporter := &recordingExporter{}
+	tracer := NewTracer(exporter)
+	child := tracer.Start(parent, "child", SpanKindInternal, time.Now())
+	if child.Context().TraceId != parent.TraceId || child.Context().SpanId == parent.SpanId || child.ParentSpanId != parent.SpanId {
+		t.Errorf("Span was not started as a child of its parent. Recieved: %v", child.SpanData)
+	}
+	root := tracer.Start(SpanContext{}, "root", SpanKindInternal, time.Now())
+	if len(root.TraceId) != 32 || len(root.SpanId) != 16 || root.ParentSpanId != "" || !root.Context().Sampled {
+		t.Errorf("Span without a parent should start a new sampled trace. Recieved: %v", root.SpanData)
+	}
+	unsampled := parent
+	unsampled.Sampled = false
+	tracer.Start(unsampled, "unsampled", SpanKindInternal, time.Now()).End()
+	child.End()
+	root.End()
+	tracer.Flush(context.Background())
+	var names []string
+	for _, span := range exporter.spans {
+		names = append(names, span.Name)
+	}
+	if want := []string{"child", "root"}; !cmp.Equal(names, want) {
+		t.Errorf("Exported the wrong spans. Want: %v, Recieved: %v", want, names)
+	}
+}
+
+func TestApp_traceRequests(t *testing.T) {
+	exporter := &recordingExporter{}
+	application := Application{
+		Queue:    NewFairQueue(1, nil),
+		Track:    make(chan PendingRequest, 1),
+		Requests: make(map[string]PendingRequest),
+		Tracer:   NewTracer(exporter),
+	}
+	router := NewRouter(&application)
+	req := httptest.NewRequest("POST", "/v1/requests", strings.NewReader(`{"message":"taco"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	application.Tracer.Flush(context.Background())
+	if len(exporter.spans) != 1 {
+		t.Fatalf("Expected a single span for the call. Recieved: %v", exporter.spans)
+	}
+	span := exporter.spans[0]
+	if span.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanId != "00f067aa0ba902b7" {
+		t.Errorf("Call was not traced under the incoming traceparent. Recieved: %v", span)
+	}
+	wantAttributes := map[string]interface{}{"http.method": "POST", "http.route": "/v1/requests", "http.status_code": 202}
+	if span.Name != "POST /v1/requests" || span.Kind != SpanKindServer || !cmp.Equal(span.Attributes, wantAttributes) {
+		t.Errorf("Call was not traced as expected. Recieved: %v", span)
+	}
+	request, _ := application.Queue.Pop(context.Background())
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + span.SpanId + "-01"; request.Traceparent != want {
+		t.Errorf("Request was not queued with the span context of the call. Want: %v, Recieved: %v", want, request.Traceparent)
+	}
+}
+
+func TestEncryptor_traceparent(t *testing.T) {
+	received := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get("traceparent")
+		_, _ = w.Write([]byte("signature"))
+	}))
+	defer upstream.Close()
+	defer func(url string) {
+		signingServiceUrl = url
+	}(signingServiceUrl)
+	signingServiceUrl = upstream.URL
+
+	exporter := &recordingExporter{}
+	scheduler := EncryptorHandler{Store: make(chan SignedRequest, 1), Tracer: NewTracer(exporter)}
+	request := Request{RequestId: "requestId", Message: "message", Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}
+	if _, err := encryptor(context.Background(), &scheduler, request, 2); err != nil {
+		t.Fatalf("Unexpected error signing the request. Details: %v", err)
+	}
+	scheduler.Tracer.Flush(context.Background())
+	if len(exporter.spans) != 1 {
+		t.Fatalf("Expected a single span for the attempt. Recieved: %v", exporter.spans)
+	}
+	span := exporter.spans[0]
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + span.SpanId + "-01"; <-received != want {
+		t.Errorf("Upstream call did not carry the span context of the attempt. Want: %v", want)
+	}
+	wantAttributes := map[string]interface{}{"request.id": "requestId", "attempt": 2, "http.status_code": 200}
+	if span.ParentSpanId != "00f067aa0ba902b7" || span.Kind != SpanKindClient || !cmp.Equal(span.Attributes, wantAttributes) {
+		t.Errorf("Attempt was not traced as expected. Recieved: %v", span)
+	}
+	if signed := <-scheduler.Store; signed.Traceparent != request.Traceparent {
+		t.Errorf("Signature was not stored with the span context of the request. Recieved: %v", signed.Traceparent)
+	}
+}
+
+func TestEncryptorHandler_traceQueueWait(t *testing.T) {
+	exporter := &recordingExporter{}
+	scheduler := EncryptorHandler{Tracer: NewTracer(exporter)}
+	queued := time.Date(2030, 1, 2, 15, 0, 0, 0, time.UTC)
+	scheduler.traceQueueWait(queuedRequest{Request: Request{RequestId: "requestId", Traceparent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, queued: queued}, "assigned")
+	scheduler.Tracer.Flush(context.Background())
+	if len(exporter.spans) != 1 {
+		t.Fatalf("Expected a single span for the wait. Recieved: %v", exporter.spans)
+	}
+	span := exporter.spans[0]
+	wantAttributes := map[string]interface{}{"request.id": "requestId", "request.priority": PriorityNormal, "queue.outcome": "assigned"}
+	if !span.Start.Equal(queued) || span.ParentSpanId != "00f067aa0ba902b7" || !cmp.Equal(span.Attributes, wantAttributes) {
+		t.Errorf("Wait was not traced from when the request was queued. Recieved: %v", span)
+	}
+}
+
+func TestOTLPExporter_ExportSpans(t *testing.T) {
+	received := make(chan []byte, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := new(bytes.Buffer)
+		_, _ = body.ReadFrom(r.Body)
+		received <- body.Bytes()
+	}))
+	defer collector.Close()
+	start := time.Unix(1893596400, 0)
+	spans := []SpanData{{
+		TraceId:      "4bf92f3577b34da6a3ce929d0e0e4736",
+		SpanId:       "00f067aa0ba902b7",
+		ParentSpanId: "b7ad6b7169203331",
+		Name:         "upstream attempt",
+		Kind:         SpanKindClient,
+		Start:        start,
+		End:          start.Add(time.Second),
+		Attributes:   map[string]interface{}{"attempt": 2, "request.id": "requestId"},
+		Error:        "Did not recieve a OK response from HTTP request",
+	}}
+	if err := NewOTLPExporter(collector.URL).ExportSpans(context.Background(), spans); err != nil {
+		t.Fatalf("Unexpected error exporting spans. Details: %v", err)
+	}
+	want := `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"synthesia-signer"}}]},` +
+		`"scopeSpans":[{"scope":{"name":"github.com/imikewhite/synthesia/internal/app"},"spans":[{"traceId":"4bf92f3577b34da6a3ce929d0e0e4736",` +
+		`"spanId":"00f067aa0ba902b7","parentSpanId":"b7ad6b7169203331","name":"upstream attempt","kind":3,"startTimeUnixNano":"1893596400000000000",` +
+		`"endTimeUnixNano":"1893596401000000000","attributes":[{"key":"attempt","value":{"intValue":"2"}},{"key":"request.id","value":{"stringValue":"requestId"}}],` +
+		`"status":{"code":2,"message":"Did not recieve a OK response from HTTP request"}}]}]}]}`
+	if body := string(<-received); body != want {
+		t.Errorf("Spans were not exported as expected. Want: %v, Recieved: %v", want, body)
+	}
+}
+
+func TestStdoutExporter_ExportSpans(t *testing.T) {
+	var out bytes.Buffer
+	spans := []SpanData{{TraceId: "a", SpanId: "b", Name: "first"}, {TraceId: "a", SpanId: "c", Name: "second"}}
+	if err := (&StdoutExporter{Writer: &out}).ExportSpans(context.Background(), spans); err != nil {
+		t.Fatalf("Unexpected error exporting spans. Details: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected a line per span. Recieved: %v", out.String())
+	}
+	var span SpanData
+	if err := json.Unmarshal([]byte(lines[1]), &span); err != nil || span.Name != "second" {
+		t.Errorf("Span was not written as JSON. Recieved: %v", lines[1])
+	}
+}
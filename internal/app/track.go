@@ -5,34 +5,157 @@ import (
 	"encoding/json"
 	"github.com/sirupsen/logrus"
 	"os"
+	"sync"
+	"time"
+)
+
+// DefaultRequestRetention is how long a request that left the pipeline without a signature is remembered when no
+// retention has been configured
+const DefaultRequestRetention = 24 * time.Hour
+
+// For mocking in tests
+var (
+	trackClock           = time.Now
+	requestPruneInterval = 1 * time.Minute
 )
 
 // Tracker object holds a connection the track channel and maintains
-// a set of pending requests
+// a set of pending requests. The time each signed request took is
+// recorded in the metrics, if there are any. Requests that left the
+// pipeline without a signature are forgotten, along with their metadata,
+// once they are older than the retention window, as are batches whose
+// requests have all left the pipeline
 type Tracker struct {
 	Track    chan PendingRequest
 	Requests map[string]PendingRequest
+	// RequestsLock guards Requests, which handlers read through the application while the tracker writes them
+	RequestsLock *sync.RWMutex
+	Metrics      *Metrics
+	Metadata     *MetadataStore
+	Batches      *BatchStore
+	Retention    time.Duration
 }
 
-// TrackPendingRequests forever listens to track channel for requests to store
+// TrackPendingRequests forever listens to track channel for requests to store, and regularly prunes the requests
+// that have outlived the retention window
 func (tracker *Tracker) TrackPendingRequests(ctx context.Context) error {
+	prune := time.NewTicker(requestPruneInterval)
+	defer prune.Stop()
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
-		default:
-			pendingRequest := <-tracker.Track
-			if pendingRequest.Add {
-				tracker.Requests[pendingRequest.RequestId] = pendingRequest
-			} else {
-				delete(tracker.Requests, pendingRequest.RequestId)
-			}
+		case <-prune.C:
+			tracker.RequestsLock.Lock()
+			tracker.prune(trackClock())
+			tracker.RequestsLock.Unlock()
+		case pendingRequest := <-tracker.Track:
+			tracker.RequestsLock.Lock()
+			tracker.apply(pendingRequest)
+			tracker.RequestsLock.Unlock()
+		}
+	}
+}
+
+// apply adds, updates or removes a pending request. Requests without a TimeAdded are progress updates from the
+// encryptor, which only change the state and attempts of a request still being tracked. Signed requests stay
+// tracked, so their tenant is known, until their signature is retrieved and they are removed
+func (tracker *Tracker) apply(pendingRequest PendingRequest) {
+	existing, tracked := tracker.Requests[pendingRequest.RequestId]
+	if !pendingRequest.Add {
+		if tracked {
+			existing.log().Debugf("No longer tracking retrieved requestId: %v", existing.RequestId)
+		}
+		delete(tracker.Requests, pendingRequest.RequestId)
+		return
+	}
+	if pendingRequest.State == StateSigned {
+		if !tracked {
+			// The request can be signed before the handler that queued it has tracked it, which fills it in later
+			tracker.set(pendingRequest)
+			return
+		}
+		tracker.Metrics.ObserveSigned(requestTenant(existing.Request), pendingRequest.TimeAdded.Sub(existing.TimeAdded))
+		existing.log().Debugf("Tracking signed requestId until it is retrieved: %v", existing.RequestId)
+		existing.State = StateSigned
+		tracker.set(existing)
+		return
+	}
+	if pendingRequest.TimeAdded.IsZero() {
+		// Updates can arrive after a request was cancelled, expired or signed, and never bring it back
+		if !tracked || isFinalState(existing.State) {
+			return
+		}
+		existing.State = pendingRequest.State
+		existing.Attempts = pendingRequest.Attempts
+		tracker.set(existing)
+		return
+	}
+	// A signature that was stored is kept, even if the request was stopped meanwhile
+	if tracked && existing.State == StateSigned {
+		pendingRequest.State = StateSigned
+	}
+	tracker.set(pendingRequest)
+}
+
+// set stores a pending request, noting when it reached a final state. Requests taken out of a final state, such as
+// requeued failed requests, are no longer finished
+func (tracker *Tracker) set(pendingRequest PendingRequest) {
+	if !isFinalState(pendingRequest.State) {
+		pendingRequest.TimeFinished = time.Time{}
+	} else if pendingRequest.TimeFinished.IsZero() {
+		pendingRequest.TimeFinished = trackClock()
+	}
+	tracker.Requests[pendingRequest.RequestId] = pendingRequest
+}
+
+// prune forgets the requests that left the pipeline without a signature longer ago than the retention window, along
+// with their metadata, and then the batches that are done with. Signed requests are kept until their signature is
+// retrieved. Callers must hold the lock
+func (tracker *Tracker) prune(now time.Time) {
+	retention := tracker.Retention
+	if retention <= 0 {
+		retention = DefaultRequestRetention
+	}
+	for requestId, request := range tracker.Requests {
+		if request.State == StateSigned || !isFinalState(request.State) || now.Sub(request.TimeFinished) <= retention {
+			continue
 		}
+		request.log().Debugf("No longer tracking %v requestId: %v", request.State, requestId)
+		delete(tracker.Requests, requestId)
+		tracker.Metadata.Delete(requestId)
 	}
+	tracker.Batches.prune(now, retention, tracker.Requests)
+}
+
+// RequestsLock is the lock guarding the application's pending requests, for the tracker writing them to share
+func (application *Application) RequestsLock() *sync.RWMutex {
+	return &application.requestsLock
 }
 
-// InstantiateCurrentRequests creates a new store for pending requests and recreates previous state if applicable
-func InstantiateCurrentRequests(encrypt chan Request, pendingPersistenceLocation string) map[string]PendingRequest {
+// lookupRequest retrieves a pending request by its id
+func (application *Application) lookupRequest(requestId string) (PendingRequest, bool) {
+	application.requestsLock.RLock()
+	defer application.requestsLock.RUnlock()
+	request, ok := application.Requests[requestId]
+	return request, ok
+}
+
+// RequestsSnapshot copies the set of tracked requests, so it can be persisted while the tracker keeps writing to it
+func (application *Application) RequestsSnapshot() map[string]PendingRequest {
+	application.requestsLock.RLock()
+	defer application.requestsLock.RUnlock()
+	snapshot := make(map[string]PendingRequest, len(application.Requests))
+	for requestId, request := range application.Requests {
+		snapshot[requestId] = request
+	}
+	return snapshot
+}
+
+// InstantiateCurrentRequests creates a new store for pending requests and recreates previous state if applicable.
+// Requests that were queued are placed back on the encrypt queue and scheduled requests back on the schedule, while
+// signed, cancelled and expired requests are only remembered
+func InstantiateCurrentRequests(queue *FairQueue, schedule *Schedule, pendingPersistenceLocation string) map[string]PendingRequest {
 	pendingBytes, err := os.ReadFile(pendingPersistenceLocation)
 	if err != nil {
 		logrus.Errorf("Was unable to read pending file. Details: %v", err)
@@ -45,7 +168,26 @@ func InstantiateCurrentRequests(encrypt chan Request, pendingPersistenceLocation
 			return make(map[string]PendingRequest)
 		}
 		for requestId, pendingRequest := range pending {
-			encrypt <- Request{RequestId: requestId, Message: pendingRequest.Message}
+			if isFinalState(pendingRequest.State) {
+				// Requests persisted before they were noted as finished are kept for a whole retention window
+				if pendingRequest.TimeFinished.IsZero() {
+					pendingRequest.TimeFinished = trackClock()
+					pending[requestId] = pendingRequest
+				}
+				continue
+			}
+			if pendingRequest.State == StateScheduled && pendingRequest.NotBefore != nil && schedule != nil {
+				request := pendingRequest.Request
+				request.RequestId = requestId
+				schedule.Add(request)
+				continue
+			}
+			// Whatever was in flight during shutdown starts over at the back of the queue
+			pendingRequest.State = StateQueued
+			pending[requestId] = pendingRequest
+			request := pendingRequest.Request
+			request.RequestId = requestId
+			queue.requeue(request, pendingRequest.TimeAdded)
 		}
 		return pending
 	}
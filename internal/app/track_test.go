@@ -3,8 +3,11 @@ package app
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/google/go-cmp/cmp"
 	"os"
+	"sort"
+	"sync"
 	"testing"
 	"time"
 )
@@ -77,7 +80,7 @@ func TestTracker_TrackPendingRequests(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			mockTrackChan := make(chan PendingRequest)
 			ctx, cancel := context.WithCancel(context.Background())
-			mockTrack := Tracker{Track: mockTrackChan, Requests: tt.startingRequests}
+			mockTrack := Tracker{Track: mockTrackChan, Requests: tt.startingRequests, RequestsLock: &sync.RWMutex{}}
 			mockTrackerErrors := make(chan error, 1)
 			go func() {
 				mockTrackerErrors <- mockTrack.TrackPendingRequests(ctx)
@@ -108,6 +111,38 @@ func TestTracker_TrackPendingRequests(t *testing.T) {
 	}
 }
 
+func TestApp_RequestsSnapshot(t *testing.T) {
+	requests := make(map[string]PendingRequest)
+	track := make(chan PendingRequest)
+	application := Application{Requests: requests}
+	tracker := Tracker{Track: track, Requests: requests, RequestsLock: application.RequestsLock()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = tracker.TrackPendingRequests(ctx)
+	}()
+	// Each snapshot is taken while the tracker writes the next request, which must not race
+	for i := 0; i < 3; i++ {
+		done := make(chan map[string]PendingRequest, 1)
+		go func() {
+			done <- application.RequestsSnapshot()
+		}()
+		track <- PendingRequest{Request: Request{RequestId: fmt.Sprintf("request-%v", i)}, Timing: Timing{time.Now(), 1}, Add: true}
+		<-done
+	}
+	// The tracker has applied the last request once it accepts another
+	track <- PendingRequest{Request: Request{RequestId: "request-3"}, Timing: Timing{time.Now(), 1}, Add: true}
+	cancel()
+	snapshot := application.RequestsSnapshot()
+	if len(snapshot) < 3 {
+		t.Errorf("Unexpected snapshot of requests. Recieved: %v", snapshot)
+	}
+	snapshot["copy"] = PendingRequest{}
+	if _, ok := application.lookupRequest("copy"); ok {
+		t.Errorf("Expected the snapshot to be a copy of the requests")
+	}
+}
+
 func TestInstantiateCurrentRequests(t *testing.T) {
 	populatedPendingBytes, err := os.ReadFile("../../testdata/populatedPendingState.json")
 	if err != nil {
@@ -117,15 +152,40 @@ func TestInstantiateCurrentRequests(t *testing.T) {
 	if err := json.Unmarshal(populatedPendingBytes, &populatedPending); err != nil {
 		t.Errorf("Was unable to unmarshal test populated signatures into object. Details: %v", err)
 	}
+	for requestId, pendingRequest := range populatedPending {
+		pendingRequest.State = StateQueued
+		populatedPending[requestId] = pendingRequest
+	}
+	scheduledPendingBytes, err := os.ReadFile("../../testdata/populatedScheduledPendingState.json")
+	if err != nil {
+		t.Errorf("Was unable to read test populated scheduled pending file. Details: %v", err)
+	}
+	var scheduledPending map[string]PendingRequest
+	if err := json.Unmarshal(scheduledPendingBytes, &scheduledPending); err != nil {
+		t.Errorf("Was unable to unmarshal test populated scheduled pending into object. Details: %v", err)
+	}
+	running := scheduledPending["7e081bf6-c8ad-49a2-94ad-741b6612a38c"]
+	running.State = StateQueued
+	scheduledPending["7e081bf6-c8ad-49a2-94ad-741b6612a38c"] = running
 	tests := []struct {
 		name              string
 		inputFileLocation string
 		want              map[string]PendingRequest
+		wantQueued        int
+		wantScheduled     int
 	}{
 		{
 			name:              "Successful Load of populated state",
 			inputFileLocation: "../../testdata/populatedPendingState.json",
 			want:              populatedPending,
+			wantQueued:        2,
+		},
+		{
+			name:              "Scheduled requests are scheduled again",
+			inputFileLocation: "../../testdata/populatedScheduledPendingState.json",
+			want:              scheduledPending,
+			wantQueued:        1,
+			wantScheduled:     1,
 		},
 		{
 			name:              "Successful Load of empty state (fresh start)",
@@ -150,18 +210,167 @@ func TestInstantiateCurrentRequests(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			mockEncryptionChan := make(chan Request)
-			mockInstantiationResults := make(chan map[string]PendingRequest, 1)
-			go func() {
-				mockInstantiationResults <- InstantiateCurrentRequests(mockEncryptionChan, tt.inputFileLocation)
-			}()
-			select {
-			case <-mockEncryptionChan:
-			case pendingRequests := <-mockInstantiationResults:
-				if !cmp.Equal(pendingRequests, tt.want) {
-					t.Errorf("Requests was not instantiated to the desired state. Want: %v, Recieved: %v", tt.want, pendingRequests)
-				}
+			queue := NewFairQueue(0, nil)
+			schedule := NewSchedule(queue, nil, nil)
+			pendingRequests := InstantiateCurrentRequests(queue, schedule, tt.inputFileLocation)
+			if !cmp.Equal(pendingRequests, tt.want) {
+				t.Errorf("Requests was not instantiated to the desired state. Want: %v, Recieved: %v", tt.want, pendingRequests)
+			}
+			// Every restored request is queued again, even past the queue's capacity
+			if queue.Len() != tt.wantQueued {
+				t.Errorf("Requests were not queued again. Want: %v, Recieved: %v", tt.wantQueued, queue.Len())
+			}
+			if schedule.Len() != tt.wantScheduled {
+				t.Errorf("Requests were not scheduled again. Want: %v, Recieved: %v", tt.wantScheduled, schedule.Len())
 			}
 		})
 	}
 }
+
+func TestTracker_apply(t *testing.T) {
+	timeAdded := time.Now()
+	finished := timeAdded.Add(time.Minute)
+	trackClock = func() time.Time { return finished }
+	defer func() { trackClock = time.Now }()
+	queued := PendingRequest{Request: Request{RequestId: "requestId", Message: "message"}, Timing: Timing{timeAdded, 1}, State: StateQueued, Add: true}
+	running := queued
+	running.State = StateRunning
+	running.Attempts = 2
+	cancelling := queued
+	cancelling.State = StateCancelled
+	cancelled := cancelling
+	cancelled.TimeFinished = finished
+	expired := queued
+	expired.State = StateExpired
+	expired.TimeFinished = finished
+	failed := queued
+	failed.State = StateFailed
+	failed.TimeFinished = finished
+	requeued := failed
+	requeued.State = StateQueued
+	signed := queued
+	signed.State = StateSigned
+	signed.TimeFinished = finished
+	signedRunning := running
+	signedRunning.State = StateSigned
+	signedRunning.TimeFinished = finished
+	progress := PendingRequest{Request: Request{RequestId: "requestId"}, State: StateRunning, Attempts: 2, Add: true}
+	signedNotice := PendingRequest{Request: Request{RequestId: "requestId"}, Timing: Timing{TimeAdded: timeAdded.Add(time.Second)}, State: StateSigned, Add: true}
+	retrieved := PendingRequest{Request: Request{RequestId: "requestId"}, Add: false}
+	tests := []struct {
+		name             string
+		startingRequests map[string]PendingRequest
+		pendingRequest   PendingRequest
+		want             map[string]PendingRequest
+	}{
+		{
+			name:             "Progress update keeps request details",
+			startingRequests: map[string]PendingRequest{"requestId": queued},
+			pendingRequest:   progress,
+			want:             map[string]PendingRequest{"requestId": running},
+		},
+		{
+			name:             "Progress update does not revive a cancelled request",
+			startingRequests: map[string]PendingRequest{"requestId": cancelled},
+			pendingRequest:   progress,
+			want:             map[string]PendingRequest{"requestId": cancelled},
+		},
+		{
+			name:             "Progress update does not revive an expired request",
+			startingRequests: map[string]PendingRequest{"requestId": expired},
+			pendingRequest:   progress,
+			want:             map[string]PendingRequest{"requestId": expired},
+		},
+		{
+			name:             "Progress update does not revive a signed request",
+			startingRequests: map[string]PendingRequest{"requestId": signed},
+			pendingRequest:   progress,
+			want:             map[string]PendingRequest{"requestId": signed},
+		},
+		{
+			name:             "Signed request stays tracked with its details",
+			startingRequests: map[string]PendingRequest{"requestId": running},
+			pendingRequest:   signedNotice,
+			want:             map[string]PendingRequest{"requestId": signedRunning},
+		},
+		{
+			name:             "Request added after it was signed stays signed",
+			startingRequests: map[string]PendingRequest{"requestId": signedNotice},
+			pendingRequest:   queued,
+			want:             map[string]PendingRequest{"requestId": signed},
+		},
+		{
+			name:             "Retrieved request is no longer tracked",
+			startingRequests: map[string]PendingRequest{"requestId": signed},
+			pendingRequest:   retrieved,
+			want:             make(map[string]PendingRequest),
+		},
+		{
+			name:             "Cancelled request is noted as finished",
+			startingRequests: map[string]PendingRequest{"requestId": queued},
+			pendingRequest:   cancelling,
+			want:             map[string]PendingRequest{"requestId": cancelled},
+		},
+		{
+			name:             "Requeued request is no longer finished",
+			startingRequests: map[string]PendingRequest{"requestId": failed},
+			pendingRequest:   requeued,
+			want:             map[string]PendingRequest{"requestId": queued},
+		},
+		{
+			name:             "Progress update for a request no longer tracked is ignored",
+			startingRequests: make(map[string]PendingRequest),
+			pendingRequest:   progress,
+			want:             make(map[string]PendingRequest),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := Tracker{Requests: tt.startingRequests}
+			tracker.apply(tt.pendingRequest)
+			if !cmp.Equal(tracker.Requests, tt.want) {
+				t.Errorf("Requests not as expected. Wanted: %v, Got: %v", tt.want, tracker.Requests)
+			}
+		})
+	}
+}
+
+func TestTracker_prune(t *testing.T) {
+	now := time.Now()
+	finished := func(state string, age time.Duration) PendingRequest {
+		return PendingRequest{Request: Request{RequestId: state}, Timing: Timing{now.Add(-age), 1}, State: state, TimeFinished: now.Add(-age), Add: true}
+	}
+	tracker := Tracker{
+		Requests: map[string]PendingRequest{
+			"cancelled": finished(StateCancelled, 2*time.Hour),
+			"expired":   finished(StateExpired, 2*time.Hour),
+			"failed":    finished(StateFailed, 30*time.Minute),
+			"signed":    finished(StateSigned, 2*time.Hour),
+			"queued":    {Request: Request{RequestId: "queued"}, Timing: Timing{now.Add(-2 * time.Hour), 1}, State: StateQueued, Add: true},
+		},
+		Batches: &BatchStore{Batches: map[string]Batch{
+			"done":    {BatchId: "done", RequestIds: []string{"cancelled"}, TimeAdded: now.Add(-2 * time.Hour)},
+			"pending": {BatchId: "pending", RequestIds: []string{"queued"}, TimeAdded: now.Add(-2 * time.Hour)},
+		}},
+		Metadata: &MetadataStore{Metadata: map[string]map[string]string{
+			"cancelled": {"key": "value"},
+			"failed":    {"key": "value"},
+		}},
+		Retention: time.Hour,
+	}
+	tracker.prune(now)
+	var kept []string
+	for requestId := range tracker.Requests {
+		kept = append(kept, requestId)
+	}
+	sort.Strings(kept)
+	if want := []string{"failed", "queued", "signed"}; !cmp.Equal(kept, want) {
+		t.Errorf("Wrong requests were pruned. Want kept: %v, Recieved: %v", want, kept)
+	}
+	if _, ok := tracker.Batches.Batches["done"]; ok || len(tracker.Batches.Batches) != 1 {
+		t.Errorf("Batches were not pruned along with their requests. Recieved: %v", tracker.Batches.Batches)
+	}
+	if tracker.Metadata.Get("cancelled") != nil || tracker.Metadata.Get("failed") == nil {
+		t.Errorf("Metadata was not pruned along with its request. Recieved: %v", tracker.Metadata.Metadata)
+	}
+}
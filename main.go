@@ -10,16 +10,43 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 )
 
 // Config struct holds all optional parameters for the application
 type Config struct {
-	MaxRequestQueueSize           int
-	MaxSynthesiaRequestsPerMinute int
-	ServerPort                    string
-	LogLevel                      string
-	SignaturesPersistenceLocation string
-	PendingPersistenceLocation    string
+	MaxRequestQueueSize            int
+	MaxSynthesiaRequestsPerMinute  int
+	ServerPort                     string
+	LogLevel                       string
+	Logging                        app.LogConfig
+	MaxMessageBytes                int64
+	MaxBatchSize                   int
+	MaxBatchBytes                  int64
+	SignaturesPersistenceLocation  string
+	PendingPersistenceLocation     string
+	BatchesPersistenceLocation     string
+	OutboxPersistenceLocation      string
+	IdempotencyPersistenceLocation string
+	MetadataPersistenceLocation    string
+	QuotasPersistenceLocation      string
+	CallbackSecretsLocation        string
+	QueueWeightsLocation           string
+	PriorityAging                  time.Duration
+	MaxCallbackAttempts            int
+	CallbackWorkers                int
+	CallbackAllowedNetworks        string
+	MaxEncryptAttempts             int
+	TraceExporter                  string
+	OTLPEndpoint                   string
+	AdminToken                     string
+	MetricsToken                   string
+	MaxWait                        time.Duration
+	IdempotencyRetention           time.Duration
+	RequestRetention               time.Duration
+	APIKeysLocation                string
+	JWT                            app.JWTConfig
+	Limits                         app.Limits
 }
 
 // SetConfigs sets application configs using parameters passed in or default values
@@ -29,75 +56,218 @@ func SetConfigs() Config {
 	maxSynthesiaRequestsPerMinute := flag.Int("maxSynthesiaRequestsPerMinute", 10, "Max requests that can be made to Synthesia per minute")
 	serverPort := flag.String("serverPort", ":8080", "Server port, including preceding colon (will hang otherwise)")
 	logLevel := flag.String("logLevel", "debug", "Set the log level for the application; panic, fatal, error, warn, info, debug, trace")
+	logFormat := flag.String("logFormat", app.LogFormatText, "Format of log lines; text or json")
+	logFile := flag.String("logFile", "", "File logs are written to, rotated as it grows, logs are written to stderr when unset")
+	logMaxSize := flag.Int64("logMaxSize", 100, "Max size in megabytes of the log file before it is rotated, never rotated by size when 0")
+	logMaxAge := flag.Duration("logMaxAge", 24*time.Hour, "Max time the log file is written to before it is rotated, never rotated by age when 0")
+	logMaxBackups := flag.Int("logMaxBackups", 7, "Rotated log files kept, the oldest are deleted beyond it, all are kept when 0")
+	logCompress := flag.Bool("logCompress", true, "Compress rotated log files with gzip")
+	privacyMode := flag.Bool("privacyMode", false, "Redact message content from logs")
+	maxMessageBytes := flag.Int64("maxMessageBytes", app.DefaultMaxMessageBytes, "Max size in bytes of a message (or POST body) submitted for encryption")
+	maxBatchSize := flag.Int("maxBatchSize", app.DefaultMaxBatchSize, "Max number of messages that can be submitted in a single batch")
+	maxBatchBytes := flag.Int64("maxBatchBytes", app.DefaultMaxBatchBytes, "Max size in bytes of the request body of a batch")
+	callbackSecretsLocation := flag.String("callbackSecretsLocation", "", "JSON file mapping client id to callback signing secret, callbacks are disabled when unset")
+	queueWeightsLocation := flag.String("queueWeightsLocation", "", "JSON file mapping client id to its weight in the encrypt queue, every client weighs 1 when unset")
+	priorityAging := flag.Duration("priorityAging", app.DefaultPriorityAging, "How long a request waits before it is served as though it had the next higher priority")
+	maxCallbackAttempts := flag.Int("maxCallbackAttempts", app.DefaultMaxCallbackAttempts, "Max attempts at delivering a callback before giving up")
+	callbackWorkers := flag.Int("callbackWorkers", app.DefaultCallbackWorkers, "Max callbacks delivered at once")
+	callbackAllowedNetworks := flag.String("callbackAllowedNetworks", "", "Comma separated private addresses or CIDR ranges callbacks may be delivered to, e.g. 127.0.0.0/8 for local development, none when unset")
+	maxEncryptAttempts := flag.Int("maxEncryptAttempts", app.DefaultMaxEncryptAttempts, "Max attempts at signing a message upstream before it is dead-lettered")
+	traceExporter := flag.String("traceExporter", "", "Exporter of trace spans; stdout or otlp, tracing is disabled when unset")
+	otlpEndpoint := flag.String("otlpEndpoint", app.DefaultOTLPEndpoint, "OTLP/HTTP traces endpoint of the collector spans are sent to by the otlp exporter")
+	adminToken := flag.String("adminToken", "", "Bearer token required by the /admin endpoints, which are disabled when unset")
+	metricsToken := flag.String("metricsToken", "", "Bearer token allowing /metrics to be scraped without admin privileges, only admins can scrape it when unset")
+	maxWait := flag.Duration("maxWait", app.DefaultMaxWait, "Max time a caller can wait for a signature using the 'wait' parameter")
+	idempotencyRetention := flag.Duration("idempotencyRetention", app.DefaultIdempotencyRetention, "How long an Idempotency-Key is remembered after the request it created")
+	requestRetention := flag.Duration("requestRetention", app.DefaultRequestRetention, "How long a cancelled, expired or failed request, or a finished batch, is remembered")
+	apiKeysLocation := flag.String("apiKeysLocation", "", "JSON file of API keys and their policies, authentication is disabled when unset")
+	jwtSecret := flag.String("jwtSecret", "", "Secret verifying HS256 bearer tokens")
+	jwksLocation := flag.String("jwksLocation", "", "JSON Web Key Set file of keys verifying bearer tokens, bearer tokens are not accepted when this and jwtSecret are unset")
+	jwtIssuer := flag.String("jwtIssuer", "", "Issuer bearer tokens must have been issued by, any when unset")
+	jwtAudience := flag.String("jwtAudience", "", "Audience bearer tokens must have been issued for, any when unset")
+	rateLimit := flag.Float64("rateLimit", 0, "Calls per second each client can make, unlimited when 0")
+	rateBurst := flag.Int("rateBurst", 0, "Calls each client can make at once, rateLimit rounded up when 0")
+	hourlyQuota := flag.Int("hourlyQuota", 0, "Messages each client can submit over the last hour, unlimited when 0")
+	dailyQuota := flag.Int("dailyQuota", 0, "Messages each client can submit over the last day, unlimited when 0")
 	flag.Parse()
 	conf := Config{
-		MaxRequestQueueSize:           *maxRequestQueueSize,
-		MaxSynthesiaRequestsPerMinute: *maxSynthesiaRequestsPerMinute,
-		ServerPort:                    *serverPort,
-		LogLevel:                      *logLevel,
-		SignaturesPersistenceLocation: "./internal/persistence/signatures.json",
-		PendingPersistenceLocation:    "./internal/persistence/pending.json",
+		MaxRequestQueueSize:            *maxRequestQueueSize,
+		MaxSynthesiaRequestsPerMinute:  *maxSynthesiaRequestsPerMinute,
+		ServerPort:                     *serverPort,
+		LogLevel:                       *logLevel,
+		MaxMessageBytes:                *maxMessageBytes,
+		MaxBatchSize:                   *maxBatchSize,
+		MaxBatchBytes:                  *maxBatchBytes,
+		SignaturesPersistenceLocation:  "./internal/persistence/signatures.json",
+		PendingPersistenceLocation:     "./internal/persistence/pending.json",
+		BatchesPersistenceLocation:     "./internal/persistence/batches.json",
+		OutboxPersistenceLocation:      "./internal/persistence/outbox.json",
+		IdempotencyPersistenceLocation: "./internal/persistence/idempotency.json",
+		MetadataPersistenceLocation:    "./internal/persistence/metadata.json",
+		QuotasPersistenceLocation:      "./internal/persistence/quotas.json",
+		CallbackSecretsLocation:        *callbackSecretsLocation,
+		QueueWeightsLocation:           *queueWeightsLocation,
+		PriorityAging:                  *priorityAging,
+		MaxCallbackAttempts:            *maxCallbackAttempts,
+		CallbackWorkers:                *callbackWorkers,
+		CallbackAllowedNetworks:        *callbackAllowedNetworks,
+		MaxEncryptAttempts:             *maxEncryptAttempts,
+		TraceExporter:                  *traceExporter,
+		OTLPEndpoint:                   *otlpEndpoint,
+		AdminToken:                     *adminToken,
+		MetricsToken:                   *metricsToken,
+		MaxWait:                        *maxWait,
+		IdempotencyRetention:           *idempotencyRetention,
+		RequestRetention:               *requestRetention,
+		APIKeysLocation:                *apiKeysLocation,
+		Logging: app.LogConfig{
+			Format:     *logFormat,
+			File:       *logFile,
+			MaxSize:    *logMaxSize << 20,
+			MaxAge:     *logMaxAge,
+			MaxBackups: *logMaxBackups,
+			Compress:   *logCompress,
+			Privacy:    *privacyMode,
+			Secrets:    []string{*adminToken, *metricsToken, *jwtSecret},
+		},
+		JWT: app.JWTConfig{
+			Secret:       *jwtSecret,
+			JWKSLocation: *jwksLocation,
+			Issuer:       *jwtIssuer,
+			Audience:     *jwtAudience,
+		},
+		Limits: app.Limits{
+			RatePerSecond: *rateLimit,
+			Burst:         *rateBurst,
+			HourlyQuota:   *hourlyQuota,
+			DailyQuota:    *dailyQuota,
+		},
 	}
 	return conf
 }
 
 // SaveState saves the state of the application to be persisted on next invokation
-func SaveState(signatures map[string]string, pendingRequests map[string]app.PendingRequest, config Config) {
-	signaturesBytes, err := json.MarshalIndent(signatures, "", " ")
-	if err != nil {
-		logrus.Errorf("Failed saving signature state during shutdown. Details: %v", err.Error())
-	} else {
-		_ = os.WriteFile(config.SignaturesPersistenceLocation, signaturesBytes, 0644)
-	}
-	pendingRequestsBytes, err := json.MarshalIndent(pendingRequests, "", " ")
+func SaveState(application *app.Application, config Config) {
+	saveJSON("signature", application.SignaturesSnapshot(), config.SignaturesPersistenceLocation)
+	saveJSON("pending requests", application.RequestsSnapshot(), config.PendingPersistenceLocation)
+	saveJSON("batches", application.Batches, config.BatchesPersistenceLocation)
+	saveJSON("outbox", application.Outbox, config.OutboxPersistenceLocation)
+	saveJSON("idempotency keys", application.Idempotency, config.IdempotencyPersistenceLocation)
+	saveJSON("metadata", application.Metadata, config.MetadataPersistenceLocation)
+	saveJSON("quotas", application.Limits, config.QuotasPersistenceLocation)
+}
+
+// saveJSON writes a piece of application state to its persistence location
+func saveJSON(name string, state interface{}, location string) {
+	stateBytes, err := json.MarshalIndent(state, "", " ")
 	if err != nil {
-		logrus.Errorf("Failed saving pending requests state during shutdown. Details: %v", err.Error())
-	} else {
-		_ = os.WriteFile(config.PendingPersistenceLocation, pendingRequestsBytes, 0644)
+		logrus.Errorf("Failed saving %v state during shutdown. Details: %v", name, err.Error())
+		return
 	}
+	_ = os.WriteFile(location, stateBytes, 0644)
 }
 
 func main() {
-	// Get configs, set log level and create context for application
+	// Get configs, set up logging and create context for application
 	config := SetConfigs()
 	level, err := logrus.ParseLevel(config.LogLevel)
 	if err != nil {
 		level = logrus.DebugLevel
 	}
 	logrus.SetLevel(level)
+	logFile := app.ConfigureLogging(logrus.StandardLogger(), config.Logging)
 	ctx, cancel := context.WithCancel(context.Background())
 
 	// create channels used for application communication and state storage
 	store := make(chan app.SignedRequest)
 	signatures := app.InstantiateSignatures(config.SignaturesPersistenceLocation)
-	encrypt := make(chan app.Request, config.MaxRequestQueueSize)
+	queue := app.NewFairQueue(config.MaxRequestQueueSize, app.LoadQueueWeights(config.QueueWeightsLocation))
+	queue.Aging = config.PriorityAging
 	encryptors := make(chan struct{}, config.MaxSynthesiaRequestsPerMinute)
 	go app.InstantiateEncryptors(config.MaxSynthesiaRequestsPerMinute, encryptors)
+	events := app.NewEventBroker()
+	notifier := app.NewNotifier()
+	cancellations := app.NewCanceller()
+	control := app.NewQueueControl()
+	metrics := app.NewMetrics()
+	tracer := app.LoadTracer(config.TraceExporter, config.OTLPEndpoint)
 	// create a channel for track
 	track := make(chan app.PendingRequest)
-	requests := app.InstantiateCurrentRequests(encrypt, config.PendingPersistenceLocation)
+	schedule := app.NewSchedule(queue, track, events)
+	requests := app.InstantiateCurrentRequests(queue, schedule, config.PendingPersistenceLocation)
+	batches := app.InstantiateBatches(config.BatchesPersistenceLocation)
+	idempotency := app.InstantiateIdempotencyKeys(config.IdempotencyPersistenceLocation, config.IdempotencyRetention)
+	metadata := app.InstantiateMetadata(config.MetadataPersistenceLocation)
+	outbox := app.InstantiateOutbox(config.OutboxPersistenceLocation, app.LoadCallbackSecrets(config.CallbackSecretsLocation), config.MaxCallbackAttempts)
+	outbox.Workers = config.CallbackWorkers
+	outbox.AllowedNetworks = app.ParseAllowedNetworks(config.CallbackAllowedNetworks)
+
+	// define application using all components, whose locks on the requests and signatures the workers share
+	application := app.Application{
+		Queue:           queue,
+		Schedule:        schedule,
+		Store:           store,
+		Signatures:      signatures,
+		Track:           track,
+		Requests:        requests,
+		ServerPort:      config.ServerPort,
+		MaxMessageBytes: config.MaxMessageBytes,
+		MaxBatchSize:    config.MaxBatchSize,
+		MaxBatchBytes:   config.MaxBatchBytes,
+		Batches:         batches,
+		Outbox:          outbox,
+		Events:          events,
+		AdminToken:      config.AdminToken,
+		MetricsToken:    config.MetricsToken,
+		Notifier:        notifier,
+		MaxWait:         config.MaxWait,
+		Cancellations:   cancellations,
+		Idempotency:     idempotency,
+		Metadata:        metadata,
+		RequestIdClaims: app.NewRequestIdClaims(),
+		Control:         control,
+		Metrics:         metrics,
+		Tracer:          tracer,
+		APIKeys:         app.LoadAPIKeys(config.APIKeysLocation),
+		JWT:             app.LoadJWTVerifier(config.JWT),
+		Limits:          app.InstantiateClientLimiter(config.QuotasPersistenceLocation, config.Limits),
+	}
 
 	// go routines
 	// spin up tracker worker that forever listens to track queue and performs the operations onto the currentRequests
-	tracker := app.Tracker{Track: track, Requests: requests}
+	tracker := app.Tracker{Track: track, Requests: requests, RequestsLock: application.RequestsLock(), Metrics: metrics, Metadata: metadata, Batches: batches, Retention: config.RequestRetention}
 	trackerErrors := make(chan error, 1)
 	go func() {
 		trackerErrors <- tracker.TrackPendingRequests(ctx)
 	}()
+	// spin up a schedule worker that forever releases scheduled requests onto the encrypt queue once they are due
+	scheduleErrors := make(chan error, 1)
+	go func() {
+		scheduleErrors <- schedule.ReleaseDueRequests(ctx)
+	}()
 	// spin up a Storer worker that forever listencs to store queue and performs the operation onto the store
-	storer := app.Storer{Store: store, Track: track, Signatures: signatures}
+	storer := app.Storer{Store: store, Track: track, Signatures: signatures, SignaturesLock: application.SignaturesLock(), Outbox: outbox, Events: events, Notifier: notifier, Metadata: metadata, Tracer: tracer}
 	storerErrors := make(chan error, 1)
 	go func() {
 		storerErrors <- storer.StoreSignedRequests(ctx)
 	}()
-	// Sping up worker scheduler that listens to encrypt queue and schedules an encryption when available
-	encryptorHandler := app.EncryptorHandler{Encrypt: encrypt, Store: store, Encryptors: encryptors}
+	// spin up a callback worker that forever delivers callbacks waiting in the outbox
+	outboxErrors := make(chan error, 1)
+	go func() {
+		outboxErrors <- outbox.DeliverCallbacks(ctx)
+	}()
+	// spin up a trace worker that forever sends finished spans to the exporter
+	tracerErrors := make(chan error, 1)
+	go func() {
+		tracerErrors <- tracer.ExportSpans(ctx)
+	}()
+	// Sping up worker scheduler that takes from the encrypt queue and schedules an encryption when available
+	encryptorHandler := app.EncryptorHandler{Queue: queue, Store: store, Encryptors: encryptors, Events: events, Track: track, Cancellations: cancellations, Outbox: outbox, Metadata: metadata, Control: control, MaxAttempts: config.MaxEncryptAttempts, Metrics: metrics, Tracer: tracer}
 	encryptorHandlerErrors := make(chan error, 1)
 	go func() {
 		encryptorHandlerErrors <- encryptorHandler.HandleEncryptRequests(ctx)
 	}()
-	// define application using all components, and start listening for incoming requests
-	application := app.Application{Encrypt: encrypt, Store: store, Signatures: signatures, Track: track, Requests: requests, ServerPort: config.ServerPort}
+	// start listening for incoming requests
 	logrus.Debug("Starting API Server...")
 	router := app.NewRouter(&application)
 	applicationErrors := make(chan error, 1)
@@ -124,21 +294,40 @@ Program:
 			go func() {
 				storerErrors <- storer.StoreSignedRequests(ctx)
 			}()
+		case outboxError := <-outboxErrors:
+			logrus.Errorf("Callback worker failed unexpectedly with the following error: %v. Creating new callback worker.", outboxError.Error())
+			go func() {
+				outboxErrors <- outbox.DeliverCallbacks(ctx)
+			}()
 		case trackerError := <-trackerErrors:
 			logrus.Errorf("Tracker failed unexpectedly with the following error: %v. Creating new tracker.", trackerError.Error())
 			go func() {
 				trackerErrors <- tracker.TrackPendingRequests(ctx)
 			}()
+		case scheduleError := <-scheduleErrors:
+			logrus.Errorf("Schedule worker failed unexpectedly with the following error: %v. Creating new schedule worker.", scheduleError.Error())
+			go func() {
+				scheduleErrors <- schedule.ReleaseDueRequests(ctx)
+			}()
+		case tracerError := <-tracerErrors:
+			logrus.Errorf("Trace worker failed unexpectedly with the following error: %v. Creating new trace worker.", tracerError.Error())
+			go func() {
+				tracerErrors <- tracer.ExportSpans(ctx)
+			}()
 		case applicationError := <-applicationErrors:
 			logrus.Errorf("Application failed unexpectedly with the following error: %v. Shutting Down.", applicationError.Error())
-			SaveState(storer.Signatures, tracker.Requests, config)
+			SaveState(&application, config)
+			tracer.Flush(context.Background())
 			cancel()
 			break Program
 		case <-shutdown:
 			logrus.Error("Server recieved Kill command. Shutting Down.")
-			SaveState(storer.Signatures, tracker.Requests, config)
+			SaveState(&application, config)
+			tracer.Flush(context.Background())
 			cancel()
 			break Program
 		}
 	}
+	// Close the log file last, so every line logged while shutting down is written
+	logFile.Close()
 }